@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"wbstorage/internal/backup"
+	"wbstorage/internal/db"
+	"wbstorage/internal/invalidation"
+
+	"github.com/nats-io/nats.go"
+)
+
+// runCommand runs a one-off subcommand instead of the service and returns
+// the process exit code.
+func runCommand(ctx context.Context, cfg Config, args []string) int {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(ctx, cfg, args[1:])
+	case "customer":
+		return runCustomer(ctx, cfg, args[1:])
+	case "reshard":
+		return runReshard(ctx, cfg, args[1:])
+	case "export":
+		return runExport(ctx, cfg, args[1:])
+	case "import":
+		return runImport(ctx, cfg, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+}
+
+// runMigrate implements "migrate up", "migrate down [steps]" and "migrate
+// status", on every shard when the database is sharded.
+func runMigrate(ctx context.Context, cfg Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: migrate up | down [steps] | status")
+		return 2
+	}
+
+	urls := cfg.ShardURLs
+	if len(urls) == 0 {
+		urls = []string{cfg.ConnString}
+	}
+	for _, url := range urls {
+		if code := migrate(ctx, cfg, url, args); code != 0 {
+			return code
+		}
+	}
+	return 0
+}
+
+func migrate(ctx context.Context, cfg Config, url string, args []string) int {
+	dbConn, err := db.NewDB(url, cfg.Pool())
+	if err != nil {
+		slog.Error("Failed to connect to the database", "error", err)
+		return 1
+	}
+	migrator, err := dbConn.NewMigrator(ctx)
+	if err != nil {
+		slog.Error("Failed to initialize migrations", "error", err)
+		return 1
+	}
+	defer migrator.Close()
+
+	switch args[0] {
+	case "up":
+		err = migrator.Up()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid number of steps %q\n", args[1])
+				return 2
+			}
+		}
+		err = migrator.Down(steps)
+	case "status":
+		var status db.MigrationStatus
+		if status, err = migrator.Status(); err == nil {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(status)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q\n", args[0])
+		return 2
+	}
+	if err != nil {
+		slog.Error("Migration failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// runCustomer implements "customer export <id>", which writes the customer's
+// data as JSON to stdout, and "customer erase <id>".
+func runCustomer(ctx context.Context, cfg Config, args []string) int {
+	if len(args) != 2 || (args[0] != "export" && args[0] != "erase") {
+		fmt.Fprintln(os.Stderr, "usage: customer export | erase <customer_id>")
+		return 2
+	}
+	action, customerID := args[0], args[1]
+
+	dbConn, err := openCommandDB(cfg)
+	if err != nil {
+		slog.Error("Failed to connect to the database", "error", err)
+		return 1
+	}
+	ctx = db.WithSource(ctx, "cli")
+
+	var result any
+	switch action {
+	case "export":
+		result, err = db.ExportCustomer(ctx, dbConn, customerID)
+	case "erase":
+		var erasure *db.Erasure
+		if erasure, err = dbConn.EraseCustomer(ctx, customerID); err == nil {
+			invalidateOrders(ctx, cfg, erasure.OrderUIDs)
+			result = erasure
+		}
+	}
+	if err != nil {
+		slog.Error("Customer "+action+" failed", "error", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		slog.Error("Failed to write result", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// runReshard implements "reshard [--dry-run]", which moves orders to the
+// shard their shardkey maps to after DATABASE_SHARD_URLS has changed.
+func runReshard(ctx context.Context, cfg Config, args []string) int {
+	dryRun := len(args) == 1 && args[0] == "--dry-run"
+	if len(args) > 1 || (len(args) == 1 && !dryRun) {
+		fmt.Fprintln(os.Stderr, "usage: reshard [--dry-run]")
+		return 2
+	}
+	dbConn, err := openCommandDB(cfg)
+	if err != nil {
+		slog.Error("Failed to connect to the database", "error", err)
+		return 1
+	}
+	sharded, ok := dbConn.(*db.ShardedDB)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "reshard needs DATABASE_SHARD_URLS")
+		return 2
+	}
+
+	stats, err := sharded.Reshard(db.WithSource(ctx, "reshard"), dryRun)
+	slog.Info("Resharding finished", "scanned", stats.Scanned, "moved", stats.Moved, "failed", stats.Failed, "dryRun", dryRun)
+	if err != nil {
+		slog.Error("Resharding failed", "error", err)
+		return 1
+	}
+	if stats.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runExport implements "export [-from date] [-to date] [-customer id]
+// [-compress auto|none|gzip|zstd] <file>", which writes the orders to an
+// NDJSON file and its manifest.
+func runExport(ctx context.Context, cfg Config, args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	from := fs.String("from", "", "only orders created at or after this date (YYYY-MM-DD or RFC 3339)")
+	to := fs.String("to", "", "only orders created before this date (YYYY-MM-DD or RFC 3339)")
+	customer := fs.String("customer", "", "only orders of this customer")
+	compression := fs.String("compress", "auto", "auto (from the file extension), none, gzip or zstd")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: export [-from date] [-to date] [-customer id] [-compress auto|none|gzip|zstd] <file>")
+		return 2
+	}
+	path := fs.Arg(0)
+
+	filter := backup.Filter{CustomerID: *customer}
+	var err error
+	if filter.From, err = parseDate(*from); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -from: %v\n", err)
+		return 2
+	}
+	if filter.To, err = parseDate(*to); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -to: %v\n", err)
+		return 2
+	}
+	if *compression == "auto" {
+		*compression = backup.CompressionFor(path)
+	}
+
+	dbConn, err := openCommandDB(cfg)
+	if err != nil {
+		slog.Error("Failed to connect to the database", "error", err)
+		return 1
+	}
+	manifest, err := backup.Export(ctx, dbConn, path, *compression, filter)
+	if err != nil {
+		slog.Error("Export failed", "error", err)
+		return 1
+	}
+	slog.Info("Export finished", "file", path, "orders", manifest.Orders, "sha256", manifest.SHA256)
+	return 0
+}
+
+// runImport implements "import [-batch n] [-replace] <file>", which loads an
+// export file. Stored orders are kept unless -replace is given.
+func runImport(ctx context.Context, cfg Config, args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	batch := fs.Int("batch", 500, "orders per transaction")
+	replace := fs.Bool("replace", false, "overwrite orders that are already stored")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import [-batch n] [-replace] <file>")
+		return 2
+	}
+	path := fs.Arg(0)
+
+	dbConn, err := openCommandDB(cfg)
+	if err != nil {
+		slog.Error("Failed to connect to the database", "error", err)
+		return 1
+	}
+	stats, err := backup.Import(db.WithSource(ctx, "import"), dbConn, path, backup.ImportOptions{
+		BatchSize: *batch,
+		Replace:   *replace,
+	})
+	slog.Info("Import finished", "file", path, "read", stats.Read,
+		"inserted", stats.Inserted, "replaced", stats.Replaced, "skipped", stats.Skipped)
+	if err != nil {
+		slog.Error("Import failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// parseDate accepts a date or an RFC 3339 timestamp; "" is the zero time.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// openCommandDB opens the configured database, or all of its shards, with
+// PII encryption set up like the service, but without its background jobs.
+func openCommandDB(cfg Config) (db.Database, error) {
+	if len(cfg.ShardURLs) == 0 {
+		return openCommandShard(cfg, cfg.ConnString)
+	}
+	shards := make([]db.Database, len(cfg.ShardURLs))
+	for i, url := range cfg.ShardURLs {
+		shard, err := openCommandShard(cfg, url)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		shards[i] = shard
+	}
+	return db.NewShardedDB(shards)
+}
+
+func openCommandShard(cfg Config, url string) (db.Database, error) {
+	dbConn, err := db.Open(url, cfg.Pool())
+	if err != nil {
+		return nil, err
+	}
+	if client, ok := dbConn.(*db.Client); ok {
+		keyring, err := loadKeyring(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if keyring != nil {
+			client.SetKeyring(keyring)
+		}
+	}
+	return dbConn, nil
+}
+
+// invalidateOrders tells running instances to drop the orders from their
+// caches, when NATS is configured.
+func invalidateOrders(ctx context.Context, cfg Config, orderUIDs []string) {
+	if cfg.NATSUrl == "" || len(orderUIDs) == 0 {
+		return
+	}
+	nc, err := nats.Connect(cfg.NATSUrl)
+	if err != nil {
+		slog.Error("Failed to connect to NATS, cached copies expire after CACHE_TTL", "error", err)
+		return
+	}
+	defer nc.Close()
+	inv, err := invalidation.NewInvalidator(nc, cfg.InstanceID, noCache{})
+	if err != nil {
+		slog.Error("Failed to initialize cache invalidation", "error", err)
+		return
+	}
+	defer inv.Close()
+	for _, uid := range orderUIDs {
+		if err := inv.Publish(ctx, uid); err != nil {
+			slog.Error("Failed to publish cache invalidation", "error", err, "orderUID", uid)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		slog.Error("Failed to flush cache invalidations", "error", err)
+	}
+}
+
+// noCache is the cache of a command, which has none to invalidate.
+type noCache struct{}
+
+func (noCache) Evict(string) {}
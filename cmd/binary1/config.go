@@ -1,7 +1,12 @@
 package main
 
 import (
+	"time"
+
+	"wbstorage/internal/db"
+
 	"github.com/caarlos0/env/v10"
+	"github.com/nats-io/nuid"
 )
 
 type Config struct {
@@ -9,6 +14,66 @@ type Config struct {
 	NWorkers   int    `env:"NWORKERS"`
 	ServerPort string `env:"SERVER_PORT"`
 	ConnString string `env:"DATABASE_URL"`
+	InstanceID string `env:"INSTANCE_ID"`
+	AdminToken string `env:"ADMIN_TOKEN"`
+	// WriteToken allows changing orders without the admin token.
+	WriteToken string `env:"WRITE_TOKEN"`
+
+	SkipMigrations bool `env:"SKIP_MIGRATIONS"`
+
+	DBMaxOpenConns    int           `env:"DB_MAX_OPEN_CONNS"`
+	DBMaxIdleConns    int           `env:"DB_MAX_IDLE_CONNS"`
+	DBConnMaxLifetime time.Duration `env:"DB_CONN_MAX_LIFETIME"`
+	DBConnMaxIdleTime time.Duration `env:"DB_CONN_MAX_IDLE_TIME"`
+	// DBStatementTimeout is off by default, as migrations may run for long.
+	DBStatementTimeout   time.Duration `env:"DB_STATEMENT_TIMEOUT"`
+	DBApplicationName    string        `env:"DB_APPLICATION_NAME"`
+	DBSlowQueryThreshold time.Duration `env:"DB_SLOW_QUERY_THRESHOLD"`
+
+	CacheTTL            time.Duration `env:"CACHE_TTL"`
+	AccessFlushInterval time.Duration `env:"ACCESS_FLUSH_INTERVAL"`
+	BreakerThreshold    int           `env:"DB_BREAKER_THRESHOLD"`
+	BreakerCooldown     time.Duration `env:"DB_BREAKER_COOLDOWN"`
+
+	WarmupMode       string        `env:"WARMUP_MODE"`
+	WarmupCount      int           `env:"WARMUP_COUNT"`
+	WarmupWindow     time.Duration `env:"WARMUP_WINDOW"`
+	WarmupWorkers    int           `env:"WARMUP_WORKERS"`
+	WarmupBackground bool          `env:"WARMUP_BACKGROUND"`
+
+	RetentionArchiveAfter time.Duration `env:"RETENTION_ARCHIVE_AFTER"`
+	RetentionPurgeAfter   time.Duration `env:"RETENTION_PURGE_AFTER"`
+	RetentionInterval     time.Duration `env:"RETENTION_INTERVAL"`
+	RetentionBatchSize    int           `env:"RETENTION_BATCH_SIZE"`
+	RetentionDir          string        `env:"RETENTION_DIR"`
+
+	// PIIKeys are base64 AES-256 keys by ID, e.g. "k1:BASE64,k2:BASE64".
+	PIIKeys               map[string]string `env:"PII_KEYS" envKeyValSeparator:":"`
+	PIIKeyID              string            `env:"PII_KEY_ID"`
+	PIIIndexKey           string            `env:"PII_INDEX_KEY"`
+	PIIReencryptInterval  time.Duration     `env:"PII_REENCRYPT_INTERVAL"`
+	PIIReencryptBatchSize int               `env:"PII_REENCRYPT_BATCH_SIZE"`
+
+	PartitionAheadMonths  int           `env:"PARTITION_AHEAD_MONTHS"`
+	PartitionRetainMonths int           `env:"PARTITION_RETAIN_MONTHS"`
+	PartitionInterval     time.Duration `env:"PARTITION_INTERVAL"`
+
+	// ReplicaURLs are comma-separated Postgres URLs of read replicas.
+	ReplicaURLs          []string      `env:"DATABASE_REPLICA_URLS"`
+	ReplicaCheckInterval time.Duration `env:"REPLICA_CHECK_INTERVAL"`
+	ReplicaMaxLag        time.Duration `env:"REPLICA_MAX_LAG"`
+	ReplicaStickyWindow  time.Duration `env:"REPLICA_STICKY_WINDOW"`
+
+	// CDCEnabled publishes order changes to the ORDERS_CDC stream; it needs
+	// NATS_URL and Postgres with wal_level = logical.
+	CDCEnabled bool   `env:"CDC_ENABLED"`
+	CDCSlot    string `env:"CDC_SLOT"`
+	// CDCMaxAge is how long ORDERS_CDC keeps events.
+	CDCMaxAge time.Duration `env:"CDC_MAX_AGE"`
+
+	// ShardURLs are comma-separated database URLs; when set, orders are
+	// spread over them by shardkey and DATABASE_URL is not used.
+	ShardURLs []string `env:"DATABASE_SHARD_URLS"`
 }
 
 func LoadConfig() (Config, error) {
@@ -19,5 +84,84 @@ func LoadConfig() (Config, error) {
 	if cfg.NWorkers == 0 {
 		cfg.NWorkers = 8
 	}
+	if cfg.DBMaxOpenConns == 0 {
+		cfg.DBMaxOpenConns = 25
+	}
+	if cfg.DBMaxIdleConns == 0 {
+		cfg.DBMaxIdleConns = 10
+	}
+	if cfg.DBConnMaxLifetime == 0 {
+		cfg.DBConnMaxLifetime = 30 * time.Minute
+	}
+	if cfg.DBConnMaxIdleTime == 0 {
+		cfg.DBConnMaxIdleTime = 5 * time.Minute
+	}
+	if cfg.DBApplicationName == "" {
+		cfg.DBApplicationName = "wbstorage"
+	}
+	if cfg.DBSlowQueryThreshold == 0 {
+		cfg.DBSlowQueryThreshold = 200 * time.Millisecond
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = 10 * time.Minute
+	}
+	if cfg.AccessFlushInterval == 0 {
+		cfg.AccessFlushInterval = 10 * time.Second
+	}
+	if cfg.WarmupMode == "" {
+		cfg.WarmupMode = db.WarmupByAccess
+	}
+	if cfg.WarmupCount == 0 && cfg.WarmupMode != db.WarmupByWindow {
+		cfg.WarmupCount = 100
+	}
+	if cfg.WarmupWindow == 0 {
+		cfg.WarmupWindow = 24 * time.Hour
+	}
+	if cfg.WarmupWorkers == 0 {
+		cfg.WarmupWorkers = 4
+	}
+	if cfg.RetentionInterval == 0 {
+		cfg.RetentionInterval = time.Hour
+	}
+	if cfg.RetentionBatchSize == 0 {
+		cfg.RetentionBatchSize = 500
+	}
+	if cfg.RetentionDir == "" {
+		cfg.RetentionDir = "archive"
+	}
+	if cfg.PIIReencryptInterval == 0 {
+		cfg.PIIReencryptInterval = 10 * time.Minute
+	}
+	if cfg.PIIReencryptBatchSize == 0 {
+		cfg.PIIReencryptBatchSize = 500
+	}
+	if cfg.PartitionAheadMonths == 0 {
+		cfg.PartitionAheadMonths = 3
+	}
+	if cfg.PartitionInterval == 0 {
+		cfg.PartitionInterval = 24 * time.Hour
+	}
+	if cfg.CDCSlot == "" {
+		cfg.CDCSlot = "orders_cdc"
+	}
+	if cfg.CDCMaxAge == 0 {
+		cfg.CDCMaxAge = 7 * 24 * time.Hour
+	}
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = nuid.Next()
+	}
 	return cfg, nil
 }
+
+// Pool returns the Postgres connection pool settings.
+func (cfg Config) Pool() db.PoolConfig {
+	return db.PoolConfig{
+		MaxOpenConns:       cfg.DBMaxOpenConns,
+		MaxIdleConns:       cfg.DBMaxIdleConns,
+		ConnMaxLifetime:    cfg.DBConnMaxLifetime,
+		ConnMaxIdleTime:    cfg.DBConnMaxIdleTime,
+		StatementTimeout:   cfg.DBStatementTimeout,
+		ApplicationName:    cfg.DBApplicationName,
+		SlowQueryThreshold: cfg.DBSlowQueryThreshold,
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
@@ -10,10 +12,16 @@ import (
 	"os/signal"
 	"time"
 
+	"wbstorage/internal/cdc"
 	"wbstorage/internal/consumer"
 	"wbstorage/internal/db"
+	"wbstorage/internal/invalidation"
+	"wbstorage/internal/pii"
+	"wbstorage/internal/retention"
 	"wbstorage/internal/server"
 
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -33,28 +41,84 @@ func main() {
 	defer cancel()
 	group, ctx := errgroup.WithContext(ctx)
 
-	slog.Info("Database connection string loaded", "connString", cfg.ConnString)
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(ctx, cfg, os.Args[1:]))
+	}
 
-	dbConn, err := db.NewDB(cfg.ConnString)
+	dbConn, err := openDatabase(ctx, cfg, group)
 	if err != nil {
-		slog.Error("Failed to connect to the database", "error", err)
+		slog.Error("Failed to open the database", "error", err)
 		os.Exit(1)
 	}
-	cachedDb, err := db.NewCachedClient(ctx, dbConn, 100)
+	breaker := db.NewBreakerClient(dbConn, db.BreakerConfig{
+		Threshold: cfg.BreakerThreshold,
+		Cooldown:  cfg.BreakerCooldown,
+	})
+	var tracker *db.AccessTracker
+	if store, ok := dbConn.(db.AccessStore); ok {
+		tracker = db.NewAccessTracker(store, cfg.AccessFlushInterval)
+		group.Go(func() error { return tracker.Run(ctx) })
+	}
+	// orders invalidated elsewhere are re-read from a primary while the
+	// replicas may still hold the old version
+	var primaryWindow time.Duration
+	for _, client := range postgresClients(dbConn) {
+		primaryWindow = max(primaryWindow, client.StickyWindow())
+	}
+	cachedDb, err := db.NewCachedClient(ctx, breaker, db.CacheConfig{
+		TTL:           cfg.CacheTTL,
+		Tracker:       tracker,
+		PrimaryWindow: primaryWindow,
+		Warmup: db.WarmupConfig{
+			Mode:       cfg.WarmupMode,
+			Count:      cfg.WarmupCount,
+			Window:     cfg.WarmupWindow,
+			Workers:    cfg.WarmupWorkers,
+			Background: cfg.WarmupBackground,
+		},
+	})
+	breaker.SetOnRecover(func() { cachedDb.RefreshStale(ctx) })
+	// changes made directly in Postgres reach the cache through NOTIFY
+	for _, client := range postgresClients(dbConn) {
+		group.Go(func() error {
+			return client.ListenOrderChanges(ctx, cachedDb.Evict, cachedDb.ExpireAll)
+		})
+	}
 
 	if err != nil {
 		slog.Error("Cache warmup failed", "error", err)
+	} else if cfg.WarmupBackground {
+		slog.Info("Cache warm-up started in background")
 	} else {
 		slog.Info("Successful cache warm-up")
 	}
 
-	consumer, err := consumer.NewConsumer(ctx, cachedDb, cfg.NATSUrl)
-	if err != nil {
-		slog.Error("Error initializing consumer", "error", err)
-		os.Exit(1)
+	if cfg.NATSUrl != "" {
+		runNATS(ctx, cachedDb, cfg, group)
+	} else {
+		slog.Warn("NATS_URL is not set, running without consumer and cache invalidation")
+	}
+
+	if cfg.CDCEnabled {
+		runCDC(ctx, postgresClients(dbConn), cfg, group)
+	}
+
+	if cfg.RetentionArchiveAfter > 0 || cfg.RetentionPurgeAfter > 0 {
+		// with shards the lock on the first one covers them all
+		var locker retention.Locker
+		if clients := postgresClients(dbConn); len(clients) > 0 {
+			locker = clients[0]
+		}
+		job := retention.NewJob(cachedDb, breaker, locker, retention.Policy{
+			ArchiveAfter: cfg.RetentionArchiveAfter,
+			PurgeAfter:   cfg.RetentionPurgeAfter,
+			Interval:     cfg.RetentionInterval,
+			BatchSize:    cfg.RetentionBatchSize,
+			Dir:          cfg.RetentionDir,
+		})
+		group.Go(func() error { return job.Run(ctx) })
+		slog.Info("Retention job started", "archiveAfter", cfg.RetentionArchiveAfter, "purgeAfter", cfg.RetentionPurgeAfter)
 	}
-	go consumer.Start(ctx, group, cfg.NWorkers)
-	slog.Info("Consumer prepared and started successfully")
 
 	runServer(ctx, cachedDb, cfg, group)
 
@@ -66,8 +130,211 @@ func main() {
 	time.Sleep(time.Second * 5)
 }
 
+// runNATS subscribes to cache invalidations and starts the order and return
+// consumers.
+func runNATS(ctx context.Context, cachedDb *db.CachedClient, cfg Config, g *errgroup.Group) {
+	nc, err := nats.Connect(cfg.NATSUrl)
+	if err != nil {
+		slog.Error("Error connecting to NATS", "error", err)
+		os.Exit(1)
+	}
+	inv, err := invalidation.NewInvalidator(nc, cfg.InstanceID, cachedDb)
+	if err != nil {
+		slog.Error("Error initializing cache invalidation", "error", err)
+		os.Exit(1)
+	}
+	cachedDb.SetInvalidator(inv)
+	slog.Info("Cache invalidation subscribed", "instanceID", cfg.InstanceID)
+	g.Go(func() error {
+		<-ctx.Done()
+		inv.Close()
+		nc.Close()
+		return nil
+	})
+
+	orderConsumer, err := consumer.NewConsumer(ctx, cachedDb, cfg.NATSUrl)
+	if err != nil {
+		slog.Error("Error initializing consumer", "error", err)
+		os.Exit(1)
+	}
+	go orderConsumer.Start(ctx, g, cfg.NWorkers)
+	slog.Info("Consumer prepared and started successfully")
+
+	returnConsumer, err := consumer.NewReturnConsumer(ctx, cachedDb, cfg.NATSUrl)
+	if err != nil {
+		slog.Error("Error initializing return consumer", "error", err)
+		os.Exit(1)
+	}
+	go returnConsumer.Start(ctx, g, cfg.NWorkers)
+	slog.Info("Return consumer started", "stream", consumer.ReturnsStream)
+}
+
+// openDatabase opens DATABASE_URL, or every shard of DATABASE_SHARD_URLS,
+// and starts the background jobs of the Postgres backends.
+func openDatabase(ctx context.Context, cfg Config, g *errgroup.Group) (db.Database, error) {
+	if len(cfg.ShardURLs) > 0 {
+		shards := make([]db.Database, len(cfg.ShardURLs))
+		for i, url := range cfg.ShardURLs {
+			shard, err := db.Open(url, cfg.Pool())
+			if err != nil {
+				return nil, fmt.Errorf("shard %d: %w", i, err)
+			}
+			if client, ok := shard.(*db.Client); ok {
+				if err := setupClient(ctx, client, cfg, g); err != nil {
+					return nil, fmt.Errorf("shard %d: %w", i, err)
+				}
+			}
+			shards[i] = shard
+		}
+		slog.Info("Orders sharded", "shards", len(shards))
+		return db.NewShardedDB(shards)
+	}
+
+	dbConn, err := db.Open(cfg.ConnString, cfg.Pool())
+	if err != nil {
+		return nil, err
+	}
+	client, ok := dbConn.(*db.Client)
+	if !ok {
+		return dbConn, nil
+	}
+	if err := setupClient(ctx, client, cfg, g); err != nil {
+		return nil, err
+	}
+	if len(cfg.ReplicaURLs) > 0 {
+		err := client.SetReplicas(db.ReplicaConfig{
+			URLs:          cfg.ReplicaURLs,
+			CheckInterval: cfg.ReplicaCheckInterval,
+			MaxLag:        cfg.ReplicaMaxLag,
+			StickyWindow:  cfg.ReplicaStickyWindow,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure read replicas: %w", err)
+		}
+		g.Go(func() error { return client.RunReplicaChecks(ctx) })
+		slog.Info("Read replicas configured", "replicas", len(cfg.ReplicaURLs))
+	}
+	return client, nil
+}
+
+// postgresClients returns the Postgres databases behind dbConn: the client
+// itself or the Postgres shards.
+func postgresClients(dbConn db.Database) []*db.Client {
+	var shards []db.Database
+	if sharded, ok := dbConn.(*db.ShardedDB); ok {
+		shards = sharded.Shards()
+	} else {
+		shards = []db.Database{dbConn}
+	}
+	var clients []*db.Client
+	for _, shard := range shards {
+		if client, ok := shard.(*db.Client); ok {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// setupClient applies migrations, configures PII encryption and starts the
+// partition manager. Only Postgres has these; the other backends create
+// their schema on open.
+func setupClient(ctx context.Context, client *db.Client, cfg Config, g *errgroup.Group) error {
+	if !cfg.SkipMigrations {
+		if err := migrateUp(ctx, client); err != nil {
+			return fmt.Errorf("failed to apply migrations: %w", err)
+		}
+	}
+	if err := setupPII(ctx, client, cfg, g); err != nil {
+		return fmt.Errorf("failed to configure PII encryption: %w", err)
+	}
+	partitions := client.NewPartitionManager(db.PartitionConfig{
+		Ahead:    cfg.PartitionAheadMonths,
+		Retain:   cfg.PartitionRetainMonths,
+		Interval: cfg.PartitionInterval,
+	})
+	g.Go(func() error { return partitions.Run(ctx) })
+	return nil
+}
+
+// runCDC starts a change data capture reader for every Postgres database.
+func runCDC(ctx context.Context, clients []*db.Client, cfg Config, g *errgroup.Group) {
+	if cfg.NATSUrl == "" || len(clients) == 0 {
+		slog.Error("CDC_ENABLED needs NATS_URL and a Postgres database")
+		os.Exit(1)
+	}
+	nc, err := nats.Connect(cfg.NATSUrl)
+	if err != nil {
+		slog.Error("Error connecting to NATS", "error", err)
+		os.Exit(1)
+	}
+	g.Go(func() error {
+		<-ctx.Done()
+		nc.Close()
+		return nil
+	})
+	js, err := jetstream.New(nc)
+	if err != nil {
+		slog.Error("Error creating a new JetStream instance", "error", err)
+		os.Exit(1)
+	}
+	for _, client := range clients {
+		reader, err := cdc.NewReader(ctx, client, js, cdc.Config{Slot: cfg.CDCSlot, MaxAge: cfg.CDCMaxAge})
+		if err != nil {
+			slog.Error("Error initializing CDC", "error", err)
+			os.Exit(1)
+		}
+		g.Go(func() error { return reader.Run(ctx) })
+	}
+	slog.Info("CDC started", "stream", cdc.Stream, "slot", cfg.CDCSlot, "databases", len(clients))
+}
+
+func migrateUp(ctx context.Context, dbConn *db.Client) error {
+	migrator, err := dbConn.NewMigrator(ctx)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+	return migrator.Up()
+}
+
+// setupPII enables delivery encryption when keys are configured and starts
+// re-encrypting rows written with older keys or in plaintext.
+func setupPII(ctx context.Context, client *db.Client, cfg Config, g *errgroup.Group) error {
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		slog.Warn("PII_KEYS is not set, storing delivery data in plaintext")
+		return nil
+	}
+	client.SetKeyring(keyring)
+	g.Go(func() error {
+		return client.RunReencryption(ctx, cfg.PIIReencryptInterval, cfg.PIIReencryptBatchSize)
+	})
+	slog.Info("PII encryption enabled", "keyID", keyring.CurrentID(), "keys", len(cfg.PIIKeys))
+	return nil
+}
+
+// loadKeyring builds the PII keyring from config, or returns nil if no keys
+// are configured.
+func loadKeyring(cfg Config) (*pii.Keyring, error) {
+	if len(cfg.PIIKeys) == 0 {
+		return nil, nil
+	}
+	keys, err := pii.ParseKeys(cfg.PIIKeys)
+	if err != nil {
+		return nil, err
+	}
+	indexKey, err := base64.StdEncoding.DecodeString(cfg.PIIIndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("PII_INDEX_KEY is not valid base64: %w", err)
+	}
+	return pii.NewKeyring(keys, cfg.PIIKeyID, indexKey)
+}
+
 func runServer(ctx context.Context, db db.Database, cfg Config, g *errgroup.Group) {
-	echoServer, err := server.NewServer(db)
+	echoServer, err := server.NewServer(db, cfg.AdminToken, cfg.WriteToken)
 	if err != nil {
 		slog.Error("Error initializing server", "error", err)
 		os.Exit(1)
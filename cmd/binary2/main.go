@@ -73,6 +73,28 @@ func generateOrder() ([]byte, error) {
 		OofShard:          "1",
 	}
 
+	order.Payment.Kind = models.PaymentCharge
+	if gofakeit.Bool() {
+		refund := order.Payment
+		refund.Kind = models.PaymentRefund
+		refund.Transaction = gofakeit.UUID()
+		refund.Amount = gofakeit.Number(1, order.Payment.Amount)
+		refund.PaymentDt = order.Payment.PaymentDt + int64(gofakeit.Number(3600, 30*24*3600))
+		refund.DeliveryCost, refund.GoodsTotal = 0, 0
+		order.Payments = append(order.Payments, refund)
+	}
+	if len(order.Items) > 1 && gofakeit.Bool() {
+		// ship the second half of the items separately
+		split := order.TrackNumber + "2"
+		order.Shipments = []models.Shipment{
+			{TrackNumber: order.TrackNumber, DeliveryService: order.DeliveryService, Status: "delivered"},
+			{TrackNumber: split, DeliveryService: order.DeliveryService, Status: "in_transit"},
+		}
+		for i := len(order.Items) / 2; i < len(order.Items); i++ {
+			order.Items[i].TrackNumber = split
+		}
+	}
+
 	jsonData, err := json.MarshalIndent(order, "", "  ")
 
 	return jsonData, err
@@ -0,0 +1,391 @@
+// Package backup exports orders to NDJSON files and imports them back, to
+// move orders between environments. Every export is accompanied by a
+// manifest with the number of orders and the checksum of the file.
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Format identifies the file layout in manifests.
+const Format = "wbstorage-orders-ndjson/1"
+
+// progressInterval is how often long exports and imports log their progress.
+const progressInterval = 5 * time.Second
+
+// Filter selects the orders to export. Zero fields match everything; To is
+// exclusive.
+type Filter struct {
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	CustomerID string    `json:"customer_id,omitempty"`
+}
+
+func (f Filter) match(order *models.Order) bool {
+	if !f.From.IsZero() && order.DateCreated.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !order.DateCreated.Before(f.To) {
+		return false
+	}
+	return f.CustomerID == "" || order.CustomerID == f.CustomerID
+}
+
+// Manifest describes an export file. It is written next to it, with
+// ManifestPath.
+type Manifest struct {
+	Format      string    `json:"format"`
+	File        string    `json:"file"`
+	Compression string    `json:"compression"`
+	Orders      int       `json:"orders"`
+	SHA256      string    `json:"sha256"`
+	Filter      Filter    `json:"filter"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ManifestPath returns the path of the manifest of the export file at path.
+func ManifestPath(path string) string {
+	return path + ".manifest.json"
+}
+
+// CompressionFor picks the compression from the file extension.
+func CompressionFor(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return CompressionGzip
+	case strings.HasSuffix(path, ".zst"):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// Export writes the orders matching filter to path, one JSON order per line,
+// and then its manifest. The file is written under a temporary name and
+// renamed once complete.
+func Export(ctx context.Context, database db.Database, path, compression string, filter Filter) (manifest *Manifest, err error) {
+	orderUIDs, err := listOrders(ctx, database, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("error creating export file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	hash := sha256.New()
+	buffered := bufio.NewWriter(io.MultiWriter(f, hash))
+	w, err := compress(buffered, compression)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+
+	manifest = &Manifest{
+		Format:      Format,
+		File:        filepath.Base(path),
+		Compression: compression,
+		Filter:      filter,
+		CreatedAt:   time.Now().UTC(),
+	}
+	lastReport := time.Now()
+	for i, uid := range orderUIDs {
+		order, err := database.SelectOrder(ctx, uid)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading order %s: %w", uid, err)
+		}
+		if !filter.match(order) {
+			continue
+		}
+		if err := enc.Encode(order.Snapshot()); err != nil {
+			return nil, fmt.Errorf("error writing order %s: %w", uid, err)
+		}
+		manifest.Orders++
+		if time.Since(lastReport) >= progressInterval {
+			slog.Info("Export progress", "checked", i+1, "total", len(orderUIDs), "exported", manifest.Orders)
+			lastReport = time.Now()
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("error finishing export: %w", err)
+	}
+	if err := buffered.Flush(); err != nil {
+		return nil, fmt.Errorf("error writing export: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("error syncing export: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("error closing export: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+
+	manifest.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(ManifestPath(path), append(data, '\n'), 0o644); err != nil {
+		return nil, fmt.Errorf("error writing manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// listOrders returns the candidates for filter, narrowed by the database
+// where it can.
+func listOrders(ctx context.Context, database db.Database, filter Filter) ([]string, error) {
+	if filter.CustomerID != "" {
+		return database.CustomerOrders(ctx, filter.CustomerID)
+	}
+	return database.GetOrdersCreatedSince(ctx, filter.From, 0)
+}
+
+// nopCloser keeps uncompressed output flushable through the same Close call.
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func compress(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone, "":
+		return nopCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("error creating zstd writer: %w", err)
+		}
+		return zw, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	// BatchSize is the number of orders written per transaction.
+	BatchSize int
+	// Replace overwrites stored orders with the imported ones. By default
+	// stored orders are kept, so importing a file again changes nothing.
+	Replace bool
+}
+
+// ImportStats counts the orders of an import.
+type ImportStats struct {
+	Read     int `json:"read"`
+	Inserted int `json:"inserted"`
+	Replaced int `json:"replaced"`
+	Skipped  int `json:"skipped"`
+}
+
+// Import loads the orders of an export file. If the file has a manifest, its
+// checksum is verified before anything is written and the number of orders
+// read is compared with it afterwards. Gzip and zstd files are recognized by
+// their content. An order without a UID or failing models.Order.Validate
+// stops the import with its line number; the batches before it stay
+// written.
+func Import(ctx context.Context, database db.Database, path string, opts ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	manifest, err := verify(path)
+	if err != nil {
+		return stats, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+	r, err := decompress(bufio.NewReader(f))
+	if err != nil {
+		return stats, err
+	}
+	defer r.Close()
+
+	dec := json.NewDecoder(r)
+	batch := make([]models.Order, 0, opts.BatchSize)
+	lastReport := time.Now()
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := writeBatch(ctx, database, batch, opts.Replace, &stats); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		if time.Since(lastReport) >= progressInterval {
+			total := 0
+			if manifest != nil {
+				total = manifest.Orders
+			}
+			slog.Info("Import progress", "read", stats.Read, "total", total,
+				"inserted", stats.Inserted, "replaced", stats.Replaced, "skipped", stats.Skipped)
+			lastReport = time.Now()
+		}
+		return nil
+	}
+	for {
+		var order models.Order
+		err := dec.Decode(&order)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("error reading line %d: %w", stats.Read+1, err)
+		}
+		stats.Read++
+		// the file holds one order per line
+		if order.OrderUID == "" {
+			return stats, fmt.Errorf("order on line %d has no order_uid", stats.Read)
+		}
+		if err := order.Validate(); err != nil {
+			return stats, fmt.Errorf("order %s on line %d: %w", order.OrderUID, stats.Read, err)
+		}
+		batch = append(batch, order)
+		if len(batch) == opts.BatchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return stats, err
+	}
+
+	if manifest != nil && stats.Read != manifest.Orders {
+		return stats, fmt.Errorf("file holds %d orders, manifest says %d", stats.Read, manifest.Orders)
+	}
+	return stats, nil
+}
+
+// verify checks the file against its manifest and returns the manifest, or
+// nil if there is none.
+func verify(path string) (*Manifest, error) {
+	data, err := os.ReadFile(ManifestPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Warn("No manifest found, importing without verification", "file", path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Format != Format {
+		return nil, fmt.Errorf("unsupported export format %q", manifest.Format)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, fmt.Errorf("error reading export file: %w", err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != manifest.SHA256 {
+		return nil, fmt.Errorf("checksum mismatch: file has %s, manifest says %s", sum, manifest.SHA256)
+	}
+	return &manifest, nil
+}
+
+func decompress(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := r.Peek(4)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("error opening gzip file: %w", err)
+		}
+		return gr, nil
+	case len(magic) == 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("error opening zstd file: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// writeBatch stores a batch in one transaction where the database supports
+// it, and order by order otherwise.
+func writeBatch(ctx context.Context, database db.Database, batch []models.Order, replace bool, stats *ImportStats) error {
+	if replace {
+		for _, order := range batch {
+			if err := database.UpsertOrder(ctx, order); err != nil {
+				return fmt.Errorf("error importing order %s: %w", order.OrderUID, err)
+			}
+			stats.Replaced++
+		}
+		return nil
+	}
+	if importer, ok := database.(db.OrderImporter); ok {
+		inserted, err := importer.ImportOrders(ctx, batch)
+		if err != nil {
+			return err
+		}
+		stats.Inserted += inserted
+		stats.Skipped += len(batch) - inserted
+		return nil
+	}
+	for _, order := range batch {
+		err := database.InsertOrder(ctx, order)
+		if errors.Is(err, db.ErrOrderExists) {
+			stats.Skipped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error importing order %s: %w", order.OrderUID, err)
+		}
+		stats.Inserted++
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+)
+
+func testOrder(orderUID, customerID string, created time.Time) models.Order {
+	return models.Order{
+		OrderUID:    orderUID,
+		TrackNumber: "WBILTRACK",
+		Entry:       "WBIL",
+		Delivery:    models.Delivery{Name: "Test Testov", City: "Kiryat Mozkin", Email: "test@gmail.com"},
+		Payment: models.Payment{
+			Kind:        models.PaymentCharge,
+			Transaction: orderUID,
+			Currency:    "USD",
+			Amount:      1817,
+		},
+		Payments:    []models.Payment{{Kind: models.PaymentRefund, Transaction: orderUID + "-refund", Currency: "USD", Amount: 100}},
+		Shipments:   []models.Shipment{{TrackNumber: "WBILTRACK", Status: "shipped"}},
+		Items:       []models.Item{{ChrtID: 9934930, RID: orderUID + "-1", Name: "Mascaras", TotalPrice: 317}},
+		CustomerID:  customerID,
+		DateCreated: created,
+	}
+}
+
+func sourceDB(t *testing.T) (*db.MemoryDB, []models.Order) {
+	t.Helper()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	orders := []models.Order{
+		testOrder("a", "customer", base),
+		testOrder("b", "customer", base.Add(24*time.Hour)),
+		testOrder("c", "other", base.Add(48*time.Hour)),
+	}
+	source := db.NewMemoryDB()
+	for _, order := range orders {
+		if err := source.InsertOrder(context.Background(), order); err != nil {
+			t.Fatalf("InsertOrder: %v", err)
+		}
+	}
+	return source, orders
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	source, orders := sourceDB(t)
+	tests := []struct {
+		name        string
+		file        string
+		compression string
+		filter      Filter
+		want        []models.Order
+	}{
+		{"plain", "orders.ndjson", CompressionNone, Filter{}, orders},
+		{"gzip", "orders.ndjson.gz", CompressionGzip, Filter{}, orders},
+		{"zstd", "orders.ndjson.zst", CompressionZstd, Filter{}, orders},
+		{"customer", "customer.ndjson", CompressionNone, Filter{CustomerID: "customer"}, orders[:2]},
+		{"range", "range.ndjson", CompressionNone, Filter{From: orders[1].DateCreated, To: orders[2].DateCreated}, orders[1:2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if CompressionFor(path) != tt.compression {
+				t.Fatalf("CompressionFor(%s) = %s, want %s", tt.file, CompressionFor(path), tt.compression)
+			}
+			manifest, err := Export(ctx, source, path, tt.compression, tt.filter)
+			if err != nil {
+				t.Fatalf("Export: %v", err)
+			}
+			if manifest.Orders != len(tt.want) {
+				t.Fatalf("exported %d orders, want %d", manifest.Orders, len(tt.want))
+			}
+
+			target := db.NewMemoryDB()
+			n := len(tt.want)
+			steps := []struct {
+				opts ImportOptions
+				want ImportStats
+			}{
+				{ImportOptions{BatchSize: 2}, ImportStats{Read: n, Inserted: n}},
+				// importing again changes nothing
+				{ImportOptions{BatchSize: 2}, ImportStats{Read: n, Skipped: n}},
+				{ImportOptions{Replace: true}, ImportStats{Read: n, Replaced: n}},
+			}
+			for i, step := range steps {
+				stats, err := Import(ctx, target, path, step.opts)
+				if err != nil {
+					t.Fatalf("Import #%d: %v", i+1, err)
+				}
+				if stats != step.want {
+					t.Fatalf("Import #%d: stats %+v, want %+v", i+1, stats, step.want)
+				}
+			}
+			for _, want := range tt.want {
+				got, err := target.SelectOrder(ctx, want.OrderUID)
+				if err != nil {
+					t.Fatalf("SelectOrder: %v", err)
+				}
+				changes, err := models.DiffOrders(&want, got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(changes) > 0 {
+					t.Fatalf("imported order %s differs: %+v", want.OrderUID, changes)
+				}
+			}
+		})
+	}
+}
+
+func TestImportRejectsCorruptedFile(t *testing.T) {
+	ctx := context.Background()
+	source, _ := sourceDB(t)
+	path := filepath.Join(t.TempDir(), "orders.ndjson")
+	if _, err := Export(ctx, source, path, CompressionNone, Filter{}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := strings.Replace(string(data), "Mascaras", "Mascarax", 1)
+	if err := os.WriteFile(path, []byte(corrupted), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := db.NewMemoryDB()
+	stats, err := Import(ctx, target, path, ImportOptions{})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("Import of a corrupted file: got %v, want a checksum mismatch", err)
+	}
+	if stats.Read != 0 {
+		t.Fatalf("Import read %d orders before verifying", stats.Read)
+	}
+	if uids, _ := target.GetRecentOrders(ctx, 0); len(uids) != 0 {
+		t.Fatalf("orders %v were written", uids)
+	}
+}
+
+func TestImportRejectsInvalidOrders(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"no uid", `{"track_number": "WBILTRACK"}`, "line 2 has no order_uid"},
+		{"invalid", `{"order_uid": "bad", "payment": {"kind": "gift", "amount": 1}}`, "order bad on line 2"},
+		{"not json", `{"order_uid": `, "error reading line 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// without a manifest the file is imported unverified
+			path := filepath.Join(t.TempDir(), "orders.ndjson")
+			content := `{"order_uid": "good"}` + "\n" + tt.line + "\n"
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Import(ctx, db.NewMemoryDB(), path, ImportOptions{})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Import: got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+// Package cdc publishes the changes of stored orders to NATS. It reads the
+// logical replication stream of Postgres (pgoutput) for the order tables
+// and the order history, and publishes one event per order changed in a
+// transaction with the whole order as that transaction committed it.
+package cdc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Stream is the JetStream stream the events are published to, on the
+// subjects ORDERS_CDC.upsert and ORDERS_CDC.delete.
+const Stream = "ORDERS_CDC"
+
+const (
+	OperationUpsert = "upsert"
+	OperationDelete = "delete"
+)
+
+// Event is the change of one order in one transaction. Order is the state
+// the transaction left the order in, nil for deletes. Its personal
+// data is removed, see models.Order.Anonymize: the stream keeps events for
+// Config.MaxAge, out of reach of encryption and erasure.
+type Event struct {
+	OrderUID    string        `json:"order_uid"`
+	Operation   string        `json:"operation"`
+	LSN         string        `json:"lsn"`
+	CommittedAt time.Time     `json:"committed_at"`
+	Order       *models.Order `json:"order,omitempty"`
+}
+
+type Config struct {
+	// Slot is the name of the replication slot, created if missing.
+	Slot string
+	// StandbyInterval is how often the confirmed position is reported to
+	// the server.
+	StandbyInterval time.Duration
+	// RetryInterval is the wait before reconnecting after an error.
+	RetryInterval time.Duration
+	// MaxAge is how long the stream keeps events.
+	MaxAge time.Duration
+}
+
+// Reader streams the changes of one Postgres database. Only one reader can
+// use a slot at a time; readers of other instances wait and retry, so one of
+// them takes over when the active one stops.
+type Reader struct {
+	client    *db.Client
+	positions positionStore
+	js        jetstream.JetStream
+	cfg       Config
+}
+
+// positionStore keeps the position the reader has published up to; it is
+// implemented by db.Client.
+type positionStore interface {
+	CDCPosition(ctx context.Context, slot string) (string, error)
+	SaveCDCPosition(ctx context.Context, slot, lsn string) error
+}
+
+func NewReader(ctx context.Context, client *db.Client, js jetstream.JetStream, cfg Config) (*Reader, error) {
+	if cfg.Slot == "" {
+		cfg.Slot = "orders_cdc"
+	}
+	if cfg.StandbyInterval <= 0 {
+		cfg.StandbyInterval = 10 * time.Second
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 5 * time.Second
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = 7 * 24 * time.Hour
+	}
+	_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     Stream,
+		Subjects: []string{Stream + ".>"},
+		MaxAge:   cfg.MaxAge,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating stream %s: %w", Stream, err)
+	}
+	return &Reader{client: client, positions: client, js: js, cfg: cfg}, nil
+}
+
+// Run streams changes until ctx is done, reconnecting after errors.
+func (r *Reader) Run(ctx context.Context) error {
+	for {
+		err := r.stream(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "55006" {
+			slog.Info("Replication slot is used by another instance, standing by", "slot", r.cfg.Slot)
+		} else {
+			slog.Error("CDC stream stopped, reconnecting", "error", err, "slot", r.cfg.Slot, "retryIn", r.cfg.RetryInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.cfg.RetryInterval):
+		}
+	}
+}
+
+// transaction collects the changes of the transaction being read.
+type transaction struct {
+	relations map[uint32]*pglogrepl.RelationMessage
+	// versions holds the last history entry of each order recorded in the
+	// transaction.
+	versions map[string]*version
+	// deleted holds the orders whose row was deleted without a history
+	// entry, as retention does.
+	deleted map[string]bool
+	// confirmed is the end of the last transaction fully published.
+	confirmed pglogrepl.LSN
+}
+
+// version is an order_history row as decoded from the replication stream.
+type version struct {
+	number    int
+	operation string
+	source    string
+	snapshot  []byte
+}
+
+func (r *Reader) stream(ctx context.Context) error {
+	connString, err := r.client.ReplicationConnString()
+	if err != nil {
+		return err
+	}
+	conn, err := pgconn.Connect(ctx, connString)
+	if err != nil {
+		return fmt.Errorf("error connecting for replication: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	if err := r.ensureSlot(ctx, conn); err != nil {
+		return err
+	}
+	var start pglogrepl.LSN
+	saved, err := r.positions.CDCPosition(ctx, r.cfg.Slot)
+	if err != nil {
+		return err
+	}
+	if saved != "" {
+		if start, err = pglogrepl.ParseLSN(saved); err != nil {
+			return fmt.Errorf("invalid saved CDC position %q: %w", saved, err)
+		}
+	}
+	// the server resumes from the slot's confirmed position if it is later
+	err = pglogrepl.StartReplication(ctx, conn, r.cfg.Slot, start, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{"proto_version '1'", "publication_names '" + db.CDCPublication + "'"},
+	})
+	if err != nil {
+		return fmt.Errorf("error starting replication: %w", err)
+	}
+	slog.Info("CDC streaming started", "slot", r.cfg.Slot, "from", start)
+
+	tx := &transaction{relations: make(map[uint32]*pglogrepl.RelationMessage), confirmed: start}
+	nextStatus := time.Now()
+	for {
+		if !time.Now().Before(nextStatus) {
+			err := pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: tx.confirmed})
+			if err != nil {
+				return fmt.Errorf("error sending standby status: %w", err)
+			}
+			nextStatus = time.Now().Add(r.cfg.StandbyInterval)
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		raw, err := conn.ReceiveMessage(receiveCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return fmt.Errorf("error receiving replication message: %w", err)
+		}
+
+		switch msg := raw.(type) {
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("replication error: %s", msg.Message)
+		case *pgproto3.CopyData:
+			switch msg.Data[0] {
+			case pglogrepl.PrimaryKeepaliveMessageByteID:
+				keepalive, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
+				if err != nil {
+					return err
+				}
+				tx.keepalive(keepalive.ServerWALEnd)
+				if keepalive.ReplyRequested {
+					nextStatus = time.Time{}
+				}
+			case pglogrepl.XLogDataByteID:
+				xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
+				if err != nil {
+					return err
+				}
+				msg, err := pglogrepl.Parse(xld.WALData)
+				if err != nil {
+					return fmt.Errorf("error parsing replication message: %w", err)
+				}
+				if err := r.handle(ctx, tx, msg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (r *Reader) ensureSlot(ctx context.Context, conn *pgconn.PgConn) error {
+	_, err := pglogrepl.CreateReplicationSlot(ctx, conn, r.cfg.Slot, "pgoutput",
+		pglogrepl.CreateReplicationSlotOptions{Mode: pglogrepl.LogicalReplication})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42710" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error creating replication slot: %w", err)
+	}
+	slog.Info("Replication slot created", "slot", r.cfg.Slot)
+	return nil
+}
+
+func (r *Reader) handle(ctx context.Context, tx *transaction, msg pglogrepl.Message) error {
+	switch m := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		tx.relations[m.RelationID] = m
+	case *pglogrepl.BeginMessage:
+		tx.versions = make(map[string]*version)
+		tx.deleted = make(map[string]bool)
+	case *pglogrepl.InsertMessage:
+		if err := tx.noteVersion(m.RelationID, m.Tuple); err != nil {
+			return err
+		}
+	case *pglogrepl.DeleteMessage:
+		tx.noteDelete(m.RelationID, m.OldTuple)
+	case *pglogrepl.TruncateMessage:
+		slog.Warn("Truncate of order tables is not published", "relations", m.RelationNum)
+	case *pglogrepl.CommitMessage:
+		if len(tx.versions) > 0 || len(tx.deleted) > 0 {
+			if err := r.publish(ctx, tx, m); err != nil {
+				return err
+			}
+			if err := r.positions.SaveCDCPosition(ctx, r.cfg.Slot, m.TransactionEndLSN.String()); err != nil {
+				return err
+			}
+		}
+		tx.confirmed = m.TransactionEndLSN
+		tx.versions = nil
+		tx.deleted = nil
+	}
+	return nil
+}
+
+// keepalive advances the confirmed position to the server's WAL end when no
+// transaction is open: everything before it has been received then.
+// Otherwise the position would only move on commits of transactions the
+// publication covers, and the slot would hold back WAL while orders don't
+// change.
+func (tx *transaction) keepalive(walEnd pglogrepl.LSN) {
+	if tx.versions == nil && walEnd > tx.confirmed {
+		tx.confirmed = walEnd
+	}
+}
+
+// columns returns the text values of tuple by column name, if the relation
+// is table.
+func (tx *transaction) columns(relationID uint32, tuple *pglogrepl.TupleData, table string) map[string]string {
+	rel, ok := tx.relations[relationID]
+	if !ok || rel.RelationName != table || tuple == nil {
+		return nil
+	}
+	values := make(map[string]string, len(rel.Columns))
+	for i, col := range rel.Columns {
+		if i < len(tuple.Columns) && tuple.Columns[i].DataType == pglogrepl.TupleDataTypeText {
+			values[col.Name] = string(tuple.Columns[i].Data)
+		}
+	}
+	return values
+}
+
+// noteVersion records an order_history row inserted in the transaction.
+// Inserts into the other tables need no attention: every change of an
+// order's content records a history entry in the same transaction.
+func (tx *transaction) noteVersion(relationID uint32, tuple *pglogrepl.TupleData) error {
+	values := tx.columns(relationID, tuple, "order_history")
+	if values == nil || tx.versions == nil {
+		return nil
+	}
+	uid := values["order_uid"]
+	number, err := strconv.Atoi(values["version"])
+	if err != nil {
+		return fmt.Errorf("invalid history version of order %s: %w", uid, err)
+	}
+	if prev, ok := tx.versions[uid]; ok && prev.number > number {
+		return nil
+	}
+	tx.versions[uid] = &version{
+		number:    number,
+		operation: values["operation"],
+		source:    values["source"],
+		snapshot:  []byte(values["snapshot"]),
+	}
+	return nil
+}
+
+// noteDelete records a deleted order row.
+func (tx *transaction) noteDelete(relationID uint32, tuple *pglogrepl.TupleData) {
+	values := tx.columns(relationID, tuple, "orders")
+	if values == nil || tx.deleted == nil {
+		return
+	}
+	tx.deleted[values["order_uid"]] = true
+}
+
+// publish sends one event per order changed in the transaction, with the
+// order as recorded in its history entry. Orders removed from a shard
+// because they moved to another one are skipped; the other shard publishes
+// their upsert. Message IDs are derived from the commit, so events
+// published again after a restart are dropped by JetStream within its
+// duplicate window.
+func (r *Reader) publish(ctx context.Context, tx *transaction, commit *pglogrepl.CommitMessage) error {
+	events := make([]Event, 0, len(tx.versions)+len(tx.deleted))
+	for uid := range tx.deleted {
+		if _, ok := tx.versions[uid]; !ok {
+			events = append(events, Event{OrderUID: uid, Operation: OperationDelete})
+		}
+	}
+	for uid, v := range tx.versions {
+		if v.source == db.SourceShardMove {
+			continue
+		}
+		event := Event{OrderUID: uid, Operation: OperationUpsert}
+		if v.operation == models.OperationDelete {
+			event.Operation = OperationDelete
+		} else {
+			// the delivery in the snapshot may be encrypted, Anonymize
+			// clears it
+			event.Order = &models.Order{}
+			if err := json.Unmarshal(v.snapshot, event.Order); err != nil {
+				return fmt.Errorf("error decoding history of order %s: %w", uid, err)
+			}
+			event.Order.Anonymize()
+		}
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].OrderUID < events[j].OrderUID })
+
+	for _, event := range events {
+		event.LSN = commit.CommitLSN.String()
+		event.CommittedAt = commit.CommitTime
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		msgID := event.LSN + "/" + event.OrderUID
+		if _, err := r.js.Publish(ctx, Stream+"."+event.Operation, data, jetstream.WithMsgID(msgID)); err != nil {
+			return fmt.Errorf("error publishing change of order %s: %w", event.OrderUID, err)
+		}
+	}
+	slog.Info("Order changes published", "orders", len(events), "lsn", commit.CommitLSN)
+	return nil
+}
@@ -0,0 +1,175 @@
+package cdc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// fakeStream records what is published to it.
+type fakeStream struct {
+	jetstream.JetStream
+	subjects []string
+	events   []Event
+}
+
+func (f *fakeStream) Publish(ctx context.Context, subject string, data []byte, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	f.subjects = append(f.subjects, subject)
+	f.events = append(f.events, event)
+	return &jetstream.PubAck{Stream: Stream}, nil
+}
+
+type fakePositions struct {
+	saved []string
+}
+
+func (f *fakePositions) CDCPosition(ctx context.Context, slot string) (string, error) {
+	return "", nil
+}
+
+func (f *fakePositions) SaveCDCPosition(ctx context.Context, slot, lsn string) error {
+	f.saved = append(f.saved, lsn)
+	return nil
+}
+
+const (
+	historyRelation = 1
+	ordersRelation  = 2
+)
+
+func relation(id uint32, table string, columns ...string) *pglogrepl.RelationMessage {
+	rel := &pglogrepl.RelationMessage{RelationID: id, RelationName: table}
+	for _, name := range columns {
+		rel.Columns = append(rel.Columns, &pglogrepl.RelationMessageColumn{Name: name})
+	}
+	return rel
+}
+
+func tuple(values ...string) *pglogrepl.TupleData {
+	data := &pglogrepl.TupleData{}
+	for _, v := range values {
+		data.Columns = append(data.Columns, &pglogrepl.TupleDataColumn{
+			DataType: pglogrepl.TupleDataTypeText,
+			Data:     []byte(v),
+		})
+	}
+	return data
+}
+
+func historyInsert(t *testing.T, order models.Order, version int, operation, source string) *pglogrepl.InsertMessage {
+	t.Helper()
+	snapshot, err := json.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pglogrepl.InsertMessage{
+		RelationID: historyRelation,
+		Tuple:      tuple(order.OrderUID, fmt.Sprint(version), operation, source, string(snapshot)),
+	}
+}
+
+func newTestReader() (*Reader, *fakeStream, *fakePositions, *transaction) {
+	js, positions := &fakeStream{}, &fakePositions{}
+	r := &Reader{positions: positions, js: js, cfg: Config{Slot: "test"}}
+	tx := &transaction{relations: make(map[uint32]*pglogrepl.RelationMessage)}
+	return r, js, positions, tx
+}
+
+func TestHandlePublishesCommittedChanges(t *testing.T) {
+	ctx := context.Background()
+	r, js, positions, tx := newTestReader()
+
+	order := models.Order{OrderUID: "b-updated", CustomerID: "customer", Delivery: models.Delivery{Name: "Test Testov"}}
+	moved := models.Order{OrderUID: "c-moved"}
+	commit := &pglogrepl.CommitMessage{CommitLSN: 0x100, TransactionEndLSN: 0x110, CommitTime: time.Now().UTC()}
+	msgs := []pglogrepl.Message{
+		relation(historyRelation, "order_history", "order_uid", "version", "operation", "source", "snapshot"),
+		relation(ordersRelation, "orders", "order_uid"),
+		&pglogrepl.BeginMessage{},
+		historyInsert(t, models.Order{OrderUID: order.OrderUID}, 1, models.OperationInsert, "test"),
+		historyInsert(t, order, 2, models.OperationUpdate, "test"),
+		historyInsert(t, moved, 3, models.OperationInsert, db.SourceShardMove),
+		// retention deletes without a history entry
+		&pglogrepl.DeleteMessage{RelationID: ordersRelation, OldTuple: tuple("a-archived")},
+		commit,
+	}
+	for _, msg := range msgs {
+		if err := r.handle(ctx, tx, msg); err != nil {
+			t.Fatalf("handle %T: %v", msg, err)
+		}
+	}
+
+	wantSubjects := []string{Stream + "." + OperationDelete, Stream + "." + OperationUpsert}
+	if fmt.Sprint(js.subjects) != fmt.Sprint(wantSubjects) {
+		t.Fatalf("published to %v, want %v", js.subjects, wantSubjects)
+	}
+	deleted, upserted := js.events[0], js.events[1]
+	if deleted.OrderUID != "a-archived" || deleted.Order != nil {
+		t.Errorf("delete event = %+v", deleted)
+	}
+	if upserted.OrderUID != order.OrderUID || upserted.Order == nil || upserted.LSN != commit.CommitLSN.String() {
+		t.Fatalf("upsert event = %+v", upserted)
+	}
+	if upserted.Order.CustomerID != "" || upserted.Order.Delivery.Name != "" {
+		t.Errorf("published order was not anonymized: %+v", upserted.Order)
+	}
+	if tx.confirmed != commit.TransactionEndLSN {
+		t.Errorf("confirmed %s, want %s", tx.confirmed, commit.TransactionEndLSN)
+	}
+	if fmt.Sprint(positions.saved) != fmt.Sprint([]string{commit.TransactionEndLSN.String()}) {
+		t.Errorf("saved positions %v", positions.saved)
+	}
+
+	// a transaction without order changes publishes nothing but is confirmed
+	empty := &pglogrepl.CommitMessage{CommitLSN: 0x200, TransactionEndLSN: 0x210}
+	for _, msg := range []pglogrepl.Message{&pglogrepl.BeginMessage{}, empty} {
+		if err := r.handle(ctx, tx, msg); err != nil {
+			t.Fatalf("handle %T: %v", msg, err)
+		}
+	}
+	if len(js.events) != 2 || len(positions.saved) != 1 || tx.confirmed != empty.TransactionEndLSN {
+		t.Errorf("after an empty transaction: %d events, %d saved, confirmed %s", len(js.events), len(positions.saved), tx.confirmed)
+	}
+}
+
+func TestKeepaliveAdvancesOnlyBetweenTransactions(t *testing.T) {
+	ctx := context.Background()
+	r, _, _, tx := newTestReader()
+	tx.confirmed = 0x100
+
+	tx.keepalive(0x200)
+	if tx.confirmed != 0x200 {
+		t.Fatalf("idle keepalive confirmed %s, want 0/200", tx.confirmed)
+	}
+	tx.keepalive(0x150)
+	if tx.confirmed != 0x200 {
+		t.Fatalf("an older WAL end moved the position back to %s", tx.confirmed)
+	}
+
+	if err := r.handle(ctx, tx, &pglogrepl.BeginMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	tx.keepalive(0x300)
+	if tx.confirmed != 0x200 {
+		t.Fatalf("keepalive inside a transaction confirmed %s", tx.confirmed)
+	}
+	if err := r.handle(ctx, tx, &pglogrepl.CommitMessage{TransactionEndLSN: 0x280}); err != nil {
+		t.Fatal(err)
+	}
+	tx.keepalive(0x300)
+	if tx.confirmed != 0x300 {
+		t.Fatalf("keepalive after the commit confirmed %s, want 0/300", tx.confirmed)
+	}
+}
@@ -3,6 +3,7 @@ package consumer
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
@@ -18,9 +19,30 @@ import (
 type consumer struct {
 	consumer jetstream.Consumer
 	db       db.Database
+	health   db.HealthChecker
+	// process handles one message of the stream.
+	process func(ctx context.Context, job job)
 }
 
 func NewConsumer(ctx context.Context, db *db.CachedClient, natsUrl string) (*consumer, error) {
+	cs, err := newStreamConsumer(ctx, natsUrl, "ORDERS", "CONS", jetstream.ConsumerConfig{})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &consumer{
+		consumer: cs,
+		db:       db,
+		health:   db,
+	}
+	c.process = c.processJob
+	return c, nil
+}
+
+// newStreamConsumer creates the stream for stream.* subjects if needed and
+// the durable consumer with its name on it, with explicit acks and the other
+// settings from cfg.
+func newStreamConsumer(ctx context.Context, natsUrl, stream, durable string, cfg jetstream.ConsumerConfig) (jetstream.Consumer, error) {
 	nc, err := nats.Connect(natsUrl)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to NATS: %w", err)
@@ -32,26 +54,21 @@ func NewConsumer(ctx context.Context, db *db.CachedClient, natsUrl string) (*con
 	}
 
 	streamConfig := jetstream.StreamConfig{
-		Name:     "ORDERS",
-		Subjects: []string{"ORDERS.*"},
+		Name:     stream,
+		Subjects: []string{stream + ".*"},
 	}
 	st, err := js.CreateStream(ctx, streamConfig)
 	if err != nil {
 		return nil, fmt.Errorf("error creating stream: %w", err)
 	}
 
-	cs, err := st.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Durable:   "CONS",
-		AckPolicy: jetstream.AckExplicitPolicy,
-	})
+	cfg.Durable = durable
+	cfg.AckPolicy = jetstream.AckExplicitPolicy
+	cs, err := st.CreateOrUpdateConsumer(ctx, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("error creating consumer: %w", err)
 	}
-
-	return &consumer{
-		consumer: cs,
-		db:       db,
-	}, nil
+	return cs, nil
 }
 
 type job struct {
@@ -71,7 +88,7 @@ func (c *consumer) startWorkers(ctx context.Context, jobs <-chan job, workers in
 		go func() {
 			defer wg.Done()
 			for job := range jobs {
-				c.processJob(ctx, job)
+				c.process(ctx, job)
 			}
 		}()
 	}
@@ -94,7 +111,14 @@ func (c *consumer) publishJobs(ctx context.Context, jobs chan<- job) {
 		case <-ctx.Done():
 			close(jobs) // very important as it lets workers to stop
 			slog.Info("Context done, jobs channel closed")
+			return
 		default:
+			if !c.health.Healthy() {
+				// no point fetching messages we can't store, let them wait in the stream
+				slog.Warn("Database unavailable, pausing message fetching")
+				c.waitHealthy(ctx)
+				continue
+			}
 			msg, err := it.Next()
 			if err != nil {
 				slog.Error("Failed to get next message", "error", err)
@@ -107,20 +131,59 @@ func (c *consumer) publishJobs(ctx context.Context, jobs chan<- job) {
 	}
 }
 
+func (c *consumer) waitHealthy(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for !c.health.Healthy() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	slog.Info("Database available again, resuming message fetching")
+}
+
+// DecoderVersion identifies how payloads are decoded into models.Order. It is
+// archived with every raw message; bump it when the decoding changes.
+const DecoderVersion = "2"
+
 func (c *consumer) processJob(ctx context.Context, job job) {
+	raw := rawMessage(job.Msg)
 	var order models.Order
-	if err := json.Unmarshal(job.Msg.Data(), &order); err != nil {
-		slog.Error("Error parsing message", "error", err)
+	parseErr := json.Unmarshal(job.Msg.Data(), &order)
+	if parseErr == nil {
+		raw.OrderUID = order.OrderUID
+		// an invalid order is archived and acknowledged like one that
+		// can't be parsed, as redelivering it can't help
+		parseErr = order.Validate()
+	}
+	if parseErr != nil {
+		raw.ParseError = parseErr.Error()
+	}
+
+	ctxInsert, cancel := context.WithTimeout(db.WithSource(ctx, "nats:"+raw.Subject), time.Second*15)
+	defer cancel()
+
+	// archive before anything else, the message is redelivered if this fails
+	if err := c.db.ArchiveRawMessage(ctxInsert, raw); err != nil {
+		slog.Error("Error archiving raw message", "error", err)
+		return
+	}
+
+	if parseErr != nil {
+		slog.Error("Error parsing message", "error", parseErr)
 		ackErr := job.Msg.Ack()
 		if ackErr != nil {
 			slog.Error("Error acknowledges a message", "error", ackErr)
 		}
 		return
 	}
-	ctxInsert, cancel := context.WithTimeout(ctx, time.Second*15)
-	defer cancel()
 
-	if err := c.db.InsertOrder(ctxInsert, order); err != nil {
+	if err := c.db.InsertOrder(ctxInsert, order); errors.Is(err, db.ErrOrderExists) {
+		c.updateOrder(ctxInsert, job, raw, order)
+		return
+	} else if err != nil {
 		slog.Error("Error writing into DB", "error", err)
 		return
 	} else {
@@ -134,3 +197,69 @@ func (c *consumer) processJob(ctx context.Context, job job) {
 	slog.Info("Success", "url", "http://localhost:8080/"+order.OrderUID)
 
 }
+
+// updateOrder handles an order that is stored already. Only its new
+// payments and shipments are applied, merged into the stored order by the
+// database, see db.Database.MergeOrder. Other changes, such as corrected
+// items, delivery or amounts, are not: they are logged and the message stays
+// in raw_messages, to be replayed by hand. A redelivered message or a
+// duplicate is acknowledged, as storing it again can't help, and so is an
+// update that is rejected.
+func (c *consumer) updateOrder(ctx context.Context, job job, raw models.RawMessage, order models.Order) {
+	merged, changed, err := c.db.MergeOrder(ctx, order)
+	if errors.Is(err, db.ErrOrderErased) || errors.Is(err, models.ErrInvalidOrder) {
+		slog.Warn("Order update rejected", "orderUID", order.OrderUID, "error", err)
+		ack(job.Msg)
+		return
+	}
+	if err != nil {
+		slog.Error("Error writing into DB", "error", err)
+		return
+	}
+
+	if changed {
+		slog.Info("Successfully updated in DB", "orderUID", order.OrderUID)
+	}
+	ignored, err := ignoredChanges(merged, order)
+	if err != nil {
+		slog.Error("Error comparing order update", "error", err, "orderUID", order.OrderUID)
+	} else if len(ignored) > 0 {
+		slog.Warn("Order update has changes that are not applied", "orderUID", order.OrderUID,
+			"fields", ignored, "stream", raw.Stream, "streamSeq", raw.StreamSeq)
+	} else if !changed {
+		slog.Warn("Order already stored, skipping message", "orderUID", order.OrderUID)
+	}
+	ack(job.Msg)
+}
+
+// ignoredChanges lists the fields in which order differs from the merged
+// one other than its payments and shipments.
+func ignoredChanges(merged *models.Order, order models.Order) ([]string, error) {
+	order.Payment, order.Payments, order.Shipments = merged.Payment, merged.Payments, merged.Shipments
+	changes, err := models.DiffOrders(merged, &order)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(changes))
+	for i, change := range changes {
+		paths[i] = change.Path
+	}
+	return paths, nil
+}
+
+func rawMessage(msg jetstream.Msg) models.RawMessage {
+	raw := models.RawMessage{
+		Subject:        msg.Subject(),
+		Headers:        msg.Headers(),
+		Payload:        msg.Data(),
+		ReceivedAt:     time.Now(),
+		DecoderVersion: DecoderVersion,
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		raw.Stream = meta.Stream
+		raw.StreamSeq = meta.Sequence.Stream
+	} else {
+		slog.Error("Error reading message metadata", "error", err)
+	}
+	return raw
+}
@@ -0,0 +1,116 @@
+package consumer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+	"wbstorage/internal/returns"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ReturnsStream holds the return events, on the subjects RETURNS.<status>.
+const ReturnsStream = "RETURNS"
+
+const (
+	// returnRetryDelay is the wait before redelivering an event that came
+	// before the one it depends on, such as a return of an order not stored
+	// yet.
+	returnRetryDelay = 30 * time.Second
+	// returnMaxDeliver bounds the redeliveries of such events, about half
+	// an hour with returnRetryDelay.
+	returnMaxDeliver = 60
+)
+
+// NewReturnConsumer consumes the return events. Events are applied in the
+// order of the return's statuses: an event arriving early is redelivered
+// later, and one the return is already past is acknowledged and skipped.
+func NewReturnConsumer(ctx context.Context, db *db.CachedClient, natsUrl string) (*consumer, error) {
+	cs, err := newStreamConsumer(ctx, natsUrl, ReturnsStream, "RETURNS_CONS", jetstream.ConsumerConfig{
+		MaxDeliver: returnMaxDeliver,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	service := returns.NewService(db)
+	c := &consumer{
+		consumer: cs,
+		db:       db,
+		health:   db,
+	}
+	c.process = func(ctx context.Context, job job) {
+		c.processReturn(ctx, service, job)
+	}
+	return c, nil
+}
+
+func (c *consumer) processReturn(ctx context.Context, service *returns.Service, job job) {
+	msg := job.Msg
+	status := strings.TrimPrefix(msg.Subject(), ReturnsStream+".")
+	var event models.ReturnEvent
+	if err := json.Unmarshal(msg.Data(), &event); err != nil {
+		slog.Error("Error parsing return event", "error", err, "subject", msg.Subject())
+		ack(msg)
+		return
+	}
+	if event.Status == "" {
+		event.Status = status
+	}
+	if event.Status != status || event.ReturnID == "" {
+		slog.Error("Invalid return event", "subject", msg.Subject(), "status", event.Status, "returnID", event.ReturnID)
+		ack(msg)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(db.WithSource(ctx, "nats:"+msg.Subject()), time.Second*15)
+	defer cancel()
+
+	var err error
+	if event.Status == models.ReturnRequested {
+		_, err = service.Request(ctx, models.Return{
+			ReturnID: event.ReturnID,
+			OrderUID: event.OrderUID,
+			Items:    event.Items,
+		})
+	} else {
+		_, err = service.Update(ctx, event.ReturnID, returns.Update{
+			Status:            event.Status,
+			Refund:            event.Refund,
+			RefundTransaction: event.RefundTransaction,
+		})
+	}
+
+	switch {
+	case err == nil:
+		ack(msg)
+		slog.Info("Return event applied", "returnID", event.ReturnID, "status", event.Status)
+	case errors.Is(err, db.ErrReturnExists), errors.Is(err, returns.ErrOutdated):
+		ack(msg)
+		slog.Info("Return event already applied", "returnID", event.ReturnID, "status", event.Status)
+	case errors.Is(err, returns.ErrOutOfOrder), errors.Is(err, db.ErrReturnChanged), errors.Is(err, sql.ErrNoRows):
+		slog.Warn("Return event not applicable yet, retrying later", "error", err, "returnID", event.ReturnID, "status", event.Status)
+		if err := msg.NakWithDelay(returnRetryDelay); err != nil {
+			slog.Error("Error rejecting a message", "error", err)
+		}
+	case errors.Is(err, returns.ErrInvalid):
+		slog.Error("Invalid return event", "error", err, "returnID", event.ReturnID, "status", event.Status)
+		ack(msg)
+	default:
+		// redelivered once the ack wait expires
+		slog.Error("Error applying return event", "error", err, "returnID", event.ReturnID)
+	}
+}
+
+func ack(msg jetstream.Msg) {
+	if err := msg.Ack(); err != nil {
+		slog.Error("Error acknowledges a message", "error", err)
+	}
+}
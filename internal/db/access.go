@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Access is the accumulated reads of one order since the last flush.
+type Access struct {
+	Hits       int64
+	AccessedAt time.Time
+}
+
+// AccessStore persists accumulated order accesses.
+type AccessStore interface {
+	RecordAccesses(ctx context.Context, accesses map[string]Access) error
+}
+
+// AccessTracker counts order reads in memory and writes them to the store in
+// batches, so reads never turn into row updates on the request path.
+type AccessTracker struct {
+	store    AccessStore
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]Access
+}
+
+func NewAccessTracker(store AccessStore, interval time.Duration) *AccessTracker {
+	return &AccessTracker{
+		store:    store,
+		interval: interval,
+		pending:  make(map[string]Access),
+	}
+}
+
+// Record notes one read of orderUID.
+func (t *AccessTracker) Record(orderUID string) {
+	t.mu.Lock()
+	a := t.pending[orderUID]
+	a.Hits++
+	a.AccessedAt = time.Now()
+	t.pending[orderUID] = a
+	t.mu.Unlock()
+}
+
+// Run flushes on every interval until ctx is done, then flushes once more.
+func (t *AccessTracker) Run(ctx context.Context) error {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+			t.Flush(flushCtx)
+			return nil
+		case <-ticker.C:
+			t.Flush(ctx)
+		}
+	}
+}
+
+// Flush writes the pending accesses. On failure they are kept and merged with
+// accesses recorded in the meantime, so the next flush retries them.
+func (t *AccessTracker) Flush(ctx context.Context) {
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = make(map[string]Access)
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := t.store.RecordAccesses(ctx, batch); err != nil {
+		slog.Error("Failed to flush order accesses", "error", err, "orders", len(batch))
+		t.mu.Lock()
+		for uid, a := range batch {
+			cur := t.pending[uid]
+			cur.Hits += a.Hits
+			if a.AccessedAt.After(cur.AccessedAt) {
+				cur.AccessedAt = a.AccessedAt
+			}
+			t.pending[uid] = cur
+		}
+		t.mu.Unlock()
+		return
+	}
+	slog.Debug("Order accesses flushed", "orders", len(batch))
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// recordingStore fails the next flush while fail is set and keeps the
+// batches it accepted.
+type recordingStore struct {
+	fail    bool
+	batches []map[string]Access
+}
+
+func (s *recordingStore) RecordAccesses(ctx context.Context, accesses map[string]Access) error {
+	if s.fail {
+		s.fail = false
+		return errUnavailable
+	}
+	s.batches = append(s.batches, accesses)
+	return nil
+}
+
+func TestAccessTrackerMergesFailedFlush(t *testing.T) {
+	ctx := context.Background()
+	store := &recordingStore{fail: true}
+	tracker := NewAccessTracker(store, time.Hour)
+
+	tracker.Record("a")
+	tracker.Record("a")
+	tracker.Record("b")
+	tracker.Flush(ctx)
+	if len(store.batches) != 0 {
+		t.Fatalf("a failed flush was recorded: %v", store.batches)
+	}
+	before := time.Now()
+	tracker.Record("a")
+	tracker.Record("c")
+
+	tracker.Flush(ctx)
+	if len(store.batches) != 1 {
+		t.Fatalf("%d batches flushed, want 1", len(store.batches))
+	}
+	batch := store.batches[0]
+	want := map[string]int64{"a": 3, "b": 1, "c": 1}
+	if len(batch) != len(want) {
+		t.Fatalf("flushed %v, want hits %v", batch, want)
+	}
+	for uid, hits := range want {
+		if batch[uid].Hits != hits {
+			t.Errorf("hits of %s = %d, want %d", uid, batch[uid].Hits, hits)
+		}
+	}
+	if batch["a"].AccessedAt.Before(before) {
+		t.Errorf("accessed_at of a is %s, not the latest read", batch["a"].AccessedAt)
+	}
+
+	// nothing is flushed twice
+	tracker.Flush(ctx)
+	if len(store.batches) != 1 {
+		t.Fatalf("%d batches flushed, want 1", len(store.batches))
+	}
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"wbstorage/internal/models"
+	"wbstorage/internal/pii"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var ErrCircuitOpen = errors.New("database circuit breaker is open")
+
+// HealthChecker is implemented by databases that track backend availability.
+type HealthChecker interface {
+	Healthy() bool
+}
+
+type BreakerConfig struct {
+	// Threshold is the number of consecutive failures that opens the breaker.
+	Threshold int
+	// Cooldown is how long the breaker stays open before letting a probe through.
+	Cooldown time.Duration
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerClient wraps a Database with a circuit breaker. After Threshold
+// consecutive backend failures every call fails fast with ErrCircuitOpen
+// until Cooldown passes; then a single probe decides whether to close again.
+type BreakerClient struct {
+	db  Database
+	cfg BreakerConfig
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	onRecover func()
+}
+
+func NewBreakerClient(db Database, cfg BreakerConfig) *BreakerClient {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 5
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 10 * time.Second
+	}
+	return &BreakerClient{db: db, cfg: cfg}
+}
+
+// SetOnRecover registers fn to be called, in its own goroutine, whenever the
+// breaker closes after having been open.
+func (b *BreakerClient) SetOnRecover(fn func()) {
+	b.mu.Lock()
+	b.onRecover = fn
+	b.mu.Unlock()
+}
+
+// Healthy reports whether calls are currently let through to the database.
+func (b *BreakerClient) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerOpen || time.Since(b.openedAt) >= b.cfg.Cooldown
+}
+
+func (b *BreakerClient) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cfg.Cooldown {
+			return ErrCircuitOpen
+		}
+		b.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// a probe is already in flight
+		return ErrCircuitOpen
+	default:
+		return nil
+	}
+}
+
+func (b *BreakerClient) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isBackendFailure(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+			if b.onRecover != nil {
+				go b.onRecover()
+			}
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.cfg.Threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *BreakerClient) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	slog.Warn("Database circuit breaker state changed", "from", b.state, "to", state, "failures", b.failures)
+	b.state = state
+}
+
+// isBackendFailure tells database outages apart from errors that say nothing
+// about the database health, such as a missing or duplicate order, a bad
+// patch, data the database rejected, a value that can't be decrypted or a
+// cancelled request.
+func isBackendFailure(err error) bool {
+	return err != nil &&
+		!errors.Is(err, sql.ErrNoRows) &&
+		!errors.Is(err, ErrOrderExists) &&
+		!errors.Is(err, ErrInvalidPatch) &&
+		!errors.Is(err, models.ErrInvalidOrder) &&
+		!errors.Is(err, ErrReturnExists) &&
+		!errors.Is(err, ErrItemReturned) &&
+		!errors.Is(err, ErrReturnChanged) &&
+		!errors.Is(err, pii.ErrUnknownKey) &&
+		!errors.Is(err, pii.ErrDecrypt) &&
+		!errors.Is(err, context.Canceled) &&
+		!isDataError(err)
+}
+
+// isDataError reports whether the database rejected the data of a statement:
+// Postgres data exceptions (class 22) and integrity constraint violations
+// (class 23), or SQLite constraint failures.
+func isDataError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		class := pqErr.Code.Class()
+		return class == "22" || class == "23"
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code()&0xff == sqlite3.SQLITE_CONSTRAINT
+	}
+	return false
+}
+
+func (b *BreakerClient) InsertOrder(ctx context.Context, order models.Order) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.db.InsertOrder(ctx, order)
+	b.record(err)
+	return err
+}
+
+func (b *BreakerClient) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	order, err := b.db.SelectOrder(ctx, orderUID)
+	b.record(err)
+	return order, err
+}
+
+func (b *BreakerClient) GetRecentOrders(ctx context.Context, n int) ([]string, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	orderUIDs, err := b.db.GetRecentOrders(ctx, n)
+	b.record(err)
+	return orderUIDs, err
+}
+
+func (b *BreakerClient) GetOrdersCreatedSince(ctx context.Context, since time.Time, n int) ([]string, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	orderUIDs, err := b.db.GetOrdersCreatedSince(ctx, since, n)
+	b.record(err)
+	return orderUIDs, err
+}
+
+func (b *BreakerClient) UpsertOrder(ctx context.Context, order models.Order) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.db.UpsertOrder(ctx, order)
+	b.record(err)
+	return err
+}
+
+func (b *BreakerClient) PatchOrder(ctx context.Context, orderUID string, patch []byte) (*models.Order, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	order, err := b.db.PatchOrder(ctx, orderUID, patch)
+	b.record(err)
+	return order, err
+}
+
+func (b *BreakerClient) AddPayment(ctx context.Context, orderUID string, p models.Payment) (*models.Order, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	order, err := b.db.AddPayment(ctx, orderUID, p)
+	b.record(err)
+	return order, err
+}
+
+func (b *BreakerClient) MergeOrder(ctx context.Context, order models.Order) (*models.Order, bool, error) {
+	if err := b.allow(); err != nil {
+		return nil, false, err
+	}
+	merged, changed, err := b.db.MergeOrder(ctx, order)
+	b.record(err)
+	return merged, changed, err
+}
+
+func (b *BreakerClient) DeleteOrder(ctx context.Context, orderUID string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.db.DeleteOrder(ctx, orderUID)
+	b.record(err)
+	return err
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wbstorage/internal/models"
+)
+
+var errUnavailable = errors.New("connection refused")
+
+// flakyDB fails every read with errUnavailable while down is set.
+type flakyDB struct {
+	*MemoryDB
+	down atomic.Bool
+}
+
+func (f *flakyDB) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
+	if f.down.Load() {
+		return nil, errUnavailable
+	}
+	return f.MemoryDB.SelectOrder(ctx, orderUID)
+}
+
+func TestBreakerStateTransitions(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyDB{MemoryDB: NewMemoryDB()}
+	order := testOrder("breaker")
+	if err := flaky.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	const cooldown = 20 * time.Millisecond
+	breaker := NewBreakerClient(flaky, BreakerConfig{Threshold: 2, Cooldown: cooldown})
+	recovered := make(chan struct{}, 1)
+	breaker.SetOnRecover(func() { recovered <- struct{}{} })
+
+	// errors about the data don't count as failures
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.SelectOrder(ctx, "missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("SelectOrder of a missing order: %v", err)
+		}
+	}
+	if breaker.state != breakerClosed {
+		t.Fatalf("state after missing orders = %s, want closed", breaker.state)
+	}
+
+	flaky.down.Store(true)
+	for i := 0; i < 2; i++ {
+		if _, err := breaker.SelectOrder(ctx, order.OrderUID); !errors.Is(err, errUnavailable) {
+			t.Fatalf("SelectOrder #%d: got %v, want the backend error", i+1, err)
+		}
+	}
+	if _, err := breaker.SelectOrder(ctx, order.OrderUID); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("SelectOrder past the threshold: got %v, want ErrCircuitOpen", err)
+	}
+	if breaker.Healthy() {
+		t.Fatal("open breaker reports healthy")
+	}
+
+	// after the cooldown a single probe goes through; its failure reopens
+	time.Sleep(cooldown)
+	if !breaker.Healthy() {
+		t.Fatal("breaker is not healthy after the cooldown")
+	}
+	if _, err := breaker.SelectOrder(ctx, order.OrderUID); !errors.Is(err, errUnavailable) {
+		t.Fatalf("probe: got %v, want the backend error", err)
+	}
+	if _, err := breaker.SelectOrder(ctx, order.OrderUID); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("SelectOrder after a failed probe: got %v, want ErrCircuitOpen", err)
+	}
+
+	flaky.down.Store(false)
+	time.Sleep(cooldown)
+	if _, err := breaker.SelectOrder(ctx, order.OrderUID); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if breaker.state != breakerClosed {
+		t.Fatalf("state after a successful probe = %s, want closed", breaker.state)
+	}
+	select {
+	case <-recovered:
+	case <-time.After(time.Second):
+		t.Fatal("onRecover was not called")
+	}
+}
+
+func TestCachedClientServesStaleDuringOutage(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyDB{MemoryDB: NewMemoryDB()}
+	order := testOrder("stale")
+	if err := flaky.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	cache, err := NewCachedClient(ctx, flaky, CacheConfig{TTL: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewCachedClient: %v", err)
+	}
+	if _, err := cache.SelectOrder(ctx, order.OrderUID); err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	flaky.down.Store(true)
+	got, stale, err := cache.SelectOrderStale(ctx, order.OrderUID)
+	if err != nil || !stale || got.OrderUID != order.OrderUID {
+		t.Fatalf("SelectOrderStale during an outage = %v, stale %v, %v", got, stale, err)
+	}
+	if _, err := cache.SelectOrder(ctx, "uncached"); !errors.Is(err, errUnavailable) {
+		t.Fatalf("SelectOrder of an uncached order: got %v, want the backend error", err)
+	}
+
+	// the order changed while the database was unreachable
+	flaky.down.Store(false)
+	updated := order
+	updated.TrackNumber = "UPDATED"
+	if err := flaky.UpsertOrder(ctx, updated); err != nil {
+		t.Fatalf("UpsertOrder: %v", err)
+	}
+	cache.RefreshStale(ctx)
+	cache.mu.Lock()
+	entry, marked := cache.cache[order.OrderUID], len(cache.stale)
+	cache.mu.Unlock()
+	if entry == nil || entry.order.TrackNumber != "UPDATED" || marked != 0 {
+		t.Fatalf("after RefreshStale: entry %v, %d orders marked stale", entry, marked)
+	}
+}
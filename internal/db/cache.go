@@ -2,25 +2,93 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog" // Ensure you import the slog package
 	"sync"
+	"sync/atomic"
+	"time"
 	"wbstorage/internal/models"
 )
 
+// Invalidator notifies other instances that an order has changed.
+type Invalidator interface {
+	Publish(ctx context.Context, orderUID string) error
+}
+
+type CacheConfig struct {
+	// TTL is how long an entry is served before it is re-read from the
+	// database; zero keeps entries forever.
+	TTL    time.Duration
+	Warmup WarmupConfig
+	// Tracker, if set, records every read served by the cache or the database.
+	Tracker *AccessTracker
+	// PrimaryWindow is how long after an eviction or ExpireAll the orders
+	// are re-read from the primary, so that a lagging replica can't put the
+	// version that was invalidated back in the cache. Set it to the
+	// replicas' sticky window, see Client.StickyWindow.
+	PrimaryWindow time.Duration
+}
+
+type cacheEntry struct {
+	order    *models.Order
+	cachedAt time.Time
+}
+
+// CachedClient keeps private copies of orders: every order stored in or
+// returned from the cache is cloned, so callers may modify what they get.
+//
+// Entries older than the TTL are re-read from the database. If that fails
+// because the database is unavailable the expired entry is served as stale
+// and refreshed by RefreshStale once the database recovers.
 type CachedClient struct {
-	mu    sync.Mutex
-	cache map[string]*models.Order
-	db    Database
+	mu          sync.Mutex
+	cache       map[string]*cacheEntry
+	stale       map[string]struct{}
+	db          Database
+	ttl         time.Duration
+	tracker     *AccessTracker
+	invalidator Invalidator
+	warmupCfg   WarmupConfig
+	warmup      warmupState
+	// warming is set while a warm-up runs, see beginWarmup.
+	warming bool
+	// expiredAt makes every entry cached before it count as expired.
+	expiredAt time.Time
+
+	primaryWindow time.Duration
+	// evicted holds when orders were evicted, for evictedRetention or the
+	// primary window, whichever is longer.
+	evicted  map[string]time.Time
+	prunedAt time.Time
+
+	hits      atomic.Uint64
+	staleHits atomic.Uint64
+	misses    atomic.Uint64
 }
 
-func NewCachedClient(ctx context.Context, db Database, n int) (*CachedClient, error) {
+// NewCachedClient creates the cache and runs the configured warm-up. In
+// background mode the warm-up continues after NewCachedClient returns and
+// its progress is available through WarmupProgress.
+func NewCachedClient(ctx context.Context, db Database, cfg CacheConfig) (*CachedClient, error) {
 	client := &CachedClient{
-		db:    db,
-		cache: make(map[string]*models.Order),
+		db:            db,
+		cache:         make(map[string]*cacheEntry),
+		stale:         make(map[string]struct{}),
+		ttl:           cfg.TTL,
+		tracker:       cfg.Tracker,
+		warmupCfg:     cfg.Warmup,
+		primaryWindow: cfg.PrimaryWindow,
+		evicted:       make(map[string]time.Time),
 	}
 
-	if err := client.cacheWarming(ctx, n); err != nil {
+	if cfg.Warmup.Background {
+		client.StartWarmup(ctx)
+		return client, nil
+	}
+
+	if err := client.Warmup(ctx); err != nil {
 		slog.Error("Failed to warm up cache", "error", err)
 		return client, fmt.Errorf("failed to warmup cache: %w", err)
 	}
@@ -35,52 +103,268 @@ func (c *CachedClient) InsertOrder(ctx context.Context, order models.Order) erro
 		return err
 	}
 
-	c.mu.Lock()
-	c.cache[order.OrderUID] = &order
-	c.mu.Unlock()
+	c.store(order.Clone())
 	slog.Info("Order cached successfully", "orderUID", order.OrderUID)
 
+	c.invalidate(ctx, order.OrderUID)
+	return nil
+}
+
+func (c *CachedClient) UpsertOrder(ctx context.Context, order models.Order) error {
+	if err := c.db.UpsertOrder(ctx, order); err != nil {
+		slog.Error("Failed to upsert order", "error", err)
+		return err
+	}
+
+	c.store(order.Clone())
+	slog.Info("Order updated in cache", "orderUID", order.OrderUID)
+
+	c.invalidate(ctx, order.OrderUID)
+	return nil
+}
+
+func (c *CachedClient) PatchOrder(ctx context.Context, orderUID string, patch []byte) (*models.Order, error) {
+	order, err := c.db.PatchOrder(ctx, orderUID, patch)
+	if err != nil {
+		slog.Error("Failed to patch order", "error", err)
+		return nil, err
+	}
+
+	c.store(order.Clone())
+	slog.Info("Order updated in cache", "orderUID", orderUID)
+
+	c.invalidate(ctx, orderUID)
+	return order, nil
+}
+
+func (c *CachedClient) AddPayment(ctx context.Context, orderUID string, p models.Payment) (*models.Order, error) {
+	order, err := c.db.AddPayment(ctx, orderUID, p)
+	if err != nil {
+		slog.Error("Failed to add payment", "error", err)
+		return nil, err
+	}
+
+	c.store(order.Clone())
+	slog.Info("Order updated in cache", "orderUID", orderUID)
+
+	c.invalidate(ctx, orderUID)
+	return order, nil
+}
+
+func (c *CachedClient) MergeOrder(ctx context.Context, order models.Order) (*models.Order, bool, error) {
+	merged, changed, err := c.db.MergeOrder(ctx, order)
+	if err != nil {
+		slog.Error("Failed to merge order", "error", err)
+		return nil, false, err
+	}
+	if !changed {
+		return merged, false, nil
+	}
+
+	c.store(merged.Clone())
+	slog.Info("Order updated in cache", "orderUID", order.OrderUID)
+
+	c.invalidate(ctx, order.OrderUID)
+	return merged, true, nil
+}
+
+func (c *CachedClient) DeleteOrder(ctx context.Context, orderUID string) error {
+	if err := c.db.DeleteOrder(ctx, orderUID); err != nil {
+		slog.Error("Failed to delete order", "error", err)
+		return err
+	}
+
+	c.Evict(orderUID)
+	slog.Info("Order removed from cache", "orderUID", orderUID)
+
+	c.invalidate(ctx, orderUID)
 	return nil
 }
 
 func (c *CachedClient) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
+	order, _, err := c.SelectOrderStale(ctx, orderUID)
+	return order, err
+}
+
+// SelectOrderStale works like SelectOrder and also reports whether the order
+// was served from an expired entry because the database is unavailable.
+func (c *CachedClient) SelectOrderStale(ctx context.Context, orderUID string) (*models.Order, bool, error) {
+	order, stale, err := c.selectOrder(ctx, orderUID)
+	if err == nil && c.tracker != nil {
+		c.tracker.Record(orderUID)
+	}
+	return order, stale, err
+}
+
+func (c *CachedClient) selectOrder(ctx context.Context, orderUID string) (*models.Order, bool, error) {
 	c.mu.Lock()
-	if order, found := c.cache[orderUID]; found {
+	entry, found := c.cache[orderUID]
+	if found && !c.expired(entry) {
+		order := entry.order.Clone()
 		c.mu.Unlock()
+		c.hits.Add(1)
 		slog.Info("Order retrieved from cache", "orderUID", orderUID)
-		return order, nil
+		return order, false, nil
 	}
 	c.mu.Unlock()
+	c.misses.Add(1)
 
-	order, err := c.db.SelectOrder(ctx, orderUID)
+	order, readAt, err := c.load(ctx, orderUID)
 	if err != nil {
+		if found && isBackendFailure(err) {
+			c.mu.Lock()
+			c.stale[orderUID] = struct{}{}
+			order := entry.order.Clone()
+			c.mu.Unlock()
+			c.staleHits.Add(1)
+			slog.Warn("Serving stale order, database unavailable", "orderUID", orderUID, "error", err)
+			return order, true, nil
+		}
+		if found && errors.Is(err, sql.ErrNoRows) {
+			c.Evict(orderUID)
+		}
 		slog.Error("Failed to select order from database", "error", err)
-		return nil, err
+		return nil, false, err
 	}
 
-	c.mu.Lock()
-	c.cache[orderUID] = order
-	c.mu.Unlock()
+	c.storeLoaded(order.Clone(), readAt)
 	slog.Info("Order cached after database retrieval", "orderUID", orderUID)
 
-	return order, nil
+	return order, false, nil
 }
 
-func (c *CachedClient) GetRecentOrders(ctx context.Context, n int) ([]string, error) {
-	return c.db.GetRecentOrders(ctx, n)
+// RefreshStale re-reads every order that was served stale. Orders that still
+// fail to load stay marked as stale.
+func (c *CachedClient) RefreshStale(ctx context.Context) {
+	c.mu.Lock()
+	uids := make([]string, 0, len(c.stale))
+	for uid := range c.stale {
+		uids = append(uids, uid)
+	}
+	c.mu.Unlock()
+
+	refreshed := 0
+	for _, orderUID := range uids {
+		order, readAt, err := c.load(ctx, orderUID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.Evict(orderUID)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to refresh stale order", "error", err, "orderUID", orderUID)
+			continue
+		}
+		c.storeLoaded(order, readAt)
+		refreshed++
+	}
+	slog.Info("Stale cache entries refreshed", "refreshed", refreshed, "total", len(uids))
 }
 
-func (c *CachedClient) cacheWarming(ctx context.Context, n int) error {
-	UIDsList, err := c.GetRecentOrders(ctx, n)
-	if err != nil {
-		slog.Error("Failed to retrieve recent orders for cache warming", "error", err)
-		return err
+// Healthy reports whether the underlying database is available.
+func (c *CachedClient) Healthy() bool {
+	if hc, ok := c.db.(HealthChecker); ok {
+		return hc.Healthy()
 	}
-	for _, orderUID := range UIDsList {
-		if _, err := c.SelectOrder(ctx, orderUID); err != nil {
-			slog.Error("Failed to select order during cache warming", "error", err)
-			return err
+	return true
+}
+
+// SetInvalidator makes the client broadcast every write through inv.
+func (c *CachedClient) SetInvalidator(inv Invalidator) {
+	c.mu.Lock()
+	c.invalidator = inv
+	c.mu.Unlock()
+}
+
+// evictedRetention is how long an eviction is remembered at least, longer
+// than a read of the order takes.
+const evictedRetention = time.Minute
+
+// Evict drops orderUID from the cache so the next read goes to the database.
+func (c *CachedClient) Evict(orderUID string) {
+	c.mu.Lock()
+	delete(c.cache, orderUID)
+	delete(c.stale, orderUID)
+	// recorded regardless of the primary window: storeLoaded needs it to
+	// drop reads that were in flight during the eviction
+	now := time.Now()
+	c.evicted[orderUID] = now
+	keep := max(c.primaryWindow, evictedRetention)
+	if now.Sub(c.prunedAt) >= keep {
+		for uid, at := range c.evicted {
+			if now.Sub(at) >= keep {
+				delete(c.evicted, uid)
+			}
 		}
+		c.prunedAt = now
 	}
-	return nil
+	c.mu.Unlock()
+}
+
+// load reads orderUID from the database, from the primary within the
+// primary window of its eviction or of ExpireAll, and returns when the read
+// started.
+func (c *CachedClient) load(ctx context.Context, orderUID string) (*models.Order, time.Time, error) {
+	c.mu.Lock()
+	readAt := time.Now()
+	if c.primaryWindow > 0 &&
+		(readAt.Sub(c.evicted[orderUID]) < c.primaryWindow || readAt.Sub(c.expiredAt) < c.primaryWindow) {
+		ctx = WithPrimary(ctx)
+	}
+	c.mu.Unlock()
+	order, err := c.db.SelectOrder(ctx, orderUID)
+	return order, readAt, err
+}
+
+// storeLoaded caches an order read at readAt, unless it was evicted since:
+// the read may have missed the change the eviction was for. Dating the entry
+// by the read makes an ExpireAll during the read expire it as well.
+func (c *CachedClient) storeLoaded(order *models.Order, readAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.evicted[order.OrderUID].After(readAt) {
+		return
+	}
+	c.cache[order.OrderUID] = &cacheEntry{order: order, cachedAt: readAt}
+	delete(c.stale, order.OrderUID)
+}
+
+// store caches order, which must not be referenced by anyone else.
+func (c *CachedClient) store(order *models.Order) {
+	c.mu.Lock()
+	c.cache[order.OrderUID] = &cacheEntry{order: order, cachedAt: time.Now()}
+	delete(c.stale, order.OrderUID)
+	c.mu.Unlock()
+}
+
+func (c *CachedClient) expired(entry *cacheEntry) bool {
+	return (c.ttl > 0 && time.Since(entry.cachedAt) > c.ttl) || !entry.cachedAt.After(c.expiredAt)
+}
+
+// ExpireAll makes every cached order be re-read on its next access. Unlike
+// evicting, it keeps the entries to be served stale if the database is down.
+func (c *CachedClient) ExpireAll() {
+	c.mu.Lock()
+	c.expiredAt = time.Now()
+	c.mu.Unlock()
+	slog.Info("All cached orders expired")
+}
+
+func (c *CachedClient) invalidate(ctx context.Context, orderUID string) {
+	c.mu.Lock()
+	inv := c.invalidator
+	c.mu.Unlock()
+	if inv == nil {
+		return
+	}
+	if err := inv.Publish(ctx, orderUID); err != nil {
+		slog.Error("Failed to publish cache invalidation", "error", err, "orderUID", orderUID)
+	}
+}
+
+func (c *CachedClient) GetRecentOrders(ctx context.Context, n int) ([]string, error) {
+	return c.db.GetRecentOrders(ctx, n)
+}
+
+func (c *CachedClient) GetOrdersCreatedSince(ctx context.Context, since time.Time, n int) ([]string, error) {
+	return c.db.GetOrdersCreatedSince(ctx, since, n)
 }
@@ -0,0 +1,383 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"wbstorage/internal/models"
+)
+
+func TestMain(m *testing.M) {
+	// the cache logs every read
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testOrder returns a valid order with two payment records, a shipment and
+// two items.
+func testOrder(orderUID string) models.Order {
+	return models.Order{
+		OrderUID:    orderUID,
+		TrackNumber: "WBILTRACK",
+		Entry:       "WBIL",
+		Delivery: models.Delivery{
+			Name:    "Test Testov",
+			Phone:   "+9720000000",
+			Zip:     "2639809",
+			City:    "Kiryat Mozkin",
+			Address: "Ploshad Mira 15",
+			Region:  "Kraiot",
+			Email:   "test@gmail.com",
+		},
+		Payment: models.Payment{
+			Kind:         models.PaymentCharge,
+			Transaction:  orderUID,
+			Currency:     "USD",
+			Provider:     "wbpay",
+			Amount:       1817,
+			PaymentDt:    1637907727,
+			Bank:         "alpha",
+			DeliveryCost: 1500,
+			GoodsTotal:   317,
+		},
+		Payments: []models.Payment{{
+			Kind:        models.PaymentRefund,
+			Transaction: orderUID + "-refund",
+			Currency:    "USD",
+			Provider:    "wbpay",
+			Amount:      100,
+			PaymentDt:   1637907800,
+		}},
+		Shipments: []models.Shipment{{TrackNumber: "WBILTRACK", DeliveryService: "meest", Status: "shipped"}},
+		Items: []models.Item{
+			{ChrtID: 9934930, TrackNumber: "WBILTRACK", Price: 453, RID: orderUID + "-1", Name: "Mascaras",
+				Sale: 30, Size: "0", TotalPrice: 317, NmID: 2389212, Brand: "Vivienne Sabo", Status: 202},
+			{ChrtID: 9934931, TrackNumber: "WBILTRACK", Price: 100, RID: orderUID + "-2", Name: "Lipstick",
+				Sale: 0, Size: "0", TotalPrice: 100, NmID: 2389213, Brand: "Vivienne Sabo", Status: 202},
+		},
+		Locale:          "en",
+		CustomerID:      "test",
+		DeliveryService: "meest",
+		ShardKey:        "9",
+		SmID:            99,
+		DateCreated:     time.Date(2021, 11, 26, 6, 22, 19, 0, time.UTC),
+		OofShard:        "1",
+	}
+}
+
+// mutate changes every part of order that a shared copy would expose.
+func mutate(order *models.Order, i int) {
+	order.TrackNumber = fmt.Sprint("changed-", i)
+	order.Delivery.Name = "changed"
+	order.Payment.Amount = i
+	for j := range order.Payments {
+		order.Payments[j].Amount = i
+	}
+	for j := range order.Shipments {
+		order.Shipments[j].Status = "changed"
+	}
+	for j := range order.Items {
+		order.Items[j].Name = "changed"
+		order.Items[j].Price = i
+	}
+	order.Items = append(order.Items, models.Item{Name: "appended"})
+}
+
+func newTestCache(t *testing.T) *CachedClient {
+	t.Helper()
+	cache, err := NewCachedClient(context.Background(), NewMemoryDB(), CacheConfig{})
+	if err != nil {
+		t.Fatalf("NewCachedClient: %v", err)
+	}
+	return cache
+}
+
+func assertUnchanged(t *testing.T, cache *CachedClient, want models.Order) {
+	t.Helper()
+	got, err := cache.SelectOrder(context.Background(), want.OrderUID)
+	if err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	changes, err := models.DiffOrders(&want, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) > 0 {
+		t.Fatalf("cached order changed: %+v", changes)
+	}
+}
+
+// TestCachedClientReturnsCopies mutates the orders returned by the cache
+// while other readers run; run with -race.
+func TestCachedClientReturnsCopies(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestCache(t)
+	order := testOrder("returned")
+	if err := cache.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				got, err := cache.SelectOrder(ctx, order.OrderUID)
+				if err != nil {
+					t.Errorf("SelectOrder: %v", err)
+					return
+				}
+				if i%2 == 0 {
+					mutate(got, j)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assertUnchanged(t, cache, order)
+}
+
+// TestCachedClientStoresCopies mutates orders after handing them to the
+// cache, through the slices they share with the caller, while readers run.
+func TestCachedClientStoresCopies(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestCache(t)
+
+	inserted := testOrder("inserted")
+	upserted := testOrder("upserted")
+	if err := cache.InsertOrder(ctx, inserted); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	if err := cache.UpsertOrder(ctx, upserted); err != nil {
+		t.Fatalf("UpsertOrder: %v", err)
+	}
+	want := map[string]models.Order{
+		inserted.OrderUID: testOrder(inserted.OrderUID),
+		upserted.OrderUID: testOrder(upserted.OrderUID),
+	}
+
+	var wg sync.WaitGroup
+	for _, order := range []*models.Order{&inserted, &upserted} {
+		wg.Add(1)
+		go func(order *models.Order) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				mutate(order, j)
+			}
+		}(order)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				for uid := range want {
+					if _, err := cache.SelectOrder(ctx, uid); err != nil {
+						t.Errorf("SelectOrder: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, order := range want {
+		assertUnchanged(t, cache, order)
+	}
+}
+
+// TestCachedClientConcurrentWrites runs writers, readers and evictions of
+// the same order together; the cache must end up holding one of the
+// written versions.
+func TestCachedClientConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestCache(t)
+	order := testOrder("written")
+	if err := cache.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				version := testOrder(order.OrderUID)
+				version.TrackNumber = fmt.Sprint("writer-", i)
+				if err := cache.UpsertOrder(ctx, version); err != nil {
+					t.Errorf("UpsertOrder: %v", err)
+					return
+				}
+				// the stored copy must not follow the caller's changes
+				mutate(&version, j)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				got, err := cache.SelectOrder(ctx, order.OrderUID)
+				if err != nil {
+					t.Errorf("SelectOrder: %v", err)
+					return
+				}
+				mutate(got, j)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.Evict(order.OrderUID)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := cache.SelectOrder(ctx, order.OrderUID)
+	if err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	want := testOrder(order.OrderUID)
+	want.TrackNumber = got.TrackNumber
+	assertUnchanged(t, cache, want)
+}
+
+// primaryRecorder records whether each read was sent to the primary and runs
+// during, if set, in the middle of it.
+type primaryRecorder struct {
+	*MemoryDB
+	primary []bool
+	during  func()
+}
+
+func (r *primaryRecorder) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
+	r.primary = append(r.primary, ctx.Value(primaryKey{}) != nil)
+	if r.during != nil {
+		r.during()
+	}
+	return r.MemoryDB.SelectOrder(ctx, orderUID)
+}
+
+func TestCachedClientRefillsFromPrimaryAfterEviction(t *testing.T) {
+	ctx := context.Background()
+	recorder := &primaryRecorder{MemoryDB: NewMemoryDB()}
+	cache, err := NewCachedClient(ctx, recorder, CacheConfig{PrimaryWindow: time.Hour})
+	if err != nil {
+		t.Fatalf("NewCachedClient: %v", err)
+	}
+	order := testOrder("invalidated")
+	if err := recorder.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+
+	// a read that misses an eviction must not be cached
+	recorder.during = func() { cache.Evict(order.OrderUID) }
+	if _, err := cache.SelectOrder(ctx, order.OrderUID); err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	recorder.during = nil
+	for i := 0; i < 2; i++ {
+		if _, err := cache.SelectOrder(ctx, order.OrderUID); err != nil {
+			t.Fatalf("SelectOrder: %v", err)
+		}
+	}
+	want := []bool{false, true}
+	if len(recorder.primary) != len(want) || recorder.primary[0] != want[0] || recorder.primary[1] != want[1] {
+		t.Fatalf("reads went to the primary: %v, want %v", recorder.primary, want)
+	}
+
+	recorder.primary = nil
+	cache.ExpireAll()
+	if _, err := cache.SelectOrder(ctx, order.OrderUID); err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	if len(recorder.primary) != 1 || !recorder.primary[0] {
+		t.Fatalf("the read after ExpireAll went to the primary: %v, want [true]", recorder.primary)
+	}
+}
+
+func TestCachedClientDropsReadsRacingEviction(t *testing.T) {
+	ctx := context.Background()
+	recorder := &primaryRecorder{MemoryDB: NewMemoryDB()}
+	cache, err := NewCachedClient(ctx, recorder, CacheConfig{})
+	if err != nil {
+		t.Fatalf("NewCachedClient: %v", err)
+	}
+	order := testOrder("evicted-during-read")
+	if err := recorder.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+
+	// without a primary window the read is still not cached
+	recorder.during = func() { cache.Evict(order.OrderUID) }
+	if _, err := cache.SelectOrder(ctx, order.OrderUID); err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	recorder.during = nil
+	for i := 0; i < 2; i++ {
+		if _, err := cache.SelectOrder(ctx, order.OrderUID); err != nil {
+			t.Fatalf("SelectOrder: %v", err)
+		}
+	}
+	if len(recorder.primary) != 2 {
+		t.Fatalf("%d database reads, want 2: the read during the eviction was cached", len(recorder.primary))
+	}
+}
+
+// blockingLister, once listing is set, signals it when warm-up candidates
+// are listed and blocks until release is closed.
+type blockingLister struct {
+	*MemoryDB
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingLister) GetOrdersCreatedSince(ctx context.Context, since time.Time, n int) ([]string, error) {
+	if b.listing != nil {
+		b.listing <- struct{}{}
+		<-b.release
+	}
+	return b.MemoryDB.GetOrdersCreatedSince(ctx, since, n)
+}
+
+func TestCachedClientRewarmStaysReady(t *testing.T) {
+	ctx := context.Background()
+	lister := &blockingLister{MemoryDB: NewMemoryDB()}
+	cache, err := NewCachedClient(ctx, lister, CacheConfig{})
+	if err != nil {
+		t.Fatalf("NewCachedClient: %v", err)
+	}
+	if !cache.WarmupProgress().Ready() {
+		t.Fatal("not ready after the first warm-up")
+	}
+
+	lister.listing = make(chan struct{})
+	lister.release = make(chan struct{})
+	if !cache.StartWarmup(ctx) {
+		t.Fatal("StartWarmup refused the re-warm")
+	}
+	<-lister.listing
+	progress := cache.WarmupProgress()
+	if !progress.Running || !progress.Ready() {
+		t.Fatalf("progress during re-warm = %+v, want running and ready", progress)
+	}
+	if cache.StartWarmup(ctx) {
+		t.Fatal("StartWarmup started a second warm-up")
+	}
+	if err := cache.Warmup(ctx); err != ErrWarmupRunning {
+		t.Fatalf("Warmup during a warm-up = %v, want ErrWarmupRunning", err)
+	}
+	close(lister.release)
+	for cache.WarmupProgress().Running {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// CDCPublication is the publication of the order tables and the order
+// history created by migrations 012, 013 and 015, which the CDC reader
+// subscribes to.
+const CDCPublication = "orders_cdc"
+
+// ReplicationConnString returns the connection string of the client for a
+// logical replication connection.
+func (c *Client) ReplicationConnString() (string, error) {
+	return setConnParam(c.connString, "replication", "database")
+}
+
+// CDCPosition returns the LSN the CDC reader using slot has published up to,
+// or "" if it has not published anything yet.
+func (c *Client) CDCPosition(ctx context.Context, slot string) (string, error) {
+	var lsn string
+	err := c.db.GetContext(ctx, &lsn, `SELECT lsn FROM cdc_positions WHERE slot_name = $1`, slot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error loading CDC position: %w", err)
+	}
+	return lsn, nil
+}
+
+// SaveCDCPosition records that the changes up to lsn have been published.
+func (c *Client) SaveCDCPosition(ctx context.Context, slot, lsn string) error {
+	query := `
+	INSERT INTO cdc_positions (slot_name, lsn) VALUES ($1, $2)
+	ON CONFLICT (slot_name) DO UPDATE SET lsn = EXCLUDED.lsn, updated_at = NOW()`
+	if _, err := c.db.ExecContext(ctx, query, slot, lsn); err != nil {
+		return fmt.Errorf("error saving CDC position: %w", err)
+	}
+	return nil
+}
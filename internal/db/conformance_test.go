@@ -0,0 +1,635 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wbstorage/internal/models"
+)
+
+// The implementations of Database must behave the same; each of them runs
+// this suite. Order UIDs carry the test name and a run suffix, so the suite
+// can share a Postgres database with earlier runs.
+
+func TestMemoryDBConformance(t *testing.T) {
+	testConformance(t, NewMemoryDB())
+}
+
+func TestSQLiteDBConformance(t *testing.T) {
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "orders.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteDB: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.db.Close() })
+	testConformance(t, sqliteDB)
+}
+
+func TestShardedDBConformance(t *testing.T) {
+	sharded, err := NewShardedDB([]Database{NewMemoryDB(), NewMemoryDB(), NewMemoryDB()})
+	if err != nil {
+		t.Fatalf("NewShardedDB: %v", err)
+	}
+	testConformance(t, sharded)
+}
+
+func TestClientConformance(t *testing.T) {
+	testConformance(t, testPostgres(t))
+}
+
+func testConformance(t *testing.T, db Database) {
+	run := fmt.Sprint(time.Now().UnixNano())
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, db Database, uid string)
+	}{
+		{"InsertSelect", testInsertSelect},
+		{"InsertDuplicate", testInsertDuplicate},
+		{"SelectMissing", testSelectMissing},
+		{"Upsert", testUpsert},
+		{"Patch", testPatch},
+		{"AddPayment", testAddPayment},
+		{"MergeOrder", testMergeOrder},
+		{"Delete", testDelete},
+		{"DeleteArchived", testDeleteArchived},
+		{"History", testHistory},
+		{"HistoryVersions", testHistoryVersions},
+		{"CustomerOrders", testCustomerOrders},
+		{"EraseCustomer", testEraseCustomer},
+		{"RawMessages", testRawMessages},
+		{"Returns", testReturns},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, db, tt.name+"-"+run)
+		})
+	}
+}
+
+func mustInsert(t *testing.T, db Database, order models.Order) {
+	t.Helper()
+	if err := db.InsertOrder(context.Background(), order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+}
+
+func assertStored(t *testing.T, db Database, want models.Order) {
+	t.Helper()
+	got, err := db.SelectOrder(context.Background(), want.OrderUID)
+	if err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	changes, err := models.DiffOrders(&want, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) > 0 {
+		t.Fatalf("stored order differs: %+v", changes)
+	}
+}
+
+func testInsertSelect(t *testing.T, db Database, uid string) {
+	order := testOrder(uid)
+	mustInsert(t, db, order)
+	assertStored(t, db, order)
+}
+
+func testInsertDuplicate(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	order := testOrder(uid)
+	mustInsert(t, db, order)
+
+	duplicate := testOrder(uid)
+	duplicate.TrackNumber = "DUPLICATE"
+	err := db.InsertOrder(ctx, duplicate)
+	if !errors.Is(err, ErrOrderExists) {
+		t.Fatalf("InsertOrder of a taken UID: got %v, want ErrOrderExists", err)
+	}
+	assertStored(t, db, order)
+
+	history, err := db.OrderHistory(ctx, uid)
+	if err != nil {
+		t.Fatalf("OrderHistory: %v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("got %d versions after a duplicate insert, want 1", len(history))
+	}
+}
+
+func testSelectMissing(t *testing.T, db Database, uid string) {
+	_, err := db.SelectOrder(context.Background(), uid)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("SelectOrder of a missing order: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testUpsert(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	order := testOrder(uid)
+	if err := db.UpsertOrder(ctx, order); err != nil {
+		t.Fatalf("UpsertOrder of a new order: %v", err)
+	}
+	assertStored(t, db, order)
+
+	order.TrackNumber = "REPLACED"
+	order.Items = order.Items[:1]
+	order.Shipments = nil
+	if err := db.UpsertOrder(ctx, order); err != nil {
+		t.Fatalf("UpsertOrder of a stored order: %v", err)
+	}
+	assertStored(t, db, order)
+}
+
+func testPatch(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	order := testOrder(uid)
+	mustInsert(t, db, order)
+
+	patched, err := db.PatchOrder(ctx, uid, []byte(`{"track_number": "PATCHED", "delivery": {"city": "Haifa"}}`))
+	if err != nil {
+		t.Fatalf("PatchOrder: %v", err)
+	}
+	order.TrackNumber = "PATCHED"
+	order.Delivery.City = "Haifa"
+	if patched.TrackNumber != "PATCHED" || patched.Delivery.City != "Haifa" {
+		t.Fatalf("PatchOrder returned %+v", patched)
+	}
+	assertStored(t, db, order)
+
+	for _, patch := range []string{`{"order_uid": "other"}`, `not json`} {
+		if _, err := db.PatchOrder(ctx, uid, []byte(patch)); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("PatchOrder(%s): got %v, want ErrInvalidPatch", patch, err)
+		}
+	}
+	assertStored(t, db, order)
+
+	if _, err := db.PatchOrder(ctx, uid+"-missing", []byte(`{}`)); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("PatchOrder of a missing order: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testAddPayment(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	order := testOrder(uid)
+	mustInsert(t, db, order)
+
+	refund := models.Payment{
+		Kind:        models.PaymentRefund,
+		Transaction: uid + "-refund-2",
+		Currency:    "USD",
+		Provider:    "wbpay",
+		Amount:      50,
+		PaymentDt:   1637907900,
+	}
+	for i := 0; i < 2; i++ {
+		got, err := db.AddPayment(ctx, uid, refund)
+		if err != nil {
+			t.Fatalf("AddPayment: %v", err)
+		}
+		if len(got.Payments) != 2 {
+			t.Fatalf("AddPayment #%d: got %d additional payments, want 2", i+1, len(got.Payments))
+		}
+	}
+	order.Payments = append(order.Payments, refund)
+	assertStored(t, db, order)
+
+	refund.Transaction = uid + "-refund-3"
+	refund.Amount = 1_000_000
+	if _, err := db.AddPayment(ctx, uid, refund); !errors.Is(err, models.ErrInvalidOrder) {
+		t.Fatalf("AddPayment of an oversized refund: got %v, want models.ErrInvalidOrder", err)
+	}
+	assertStored(t, db, order)
+
+	if _, err := db.AddPayment(ctx, uid+"-missing", refund); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("AddPayment to a missing order: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testMergeOrder(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	order := testOrder(uid)
+	order.CustomerID = uid
+	mustInsert(t, db, order)
+	// recorded after the message below was sent
+	late := models.Payment{Kind: models.PaymentRefund, Transaction: uid + "-late", Currency: "USD", Amount: 10}
+	if _, err := db.AddPayment(ctx, uid, late); err != nil {
+		t.Fatalf("AddPayment: %v", err)
+	}
+
+	update := testOrder(uid)
+	update.CustomerID = uid
+	update.TrackNumber = "IGNORED"
+	chargeback := models.Payment{Kind: models.PaymentChargeback, Transaction: uid + "-chargeback", Currency: "USD", Amount: 20}
+	parcel := models.Shipment{TrackNumber: "WBILTRACK-2", DeliveryService: "meest", Status: "created"}
+	update.Payments = append(update.Payments, chargeback, models.Payment{Kind: models.PaymentRefund, Currency: "USD", Amount: 5})
+	update.Shipments = append(update.Shipments, parcel)
+	for i, want := range []bool{true, false} {
+		_, changed, err := db.MergeOrder(ctx, update)
+		if err != nil {
+			t.Fatalf("MergeOrder #%d: %v", i+1, err)
+		}
+		if changed != want {
+			t.Fatalf("MergeOrder #%d: changed %v, want %v", i+1, changed, want)
+		}
+	}
+	order.Payments = append(order.Payments, late, chargeback)
+	order.Shipments = append(order.Shipments, parcel)
+	assertStored(t, db, order)
+
+	if _, _, err := db.MergeOrder(ctx, testOrder(uid+"-missing")); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("MergeOrder of a missing order: got %v, want sql.ErrNoRows", err)
+	}
+
+	if _, err := db.EraseCustomer(ctx, uid); err != nil {
+		t.Fatalf("EraseCustomer: %v", err)
+	}
+	update.Payments = append(update.Payments, models.Payment{Kind: models.PaymentRefund, Transaction: uid + "-after", Currency: "USD", Amount: 1})
+	if _, _, err := db.MergeOrder(ctx, update); !errors.Is(err, ErrOrderErased) {
+		t.Fatalf("MergeOrder of an erased order: got %v, want ErrOrderErased", err)
+	}
+}
+
+func testDelete(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	mustInsert(t, db, testOrder(uid))
+	if err := db.DeleteOrder(ctx, uid); err != nil {
+		t.Fatalf("DeleteOrder: %v", err)
+	}
+	if _, err := db.SelectOrder(ctx, uid); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("SelectOrder of a deleted order: got %v, want sql.ErrNoRows", err)
+	}
+	if err := db.DeleteOrder(ctx, uid); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("DeleteOrder of a missing order: got %v, want sql.ErrNoRows", err)
+	}
+	// the UID is free again
+	mustInsert(t, db, testOrder(uid))
+}
+
+func testDeleteArchived(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	kept, deleted := testOrder(uid+"-kept"), testOrder(uid+"-deleted")
+	mustInsert(t, db, kept)
+	mustInsert(t, db, deleted)
+	archived := []models.Order{kept, deleted, testOrder(uid + "-missing")}
+
+	// an update after the export must not be lost
+	updated := kept
+	updated.TrackNumber = "UPDATED"
+	if err := db.UpsertOrder(ctx, updated); err != nil {
+		t.Fatalf("UpsertOrder: %v", err)
+	}
+	n, err := db.DeleteOrders(ctx, archived)
+	if err != nil {
+		t.Fatalf("DeleteOrders: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("DeleteOrders removed %d orders, want 1", n)
+	}
+	if _, err := db.SelectOrder(ctx, deleted.OrderUID); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("SelectOrder of an archived order: got %v, want sql.ErrNoRows", err)
+	}
+	assertStored(t, db, updated)
+}
+
+func testHistory(t *testing.T, db Database, uid string) {
+	ctx := WithSource(context.Background(), "test")
+	order := testOrder(uid)
+	mustInsert(t, db, order)
+	inserted := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	updated := testOrder(uid)
+	updated.TrackNumber = "UPDATED"
+	if err := db.UpsertOrder(ctx, updated); err != nil {
+		t.Fatalf("UpsertOrder: %v", err)
+	}
+	if err := db.DeleteOrder(ctx, uid); err != nil {
+		t.Fatalf("DeleteOrder: %v", err)
+	}
+
+	history, err := db.OrderHistory(ctx, uid)
+	if err != nil {
+		t.Fatalf("OrderHistory: %v", err)
+	}
+	wantOps := []string{models.OperationInsert, models.OperationUpdate, models.OperationDelete}
+	if len(history) != len(wantOps) {
+		t.Fatalf("got %d versions, want %d", len(history), len(wantOps))
+	}
+	for i, v := range history {
+		if v.Version != i+1 || v.Operation != wantOps[i] {
+			t.Errorf("version %d: got %d %s, want %d %s", i, v.Version, v.Operation, i+1, wantOps[i])
+		}
+	}
+	if history[1].Source != "test" {
+		t.Errorf("got source %q, want %q", history[1].Source, "test")
+	}
+	if history[1].Order.TrackNumber != "UPDATED" {
+		t.Errorf("update snapshot has track number %q", history[1].Order.TrackNumber)
+	}
+
+	asOf, err := db.SelectOrderAsOf(ctx, uid, inserted)
+	if err != nil {
+		t.Fatalf("SelectOrderAsOf: %v", err)
+	}
+	if asOf.TrackNumber != order.TrackNumber {
+		t.Errorf("SelectOrderAsOf returned track number %q, want %q", asOf.TrackNumber, order.TrackNumber)
+	}
+	if _, err := db.SelectOrderAsOf(ctx, uid, time.Now()); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SelectOrderAsOf after the delete: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+// testHistoryVersions checks that every write changing the order records a
+// version, numbered on across a delete, and writes changing nothing don't.
+func testHistoryVersions(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	order := testOrder(uid)
+	mustInsert(t, db, order)
+	if _, err := db.SelectOrderAsOf(ctx, uid, before); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("SelectOrderAsOf before the insert: got %v, want sql.ErrNoRows", err)
+	}
+
+	if _, err := db.PatchOrder(ctx, uid, []byte(`{"track_number": "PATCHED"}`)); err != nil {
+		t.Fatalf("PatchOrder: %v", err)
+	}
+	chargeback := models.Payment{Kind: models.PaymentChargeback, Transaction: uid + "-chargeback", Currency: "USD", Amount: 10}
+	for i := 0; i < 2; i++ {
+		if _, err := db.AddPayment(ctx, uid, chargeback); err != nil {
+			t.Fatalf("AddPayment: %v", err)
+		}
+	}
+	if _, _, err := db.MergeOrder(ctx, order); err != nil {
+		t.Fatalf("MergeOrder: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	patched := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if err := db.DeleteOrder(ctx, uid); err != nil {
+		t.Fatalf("DeleteOrder: %v", err)
+	}
+	mustInsert(t, db, order)
+
+	history, err := db.OrderHistory(ctx, uid)
+	if err != nil {
+		t.Fatalf("OrderHistory: %v", err)
+	}
+	wantOps := []string{
+		models.OperationInsert, models.OperationUpdate, models.OperationUpdate,
+		models.OperationDelete, models.OperationInsert,
+	}
+	if len(history) != len(wantOps) {
+		t.Fatalf("got %d versions, want %d: %+v", len(history), len(wantOps), history)
+	}
+	for i, v := range history {
+		if v.Version != i+1 || v.Operation != wantOps[i] {
+			t.Errorf("version %d: got %d %s, want %d %s", i, v.Version, v.Operation, i+1, wantOps[i])
+		}
+		if i > 0 && v.ChangedAt.Before(history[i-1].ChangedAt) {
+			t.Errorf("version %d changed before version %d", v.Version, v.Version-1)
+		}
+	}
+	if len(history[2].Order.Payments) != len(order.Payments)+1 {
+		t.Errorf("version 3 has %d payments, want the chargeback added", len(history[2].Order.Payments))
+	}
+
+	asOf, err := db.SelectOrderAsOf(ctx, uid, patched)
+	if err != nil {
+		t.Fatalf("SelectOrderAsOf: %v", err)
+	}
+	if asOf.TrackNumber != "PATCHED" || len(asOf.Payments) != len(order.Payments)+1 {
+		t.Errorf("SelectOrderAsOf before the delete returned %q with %d payments", asOf.TrackNumber, len(asOf.Payments))
+	}
+	asOf, err = db.SelectOrderAsOf(ctx, uid, time.Now())
+	if err != nil {
+		t.Fatalf("SelectOrderAsOf after the re-insert: %v", err)
+	}
+	if asOf.TrackNumber != order.TrackNumber {
+		t.Errorf("SelectOrderAsOf after the re-insert returned track number %q", asOf.TrackNumber)
+	}
+}
+
+func testCustomerOrders(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	var want []string
+	for i := 0; i < 3; i++ {
+		order := testOrder(fmt.Sprint(uid, "-", i))
+		order.CustomerID = uid
+		order.DateCreated = order.DateCreated.Add(time.Duration(i) * time.Hour)
+		mustInsert(t, db, order)
+		want = append(want, order.OrderUID)
+	}
+	got, err := db.CustomerOrders(ctx, uid)
+	if err != nil {
+		t.Fatalf("CustomerOrders: %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("CustomerOrders: got %v, want %v", got, want)
+	}
+}
+
+func testEraseCustomer(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	stored := testOrder(uid + "-stored")
+	stored.CustomerID = uid
+	mustInsert(t, db, stored)
+	deleted := testOrder(uid + "-deleted")
+	deleted.CustomerID = uid
+	mustInsert(t, db, deleted)
+	for i, order := range []models.Order{stored, deleted} {
+		msg := models.RawMessage{
+			OrderUID:       order.OrderUID,
+			Subject:        "ORDERS.created",
+			Stream:         uid,
+			StreamSeq:      uint64(i + 1),
+			Payload:        []byte(`{"order_uid": "` + order.OrderUID + `"}`),
+			ReceivedAt:     time.Now().UTC(),
+			DecoderVersion: "1",
+		}
+		if err := db.ArchiveRawMessage(ctx, msg); err != nil {
+			t.Fatalf("ArchiveRawMessage: %v", err)
+		}
+	}
+	msgs, err := db.SelectRawMessages(ctx, stored.OrderUID)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("SelectRawMessages: %v, %d messages", err, len(msgs))
+	}
+	rawID := msgs[0].ID
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	refunded := models.Return{
+		ReturnID:          uid + "-refunded",
+		OrderUID:          stored.OrderUID,
+		Status:            models.ReturnRefunded,
+		Items:             []models.ReturnItem{{RID: stored.Items[0].RID, ChrtID: stored.Items[0].ChrtID, Reason: models.ReasonDefective}},
+		RefundTransaction: stored.Payment.Transaction,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	if err := db.InsertReturn(ctx, refunded); err != nil {
+		t.Fatalf("InsertReturn: %v", err)
+	}
+	if err := db.DeleteOrder(ctx, deleted.OrderUID); err != nil {
+		t.Fatalf("DeleteOrder: %v", err)
+	}
+
+	erasure, err := db.EraseCustomer(ctx, uid)
+	if err != nil {
+		t.Fatalf("EraseCustomer: %v", err)
+	}
+	want := []string{deleted.OrderUID, stored.OrderUID}
+	if fmt.Sprint(erasure.OrderUIDs) != fmt.Sprint(want) {
+		t.Fatalf("erased orders %v, want %v", erasure.OrderUIDs, want)
+	}
+
+	order, err := db.SelectOrder(ctx, stored.OrderUID)
+	if err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	if order.CustomerID != "" || order.Delivery.Name != "" || order.Payment.Transaction != "" {
+		t.Errorf("stored order was not anonymized: %+v", order)
+	}
+	for _, orderUID := range want {
+		history, err := db.OrderHistory(ctx, orderUID)
+		if err != nil {
+			t.Fatalf("OrderHistory: %v", err)
+		}
+		if len(history) == 0 {
+			t.Fatalf("history of %s is gone", orderUID)
+		}
+		for _, v := range history {
+			if v.Order.CustomerID != "" || v.Order.Delivery.Name != "" {
+				t.Errorf("version %d of %s was not anonymized", v.Version, orderUID)
+			}
+		}
+		msgs, err := db.SelectRawMessages(ctx, orderUID)
+		if err != nil {
+			t.Fatalf("SelectRawMessages: %v", err)
+		}
+		if len(msgs) != 0 {
+			t.Errorf("%d raw messages of %s are left", len(msgs), orderUID)
+		}
+	}
+	if _, err := db.SelectRawMessage(ctx, rawID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SelectRawMessage of an erased message: got %v, want sql.ErrNoRows", err)
+	}
+	ret, err := db.SelectReturn(ctx, refunded.ReturnID)
+	if err != nil {
+		t.Fatalf("SelectReturn: %v", err)
+	}
+	if ret.RefundTransaction != "" {
+		t.Errorf("refund transaction %q was not erased", ret.RefundTransaction)
+	}
+	orderUIDs, err := db.CustomerOrders(ctx, uid)
+	if err != nil {
+		t.Fatalf("CustomerOrders: %v", err)
+	}
+	if len(orderUIDs) != 0 {
+		t.Errorf("customer still has orders %v", orderUIDs)
+	}
+}
+
+func testRawMessages(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	msg := models.RawMessage{
+		OrderUID:       uid,
+		Subject:        "ORDERS.created",
+		Stream:         uid,
+		StreamSeq:      1,
+		Headers:        map[string][]string{"Nats-Msg-Id": {uid}},
+		Payload:        []byte(`{"order_uid": "` + uid + `"}`),
+		ReceivedAt:     time.Now().UTC().Truncate(time.Millisecond),
+		DecoderVersion: "1",
+	}
+	// redeliveries are archived once
+	for i := 0; i < 2; i++ {
+		if err := db.ArchiveRawMessage(ctx, msg); err != nil {
+			t.Fatalf("ArchiveRawMessage: %v", err)
+		}
+	}
+	msgs, err := db.SelectRawMessages(ctx, uid)
+	if err != nil {
+		t.Fatalf("SelectRawMessages: %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("got %d raw messages, want 1", len(msgs))
+	}
+	if string(msgs[0].Payload) != string(msg.Payload) || msgs[0].Headers["Nats-Msg-Id"][0] != uid {
+		t.Fatalf("got raw message %+v", msgs[0])
+	}
+	stored, err := db.SelectRawMessage(ctx, msgs[0].ID)
+	if err != nil {
+		t.Fatalf("SelectRawMessage: %v", err)
+	}
+	if string(stored.Payload) != string(msg.Payload) {
+		t.Fatalf("SelectRawMessage returned payload %q", stored.Payload)
+	}
+}
+
+func testReturns(t *testing.T, db Database, uid string) {
+	ctx := context.Background()
+	order := testOrder(uid)
+	mustInsert(t, db, order)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	ret := models.Return{
+		ReturnID:  uid + "-1",
+		OrderUID:  uid,
+		Status:    models.ReturnRequested,
+		Items:     []models.ReturnItem{{RID: order.Items[0].RID, ChrtID: order.Items[0].ChrtID, Reason: models.ReasonDefective}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := db.InsertReturn(ctx, ret); err != nil {
+		t.Fatalf("InsertReturn: %v", err)
+	}
+	if err := db.InsertReturn(ctx, ret); !errors.Is(err, ErrReturnExists) {
+		t.Fatalf("InsertReturn of a taken ID: got %v, want ErrReturnExists", err)
+	}
+	overlapping := ret
+	overlapping.ReturnID = uid + "-2"
+	if err := db.InsertReturn(ctx, overlapping); !errors.Is(err, ErrItemReturned) {
+		t.Fatalf("InsertReturn of a returned item: got %v, want ErrItemReturned", err)
+	}
+
+	received := ret
+	received.Status = models.ReturnReceived
+	if err := db.UpdateReturn(ctx, received, models.ReturnRequested); err != nil {
+		t.Fatalf("UpdateReturn: %v", err)
+	}
+	if err := db.UpdateReturn(ctx, received, models.ReturnRequested); !errors.Is(err, ErrReturnChanged) {
+		t.Fatalf("UpdateReturn from a stale status: got %v, want ErrReturnChanged", err)
+	}
+	stored, err := db.SelectReturn(ctx, ret.ReturnID)
+	if err != nil {
+		t.Fatalf("SelectReturn: %v", err)
+	}
+	if stored.Status != models.ReturnReceived || len(stored.Items) != 1 {
+		t.Fatalf("SelectReturn returned %+v", stored)
+	}
+
+	rejected := received
+	rejected.Status = models.ReturnRejected
+	if err := db.UpdateReturn(ctx, rejected, models.ReturnReceived); err != nil {
+		t.Fatalf("UpdateReturn: %v", err)
+	}
+	// the item is free again once its return is closed
+	if err := db.InsertReturn(ctx, overlapping); err != nil {
+		t.Fatalf("InsertReturn after the first return was rejected: %v", err)
+	}
+	returns, err := db.OrderReturns(ctx, uid)
+	if err != nil {
+		t.Fatalf("OrderReturns: %v", err)
+	}
+	if len(returns) != 2 || returns[0].ReturnID != ret.ReturnID {
+		t.Fatalf("OrderReturns returned %+v", returns)
+	}
+
+	if _, err := db.SelectReturn(ctx, uid+"-missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("SelectReturn of a missing return: got %v, want sql.ErrNoRows", err)
+	}
+}
@@ -2,34 +2,123 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sort"
+	"sync"
+	"time"
 	"wbstorage/internal/models"
+	"wbstorage/internal/pii"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Database interface {
 	InsertOrder(ctx context.Context, order models.Order) error
 	SelectOrder(ctx context.Context, orderUID string) (*models.Order, error)
+	// GetRecentOrders returns the n most accessed orders.
 	GetRecentOrders(ctx context.Context, n int) ([]string, error)
+	// GetOrdersCreatedSince returns up to n of the newest orders created at or
+	// after since; n <= 0 means no limit.
+	GetOrdersCreatedSince(ctx context.Context, since time.Time, n int) ([]string, error)
+	// UpsertOrder inserts order or replaces the stored one, including its
+	// delivery, payments, shipments and items.
+	UpsertOrder(ctx context.Context, order models.Order) error
+	// PatchOrder applies a JSON merge patch to a stored order and returns it.
+	PatchOrder(ctx context.Context, orderUID string, patch []byte) (*models.Order, error)
+	// AddPayment appends a payment record to a stored order and returns the
+	// order. An order with a payment of the same transaction is returned
+	// unchanged, so retries record the payment once; a payment without a
+	// transaction is always added.
+	AddPayment(ctx context.Context, orderUID string, p models.Payment) (*models.Order, error)
+	// MergeOrder adds the payments and shipments of order that the stored
+	// order lacks and returns the stored order and whether it changed; see
+	// models.Order.MergeRecords. Orders of an erased customer yield
+	// ErrOrderErased.
+	MergeOrder(ctx context.Context, order models.Order) (*models.Order, bool, error)
+	// DeleteOrder removes an order with all of its details.
+	DeleteOrder(ctx context.Context, orderUID string) error
+	// SearchOrders finds orders by item names and brands and by delivery
+	// name, city and address, best matches first. Query words match the start
+	// of words, except in encrypted delivery names and addresses, where they
+	// match whole words and are not highlighted in snippets.
+	SearchOrders(ctx context.Context, query string, limit int) ([]SearchResult, error)
+	// ArchiveRawMessage stores a message as received from NATS.
+	ArchiveRawMessage(ctx context.Context, msg models.RawMessage) error
+	// SelectRawMessages returns the archived messages of an order, oldest first.
+	SelectRawMessages(ctx context.Context, orderUID string) ([]models.RawMessage, error)
+	SelectRawMessage(ctx context.Context, id int64) (*models.RawMessage, error)
+	// OrderHistory returns every recorded version of an order, oldest first.
+	OrderHistory(ctx context.Context, orderUID string) ([]models.OrderVersion, error)
+	// SelectOrderAsOf returns an order as it was at the given time.
+	SelectOrderAsOf(ctx context.Context, orderUID string, t time.Time) (*models.Order, error)
+	// GetOrdersCreatedBefore returns up to n of the oldest orders created
+	// before the given time; n <= 0 means no limit.
+	GetOrdersCreatedBefore(ctx context.Context, before time.Time, n int) ([]string, error)
+	// DeleteOrders removes archived orders without recording history and
+	// returns how many it removed. An order that changed since it was
+	// archived, see checkUnchanged, is kept.
+	DeleteOrders(ctx context.Context, archived []models.Order) (int, error)
+	// PurgeHistory removes raw messages and the history of deleted orders
+	// older than the given time.
+	PurgeHistory(ctx context.Context, before time.Time) (int, error)
+	// LookupOrders returns the UIDs of orders whose delivery matches contact.
+	LookupOrders(ctx context.Context, contact Contact) ([]string, error)
+	// CustomerOrders returns the UIDs of the customer's orders, oldest first.
+	CustomerOrders(ctx context.Context, customerID string) ([]string, error)
+	// EraseCustomer anonymizes the customer's orders, and the history and
+	// raw messages of the deleted ones, and records an audit entry; see
+	// models.Order.Anonymize.
+	EraseCustomer(ctx context.Context, customerID string) (*Erasure, error)
+	// InsertReturn stores a new return; a taken return ID yields
+	// ErrReturnExists and an item in another open return of the order
+	// ErrItemReturned.
+	InsertReturn(ctx context.Context, ret models.Return) error
+	SelectReturn(ctx context.Context, returnID string) (*models.Return, error)
+	// OrderReturns returns the returns of an order, oldest first.
+	OrderReturns(ctx context.Context, orderUID string) ([]models.Return, error)
+	// UpdateReturn stores the status and refund of ret if the stored return
+	// is still in status from, and yields ErrReturnChanged otherwise.
+	UpdateReturn(ctx context.Context, ret models.Return, from string) error
 }
+
+// ErrInvalidPatch is returned by PatchOrder for patches that can't be applied.
+var ErrInvalidPatch = errors.New("invalid order patch")
+
 type Client struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	stmts stmtCache
+
+	pii *pii.Keyring
+
+	replicas *replicaSet
+	pool     PoolConfig
+	// connString is kept for the LISTEN connection.
+	connString string
 }
 
-func NewDB(conntectionString string) (*Client, error) {
-	db, err := sqlx.Connect("postgres", conntectionString)
+func NewDB(conntectionString string, pool PoolConfig) (*Client, error) {
+	connString, err := pool.connString(conntectionString)
 	if err != nil {
+		return nil, err
+	}
+	db, err := pool.open(connString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
-	return &Client{db: db}, nil
+	return &Client{db: db, pool: pool, connString: connString}, nil
 }
 
-func (c *Client) InsertOrder(ctx context.Context, order models.Order) error {
-
-	orderQuery := `
+const (
+	insertOrderQuery = `
 	INSERT INTO orders 
 		(order_uid, track_number, entry, locale, internal_signature, 
 		customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard, last_interaction)
@@ -38,55 +127,147 @@ func (c *Client) InsertOrder(ctx context.Context, order models.Order) error {
 		:customer_id, :delivery_service, :shardkey, :sm_id, :date_created, :oof_shard, NOW())
 	`
 
-	deliveryQuery := `
+	insertDeliveryQuery = `
 	INSERT INTO deliveries 
-		(order_uid, name, phone, zip, city, address, region, email) 
+		(order_uid, date_created, name, phone, zip, city, address, region, email, pii_key_id, email_hash, phone_hash, search_tokens) 
 		VALUES 
-		(:order_uid, :name, :phone, :zip, :city, :address, :region, :email)
+		(:order_uid, :date_created, :name, :phone, :zip, :city, :address, :region, :email, :pii_key_id, :email_hash, :phone_hash, :search_tokens)
 	`
 
-	paymentQuery := `
+	insertPaymentQuery = `
 	INSERT INTO payments
-		(order_uid, transaction, request_id, currency, provider, 
+		(order_uid, date_created, kind, transaction, request_id, currency, provider, 
 		amount, payment_dt, bank, delivery_cost, goods_total, custom_fee) 
 		VALUES 
-		(:order_uid, :transaction, :request_id, :currency, :provider, 
+		(:order_uid, :date_created, COALESCE(NULLIF(:kind, ''), 'charge'), :transaction, :request_id, :currency, :provider, 
 		:amount, to_timestamp(:payment_dt), :bank, :delivery_cost, :goods_total, :custom_fee)
 	`
-	ItemsQuery := `INSERT INTO items
-		(order_uid, chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status)
-		VALUES (:order_uid, :chrt_id, :track_number, :price, :rid, :name, :sale, :size, :total_price, :nm_id, :brand, :status)`
 
-	tx, err := c.db.BeginTxx(ctx, nil)
-	if err != nil {
-		errRollback := tx.Rollback()
-		if errRollback != nil {
-			slog.Error("error while rollback", errRollback)
-		}
+	insertShipmentsQuery = `INSERT INTO shipments
+		(order_uid, date_created, track_number, delivery_service, status)
+		VALUES (:order_uid, :date_created, :track_number, :delivery_service, :status)`
+
+	insertItemsQuery = `INSERT INTO items
+		(order_uid, date_created, chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status)
+		VALUES (:order_uid, :date_created, :chrt_id, :track_number, :price, :rid, :name, :sale, :size, :total_price, :nm_id, :brand, :status)`
+)
+
+// paymentRow, shipmentRow and itemRow are children as stored in Postgres, which carry the
+// date_created of their order to be partitioned with it.
+type paymentRow struct {
+	models.Payment
+	DateCreated time.Time `db:"date_created"`
+}
+
+type shipmentRow struct {
+	models.Shipment
+	DateCreated time.Time `db:"date_created"`
+}
+
+type itemRow struct {
+	models.Item
+	DateCreated time.Time `db:"date_created"`
+}
+
+// lockOrderUID serializes the writes to one order UID until the transaction
+// ends. The partitioned orders table cannot enforce a unique order_uid, as
+// its unique keys must include date_created, so every write takes this lock
+// before checking for an existing order.
+func lockOrderUID(ctx context.Context, tx *sqlx.Tx, orderUID string) error {
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, orderUID); err != nil {
+		return fmt.Errorf("error locking order %s: %w", orderUID, err)
 	}
+	return nil
+}
 
-	if _, err := tx.NamedExecContext(ctx, orderQuery, order); err != nil {
-		errRollback := tx.Rollback()
-		if errRollback != nil {
-			slog.Error("error while rollback", "error", errRollback)
+// lockOrder locks the order row and returns its date_created, the partition
+// key that lets later statements on the order prune partitions.
+func lockOrder(ctx context.Context, tx *sqlx.Tx, orderUID string) (time.Time, error) {
+	if err := lockOrderUID(ctx, tx, orderUID); err != nil {
+		return time.Time{}, err
+	}
+	var dateCreated time.Time
+	lockQuery := `SELECT date_created FROM orders WHERE order_uid = $1 FOR UPDATE`
+	if err := tx.GetContext(ctx, &dateCreated, lockQuery, orderUID); err != nil {
+		return time.Time{}, fmt.Errorf("error locking order: %w", err)
+	}
+	return dateCreated, nil
+}
+
+func (c *Client) InsertOrder(ctx context.Context, order models.Order) error {
+	c.noteWrite(order.OrderUID)
+	return c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		if err := lockOrderUID(ctx, tx, order.OrderUID); err != nil {
+			return err
+		}
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM orders WHERE order_uid = $1)`, order.OrderUID); err != nil {
+			return fmt.Errorf("error inserting order: %w", err)
+		}
+		if exists {
+			return fmt.Errorf("error inserting order %s: %w", order.OrderUID, ErrOrderExists)
+		}
+		if _, err := tx.NamedExecContext(ctx, insertOrderQuery, order); err != nil {
+			return err
+		}
+		if err := c.insertChildren(ctx, tx, order); err != nil {
+			return err
 		}
+		return c.recordHistory(ctx, tx, models.OperationInsert, &order)
+	})
+}
+
+// insertChildren inserts the delivery, payments, shipments and items of
+// order. Payments are inserted in order, so the original one gets the lowest
+// id.
+func (c *Client) insertChildren(ctx context.Context, tx *sqlx.Tx, order models.Order) error {
+	delivery, err := c.sealDelivery(order.Delivery)
+	if err != nil {
 		return err
 	}
-	if _, err := tx.NamedExecContext(ctx, deliveryQuery, order.Delivery); err != nil {
-		errRollback := tx.Rollback()
-		if errRollback != nil {
-			slog.Error("error while rollback", "error", errRollback)
-		}
+	delivery.DateCreated = order.DateCreated
+	if _, err := tx.NamedExecContext(ctx, insertDeliveryQuery, delivery); err != nil {
 		return err
 	}
-	if _, err := tx.NamedExecContext(ctx, paymentQuery, order.Payment); err != nil {
-		errRollback := tx.Rollback()
-		if errRollback != nil {
-			slog.Error("error while rollback", "error", errRollback)
+	all := order.AllPayments()
+	payments := make([]paymentRow, len(all))
+	for i, payment := range all {
+		payments[i] = paymentRow{Payment: payment, DateCreated: order.DateCreated}
+	}
+	if _, err := tx.NamedExecContext(ctx, insertPaymentQuery, payments); err != nil {
+		return err
+	}
+	if len(order.Shipments) > 0 {
+		shipments := make([]shipmentRow, len(order.Shipments))
+		for i, shipment := range order.Shipments {
+			shipments[i] = shipmentRow{Shipment: shipment, DateCreated: order.DateCreated}
+		}
+		if _, err := tx.NamedExecContext(ctx, insertShipmentsQuery, shipments); err != nil {
+			return err
 		}
+	}
+	if len(order.Items) == 0 {
+		return nil
+	}
+	items := make([]itemRow, len(order.Items))
+	for i, item := range order.Items {
+		items[i] = itemRow{Item: item, DateCreated: order.DateCreated}
+	}
+	if _, err := tx.NamedExecContext(ctx, insertItemsQuery, items); err != nil {
 		return err
 	}
-	if _, err = tx.NamedExecContext(ctx, ItemsQuery, order.Items); err != nil {
+	return nil
+}
+
+// withTx runs fn in a transaction, committing if fn succeeds and rolling back
+// otherwise.
+func (c *Client) withTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) error {
+	tx, err := c.db.BeginTxx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	if err := fn(tx); err != nil {
 		errRollback := tx.Rollback()
 		if errRollback != nil {
 			slog.Error("error while rollback", "error", errRollback)
@@ -97,72 +278,239 @@ func (c *Client) InsertOrder(ctx context.Context, order models.Order) error {
 	return tx.Commit()
 }
 
-func (c *Client) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
-	updateQuery := `
-	UPDATE orders
-	SET last_interaction = NOW()
-	WHERE order_uid = $1
-	`
-	if _, err := c.db.ExecContext(ctx, updateQuery, orderUID); err != nil {
-		return nil, fmt.Errorf("error updating last interaction time: %v", err)
-	}
-
-	order := models.Order{}
-
-	orderQuery := `
-	SELECT * 
-	FROM orders 
-	WHERE order_uid = $1
-	`
+// orderColumns lists the orders columns scanned into models.Order.
+const orderColumns = `order_uid, track_number, entry, locale, internal_signature,
+	customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard, last_interaction`
 
-	deliveryQuery := `
-	SELECT * 
-	FROM deliveries 
-	WHERE order_uid = $1
+// selectOrderQuery fetches an order with its delivery, payments, shipments
+// and items in one read-only statement, so the whole order is read from a
+// single snapshot. Child rows are aggregated to JSON whose keys match the models' json tags.
+// Joining on date_created lets the children's partitions be pruned at run
+// time to the one of the order.
+const selectOrderQuery = `
+	SELECT ` + orderColumns + `, d.delivery, p.payments, s.shipments, i.items
+	FROM orders o
+	LEFT JOIN LATERAL (
+		SELECT to_jsonb(d) AS delivery
+		FROM deliveries d
+		WHERE d.order_uid = o.order_uid AND d.date_created = o.date_created
+		ORDER BY d.id
+		LIMIT 1
+	) d ON true
+	LEFT JOIN LATERAL (
+		SELECT jsonb_agg(to_jsonb(p) || jsonb_build_object(
+			'payment_dt', FLOOR(EXTRACT(EPOCH FROM p.payment_dt))::BIGINT
+		) ORDER BY p.id) AS payments
+		FROM payments p
+		WHERE p.order_uid = o.order_uid AND p.date_created = o.date_created
+	) p ON true
+	LEFT JOIN LATERAL (
+		SELECT jsonb_agg(to_jsonb(s) ORDER BY s.id) AS shipments
+		FROM shipments s
+		WHERE s.order_uid = o.order_uid AND s.date_created = o.date_created
+	) s ON true
+	LEFT JOIN LATERAL (
+		SELECT jsonb_agg(to_jsonb(i) ORDER BY i.id) AS items
+		FROM items i
+		WHERE i.order_uid = o.order_uid AND i.date_created = o.date_created
+	) i ON true
+	WHERE o.order_uid = $1
 	`
 
-	paymentQuery := `
-	SELECT order_uid, transaction, request_id, currency, provider, 
-		   amount, FLOOR(EXTRACT(EPOCH FROM payment_dt))::BIGINT AS payment_dt, 
-		   bank, delivery_cost, goods_total, custom_fee 
-	FROM payments
-	WHERE order_uid = $1
-	`
+type orderRow struct {
+	models.Order
+	DeliveryJSON  []byte `db:"delivery"`
+	PaymentsJSON  []byte `db:"payments"`
+	ShipmentsJSON []byte `db:"shipments"`
+	ItemsJSON     []byte `db:"items"`
+}
 
-	itemsQuery := `
-	SELECT * 
-	FROM items 
-	WHERE order_uid = $1
-	`
+// SelectOrder reads from a replica unless the order was written recently.
+func (c *Client) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
+	var order *models.Order
+	err := c.read(ctx, orderUID, func(p preparer) error {
+		stmt, err := p.prepared(ctx, selectOrderQuery)
+		if err != nil {
+			return err
+		}
+		order, err = c.scanOrder(ctx, stmt, orderUID)
+		return err
+	})
+	return order, err
+}
 
-	if err := c.db.GetContext(ctx, &order, orderQuery, orderUID); err != nil {
-		return nil, fmt.Errorf("error fetching order: %v", err)
+// scanOrder runs selectOrderQuery through stmt and decodes the result,
+// decrypting the delivery.
+func (c *Client) scanOrder(ctx context.Context, stmt *sqlx.Stmt, orderUID string) (*models.Order, error) {
+	var row orderRow
+	if err := stmt.GetContext(ctx, &row, orderUID); err != nil {
+		return nil, fmt.Errorf("error fetching order: %w", err)
 	}
-	if err := c.db.GetContext(ctx, &order.Delivery, deliveryQuery, orderUID); err != nil {
-		return nil, fmt.Errorf("error fetching delivery data: %v", err)
+	order := row.Order
+	if row.DeliveryJSON != nil {
+		var delivery deliveryRow
+		if err := json.Unmarshal(row.DeliveryJSON, &delivery); err != nil {
+			return nil, fmt.Errorf("error decoding delivery data: %w", err)
+		}
+		if err := c.openDelivery(delivery.PIIKeyID, &delivery.Delivery); err != nil {
+			return nil, err
+		}
+		order.Delivery = delivery.Delivery
 	}
-	if err := c.db.GetContext(ctx, &order.Payment, paymentQuery, orderUID); err != nil {
-		return nil, fmt.Errorf("error fetching payment data: %v", err)
+	if row.PaymentsJSON != nil {
+		var payments []models.Payment
+		if err := json.Unmarshal(row.PaymentsJSON, &payments); err != nil {
+			return nil, fmt.Errorf("error decoding payment data: %w", err)
+		}
+		if len(payments) > 0 {
+			order.Payment = payments[0]
+		}
+		if len(payments) > 1 {
+			order.Payments = payments[1:]
+		}
+	}
+	if row.ShipmentsJSON != nil {
+		if err := json.Unmarshal(row.ShipmentsJSON, &order.Shipments); err != nil {
+			return nil, fmt.Errorf("error decoding shipments: %w", err)
+		}
 	}
-	if err := c.db.SelectContext(ctx, &order.Items, itemsQuery, orderUID); err != nil {
-		return nil, fmt.Errorf("error fetching items: %v", err)
+	if row.ItemsJSON != nil {
+		if err := json.Unmarshal(row.ItemsJSON, &order.Items); err != nil {
+			return nil, fmt.Errorf("error decoding items: %w", err)
+		}
 	}
+	order.SetOrderUID(order.OrderUID)
 
 	return &order, nil
 }
 
+// prepared returns a statement for query on the primary.
+func (c *Client) prepared(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	return c.stmts.get(ctx, c.db, query)
+}
+
+// stmtCache holds the prepared statements of one connection pool. Statements
+// are prepared lazily so the client can be created before migrations run.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sqlx.Stmt
+}
+
+func (s *stmtCache) get(ctx context.Context, db *sqlx.DB, query string) (*sqlx.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stmt, ok := s.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing statement: %w", err)
+	}
+	if s.stmts == nil {
+		s.stmts = make(map[string]*sqlx.Stmt)
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
 func (c *Client) GetRecentOrders(ctx context.Context, n int) ([]string, error) {
 	var orderUIDs []string
 	query := `
-	SELECT order_uid 
-	FROM orders 
-	ORDER BY last_interaction DESC 
+	SELECT order_uid
+	FROM orders
+	ORDER BY access_count DESC, last_interaction DESC NULLS LAST
 	LIMIT $1
 	`
 
-	err := c.db.SelectContext(ctx, &orderUIDs, query, n)
+	err := c.read(ctx, "", func(p preparer) error {
+		stmt, err := p.prepared(ctx, query)
+		if err != nil {
+			return err
+		}
+		orderUIDs = orderUIDs[:0]
+		if err := stmt.SelectContext(ctx, &orderUIDs, n); err != nil {
+			return fmt.Errorf("error fetching recent orders: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orderUIDs, nil
+}
+
+func (c *Client) GetOrdersCreatedSince(ctx context.Context, since time.Time, n int) ([]string, error) {
+	var orderUIDs []string
+	query := `
+	SELECT order_uid
+	FROM orders
+	WHERE date_created >= $1
+	ORDER BY date_created DESC
+	LIMIT NULLIF($2, 0)
+	`
+
+	stmt, err := c.prepared(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching recent orders: %v", err)
+		return nil, err
+	}
+	if err := stmt.SelectContext(ctx, &orderUIDs, since, max(n, 0)); err != nil {
+		return nil, fmt.Errorf("error fetching orders created since %s: %v", since, err)
 	}
 	return orderUIDs, nil
 }
+
+const accessBatchSize = 1000
+
+// RecordAccesses adds the accumulated hits to access_count and moves
+// last_interaction forward, in batches of accessBatchSize orders. The
+// batches share one transaction, so a failure writes none of them and the
+// tracker can retry them all without counting any hit twice.
+func (c *Client) RecordAccesses(ctx context.Context, accesses map[string]Access) error {
+	query := `
+	UPDATE orders o
+	SET access_count = o.access_count + v.hits,
+		last_interaction = GREATEST(o.last_interaction, to_timestamp(v.accessed_at)::timestamp)
+	FROM unnest($1::varchar[], $2::float8[], $3::bigint[]) AS v(order_uid, accessed_at, hits)
+	WHERE o.order_uid = v.order_uid
+	`
+	stmt, err := c.prepared(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	return c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		txStmt := tx.StmtxContext(ctx, stmt)
+		uids := make([]string, 0, accessBatchSize)
+		times := make([]float64, 0, accessBatchSize)
+		hits := make([]int64, 0, accessBatchSize)
+		flush := func() error {
+			if len(uids) == 0 {
+				return nil
+			}
+			if _, err := txStmt.ExecContext(ctx, pq.Array(uids), pq.Array(times), pq.Array(hits)); err != nil {
+				return fmt.Errorf("error recording order accesses: %w", err)
+			}
+			uids, times, hits = uids[:0], times[:0], hits[:0]
+			return nil
+		}
+		// in UID order, so that instances flushing at once lock the rows in
+		// the same order
+		ordered := make([]string, 0, len(accesses))
+		for uid := range accesses {
+			ordered = append(ordered, uid)
+		}
+		sort.Strings(ordered)
+		for _, uid := range ordered {
+			a := accesses[uid]
+			uids = append(uids, uid)
+			times = append(times, float64(a.AccessedAt.UnixMicro())/1e6)
+			hits = append(hits, a.Hits)
+			if len(uids) == accessBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		return flush()
+	})
+}
@@ -0,0 +1,189 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"wbstorage/internal/models"
+)
+
+// testPostgres connects to TEST_DATABASE_URL and applies the migrations. Tests
+// that need Postgres are skipped when it is not set; the database is shared
+// between them, so they use order UIDs of their own.
+func testPostgres(tb testing.TB) *Client {
+	tb.Helper()
+	connString := os.Getenv("TEST_DATABASE_URL")
+	if connString == "" {
+		tb.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	client, err := NewDB(connString, PoolConfig{})
+	if err != nil {
+		tb.Fatalf("NewDB: %v", err)
+	}
+	tb.Cleanup(func() { client.db.Close() })
+	migrator, err := client.NewMigrator(ctx)
+	if err != nil {
+		tb.Fatalf("NewMigrator: %v", err)
+	}
+	defer migrator.Close()
+	if err := migrator.Up(); err != nil {
+		tb.Fatalf("migrating: %v", err)
+	}
+	return client
+}
+
+// selectOrderPerTable reads an order the way SelectOrder did before it was a
+// single statement: one query per table, each in its own snapshot. The
+// last_interaction update it started with is gone, accesses are tracked in
+// memory now, so it is left out of the comparison.
+func (c *Client) selectOrderPerTable(ctx context.Context, orderUID string) (*models.Order, error) {
+	var order models.Order
+	orderQuery := `SELECT ` + orderColumns + ` FROM orders WHERE order_uid = $1`
+	deliveryQuery := `
+	SELECT id, order_uid, name, phone, zip, city, address, region, email
+	FROM deliveries
+	WHERE order_uid = $1
+	`
+	paymentsQuery := `
+	SELECT id, order_uid, kind, transaction, request_id, currency, provider,
+		   amount, FLOOR(EXTRACT(EPOCH FROM payment_dt))::BIGINT AS payment_dt,
+		   bank, delivery_cost, goods_total, custom_fee
+	FROM payments
+	WHERE order_uid = $1
+	ORDER BY id
+	`
+	shipmentsQuery := `
+	SELECT id, order_uid, track_number, delivery_service, status
+	FROM shipments
+	WHERE order_uid = $1
+	ORDER BY id
+	`
+	itemsQuery := `
+	SELECT id, order_uid, chrt_id, track_number, price, rid, name, sale, size,
+		   total_price, nm_id, brand, status
+	FROM items
+	WHERE order_uid = $1
+	ORDER BY id
+	`
+	if err := c.db.GetContext(ctx, &order, orderQuery, orderUID); err != nil {
+		return nil, err
+	}
+	if err := c.db.GetContext(ctx, &order.Delivery, deliveryQuery, orderUID); err != nil {
+		return nil, err
+	}
+	var payments []models.Payment
+	if err := c.db.SelectContext(ctx, &payments, paymentsQuery, orderUID); err != nil {
+		return nil, err
+	}
+	if len(payments) > 0 {
+		order.Payment, order.Payments = payments[0], payments[1:]
+	}
+	if err := c.db.SelectContext(ctx, &order.Shipments, shipmentsQuery, orderUID); err != nil {
+		return nil, err
+	}
+	if err := c.db.SelectContext(ctx, &order.Items, itemsQuery, orderUID); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func benchmarkOrder(b *testing.B, client *Client) string {
+	b.Helper()
+	order := testOrder("bench-select-order")
+	if err := client.UpsertOrder(context.Background(), order); err != nil {
+		b.Fatalf("UpsertOrder: %v", err)
+	}
+	return order.OrderUID
+}
+
+func BenchmarkSelectOrderPerTable(b *testing.B) {
+	client := testPostgres(b)
+	uid := benchmarkOrder(b, client)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.selectOrderPerTable(ctx, uid); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSelectOrderSingleStatement(b *testing.B) {
+	client := testPostgres(b)
+	uid := benchmarkOrder(b, client)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.SelectOrder(ctx, uid); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSelectOrderPerTableParallel(b *testing.B) {
+	client := testPostgres(b)
+	uid := benchmarkOrder(b, client)
+	ctx := context.Background()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := client.selectOrderPerTable(ctx, uid); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSelectOrderSingleStatementParallel(b *testing.B) {
+	client := testPostgres(b)
+	uid := benchmarkOrder(b, client)
+	ctx := context.Background()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := client.SelectOrder(ctx, uid); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestEnsureOrderPartitionMovesDefaultRows(t *testing.T) {
+	client := testPostgres(t)
+	ctx := context.Background()
+	order := testOrder("partition-default-rows")
+	// far beyond the partitions created ahead
+	order.DateCreated = time.Date(2099, 1, 15, 0, 0, 0, 0, time.UTC)
+	if err := client.DeleteOrder(ctx, order.OrderUID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("DeleteOrder: %v", err)
+	}
+	if err := client.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	if _, err := client.db.ExecContext(ctx, `SELECT ensure_order_partition($1)`, order.DateCreated); err != nil {
+		t.Fatalf("ensure_order_partition with rows in the default partition: %v", err)
+	}
+
+	var partition string
+	query := `SELECT tableoid::regclass::text FROM orders WHERE order_uid = $1`
+	if err := client.db.GetContext(ctx, &partition, query, order.OrderUID); err != nil {
+		t.Fatalf("locating the order: %v", err)
+	}
+	if partition != "orders_p2099_01" {
+		t.Fatalf("order is in %s, want orders_p2099_01", partition)
+	}
+	got, err := client.SelectOrder(ctx, order.OrderUID)
+	if err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	if len(got.Items) != len(order.Items) || len(got.Shipments) != len(order.Shipments) {
+		t.Fatalf("moved order lost details: %d items, %d shipments", len(got.Items), len(got.Shipments))
+	}
+}
@@ -0,0 +1,454 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"wbstorage/internal/models"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Erasure is the audit record of an erasure request. OrderUIDs are the orders
+// that were anonymized, including deleted and archived ones whose history
+// was; it is empty when the customer had none left.
+//
+// Erasure covers the databases only. Orders archived by the retention job
+// stay in their archive files until the job purges them, and CDC events
+// carry anonymized orders only, so the retention and CDC age limits bound
+// how long data outlives an erasure.
+type Erasure struct {
+	CustomerID string    `json:"customer_id"`
+	OrderUIDs  []string  `json:"order_uids"`
+	Source     string    `json:"source"`
+	ErasedAt   time.Time `json:"erased_at"`
+}
+
+// ErrOrderErased is returned for updates of orders whose customer was
+// erased: they would bring back the data the erasure removed.
+var ErrOrderErased = errors.New("order belongs to an erased customer")
+
+func newErasure(ctx context.Context, customerID string) *Erasure {
+	return &Erasure{
+		CustomerID: customerID,
+		OrderUIDs:  []string{},
+		Source:     SourceFrom(ctx),
+		ErasedAt:   time.Now().UTC(),
+	}
+}
+
+// CustomerExport is everything stored about a customer's orders.
+type CustomerExport struct {
+	CustomerID string          `json:"customer_id"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Orders     []ExportedOrder `json:"orders"`
+}
+
+type ExportedOrder struct {
+	Order       *models.Order         `json:"order"`
+	History     []models.OrderVersion `json:"history"`
+	RawMessages []ExportedRawMessage  `json:"raw_messages"`
+	Returns     []models.Return       `json:"returns"`
+}
+
+// ExportedRawMessage includes the payload, which the API otherwise serves
+// only as a separate download.
+type ExportedRawMessage struct {
+	models.RawMessage
+	Payload string `json:"payload"`
+}
+
+// ExportCustomer collects the current state, history, raw messages and
+// returns of every order of the customer.
+func ExportCustomer(ctx context.Context, d Database, customerID string) (*CustomerExport, error) {
+	orderUIDs, err := d.CustomerOrders(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	export := &CustomerExport{
+		CustomerID: customerID,
+		ExportedAt: time.Now().UTC(),
+		Orders:     make([]ExportedOrder, 0, len(orderUIDs)),
+	}
+	for _, uid := range orderUIDs {
+		order, err := d.SelectOrder(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		history, err := d.OrderHistory(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := d.SelectRawMessages(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		raw := make([]ExportedRawMessage, 0, len(msgs))
+		for _, msg := range msgs {
+			full, err := d.SelectRawMessage(ctx, msg.ID)
+			if err != nil {
+				return nil, err
+			}
+			raw = append(raw, ExportedRawMessage{RawMessage: *full, Payload: string(full.Payload)})
+		}
+		rets, err := d.OrderReturns(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		export.Orders = append(export.Orders, ExportedOrder{Order: order, History: history, RawMessages: raw, Returns: rets})
+	}
+	return export, nil
+}
+
+func (c *Client) CustomerOrders(ctx context.Context, customerID string) ([]string, error) {
+	orderUIDs := []string{}
+	query := `SELECT order_uid FROM orders WHERE customer_id = $1 ORDER BY date_created, order_uid`
+	if err := c.db.SelectContext(ctx, &orderUIDs, query, customerID); err != nil {
+		return nil, fmt.Errorf("error fetching customer orders: %w", err)
+	}
+	return orderUIDs, nil
+}
+
+// EraseCustomer anonymizes every order of the customer, including its
+// history snapshots and the refund transactions of its returns, deletes the
+// raw messages they were received in and writes an audit record, all in one transaction. Orders that were deleted
+// or archived are found through their history, whose snapshots and raw
+// messages are erased as well.
+func (c *Client) EraseCustomer(ctx context.Context, customerID string) (*Erasure, error) {
+	erasure := newErasure(ctx, customerID)
+	err := c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		query := `
+		SELECT order_uid FROM orders WHERE customer_id = $1
+		UNION
+		SELECT order_uid FROM order_history WHERE snapshot->>'customer_id' = $1
+		ORDER BY order_uid
+		`
+		if err := tx.SelectContext(ctx, &erasure.OrderUIDs, query, customerID); err != nil {
+			return fmt.Errorf("error fetching customer orders: %w", err)
+		}
+		// in UID order, and before the rows, like every writer of an order
+		for _, uid := range erasure.OrderUIDs {
+			if err := lockOrderUID(ctx, tx, uid); err != nil {
+				return err
+			}
+		}
+		var stored []string
+		lockQuery := `SELECT order_uid FROM orders WHERE customer_id = $1 ORDER BY order_uid FOR UPDATE`
+		if err := tx.SelectContext(ctx, &stored, lockQuery, customerID); err != nil {
+			return fmt.Errorf("error locking customer orders: %w", err)
+		}
+		erasure.OrderUIDs = mergeUIDs(erasure.OrderUIDs, stored)
+
+		statements := []struct {
+			query     string
+			orderUIDs []string
+		}{
+			{`UPDATE orders SET customer_id = '' WHERE order_uid = ANY($1)`, stored},
+			{`UPDATE deliveries SET name = '', phone = '', zip = '', address = '', email = '',
+				pii_key_id = NULL, email_hash = NULL, phone_hash = NULL, search_tokens = NULL
+			WHERE order_uid = ANY($1)`, stored},
+			{`UPDATE payments SET transaction = '', request_id = '' WHERE order_uid = ANY($1)`, stored},
+		}
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement.query, pq.Array(statement.orderUIDs)); err != nil {
+				return fmt.Errorf("error erasing customer data: %w", err)
+			}
+		}
+		if err := c.eraseOrders(ctx, tx, erasure.OrderUIDs); err != nil {
+			return err
+		}
+
+		audit := `INSERT INTO audit_log (action, subject, order_uids, source, created_at) VALUES ('erase', $1, $2, $3, $4)`
+		if _, err := tx.ExecContext(ctx, audit, customerID, pq.Array(erasure.OrderUIDs), erasure.Source, erasure.ErasedAt); err != nil {
+			return fmt.Errorf("error writing audit record: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.noteWrite(erasure.OrderUIDs...)
+	return erasure, nil
+}
+
+// eraseOrders anonymizes the history of the orders, clears the refund
+// transactions of their returns and deletes the raw messages they were
+// received in.
+func (c *Client) eraseOrders(ctx context.Context, tx *sqlx.Tx, orderUIDs []string) error {
+	uids := pq.Array(orderUIDs)
+	if _, err := tx.ExecContext(ctx, `DELETE FROM raw_messages WHERE order_uid = ANY($1)`, uids); err != nil {
+		return fmt.Errorf("error erasing customer data: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE returns SET refund_transaction = NULL WHERE order_uid = ANY($1)`, uids); err != nil {
+		return fmt.Errorf("error erasing customer data: %w", err)
+	}
+	var versions []historyRow
+	query := `SELECT ` + historyColumns + `, pii_key_id FROM order_history WHERE order_uid = ANY($1) FOR UPDATE`
+	if err := tx.SelectContext(ctx, &versions, query, uids); err != nil {
+		return fmt.Errorf("error fetching order history: %w", err)
+	}
+	return c.rewriteHistory(ctx, tx, versions, (*models.Order).Anonymize)
+}
+
+// mergeUIDs returns the sorted union of a and b.
+func mergeUIDs(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	merged := []string{}
+	for _, uid := range append(append([]string(nil), a...), b...) {
+		if !seen[uid] {
+			seen[uid] = true
+			merged = append(merged, uid)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+func (m *MemoryDB) CustomerOrders(ctx context.Context, customerID string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var matched []*memoryOrder
+	for _, stored := range m.orders {
+		if stored.order.CustomerID == customerID {
+			matched = append(matched, stored)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i].order, matched[j].order
+		if !a.DateCreated.Equal(b.DateCreated) {
+			return a.DateCreated.Before(b.DateCreated)
+		}
+		return a.OrderUID < b.OrderUID
+	})
+	return orderUIDs(matched, 0), nil
+}
+
+func (m *MemoryDB) EraseCustomer(ctx context.Context, customerID string) (*Erasure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	erasure := newErasure(ctx, customerID)
+	erased := make(map[string]bool)
+	for uid, stored := range m.orders {
+		if stored.order.CustomerID == customerID {
+			stored.order.Anonymize()
+			erased[uid] = true
+		}
+	}
+	// deleted orders are only left in the history
+	for uid, versions := range m.history {
+		for _, v := range versions {
+			if v.Order.CustomerID == customerID {
+				erased[uid] = true
+			}
+		}
+	}
+	for uid := range erased {
+		erasure.OrderUIDs = append(erasure.OrderUIDs, uid)
+	}
+	sort.Strings(erasure.OrderUIDs)
+	m.eraseOrders(erasure.OrderUIDs)
+	m.audit = append(m.audit, *erasure)
+	return erasure, nil
+}
+
+// eraseOrders anonymizes the history of the orders, clears the refund
+// transactions of their returns and deletes the raw messages they were
+// received in. m.mu must be held.
+func (m *MemoryDB) eraseOrders(orderUIDs []string) {
+	erased := make(map[string]bool, len(orderUIDs))
+	for _, uid := range orderUIDs {
+		erased[uid] = true
+		for _, v := range m.history[uid] {
+			v.Order.Anonymize()
+		}
+	}
+	for _, ret := range m.returns {
+		if erased[ret.OrderUID] {
+			ret.RefundTransaction = ""
+		}
+	}
+	m.deleteRawMessages(func(msg models.RawMessage) bool { return erased[msg.OrderUID] })
+}
+
+func (s *SQLiteDB) CustomerOrders(ctx context.Context, customerID string) ([]string, error) {
+	orderUIDs := []string{}
+	query := `
+	SELECT order_uid
+	FROM orders
+	WHERE json_extract(data, '$.customer_id') = $1
+	ORDER BY date_created, order_uid
+	`
+	if err := s.db.SelectContext(ctx, &orderUIDs, query, customerID); err != nil {
+		return nil, fmt.Errorf("error fetching customer orders: %w", err)
+	}
+	return orderUIDs, nil
+}
+
+func (s *SQLiteDB) EraseCustomer(ctx context.Context, customerID string) (*Erasure, error) {
+	erasure := newErasure(ctx, customerID)
+	err := s.withTx(ctx, func(tx *sqlx.Tx) error {
+		var stored []string
+		query := `SELECT order_uid FROM orders WHERE json_extract(data, '$.customer_id') = $1 ORDER BY order_uid`
+		if err := tx.SelectContext(ctx, &stored, query, customerID); err != nil {
+			return fmt.Errorf("error fetching customer orders: %w", err)
+		}
+		for _, uid := range stored {
+			order, err := s.selectOrder(ctx, tx, uid)
+			if err != nil {
+				return err
+			}
+			order.Anonymize()
+			data, err := json.Marshal(order)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE orders SET data = $2 WHERE order_uid = $1`, uid, data); err != nil {
+				return fmt.Errorf("error erasing customer data: %w", err)
+			}
+		}
+
+		// deleted orders are only left in the history
+		var deleted []string
+		query = `SELECT DISTINCT order_uid FROM order_history WHERE json_extract(snapshot, '$.customer_id') = $1`
+		if err := tx.SelectContext(ctx, &deleted, query, customerID); err != nil {
+			return fmt.Errorf("error fetching customer orders: %w", err)
+		}
+		erasure.OrderUIDs = mergeUIDs(stored, deleted)
+
+		for _, uid := range erasure.OrderUIDs {
+			if err := s.eraseOrder(ctx, tx, uid); err != nil {
+				return err
+			}
+		}
+
+		orderUIDs, err := json.Marshal(erasure.OrderUIDs)
+		if err != nil {
+			return err
+		}
+		audit := `INSERT INTO audit_log (action, subject, order_uids, source, created_at) VALUES ('erase', $1, $2, $3, $4)`
+		if _, err := tx.ExecContext(ctx, audit, customerID, string(orderUIDs), erasure.Source, erasure.ErasedAt); err != nil {
+			return fmt.Errorf("error writing audit record: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return erasure, nil
+}
+
+// eraseOrder anonymizes the history of the order, clears the refund
+// transactions of its returns and deletes the raw messages it was received
+// in.
+func (s *SQLiteDB) eraseOrder(ctx context.Context, tx *sqlx.Tx, orderUID string) error {
+	var versions []historyRow
+	query := `SELECT ` + historyColumns + ` FROM order_history WHERE order_uid = $1`
+	if err := tx.SelectContext(ctx, &versions, query, orderUID); err != nil {
+		return fmt.Errorf("error fetching order history: %w", err)
+	}
+	for _, row := range versions {
+		v, err := row.version()
+		if err != nil {
+			return err
+		}
+		v.Order.Anonymize()
+		snapshot, err := json.Marshal(v.Order)
+		if err != nil {
+			return err
+		}
+		update := `UPDATE order_history SET snapshot = $3 WHERE order_uid = $1 AND version = $2`
+		if _, err := tx.ExecContext(ctx, update, orderUID, row.Version, snapshot); err != nil {
+			return fmt.Errorf("error rewriting order history: %w", err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM raw_messages WHERE order_uid = $1`, orderUID); err != nil {
+		return fmt.Errorf("error erasing customer data: %w", err)
+	}
+	refunds := `UPDATE returns SET data = json_remove(data, '$.refund_transaction') WHERE order_uid = $1`
+	if _, err := tx.ExecContext(ctx, refunds, orderUID); err != nil {
+		return fmt.Errorf("error erasing customer data: %w", err)
+	}
+	return nil
+}
+
+func (b *BreakerClient) CustomerOrders(ctx context.Context, customerID string) ([]string, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	orderUIDs, err := b.db.CustomerOrders(ctx, customerID)
+	b.record(err)
+	return orderUIDs, err
+}
+
+func (b *BreakerClient) EraseCustomer(ctx context.Context, customerID string) (*Erasure, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	erasure, err := b.db.EraseCustomer(ctx, customerID)
+	b.record(err)
+	return erasure, err
+}
+
+func (c *CachedClient) CustomerOrders(ctx context.Context, customerID string) ([]string, error) {
+	return c.db.CustomerOrders(ctx, customerID)
+}
+
+// EraseCustomer erases the customer and evicts the anonymized orders here
+// and on other instances.
+func (c *CachedClient) EraseCustomer(ctx context.Context, customerID string) (*Erasure, error) {
+	erasure, err := c.db.EraseCustomer(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, uid := range erasure.OrderUIDs {
+		c.Evict(uid)
+		c.invalidate(ctx, uid)
+	}
+	return erasure, nil
+}
+
+// checkErased yields ErrOrderErased if an erasure anonymized the order.
+func (c *Client) checkErased(ctx context.Context, tx *sqlx.Tx, orderUID string) error {
+	var erased bool
+	query := `SELECT EXISTS (SELECT 1 FROM audit_log WHERE action = 'erase' AND order_uids @> ARRAY[$1]::TEXT[])`
+	if err := tx.GetContext(ctx, &erased, query, orderUID); err != nil {
+		return fmt.Errorf("error reading audit log: %w", err)
+	}
+	if erased {
+		return fmt.Errorf("error updating order %s: %w", orderUID, ErrOrderErased)
+	}
+	return nil
+}
+
+func (m *MemoryDB) erased(orderUID string) bool {
+	for _, erasure := range m.audit {
+		for _, uid := range erasure.OrderUIDs {
+			if uid == orderUID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *SQLiteDB) checkErased(ctx context.Context, tx *sqlx.Tx, orderUID string) error {
+	var erased bool
+	query := `
+	SELECT EXISTS (
+		SELECT 1 FROM audit_log, json_each(audit_log.order_uids)
+		WHERE audit_log.action = 'erase' AND json_each.value = $1
+	)
+	`
+	if err := tx.GetContext(ctx, &erased, query, orderUID); err != nil {
+		return fmt.Errorf("error reading audit log: %w", err)
+	}
+	if erased {
+		return fmt.Errorf("error updating order %s: %w", orderUID, ErrOrderErased)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"wbstorage/internal/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type historyRow struct {
+	models.OrderVersion
+	Snapshot []byte  `db:"snapshot"`
+	PIIKeyID *string `db:"pii_key_id"`
+}
+
+func (r historyRow) version() (models.OrderVersion, error) {
+	v := r.OrderVersion
+	v.Order = &models.Order{}
+	if err := json.Unmarshal(r.Snapshot, v.Order); err != nil {
+		return v, fmt.Errorf("error decoding order snapshot: %w", err)
+	}
+	return v, nil
+}
+
+// openVersion decodes a history row, decrypting the delivery of its snapshot.
+func (c *Client) openVersion(row historyRow) (models.OrderVersion, error) {
+	v, err := row.version()
+	if err != nil {
+		return v, err
+	}
+	return v, c.openDelivery(row.PIIKeyID, &v.Order.Delivery)
+}
+
+// recordHistory appends a version of order. It must run in the transaction
+// that changed the order, after the order row was written or locked, which
+// keeps version numbers gapless and in commit order.
+func (c *Client) recordHistory(ctx context.Context, tx *sqlx.Tx, operation string, order *models.Order) error {
+	snapshot, keyID, err := c.sealSnapshot(order)
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT INTO order_history (order_uid, version, operation, source, snapshot, pii_key_id, changed_at)
+	SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, NOW()
+	FROM order_history
+	WHERE order_uid = $1
+	`
+	if _, err := tx.ExecContext(ctx, query, order.OrderUID, operation, SourceFrom(ctx), snapshot, keyID); err != nil {
+		return fmt.Errorf("error recording order history: %w", err)
+	}
+	return nil
+}
+
+const historyColumns = `order_uid, version, operation, source, snapshot, changed_at`
+
+// OrderHistory returns every recorded version of the order, oldest first.
+func (c *Client) OrderHistory(ctx context.Context, orderUID string) ([]models.OrderVersion, error) {
+	query := `SELECT ` + historyColumns + `, pii_key_id FROM order_history WHERE order_uid = $1 ORDER BY version`
+	var rows []historyRow
+	if err := c.db.SelectContext(ctx, &rows, query, orderUID); err != nil {
+		return nil, fmt.Errorf("error fetching order history: %w", err)
+	}
+	return historyVersions(rows, c.openVersion)
+}
+
+// SelectOrderAsOf returns the order as it was at t. An order that did not
+// exist or was deleted at t yields sql.ErrNoRows.
+func (c *Client) SelectOrderAsOf(ctx context.Context, orderUID string, t time.Time) (*models.Order, error) {
+	query := `
+	SELECT ` + historyColumns + `, pii_key_id
+	FROM order_history
+	WHERE order_uid = $1 AND changed_at <= $2
+	ORDER BY version DESC
+	LIMIT 1
+	`
+	var row historyRow
+	if err := c.db.GetContext(ctx, &row, query, orderUID, t); err != nil {
+		return nil, fmt.Errorf("error fetching order history: %w", err)
+	}
+	return versionOrder(row, c.openVersion)
+}
+
+func historyVersions(rows []historyRow, decode func(historyRow) (models.OrderVersion, error)) ([]models.OrderVersion, error) {
+	versions := make([]models.OrderVersion, 0, len(rows))
+	for _, row := range rows {
+		v, err := decode(row)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+func versionOrder(row historyRow, decode func(historyRow) (models.OrderVersion, error)) (*models.Order, error) {
+	if row.Operation == models.OperationDelete {
+		return nil, fmt.Errorf("order was deleted at %s: %w", row.ChangedAt, sql.ErrNoRows)
+	}
+	v, err := decode(row)
+	if err != nil {
+		return nil, err
+	}
+	return v.Order, nil
+}
+
+// recordVersion appends a version to the in-memory history; m.mu must be held.
+func (m *MemoryDB) recordVersion(ctx context.Context, operation string, order *models.Order) {
+	versions := m.history[order.OrderUID]
+	m.history[order.OrderUID] = append(versions, models.OrderVersion{
+		OrderUID:  order.OrderUID,
+		Version:   len(versions) + 1,
+		Operation: operation,
+		Source:    SourceFrom(ctx),
+		ChangedAt: time.Now(),
+		Order:     order.Snapshot(),
+	})
+}
+
+func (m *MemoryDB) OrderHistory(ctx context.Context, orderUID string) ([]models.OrderVersion, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	versions := make([]models.OrderVersion, 0, len(m.history[orderUID]))
+	for _, v := range m.history[orderUID] {
+		v.Order = v.Order.Clone()
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+func (m *MemoryDB) SelectOrderAsOf(ctx context.Context, orderUID string, t time.Time) (*models.Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	versions := m.history[orderUID]
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if v.ChangedAt.After(t) {
+			continue
+		}
+		if v.Operation == models.OperationDelete {
+			return nil, fmt.Errorf("order was deleted at %s: %w", v.ChangedAt, sql.ErrNoRows)
+		}
+		return v.Order.Clone(), nil
+	}
+	return nil, fmt.Errorf("error fetching order history: %w", sql.ErrNoRows)
+}
+
+// recordVersion appends a version of order in the transaction that changed it.
+func (s *SQLiteDB) recordVersion(ctx context.Context, tx *sqlx.Tx, operation string, order *models.Order) error {
+	snapshot, err := json.Marshal(order.Snapshot())
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT INTO order_history (order_uid, version, operation, source, snapshot, changed_at)
+	SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5
+	FROM order_history
+	WHERE order_uid = $1
+	`
+	if _, err := tx.ExecContext(ctx, query, order.OrderUID, operation, SourceFrom(ctx), snapshot, time.Now().UTC()); err != nil {
+		return fmt.Errorf("error recording order history: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteDB) OrderHistory(ctx context.Context, orderUID string) ([]models.OrderVersion, error) {
+	query := `SELECT ` + historyColumns + ` FROM order_history WHERE order_uid = $1 ORDER BY version`
+	var rows []historyRow
+	if err := s.db.SelectContext(ctx, &rows, query, orderUID); err != nil {
+		return nil, fmt.Errorf("error fetching order history: %w", err)
+	}
+	return historyVersions(rows, historyRow.version)
+}
+
+func (s *SQLiteDB) SelectOrderAsOf(ctx context.Context, orderUID string, t time.Time) (*models.Order, error) {
+	query := `
+	SELECT ` + historyColumns + `
+	FROM order_history
+	WHERE order_uid = $1 AND changed_at <= $2
+	ORDER BY version DESC
+	LIMIT 1
+	`
+	var row historyRow
+	if err := s.db.GetContext(ctx, &row, query, orderUID, t.UTC()); err != nil {
+		return nil, fmt.Errorf("error fetching order history: %w", err)
+	}
+	return versionOrder(row, historyRow.version)
+}
+
+func (b *BreakerClient) OrderHistory(ctx context.Context, orderUID string) ([]models.OrderVersion, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	versions, err := b.db.OrderHistory(ctx, orderUID)
+	b.record(err)
+	return versions, err
+}
+
+func (b *BreakerClient) SelectOrderAsOf(ctx context.Context, orderUID string, t time.Time) (*models.Order, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	order, err := b.db.SelectOrderAsOf(ctx, orderUID, t)
+	b.record(err)
+	return order, err
+}
+
+func (c *CachedClient) OrderHistory(ctx context.Context, orderUID string) ([]models.OrderVersion, error) {
+	return c.db.OrderHistory(ctx, orderUID)
+}
+
+func (c *CachedClient) SelectOrderAsOf(ctx context.Context, orderUID string, t time.Time) (*models.Order, error) {
+	return c.db.SelectOrderAsOf(ctx, orderUID, t)
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"wbstorage/internal/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// OrderImporter is implemented by databases that can load many orders in
+// one transaction. ImportOrders inserts the orders that are not stored yet,
+// leaves existing ones untouched, and returns how many it inserted, so
+// loading the same orders again changes nothing.
+type OrderImporter interface {
+	ImportOrders(ctx context.Context, orders []models.Order) (int, error)
+}
+
+func (c *Client) ImportOrders(ctx context.Context, orders []models.Order) (int, error) {
+	uids := make([]string, len(orders))
+	for i, order := range orders {
+		uids[i] = order.OrderUID
+	}
+	c.noteWrite(uids...)
+
+	var inserted int
+	err := c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		inserted = 0
+		for _, order := range orders {
+			if err := lockOrderUID(ctx, tx, order.OrderUID); err != nil {
+				return err
+			}
+			var exists bool
+			if err := tx.GetContext(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM orders WHERE order_uid = $1)`, order.OrderUID); err != nil {
+				return fmt.Errorf("error importing order: %w", err)
+			}
+			if exists {
+				continue
+			}
+			if _, err := tx.NamedExecContext(ctx, insertOrderQuery, order); err != nil {
+				return fmt.Errorf("error importing order %s: %w", order.OrderUID, err)
+			}
+			if err := c.insertChildren(ctx, tx, order); err != nil {
+				return fmt.Errorf("error importing order %s: %w", order.OrderUID, err)
+			}
+			if err := c.recordHistory(ctx, tx, models.OperationInsert, &order); err != nil {
+				return err
+			}
+			inserted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+func (s *SQLiteDB) ImportOrders(ctx context.Context, orders []models.Order) (int, error) {
+	query := `
+	INSERT INTO orders (order_uid, date_created, last_interaction, data)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (order_uid) DO NOTHING
+	`
+	var inserted int
+	err := s.withTx(ctx, func(tx *sqlx.Tx) error {
+		inserted = 0
+		for _, order := range orders {
+			data, err := json.Marshal(order)
+			if err != nil {
+				return err
+			}
+			res, err := tx.ExecContext(ctx, query, order.OrderUID, order.DateCreated.UnixMicro(), time.Now().UnixMicro(), data)
+			if err != nil {
+				return fmt.Errorf("error importing order %s: %w", order.OrderUID, err)
+			}
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				continue
+			}
+			if err := s.recordVersion(ctx, tx, models.OperationInsert, &order); err != nil {
+				return err
+			}
+			inserted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+func (m *MemoryDB) ImportOrders(ctx context.Context, orders []models.Order) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inserted := 0
+	for _, order := range orders {
+		if _, ok := m.orders[order.OrderUID]; ok {
+			continue
+		}
+		stored := order.Clone()
+		stored.LastInteraction = time.Now()
+		m.orders[order.OrderUID] = &memoryOrder{order: stored}
+		m.recordVersion(ctx, models.OperationInsert, stored)
+		inserted++
+	}
+	return inserted, nil
+}
+
+// ImportOrders skips orders stored on any shard and imports the others on
+// their home shards, one transaction per shard.
+func (s *ShardedDB) ImportOrders(ctx context.Context, orders []models.Order) (int, error) {
+	batches := make([][]models.Order, len(s.shards))
+	for _, order := range orders {
+		home := s.home(&order)
+		copies, err := s.locate(ctx, order.OrderUID, home)
+		if err != nil {
+			return 0, err
+		}
+		if len(copies) > 0 {
+			continue
+		}
+		batches[home] = append(batches[home], order)
+	}
+
+	inserted := 0
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if importer, ok := s.shards[i].(OrderImporter); ok {
+			n, err := importer.ImportOrders(ctx, batch)
+			inserted += n
+			if err != nil {
+				return inserted, err
+			}
+			continue
+		}
+		for _, order := range batch {
+			err := s.shards[i].InsertOrder(ctx, order)
+			if errors.Is(err, ErrOrderExists) {
+				continue
+			}
+			if err != nil {
+				return inserted, err
+			}
+			inserted++
+		}
+	}
+	return inserted, nil
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+)
+
+// TryLock takes the session advisory lock name on a dedicated connection, so
+// that only one of the instances sharing the database runs a periodic job at
+// a time. ok is false when another session holds the lock. unlock releases
+// it and returns the connection to the pool.
+func (c *Client) TryLock(ctx context.Context, name string) (unlock func(), ok bool, err error) {
+	conn, err := c.db.Connx(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("error acquiring connection: %w", err)
+	}
+	// prefixed so job names don't share the keys of lockOrderUID
+	key := "job:" + name
+	if err := conn.GetContext(ctx, &ok, `SELECT pg_try_advisory_lock(hashtextextended($1, 0))`, key); err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("error taking lock %s: %w", name, err)
+	}
+	if !ok {
+		conn.Close()
+		return nil, false, nil
+	}
+	unlock = func() {
+		// the run's context may be done already
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtextextended($1, 0))`, key); err != nil {
+			slog.Error("Failed to release lock, dropping its connection", "lock", name, "error", err)
+			// a connection the pool discards ends its session and the lock
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+	return unlock, true, nil
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"wbstorage/internal/models"
+	"wbstorage/internal/pii"
+)
+
+// Contact selects orders by the delivery email and/or phone. Both are matched
+// exactly after normalization; when both are set an order must match both.
+type Contact struct {
+	Email string
+	Phone string
+}
+
+func (c Contact) normalized() Contact {
+	return Contact{Email: pii.NormalizeEmail(c.Email), Phone: pii.NormalizePhone(c.Phone)}
+}
+
+func (c Contact) matches(d models.Delivery) bool {
+	return (c.Email == "" || pii.NormalizeEmail(d.Email) == c.Email) &&
+		(c.Phone == "" || pii.NormalizePhone(d.Phone) == c.Phone)
+}
+
+// LookupOrders finds orders through the blind indexes of encrypted
+// deliveries, and by comparing the columns of deliveries still in plaintext.
+func (c *Client) LookupOrders(ctx context.Context, contact Contact) ([]string, error) {
+	contact = contact.normalized()
+	if contact.Email == "" && contact.Phone == "" {
+		return nil, nil
+	}
+	var emailHash, phoneHash []byte
+	if c.pii != nil {
+		emailHash = c.pii.BlindIndex("email", contact.Email)
+		phoneHash = c.pii.BlindIndex("phone", contact.Phone)
+	}
+	query := `
+	SELECT DISTINCT order_uid
+	FROM deliveries
+	WHERE ($1 = '' OR email_hash = $2 OR (pii_key_id IS NULL AND lower(trim(email)) = $1))
+		AND ($3 = '' OR phone_hash = $4 OR (pii_key_id IS NULL AND regexp_replace(phone, '\D', '', 'g') = $3))
+	ORDER BY order_uid
+	`
+	var orderUIDs []string
+	if err := c.db.SelectContext(ctx, &orderUIDs, query, contact.Email, emailHash, contact.Phone, phoneHash); err != nil {
+		return nil, fmt.Errorf("error looking up orders: %w", err)
+	}
+	return orderUIDs, nil
+}
+
+func (m *MemoryDB) LookupOrders(ctx context.Context, contact Contact) ([]string, error) {
+	contact = contact.normalized()
+	if contact.Email == "" && contact.Phone == "" {
+		return nil, nil
+	}
+	m.mu.RLock()
+	var orderUIDs []string
+	for uid, stored := range m.orders {
+		if contact.matches(stored.order.Delivery) {
+			orderUIDs = append(orderUIDs, uid)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Strings(orderUIDs)
+	return orderUIDs, nil
+}
+
+func (s *SQLiteDB) LookupOrders(ctx context.Context, contact Contact) ([]string, error) {
+	contact = contact.normalized()
+	if contact.Email == "" && contact.Phone == "" {
+		return nil, nil
+	}
+	var rows []struct {
+		OrderUID string `db:"order_uid"`
+		models.Delivery
+	}
+	query := `
+	SELECT order_uid,
+		COALESCE(json_extract(data, '$.delivery.email'), '') AS email,
+		COALESCE(json_extract(data, '$.delivery.phone'), '') AS phone
+	FROM orders
+	ORDER BY order_uid
+	`
+	if err := s.db.SelectContext(ctx, &rows, query); err != nil {
+		return nil, fmt.Errorf("error looking up orders: %w", err)
+	}
+	var orderUIDs []string
+	for _, row := range rows {
+		if contact.matches(row.Delivery) {
+			orderUIDs = append(orderUIDs, row.OrderUID)
+		}
+	}
+	return orderUIDs, nil
+}
+
+func (b *BreakerClient) LookupOrders(ctx context.Context, contact Contact) ([]string, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	orderUIDs, err := b.db.LookupOrders(ctx, contact)
+	b.record(err)
+	return orderUIDs, err
+}
+
+func (c *CachedClient) LookupOrders(ctx context.Context, contact Contact) ([]string, error) {
+	return c.db.LookupOrders(ctx, contact)
+}
@@ -0,0 +1,222 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"wbstorage/internal/models"
+)
+
+// ErrOrderExists is returned by InsertOrder for an order UID that is taken.
+var ErrOrderExists = errors.New("order already exists")
+
+type memoryOrder struct {
+	order       *models.Order
+	accessCount int64
+}
+
+// MemoryDB is a Database kept entirely in memory, for local development and
+// tests. It is safe for concurrent use; orders are cloned on the way in and
+// out, like in CachedClient.
+type MemoryDB struct {
+	mu      sync.RWMutex
+	orders  map[string]*memoryOrder
+	raw     []models.RawMessage
+	rawID   int64
+	history map[string][]models.OrderVersion
+	audit   []Erasure
+	returns map[string]*models.Return
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		orders:  make(map[string]*memoryOrder),
+		history: make(map[string][]models.OrderVersion),
+		returns: make(map[string]*models.Return),
+	}
+}
+
+func (m *MemoryDB) InsertOrder(ctx context.Context, order models.Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.orders[order.OrderUID]; ok {
+		return fmt.Errorf("error inserting order %s: %w", order.OrderUID, ErrOrderExists)
+	}
+	stored := order.Clone()
+	stored.LastInteraction = time.Now()
+	m.orders[order.OrderUID] = &memoryOrder{order: stored}
+	m.recordVersion(ctx, models.OperationInsert, stored)
+	return nil
+}
+
+func (m *MemoryDB) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored, ok := m.orders[orderUID]
+	if !ok {
+		return nil, fmt.Errorf("error fetching order: %w", sql.ErrNoRows)
+	}
+	return stored.order.Clone(), nil
+}
+
+func (m *MemoryDB) GetRecentOrders(ctx context.Context, n int) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	all := make([]*memoryOrder, 0, len(m.orders))
+	for _, stored := range m.orders {
+		all = append(all, stored)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].accessCount != all[j].accessCount {
+			return all[i].accessCount > all[j].accessCount
+		}
+		return all[i].order.LastInteraction.After(all[j].order.LastInteraction)
+	})
+	return orderUIDs(all, n), nil
+}
+
+func (m *MemoryDB) GetOrdersCreatedSince(ctx context.Context, since time.Time, n int) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var matched []*memoryOrder
+	for _, stored := range m.orders {
+		if !stored.order.DateCreated.Before(since) {
+			matched = append(matched, stored)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].order.DateCreated.After(matched[j].order.DateCreated)
+	})
+	return orderUIDs(matched, n), nil
+}
+
+func (m *MemoryDB) UpsertOrder(ctx context.Context, order models.Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := order.Clone()
+	stored.LastInteraction = time.Now()
+	if prev, ok := m.orders[order.OrderUID]; ok {
+		prev.order = stored
+		m.recordVersion(ctx, models.OperationUpdate, stored)
+		return nil
+	}
+	m.orders[order.OrderUID] = &memoryOrder{order: stored}
+	m.recordVersion(ctx, models.OperationInsert, stored)
+	return nil
+}
+
+func (m *MemoryDB) PatchOrder(ctx context.Context, orderUID string, patch []byte) (*models.Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.orders[orderUID]
+	if !ok {
+		return nil, fmt.Errorf("error fetching order: %w", sql.ErrNoRows)
+	}
+	order := stored.order.Clone()
+	if err := order.ApplyMergePatch(patch); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	if order.OrderUID != orderUID {
+		return nil, fmt.Errorf("%w: order_uid cannot be changed", ErrInvalidPatch)
+	}
+	order.SetOrderUID(orderUID)
+	stored.order = order
+	m.recordVersion(ctx, models.OperationUpdate, order)
+	return order.Clone(), nil
+}
+
+func (m *MemoryDB) AddPayment(ctx context.Context, orderUID string, p models.Payment) (*models.Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.orders[orderUID]
+	if !ok {
+		return nil, fmt.Errorf("error fetching order: %w", sql.ErrNoRows)
+	}
+	order := stored.order.Clone()
+	added, err := order.AddPayment(p)
+	if err != nil {
+		return nil, err
+	}
+	if added {
+		stored.order = order
+		m.recordVersion(ctx, models.OperationUpdate, order)
+	}
+	return order.Clone(), nil
+}
+
+func (m *MemoryDB) MergeOrder(ctx context.Context, update models.Order) (*models.Order, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.orders[update.OrderUID]
+	if !ok {
+		return nil, false, fmt.Errorf("error fetching order: %w", sql.ErrNoRows)
+	}
+	if m.erased(update.OrderUID) {
+		return nil, false, fmt.Errorf("error updating order %s: %w", update.OrderUID, ErrOrderErased)
+	}
+	order := stored.order.Clone()
+	merged, err := order.MergeRecords(&update)
+	if err != nil {
+		return nil, false, err
+	}
+	if merged {
+		stored.order = order
+		m.recordVersion(ctx, models.OperationUpdate, order)
+	}
+	return order.Clone(), merged, nil
+}
+
+func (m *MemoryDB) DeleteOrder(ctx context.Context, orderUID string) error {
+	return m.deleteOrder(ctx, orderUID, nil)
+}
+
+// deleteOrder deletes the order; with expected set only if the stored order
+// still equals it, see checkUnchanged.
+func (m *MemoryDB) deleteOrder(ctx context.Context, orderUID string, expected *models.Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.orders[orderUID]
+	if !ok {
+		return fmt.Errorf("error deleting order: %w", sql.ErrNoRows)
+	}
+	if expected != nil {
+		if err := checkUnchanged(expected, stored.order); err != nil {
+			return err
+		}
+	}
+	delete(m.orders, orderUID)
+	m.recordVersion(ctx, models.OperationDelete, stored.order)
+	return nil
+}
+
+func (m *MemoryDB) RecordAccesses(ctx context.Context, accesses map[string]Access) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uid, a := range accesses {
+		stored, ok := m.orders[uid]
+		if !ok {
+			continue
+		}
+		stored.accessCount += a.Hits
+		if a.AccessedAt.After(stored.order.LastInteraction) {
+			stored.order.LastInteraction = a.AccessedAt
+		}
+	}
+	return nil
+}
+
+func orderUIDs(orders []*memoryOrder, n int) []string {
+	if n > 0 && len(orders) > n {
+		orders = orders[:n]
+	}
+	uids := make([]string, len(orders))
+	for i, stored := range orders {
+		uids[i] = stored.order.OrderUID
+	}
+	return uids
+}
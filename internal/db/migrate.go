@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// Migrator applies the schema migrations embedded in the binary. Every
+// operation holds a Postgres advisory lock, so instances starting in
+// parallel apply each migration exactly once.
+type Migrator struct {
+	m    *migrate.Migrate
+	conn *sql.Conn
+}
+
+type MigrationInfo struct {
+	Version uint   `json:"version"`
+	Name    string `json:"name"`
+	Applied bool   `json:"applied"`
+}
+
+type MigrationStatus struct {
+	// Version is the last applied migration, zero if none was applied.
+	Version uint `json:"version"`
+	// Dirty is set when a migration failed halfway and needs manual repair.
+	Dirty      bool            `json:"dirty"`
+	Migrations []MigrationInfo `json:"migrations"`
+}
+
+// NewMigrator creates a migrator on a dedicated connection from the client's
+// pool; Close returns it.
+func (c *Client) NewMigrator(ctx context.Context) (*Migrator, error) {
+	src, err := iofs.New(migrationsFS, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error loading migrations: %w", err)
+	}
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error acquiring connection: %w", err)
+	}
+	// migrations may run far longer than PoolConfig.StatementTimeout
+	if _, err := conn.ExecContext(ctx, `SET statement_timeout = 0`); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error disabling statement timeout: %w", err)
+	}
+	driver, err := postgres.WithConnection(ctx, conn, &postgres.Config{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error creating migration driver: %w", err)
+	}
+	m, err := migrate.NewWithInstance("iofs", src, "postgres", driver)
+	if err != nil {
+		driver.Close()
+		return nil, fmt.Errorf("error creating migrator: %w", err)
+	}
+	m.Log = migrateLogger{}
+	return &Migrator{m: m, conn: conn}, nil
+}
+
+// Up applies all pending migrations.
+func (m *Migrator) Up() error {
+	if err := m.m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("error applying migrations: %w", err)
+	}
+	return nil
+}
+
+// Down reverts the last steps migrations.
+func (m *Migrator) Down(steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("invalid number of steps %d", steps)
+	}
+	if err := m.m.Steps(-steps); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("error reverting migrations: %w", err)
+	}
+	return nil
+}
+
+func (m *Migrator) Status() (MigrationStatus, error) {
+	var status MigrationStatus
+	version, dirty, err := m.m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return status, fmt.Errorf("error reading schema version: %w", err)
+	}
+	status.Version, status.Dirty = version, dirty
+
+	entries, err := fs.ReadDir(migrationsFS, "migrations")
+	if err != nil {
+		return status, err
+	}
+	for _, entry := range entries {
+		mig, err := source.DefaultParse(entry.Name())
+		if err != nil || mig.Direction != source.Up {
+			continue
+		}
+		status.Migrations = append(status.Migrations, MigrationInfo{
+			Version: mig.Version,
+			Name:    mig.Identifier,
+			Applied: mig.Version <= version && !(dirty && mig.Version == version),
+		})
+	}
+	sort.Slice(status.Migrations, func(i, j int) bool {
+		return status.Migrations[i].Version < status.Migrations[j].Version
+	})
+	return status, nil
+}
+
+func (m *Migrator) Close() error {
+	// the connection goes back to the pool, with the configured timeout
+	_, resetErr := m.conn.ExecContext(context.Background(), `RESET statement_timeout`)
+	srcErr, dbErr := m.m.Close()
+	return errors.Join(resetErr, srcErr, dbErr)
+}
+
+type migrateLogger struct{}
+
+func (migrateLogger) Printf(format string, v ...any) {
+	slog.Info(strings.TrimSpace(fmt.Sprintf(format, v...)), "component", "migrate")
+}
+
+func (migrateLogger) Verbose() bool {
+	return false
+}
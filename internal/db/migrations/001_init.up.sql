@@ -1,22 +1,3 @@
-DO $$
-BEGIN
-    IF NOT EXISTS (SELECT FROM pg_database WHERE datname = 'wbstore') THEN
-        CREATE DATABASE wbstore;
-    END IF;
-END
-$$;
-
-DO $$
-BEGIN
-    IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'felix') THEN
-        CREATE ROLE felix WITH LOGIN;
-    END IF;
-END
-$$;
-
-GRANT CREATE ON DATABASE wbstore TO felix;
-
-
 CREATE TABLE IF NOT EXISTS orders (
     order_uid VARCHAR PRIMARY KEY,
     track_number VARCHAR,
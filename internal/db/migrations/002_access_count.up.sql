@@ -0,0 +1 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS access_count BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,14 @@
+ALTER TABLE deliveries
+    DROP CONSTRAINT IF EXISTS deliveries_order_uid_fkey,
+    ADD CONSTRAINT deliveries_order_uid_fkey
+        FOREIGN KEY (order_uid) REFERENCES orders(order_uid) ON DELETE CASCADE;
+
+ALTER TABLE payments
+    DROP CONSTRAINT IF EXISTS payments_order_uid_fkey,
+    ADD CONSTRAINT payments_order_uid_fkey
+        FOREIGN KEY (order_uid) REFERENCES orders(order_uid) ON DELETE CASCADE;
+
+ALTER TABLE items
+    DROP CONSTRAINT IF EXISTS items_order_uid_fkey,
+    ADD CONSTRAINT items_order_uid_fkey
+        FOREIGN KEY (order_uid) REFERENCES orders(order_uid) ON DELETE CASCADE;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS orders_date_created_idx;
+DROP INDEX IF EXISTS orders_access_idx;
+DROP INDEX IF EXISTS orders_last_interaction_idx;
+
+DROP INDEX IF EXISTS items_order_uid_idx;
+DROP INDEX IF EXISTS payments_order_uid_idx;
+DROP INDEX IF EXISTS deliveries_order_uid_idx;
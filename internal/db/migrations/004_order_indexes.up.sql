@@ -0,0 +1,7 @@
+CREATE INDEX IF NOT EXISTS deliveries_order_uid_idx ON deliveries (order_uid);
+CREATE INDEX IF NOT EXISTS payments_order_uid_idx ON payments (order_uid);
+CREATE INDEX IF NOT EXISTS items_order_uid_idx ON items (order_uid);
+
+CREATE INDEX IF NOT EXISTS orders_last_interaction_idx ON orders (last_interaction DESC);
+CREATE INDEX IF NOT EXISTS orders_access_idx ON orders (access_count DESC, last_interaction DESC NULLS LAST);
+CREATE INDEX IF NOT EXISTS orders_date_created_idx ON orders (date_created DESC);
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS deliveries_order_search ON deliveries;
+DROP TRIGGER IF EXISTS items_order_search ON items;
+DROP FUNCTION IF EXISTS order_search_trigger();
+DROP FUNCTION IF EXISTS refresh_order_search(VARCHAR);
+DROP TABLE IF EXISTS order_search;
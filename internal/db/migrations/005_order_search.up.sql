@@ -0,0 +1,47 @@
+-- One search document per order, built from its items and deliveries and
+-- kept current by triggers on those tables.
+CREATE TABLE IF NOT EXISTS order_search (
+    order_uid VARCHAR PRIMARY KEY REFERENCES orders(order_uid) ON DELETE CASCADE,
+    document TEXT NOT NULL,
+    tsv TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', document)) STORED
+);
+
+CREATE INDEX IF NOT EXISTS order_search_tsv_idx ON order_search USING GIN (tsv);
+
+CREATE OR REPLACE FUNCTION refresh_order_search(uid VARCHAR) RETURNS VOID AS $$
+BEGIN
+    INSERT INTO order_search (order_uid, document)
+    SELECT o.order_uid, concat_ws(' ',
+        (SELECT string_agg(concat_ws(' ', i.name, i.brand), ' ' ORDER BY i.id)
+         FROM items i WHERE i.order_uid = o.order_uid),
+        (SELECT string_agg(concat_ws(' ', d.name, d.city, d.address), ' ' ORDER BY d.id)
+         FROM deliveries d WHERE d.order_uid = o.order_uid))
+    FROM orders o
+    WHERE o.order_uid = uid
+    ON CONFLICT (order_uid) DO UPDATE SET document = EXCLUDED.document;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION order_search_trigger() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        PERFORM refresh_order_search(OLD.order_uid);
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND (TG_OP = 'INSERT' OR NEW.order_uid IS DISTINCT FROM OLD.order_uid) THEN
+        PERFORM refresh_order_search(NEW.order_uid);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS items_order_search ON items;
+CREATE TRIGGER items_order_search
+    AFTER INSERT OR UPDATE OR DELETE ON items
+    FOR EACH ROW EXECUTE FUNCTION order_search_trigger();
+
+DROP TRIGGER IF EXISTS deliveries_order_search ON deliveries;
+CREATE TRIGGER deliveries_order_search
+    AFTER INSERT OR UPDATE OR DELETE ON deliveries
+    FOR EACH ROW EXECUTE FUNCTION order_search_trigger();
+
+SELECT refresh_order_search(order_uid) FROM orders;
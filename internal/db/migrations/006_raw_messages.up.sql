@@ -0,0 +1,17 @@
+-- Raw messages are not tied to orders by a foreign key: undecodable messages
+-- have no order, and the archive outlives deleted orders.
+CREATE TABLE IF NOT EXISTS raw_messages (
+    id BIGSERIAL PRIMARY KEY,
+    order_uid VARCHAR,
+    subject VARCHAR NOT NULL,
+    stream VARCHAR NOT NULL,
+    stream_seq BIGINT NOT NULL,
+    headers JSONB,
+    payload BYTEA NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL,
+    decoder_version VARCHAR NOT NULL,
+    parse_error TEXT NOT NULL DEFAULT '',
+    UNIQUE (stream, stream_seq)
+);
+
+CREATE INDEX IF NOT EXISTS raw_messages_order_uid_idx ON raw_messages (order_uid);
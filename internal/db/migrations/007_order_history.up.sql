@@ -0,0 +1,12 @@
+-- Full snapshots of every change; kept after the order itself is deleted.
+CREATE TABLE IF NOT EXISTS order_history (
+    order_uid VARCHAR NOT NULL,
+    version INT NOT NULL,
+    operation VARCHAR NOT NULL,
+    source VARCHAR NOT NULL,
+    snapshot JSONB NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (order_uid, version)
+);
+
+CREATE INDEX IF NOT EXISTS order_history_changed_at_idx ON order_history (order_uid, changed_at);
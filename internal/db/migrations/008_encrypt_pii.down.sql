@@ -0,0 +1,26 @@
+-- Encrypted values are not decrypted by this migration; without pii_key_id
+-- they would be read as plaintext, so only migrate down an unencrypted table.
+
+CREATE OR REPLACE FUNCTION refresh_order_search(uid VARCHAR) RETURNS VOID AS $$
+BEGIN
+    INSERT INTO order_search (order_uid, document)
+    SELECT o.order_uid, concat_ws(' ',
+        (SELECT string_agg(concat_ws(' ', i.name, i.brand), ' ' ORDER BY i.id)
+         FROM items i WHERE i.order_uid = o.order_uid),
+        (SELECT string_agg(concat_ws(' ', d.name, d.city, d.address), ' ' ORDER BY d.id)
+         FROM deliveries d WHERE d.order_uid = o.order_uid))
+    FROM orders o
+    WHERE o.order_uid = uid
+    ON CONFLICT (order_uid) DO UPDATE SET document = EXCLUDED.document;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE order_history DROP COLUMN IF EXISTS pii_key_id;
+
+DROP INDEX IF EXISTS deliveries_pii_key_id_idx;
+DROP INDEX IF EXISTS deliveries_phone_hash_idx;
+DROP INDEX IF EXISTS deliveries_email_hash_idx;
+
+ALTER TABLE deliveries DROP COLUMN IF EXISTS phone_hash;
+ALTER TABLE deliveries DROP COLUMN IF EXISTS email_hash;
+ALTER TABLE deliveries DROP COLUMN IF EXISTS pii_key_id;
@@ -0,0 +1,29 @@
+-- pii_key_id names the key the PII columns were encrypted with; NULL means
+-- they are plaintext. The hashes are blind indexes for exact lookups.
+ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS pii_key_id VARCHAR;
+ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS email_hash BYTEA;
+ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS phone_hash BYTEA;
+
+CREATE INDEX IF NOT EXISTS deliveries_email_hash_idx ON deliveries (email_hash);
+CREATE INDEX IF NOT EXISTS deliveries_phone_hash_idx ON deliveries (phone_hash);
+CREATE INDEX IF NOT EXISTS deliveries_pii_key_id_idx ON deliveries (pii_key_id);
+
+-- History snapshots carry the delivery too and are encrypted the same way.
+ALTER TABLE order_history ADD COLUMN IF NOT EXISTS pii_key_id VARCHAR;
+
+-- Encrypted names and addresses are left out of the search document.
+CREATE OR REPLACE FUNCTION refresh_order_search(uid VARCHAR) RETURNS VOID AS $$
+BEGIN
+    INSERT INTO order_search (order_uid, document)
+    SELECT o.order_uid, concat_ws(' ',
+        (SELECT string_agg(concat_ws(' ', i.name, i.brand), ' ' ORDER BY i.id)
+         FROM items i WHERE i.order_uid = o.order_uid),
+        (SELECT string_agg(CASE WHEN d.pii_key_id IS NULL
+                                THEN concat_ws(' ', d.name, d.city, d.address)
+                                ELSE d.city END, ' ' ORDER BY d.id)
+         FROM deliveries d WHERE d.order_uid = o.order_uid))
+    FROM orders o
+    WHERE o.order_uid = uid
+    ON CONFLICT (order_uid) DO UPDATE SET document = EXCLUDED.document;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS audit_log;
+DROP INDEX IF EXISTS orders_customer_id_idx;
@@ -0,0 +1,12 @@
+CREATE INDEX IF NOT EXISTS orders_customer_id_idx ON orders (customer_id);
+
+-- Record of privacy operations, kept independently of the orders they
+-- touched. subject is what the operation was requested for.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    action VARCHAR NOT NULL,
+    subject VARCHAR NOT NULL,
+    order_uids TEXT[] NOT NULL,
+    source VARCHAR NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,141 @@
+-- Converts the partitioned tables back to plain tables. Partitions detached
+-- by the partition manager are not included.
+
+DROP TRIGGER IF EXISTS orders_order_search ON orders;
+DROP FUNCTION IF EXISTS order_search_delete_trigger();
+DROP FUNCTION IF EXISTS detach_order_partition(DATE);
+DROP FUNCTION IF EXISTS ensure_order_partition(DATE);
+
+ALTER TABLE items RENAME TO items_partitioned;
+ALTER TABLE payments RENAME TO payments_partitioned;
+ALTER TABLE deliveries RENAME TO deliveries_partitioned;
+ALTER TABLE orders RENAME TO orders_partitioned;
+ALTER SEQUENCE items_id_seq RENAME TO items_partitioned_id_seq;
+ALTER SEQUENCE payments_id_seq RENAME TO payments_partitioned_id_seq;
+ALTER SEQUENCE deliveries_id_seq RENAME TO deliveries_partitioned_id_seq;
+ALTER INDEX items_pkey RENAME TO items_partitioned_pkey;
+ALTER INDEX payments_pkey RENAME TO payments_partitioned_pkey;
+ALTER INDEX deliveries_pkey RENAME TO deliveries_partitioned_pkey;
+ALTER INDEX orders_pkey RENAME TO orders_partitioned_pkey;
+ALTER INDEX orders_last_interaction_idx RENAME TO orders_partitioned_last_interaction_idx;
+ALTER INDEX orders_access_idx RENAME TO orders_partitioned_access_idx;
+ALTER INDEX orders_date_created_idx RENAME TO orders_partitioned_date_created_idx;
+ALTER INDEX orders_customer_id_idx RENAME TO orders_partitioned_customer_id_idx;
+ALTER INDEX deliveries_order_uid_idx RENAME TO deliveries_partitioned_order_uid_idx;
+ALTER INDEX deliveries_email_hash_idx RENAME TO deliveries_partitioned_email_hash_idx;
+ALTER INDEX deliveries_phone_hash_idx RENAME TO deliveries_partitioned_phone_hash_idx;
+ALTER INDEX deliveries_pii_key_id_idx RENAME TO deliveries_partitioned_pii_key_id_idx;
+ALTER INDEX payments_order_uid_idx RENAME TO payments_partitioned_order_uid_idx;
+ALTER INDEX items_order_uid_idx RENAME TO items_partitioned_order_uid_idx;
+
+CREATE TABLE orders (
+    order_uid VARCHAR PRIMARY KEY,
+    track_number VARCHAR,
+    entry VARCHAR,
+    locale VARCHAR,
+    internal_signature VARCHAR,
+    customer_id VARCHAR,
+    delivery_service VARCHAR,
+    shardkey VARCHAR,
+    sm_id INT,
+    date_created TIMESTAMP,
+    oof_shard VARCHAR,
+    last_interaction TIMESTAMP,
+    access_count BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE deliveries (
+    id SERIAL PRIMARY KEY,
+    order_uid VARCHAR REFERENCES orders(order_uid) ON DELETE CASCADE,
+    name VARCHAR,
+    phone VARCHAR,
+    zip VARCHAR,
+    city VARCHAR,
+    address VARCHAR,
+    region VARCHAR,
+    email VARCHAR,
+    pii_key_id VARCHAR,
+    email_hash BYTEA,
+    phone_hash BYTEA
+);
+
+CREATE TABLE payments (
+    id SERIAL PRIMARY KEY,
+    order_uid VARCHAR REFERENCES orders(order_uid) ON DELETE CASCADE,
+    transaction VARCHAR,
+    request_id VARCHAR,
+    currency VARCHAR,
+    provider VARCHAR,
+    amount INT,
+    payment_dt TIMESTAMP,
+    bank VARCHAR,
+    delivery_cost INT,
+    goods_total INT,
+    custom_fee INT
+);
+
+CREATE TABLE items (
+    id SERIAL PRIMARY KEY,
+    order_uid VARCHAR REFERENCES orders(order_uid) ON DELETE CASCADE,
+    chrt_id INT,
+    track_number VARCHAR,
+    price INT,
+    rid VARCHAR,
+    name VARCHAR,
+    sale INT,
+    size VARCHAR,
+    total_price INT,
+    nm_id INT,
+    brand VARCHAR,
+    status INT
+);
+
+INSERT INTO orders
+SELECT order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service,
+    shardkey, sm_id, date_created, oof_shard, last_interaction, access_count
+FROM orders_partitioned;
+
+INSERT INTO deliveries
+SELECT id, order_uid, name, phone, zip, city, address, region, email, pii_key_id, email_hash, phone_hash
+FROM deliveries_partitioned;
+
+INSERT INTO payments
+SELECT id, order_uid, transaction, request_id, currency, provider, amount, payment_dt, bank,
+    delivery_cost, goods_total, custom_fee
+FROM payments_partitioned;
+
+INSERT INTO items
+SELECT id, order_uid, chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status
+FROM items_partitioned;
+
+SELECT setval('deliveries_id_seq', COALESCE((SELECT MAX(id) FROM deliveries), 0) + 1, false);
+SELECT setval('payments_id_seq', COALESCE((SELECT MAX(id) FROM payments), 0) + 1, false);
+SELECT setval('items_id_seq', COALESCE((SELECT MAX(id) FROM items), 0) + 1, false);
+
+DROP TABLE items_partitioned;
+DROP TABLE payments_partitioned;
+DROP TABLE deliveries_partitioned;
+DROP TABLE orders_partitioned;
+
+CREATE INDEX orders_last_interaction_idx ON orders (last_interaction DESC);
+CREATE INDEX orders_access_idx ON orders (access_count DESC, last_interaction DESC NULLS LAST);
+CREATE INDEX orders_date_created_idx ON orders (date_created DESC);
+CREATE INDEX orders_customer_id_idx ON orders (customer_id);
+CREATE INDEX deliveries_order_uid_idx ON deliveries (order_uid);
+CREATE INDEX deliveries_email_hash_idx ON deliveries (email_hash);
+CREATE INDEX deliveries_phone_hash_idx ON deliveries (phone_hash);
+CREATE INDEX deliveries_pii_key_id_idx ON deliveries (pii_key_id);
+CREATE INDEX payments_order_uid_idx ON payments (order_uid);
+CREATE INDEX items_order_uid_idx ON items (order_uid);
+
+CREATE TRIGGER items_order_search
+    AFTER INSERT OR UPDATE OR DELETE ON items
+    FOR EACH ROW EXECUTE FUNCTION order_search_trigger();
+
+CREATE TRIGGER deliveries_order_search
+    AFTER INSERT OR UPDATE OR DELETE ON deliveries
+    FOR EACH ROW EXECUTE FUNCTION order_search_trigger();
+
+DELETE FROM order_search s WHERE NOT EXISTS (SELECT 1 FROM orders o WHERE o.order_uid = s.order_uid);
+ALTER TABLE order_search ADD CONSTRAINT order_search_order_uid_fkey
+    FOREIGN KEY (order_uid) REFERENCES orders(order_uid) ON DELETE CASCADE;
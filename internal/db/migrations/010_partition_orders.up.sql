@@ -0,0 +1,216 @@
+-- Converts orders and its child tables to tables range-partitioned by month
+-- of date_created. The children carry date_created as well, so each order
+-- and its delivery, payment and items live in partitions for the same month.
+--
+-- Unique keys of a partitioned table must include the partition key, so
+-- order_uid alone is no longer enforced unique by Postgres; db.Client takes
+-- an advisory lock on the UID for every write instead.
+
+ALTER TABLE order_search DROP CONSTRAINT IF EXISTS order_search_order_uid_fkey;
+DROP TRIGGER IF EXISTS deliveries_order_search ON deliveries;
+DROP TRIGGER IF EXISTS items_order_search ON items;
+
+ALTER TABLE items RENAME TO items_unpartitioned;
+ALTER TABLE payments RENAME TO payments_unpartitioned;
+ALTER TABLE deliveries RENAME TO deliveries_unpartitioned;
+ALTER TABLE orders RENAME TO orders_unpartitioned;
+ALTER SEQUENCE IF EXISTS items_id_seq RENAME TO items_unpartitioned_id_seq;
+ALTER SEQUENCE IF EXISTS payments_id_seq RENAME TO payments_unpartitioned_id_seq;
+ALTER SEQUENCE IF EXISTS deliveries_id_seq RENAME TO deliveries_unpartitioned_id_seq;
+ALTER TABLE items_unpartitioned RENAME CONSTRAINT items_pkey TO items_unpartitioned_pkey;
+ALTER TABLE payments_unpartitioned RENAME CONSTRAINT payments_pkey TO payments_unpartitioned_pkey;
+ALTER TABLE deliveries_unpartitioned RENAME CONSTRAINT deliveries_pkey TO deliveries_unpartitioned_pkey;
+ALTER TABLE orders_unpartitioned RENAME CONSTRAINT orders_pkey TO orders_unpartitioned_pkey;
+
+CREATE TABLE orders (
+    order_uid VARCHAR NOT NULL,
+    track_number VARCHAR,
+    entry VARCHAR,
+    locale VARCHAR,
+    internal_signature VARCHAR,
+    customer_id VARCHAR,
+    delivery_service VARCHAR,
+    shardkey VARCHAR,
+    sm_id INT,
+    date_created TIMESTAMP NOT NULL,
+    oof_shard VARCHAR,
+    last_interaction TIMESTAMP,
+    access_count BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (order_uid, date_created)
+) PARTITION BY RANGE (date_created);
+
+CREATE TABLE deliveries (
+    id SERIAL,
+    order_uid VARCHAR NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    name VARCHAR,
+    phone VARCHAR,
+    zip VARCHAR,
+    city VARCHAR,
+    address VARCHAR,
+    region VARCHAR,
+    email VARCHAR,
+    pii_key_id VARCHAR,
+    email_hash BYTEA,
+    phone_hash BYTEA,
+    PRIMARY KEY (id, date_created),
+    CONSTRAINT deliveries_order_fkey FOREIGN KEY (order_uid, date_created)
+        REFERENCES orders (order_uid, date_created) ON DELETE CASCADE
+) PARTITION BY RANGE (date_created);
+
+CREATE TABLE payments (
+    id SERIAL,
+    order_uid VARCHAR NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    transaction VARCHAR,
+    request_id VARCHAR,
+    currency VARCHAR,
+    provider VARCHAR,
+    amount INT,
+    payment_dt TIMESTAMP,
+    bank VARCHAR,
+    delivery_cost INT,
+    goods_total INT,
+    custom_fee INT,
+    PRIMARY KEY (id, date_created),
+    CONSTRAINT payments_order_fkey FOREIGN KEY (order_uid, date_created)
+        REFERENCES orders (order_uid, date_created) ON DELETE CASCADE
+) PARTITION BY RANGE (date_created);
+
+CREATE TABLE items (
+    id SERIAL,
+    order_uid VARCHAR NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    chrt_id INT,
+    track_number VARCHAR,
+    price INT,
+    rid VARCHAR,
+    name VARCHAR,
+    sale INT,
+    size VARCHAR,
+    total_price INT,
+    nm_id INT,
+    brand VARCHAR,
+    status INT,
+    PRIMARY KEY (id, date_created),
+    CONSTRAINT items_order_fkey FOREIGN KEY (order_uid, date_created)
+        REFERENCES orders (order_uid, date_created) ON DELETE CASCADE
+) PARTITION BY RANGE (date_created);
+
+-- Rows outside every monthly partition, e.g. with a zero date_created.
+CREATE TABLE orders_default PARTITION OF orders DEFAULT;
+CREATE TABLE deliveries_default PARTITION OF deliveries DEFAULT;
+CREATE TABLE payments_default PARTITION OF payments DEFAULT;
+CREATE TABLE items_default PARTITION OF items DEFAULT;
+
+-- ensure_order_partition creates the partitions of all four tables for the
+-- month containing the given date, if they do not exist yet.
+CREATE OR REPLACE FUNCTION ensure_order_partition(month DATE) RETURNS VOID AS $$
+DECLARE
+    lower_bound DATE := date_trunc('month', month);
+    upper_bound DATE := date_trunc('month', month) + INTERVAL '1 month';
+    parent TEXT;
+BEGIN
+    FOREACH parent IN ARRAY ARRAY['orders', 'deliveries', 'payments', 'items'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+            parent || to_char(lower_bound, '"_p"YYYY_MM'), parent, lower_bound, upper_bound);
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+
+-- detach_order_partition detaches the partitions for the month containing the
+-- given date, children first, and returns whether there was one. Detached
+-- tables are kept, without their foreign keys, for archiving or dropping.
+CREATE OR REPLACE FUNCTION detach_order_partition(month DATE) RETURNS BOOLEAN AS $$
+DECLARE
+    suffix TEXT := to_char(date_trunc('month', month), '"_p"YYYY_MM');
+    parent TEXT;
+    detached BOOLEAN := false;
+BEGIN
+    FOREACH parent IN ARRAY ARRAY['items', 'payments', 'deliveries', 'orders'] LOOP
+        IF EXISTS (SELECT 1 FROM pg_inherits
+                   WHERE inhrelid = to_regclass(parent || suffix) AND inhparent = parent::regclass) THEN
+            EXECUTE format('ALTER TABLE %I DETACH PARTITION %I', parent, parent || suffix);
+            IF parent <> 'orders' THEN
+                EXECUTE format('ALTER TABLE %I DROP CONSTRAINT IF EXISTS %I', parent || suffix, parent || '_order_fkey');
+            END IF;
+            detached := true;
+        END IF;
+    END LOOP;
+    IF detached THEN
+        EXECUTE format('DELETE FROM order_search WHERE order_uid IN (SELECT order_uid FROM %I)', 'orders' || suffix);
+    END IF;
+    RETURN detached;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Monthly partitions for the existing data since 2000 and the next three
+-- months; older rows end up in the default partitions.
+SELECT ensure_order_partition(month::DATE)
+FROM generate_series(
+    date_trunc('month', GREATEST(
+        COALESCE((SELECT MIN(date_created) FROM orders_unpartitioned WHERE date_created >= '2000-01-01'), NOW()),
+        '2000-01-01')),
+    date_trunc('month', NOW()) + INTERVAL '3 months',
+    INTERVAL '1 month') AS month;
+
+INSERT INTO orders
+SELECT order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service,
+    shardkey, sm_id, COALESCE(date_created, '0001-01-01'), oof_shard, last_interaction, access_count
+FROM orders_unpartitioned;
+
+INSERT INTO deliveries
+SELECT d.id, d.order_uid, o.date_created, d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
+    d.pii_key_id, d.email_hash, d.phone_hash
+FROM deliveries_unpartitioned d JOIN orders o ON o.order_uid = d.order_uid;
+
+INSERT INTO payments
+SELECT p.id, p.order_uid, o.date_created, p.transaction, p.request_id, p.currency, p.provider, p.amount,
+    p.payment_dt, p.bank, p.delivery_cost, p.goods_total, p.custom_fee
+FROM payments_unpartitioned p JOIN orders o ON o.order_uid = p.order_uid;
+
+INSERT INTO items
+SELECT i.id, i.order_uid, o.date_created, i.chrt_id, i.track_number, i.price, i.rid, i.name, i.sale,
+    i.size, i.total_price, i.nm_id, i.brand, i.status
+FROM items_unpartitioned i JOIN orders o ON o.order_uid = i.order_uid;
+
+SELECT setval('deliveries_id_seq', COALESCE((SELECT MAX(id) FROM deliveries), 0) + 1, false);
+SELECT setval('payments_id_seq', COALESCE((SELECT MAX(id) FROM payments), 0) + 1, false);
+SELECT setval('items_id_seq', COALESCE((SELECT MAX(id) FROM items), 0) + 1, false);
+
+DROP TABLE items_unpartitioned;
+DROP TABLE payments_unpartitioned;
+DROP TABLE deliveries_unpartitioned;
+DROP TABLE orders_unpartitioned;
+
+CREATE INDEX orders_last_interaction_idx ON orders (last_interaction DESC);
+CREATE INDEX orders_access_idx ON orders (access_count DESC, last_interaction DESC NULLS LAST);
+CREATE INDEX orders_date_created_idx ON orders (date_created DESC);
+CREATE INDEX orders_customer_id_idx ON orders (customer_id);
+CREATE INDEX deliveries_order_uid_idx ON deliveries (order_uid, date_created);
+CREATE INDEX deliveries_email_hash_idx ON deliveries (email_hash);
+CREATE INDEX deliveries_phone_hash_idx ON deliveries (phone_hash);
+CREATE INDEX deliveries_pii_key_id_idx ON deliveries (pii_key_id);
+CREATE INDEX payments_order_uid_idx ON payments (order_uid, date_created);
+CREATE INDEX items_order_uid_idx ON items (order_uid, date_created);
+
+CREATE TRIGGER items_order_search
+    AFTER INSERT OR UPDATE OR DELETE ON items
+    FOR EACH ROW EXECUTE FUNCTION order_search_trigger();
+
+CREATE TRIGGER deliveries_order_search
+    AFTER INSERT OR UPDATE OR DELETE ON deliveries
+    FOR EACH ROW EXECUTE FUNCTION order_search_trigger();
+
+-- order_search can no longer reference orders by order_uid alone, so its
+-- rows are removed by trigger instead of by the cascading foreign key.
+CREATE OR REPLACE FUNCTION order_search_delete_trigger() RETURNS TRIGGER AS $$
+BEGIN
+    DELETE FROM order_search WHERE order_uid = OLD.order_uid;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER orders_order_search
+    AFTER DELETE ON orders
+    FOR EACH ROW EXECUTE FUNCTION order_search_delete_trigger();
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS items_notify ON items;
+DROP TRIGGER IF EXISTS payments_notify ON payments;
+DROP TRIGGER IF EXISTS deliveries_notify ON deliveries;
+DROP TRIGGER IF EXISTS orders_notify ON orders;
+DROP FUNCTION IF EXISTS notify_order_change();
@@ -0,0 +1,42 @@
+-- Sends the order UID on the order_changed channel whenever an order or one
+-- of its details changes, including changes made by hand in SQL, so caches
+-- can drop their copy. Postgres sends a payload once per transaction, however
+-- many rows of the order were touched.
+
+CREATE OR REPLACE FUNCTION notify_order_change() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('order_changed', OLD.order_uid);
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'UPDATE' THEN
+        -- orders passes 'ignore_access': the flushed access counters are
+        -- not part of the order that caches hold
+        IF TG_NARGS > 0 AND TG_ARGV[0] = 'ignore_access' AND
+            to_jsonb(OLD) - 'access_count' - 'last_interaction' = to_jsonb(NEW) - 'access_count' - 'last_interaction' THEN
+            RETURN NULL;
+        END IF;
+        IF OLD.order_uid IS DISTINCT FROM NEW.order_uid THEN
+            PERFORM pg_notify('order_changed', OLD.order_uid);
+        END IF;
+    END IF;
+    PERFORM pg_notify('order_changed', NEW.order_uid);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER orders_notify
+    AFTER INSERT OR UPDATE OR DELETE ON orders
+    FOR EACH ROW EXECUTE FUNCTION notify_order_change('ignore_access');
+
+CREATE TRIGGER deliveries_notify
+    AFTER INSERT OR UPDATE OR DELETE ON deliveries
+    FOR EACH ROW EXECUTE FUNCTION notify_order_change();
+
+CREATE TRIGGER payments_notify
+    AFTER INSERT OR UPDATE OR DELETE ON payments
+    FOR EACH ROW EXECUTE FUNCTION notify_order_change();
+
+CREATE TRIGGER items_notify
+    AFTER INSERT OR UPDATE OR DELETE ON items
+    FOR EACH ROW EXECUTE FUNCTION notify_order_change();
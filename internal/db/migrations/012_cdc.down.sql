@@ -0,0 +1,31 @@
+-- The replication slot, if the CDC reader created one, is not dropped here:
+-- SELECT pg_drop_replication_slot('orders_cdc');
+
+CREATE OR REPLACE FUNCTION ensure_order_partition(month DATE) RETURNS VOID AS $$
+DECLARE
+    lower_bound DATE := date_trunc('month', month);
+    upper_bound DATE := date_trunc('month', month) + INTERVAL '1 month';
+    parent TEXT;
+BEGIN
+    FOREACH parent IN ARRAY ARRAY['orders', 'deliveries', 'payments', 'items'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+            parent || to_char(lower_bound, '"_p"YYYY_MM'), parent, lower_bound, upper_bound);
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+
+DO $$
+DECLARE
+    part REGCLASS;
+BEGIN
+    FOR part IN
+        SELECT inhrelid::regclass FROM pg_inherits
+        WHERE inhparent IN ('deliveries'::regclass, 'payments'::regclass, 'items'::regclass)
+    LOOP
+        EXECUTE format('ALTER TABLE %s REPLICA IDENTITY DEFAULT', part);
+    END LOOP;
+END;
+$$;
+
+DROP TABLE IF EXISTS cdc_positions;
+DROP PUBLICATION IF EXISTS orders_cdc;
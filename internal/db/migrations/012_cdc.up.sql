@@ -0,0 +1,46 @@
+-- Change data capture: a publication of the order tables for logical
+-- replication with pgoutput, and the position the CDC reader has published
+-- up to. The server needs wal_level = logical.
+--
+-- The tables are published through their partitioned parents. Deletes of
+-- details carry the whole old row, so their order_uid is known.
+
+CREATE PUBLICATION orders_cdc FOR TABLE orders, deliveries, payments, items
+    WITH (publish_via_partition_root = true);
+
+CREATE TABLE cdc_positions (
+    slot_name TEXT PRIMARY KEY,
+    lsn TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+DO $$
+DECLARE
+    part REGCLASS;
+BEGIN
+    FOR part IN
+        SELECT inhrelid::regclass FROM pg_inherits
+        WHERE inhparent IN ('deliveries'::regclass, 'payments'::regclass, 'items'::regclass)
+    LOOP
+        EXECUTE format('ALTER TABLE %s REPLICA IDENTITY FULL', part);
+    END LOOP;
+END;
+$$;
+
+-- ensure_order_partition as in 010, with full replica identity for the
+-- partitions of the details.
+CREATE OR REPLACE FUNCTION ensure_order_partition(month DATE) RETURNS VOID AS $$
+DECLARE
+    lower_bound DATE := date_trunc('month', month);
+    upper_bound DATE := date_trunc('month', month) + INTERVAL '1 month';
+    parent TEXT;
+BEGIN
+    FOREACH parent IN ARRAY ARRAY['orders', 'deliveries', 'payments', 'items'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+            parent || to_char(lower_bound, '"_p"YYYY_MM'), parent, lower_bound, upper_bound);
+        IF parent <> 'orders' THEN
+            EXECUTE format('ALTER TABLE %I REPLICA IDENTITY FULL', parent || to_char(lower_bound, '"_p"YYYY_MM'));
+        END IF;
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,44 @@
+-- Payment records after the first one of each order are kept, with their
+-- kind lost; delete them first to go back to one payment per order.
+
+DROP TABLE IF EXISTS shipments;
+ALTER TABLE payments DROP COLUMN IF EXISTS kind;
+
+CREATE OR REPLACE FUNCTION ensure_order_partition(month DATE) RETURNS VOID AS $$
+DECLARE
+    lower_bound DATE := date_trunc('month', month);
+    upper_bound DATE := date_trunc('month', month) + INTERVAL '1 month';
+    parent TEXT;
+BEGIN
+    FOREACH parent IN ARRAY ARRAY['orders', 'deliveries', 'payments', 'items'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+            parent || to_char(lower_bound, '"_p"YYYY_MM'), parent, lower_bound, upper_bound);
+        IF parent <> 'orders' THEN
+            EXECUTE format('ALTER TABLE %I REPLICA IDENTITY FULL', parent || to_char(lower_bound, '"_p"YYYY_MM'));
+        END IF;
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION detach_order_partition(month DATE) RETURNS BOOLEAN AS $$
+DECLARE
+    suffix TEXT := to_char(date_trunc('month', month), '"_p"YYYY_MM');
+    parent TEXT;
+    detached BOOLEAN := false;
+BEGIN
+    FOREACH parent IN ARRAY ARRAY['items', 'payments', 'deliveries', 'orders'] LOOP
+        IF EXISTS (SELECT 1 FROM pg_inherits
+                   WHERE inhrelid = to_regclass(parent || suffix) AND inhparent = parent::regclass) THEN
+            EXECUTE format('ALTER TABLE %I DETACH PARTITION %I', parent, parent || suffix);
+            IF parent <> 'orders' THEN
+                EXECUTE format('ALTER TABLE %I DROP CONSTRAINT IF EXISTS %I', parent || suffix, parent || '_order_fkey');
+            END IF;
+            detached := true;
+        END IF;
+    END LOOP;
+    IF detached THEN
+        EXECUTE format('DELETE FROM order_search WHERE order_uid IN (SELECT order_uid FROM %I)', 'orders' || suffix);
+    END IF;
+    RETURN detached;
+END;
+$$ LANGUAGE plpgsql;
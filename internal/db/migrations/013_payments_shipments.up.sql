@@ -0,0 +1,74 @@
+-- Several payment records per order, told apart by kind, and shipments that
+-- split an order into parcels. Items belong to the shipment with their track
+-- number. The first payment of an order, by id, is its original charge.
+
+ALTER TABLE payments ADD COLUMN kind VARCHAR NOT NULL DEFAULT 'charge';
+
+CREATE TABLE shipments (
+    id SERIAL,
+    order_uid VARCHAR NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    track_number VARCHAR NOT NULL,
+    delivery_service VARCHAR,
+    status VARCHAR,
+    PRIMARY KEY (id, date_created),
+    CONSTRAINT shipments_order_fkey FOREIGN KEY (order_uid, date_created)
+        REFERENCES orders (order_uid, date_created) ON DELETE CASCADE
+) PARTITION BY RANGE (date_created);
+
+CREATE TABLE shipments_default PARTITION OF shipments DEFAULT;
+ALTER TABLE shipments_default REPLICA IDENTITY FULL;
+CREATE INDEX shipments_order_uid_idx ON shipments (order_uid, date_created);
+
+-- ensure_order_partition as in 012, with the shipments partition.
+CREATE OR REPLACE FUNCTION ensure_order_partition(month DATE) RETURNS VOID AS $$
+DECLARE
+    lower_bound DATE := date_trunc('month', month);
+    upper_bound DATE := date_trunc('month', month) + INTERVAL '1 month';
+    parent TEXT;
+BEGIN
+    FOREACH parent IN ARRAY ARRAY['orders', 'deliveries', 'payments', 'items', 'shipments'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+            parent || to_char(lower_bound, '"_p"YYYY_MM'), parent, lower_bound, upper_bound);
+        IF parent <> 'orders' THEN
+            EXECUTE format('ALTER TABLE %I REPLICA IDENTITY FULL', parent || to_char(lower_bound, '"_p"YYYY_MM'));
+        END IF;
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+
+-- detach_order_partition as in 010, with the shipments partition.
+CREATE OR REPLACE FUNCTION detach_order_partition(month DATE) RETURNS BOOLEAN AS $$
+DECLARE
+    suffix TEXT := to_char(date_trunc('month', month), '"_p"YYYY_MM');
+    parent TEXT;
+    detached BOOLEAN := false;
+BEGIN
+    FOREACH parent IN ARRAY ARRAY['shipments', 'items', 'payments', 'deliveries', 'orders'] LOOP
+        IF EXISTS (SELECT 1 FROM pg_inherits
+                   WHERE inhrelid = to_regclass(parent || suffix) AND inhparent = parent::regclass) THEN
+            EXECUTE format('ALTER TABLE %I DETACH PARTITION %I', parent, parent || suffix);
+            IF parent <> 'orders' THEN
+                EXECUTE format('ALTER TABLE %I DROP CONSTRAINT IF EXISTS %I', parent || suffix, parent || '_order_fkey');
+            END IF;
+            detached := true;
+        END IF;
+    END LOOP;
+    IF detached THEN
+        EXECUTE format('DELETE FROM order_search WHERE order_uid IN (SELECT order_uid FROM %I)', 'orders' || suffix);
+    END IF;
+    RETURN detached;
+END;
+$$ LANGUAGE plpgsql;
+
+-- shipments partitions for the months that have order partitions
+SELECT ensure_order_partition(to_date(substring(c.relname FROM '_p(\d{4}_\d{2})$'), 'YYYY_MM'))
+FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = 'orders'::regclass AND c.relname ~ '^orders_p\d{4}_\d{2}$';
+
+CREATE TRIGGER shipments_notify
+    AFTER INSERT OR UPDATE OR DELETE ON shipments
+    FOR EACH ROW EXECUTE FUNCTION notify_order_change();
+
+ALTER PUBLICATION orders_cdc ADD TABLE shipments;
@@ -0,0 +1,14 @@
+-- Return requests (RMAs) for order items. Returns are kept independently of
+-- the partitioned orders table, like the order history. items holds the
+-- returned items with their reason codes as a JSON array.
+CREATE TABLE IF NOT EXISTS returns (
+    return_id VARCHAR PRIMARY KEY,
+    order_uid VARCHAR NOT NULL,
+    status VARCHAR NOT NULL,
+    items JSONB NOT NULL,
+    refund_transaction VARCHAR,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS returns_order_uid_idx ON returns (order_uid, created_at);
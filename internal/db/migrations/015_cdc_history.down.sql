@@ -0,0 +1 @@
+ALTER PUBLICATION orders_cdc DROP TABLE order_history;
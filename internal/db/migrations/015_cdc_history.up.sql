@@ -0,0 +1,4 @@
+-- The CDC reader builds its events from the history entries written in each
+-- transaction, which hold the whole order as committed.
+
+ALTER PUBLICATION orders_cdc ADD TABLE order_history;
@@ -0,0 +1,4 @@
+-- Encrypted payloads stay encrypted and can no longer be read; re-encrypt
+-- them to plaintext first if they are needed.
+DROP INDEX IF EXISTS raw_messages_payload_key_id_idx;
+ALTER TABLE raw_messages DROP COLUMN IF EXISTS payload_key_id;
@@ -0,0 +1,6 @@
+-- payload_key_id names the key the raw message payload was encrypted with;
+-- NULL means it is plaintext. Plaintext payloads are encrypted by the PII
+-- re-encryption job once keys are configured.
+ALTER TABLE raw_messages ADD COLUMN IF NOT EXISTS payload_key_id VARCHAR;
+
+CREATE INDEX IF NOT EXISTS raw_messages_payload_key_id_idx ON raw_messages (payload_key_id);
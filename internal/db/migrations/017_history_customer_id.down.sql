@@ -0,0 +1 @@
+DROP INDEX IF EXISTS order_history_customer_id_idx;
@@ -0,0 +1,3 @@
+-- Erasure finds the orders of a customer that only the history still holds,
+-- deleted or archived ones, by the customer of their snapshots.
+CREATE INDEX IF NOT EXISTS order_history_customer_id_idx ON order_history ((snapshot->>'customer_id'));
@@ -0,0 +1,15 @@
+CREATE OR REPLACE FUNCTION ensure_order_partition(month DATE) RETURNS VOID AS $$
+DECLARE
+    lower_bound DATE := date_trunc('month', month);
+    upper_bound DATE := date_trunc('month', month) + INTERVAL '1 month';
+    parent TEXT;
+BEGIN
+    FOREACH parent IN ARRAY ARRAY['orders', 'deliveries', 'payments', 'items', 'shipments'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+            parent || to_char(lower_bound, '"_p"YYYY_MM'), parent, lower_bound, upper_bound);
+        IF parent <> 'orders' THEN
+            EXECUTE format('ALTER TABLE %I REPLICA IDENTITY FULL', parent || to_char(lower_bound, '"_p"YYYY_MM'));
+        END IF;
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS audit_log_order_uids_idx;
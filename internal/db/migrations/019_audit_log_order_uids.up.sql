@@ -0,0 +1,3 @@
+-- Order updates check that no erasure touched the order, see
+-- db.ErrOrderErased.
+CREATE INDEX IF NOT EXISTS audit_log_order_uids_idx ON audit_log USING GIN (order_uids);
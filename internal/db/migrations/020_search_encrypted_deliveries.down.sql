@@ -0,0 +1,23 @@
+CREATE OR REPLACE FUNCTION refresh_order_search(uid VARCHAR) RETURNS VOID AS $$
+BEGIN
+    INSERT INTO order_search (order_uid, document)
+    SELECT o.order_uid, concat_ws(' ',
+        (SELECT string_agg(concat_ws(' ', i.name, i.brand), ' ' ORDER BY i.id)
+         FROM items i WHERE i.order_uid = o.order_uid),
+        (SELECT string_agg(CASE WHEN d.pii_key_id IS NULL
+                                THEN concat_ws(' ', d.name, d.city, d.address)
+                                ELSE d.city END, ' ' ORDER BY d.id)
+         FROM deliveries d WHERE d.order_uid = o.order_uid))
+    FROM orders o
+    WHERE o.order_uid = uid
+    ON CONFLICT (order_uid) DO UPDATE SET document = EXCLUDED.document;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP INDEX IF EXISTS order_search_tsv_idx;
+ALTER TABLE order_search DROP COLUMN tsv;
+ALTER TABLE order_search ADD COLUMN tsv TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', document)) STORED;
+CREATE INDEX IF NOT EXISTS order_search_tsv_idx ON order_search USING GIN (tsv);
+ALTER TABLE order_search DROP COLUMN IF EXISTS tokens;
+
+ALTER TABLE deliveries DROP COLUMN IF EXISTS search_tokens;
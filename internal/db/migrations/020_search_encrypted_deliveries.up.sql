@@ -0,0 +1,31 @@
+-- Encrypted delivery names and addresses are searchable through the blind
+-- indexes of their words, kept in search_tokens (see db.searchTokens). The
+-- tokens are indexed with the document but kept apart from it, so snippets
+-- don't show them. ReencryptPII fills in the tokens of deliveries encrypted
+-- before this migration.
+ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS search_tokens TEXT;
+
+ALTER TABLE order_search ADD COLUMN IF NOT EXISTS tokens TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS order_search_tsv_idx;
+ALTER TABLE order_search DROP COLUMN tsv;
+ALTER TABLE order_search ADD COLUMN tsv TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('simple', document || ' ' || tokens)) STORED;
+CREATE INDEX IF NOT EXISTS order_search_tsv_idx ON order_search USING GIN (tsv);
+
+CREATE OR REPLACE FUNCTION refresh_order_search(uid VARCHAR) RETURNS VOID AS $$
+BEGIN
+    INSERT INTO order_search (order_uid, document, tokens)
+    SELECT o.order_uid, concat_ws(' ',
+        (SELECT string_agg(concat_ws(' ', i.name, i.brand), ' ' ORDER BY i.id)
+         FROM items i WHERE i.order_uid = o.order_uid),
+        (SELECT string_agg(CASE WHEN d.pii_key_id IS NULL
+                                THEN concat_ws(' ', d.name, d.city, d.address)
+                                ELSE d.city END, ' ' ORDER BY d.id)
+         FROM deliveries d WHERE d.order_uid = o.order_uid)),
+        COALESCE((SELECT string_agg(d.search_tokens, ' ' ORDER BY d.id)
+                  FROM deliveries d WHERE d.order_uid = o.order_uid AND d.pii_key_id IS NOT NULL), '')
+    FROM orders o
+    WHERE o.order_uid = uid
+    ON CONFLICT (order_uid) DO UPDATE SET document = EXCLUDED.document, tokens = EXCLUDED.tokens;
+END;
+$$ LANGUAGE plpgsql;
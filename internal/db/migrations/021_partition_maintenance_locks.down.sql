@@ -0,0 +1,35 @@
+-- ensure_order_partition as in 018
+CREATE OR REPLACE FUNCTION ensure_order_partition(month DATE) RETURNS VOID AS $$
+DECLARE
+    lower_bound DATE := date_trunc('month', month);
+    upper_bound DATE := date_trunc('month', month) + INTERVAL '1 month';
+    suffix TEXT := to_char(date_trunc('month', month), '"_p"YYYY_MM');
+    parent TEXT;
+    move BOOLEAN;
+BEGIN
+    move := to_regclass('orders' || suffix) IS NULL
+        AND EXISTS (SELECT 1 FROM orders_default WHERE date_created >= lower_bound AND date_created < upper_bound);
+    IF move THEN
+        FOREACH parent IN ARRAY ARRAY['shipments', 'items', 'payments', 'deliveries', 'orders'] LOOP
+            EXECUTE format('ALTER TABLE %I DETACH PARTITION %I', parent, parent || '_default');
+            IF parent <> 'orders' THEN
+                EXECUTE format('ALTER TABLE %I DROP CONSTRAINT IF EXISTS %I', parent || '_default', parent || '_order_fkey');
+            END IF;
+        END LOOP;
+    END IF;
+
+    FOREACH parent IN ARRAY ARRAY['orders', 'deliveries', 'payments', 'items', 'shipments'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+            parent || suffix, parent, lower_bound, upper_bound);
+        IF parent <> 'orders' THEN
+            EXECUTE format('ALTER TABLE %I REPLICA IDENTITY FULL', parent || suffix);
+        END IF;
+        IF move THEN
+            EXECUTE format('WITH moved AS (DELETE FROM %I WHERE date_created >= %L AND date_created < %L RETURNING *) '
+                'INSERT INTO %I SELECT * FROM moved',
+                parent || '_default', lower_bound, upper_bound, parent || suffix);
+            EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I DEFAULT', parent, parent || '_default');
+        END IF;
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
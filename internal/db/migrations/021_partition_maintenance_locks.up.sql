@@ -0,0 +1,53 @@
+-- ensure_order_partition as in 018, but a month whose partitions all exist
+-- is left alone. Before, every maintenance run re-ran CREATE TABLE IF NOT
+-- EXISTS and ALTER TABLE REPLICA IDENTITY on the existing partitions, which
+-- takes ACCESS EXCLUSIVE locks on them.
+--
+-- Rows are moved out of the default partitions only when EXISTS finds rows
+-- of the month there, which happens once, when partitions fell behind the
+-- orders. The move detaches and re-attaches the default partitions: it
+-- holds ACCESS EXCLUSIVE locks on orders and its child tables until the
+-- call commits, blocking reads and writes of every order for as long as the
+-- move takes.
+CREATE OR REPLACE FUNCTION ensure_order_partition(month DATE) RETURNS VOID AS $$
+DECLARE
+    lower_bound DATE := date_trunc('month', month);
+    upper_bound DATE := date_trunc('month', month) + INTERVAL '1 month';
+    suffix TEXT := to_char(date_trunc('month', month), '"_p"YYYY_MM');
+    parents TEXT[] := ARRAY['orders', 'deliveries', 'payments', 'items', 'shipments'];
+    parent TEXT;
+    move BOOLEAN := false;
+BEGIN
+    IF (SELECT bool_and(to_regclass(p || suffix) IS NOT NULL) FROM unnest(parents) p) THEN
+        RETURN;
+    END IF;
+
+    IF to_regclass('orders' || suffix) IS NULL THEN
+        move := EXISTS (SELECT 1 FROM orders_default WHERE date_created >= lower_bound AND date_created < upper_bound);
+    END IF;
+    IF move THEN
+        FOREACH parent IN ARRAY ARRAY['shipments', 'items', 'payments', 'deliveries', 'orders'] LOOP
+            EXECUTE format('ALTER TABLE %I DETACH PARTITION %I', parent, parent || '_default');
+            IF parent <> 'orders' THEN
+                EXECUTE format('ALTER TABLE %I DROP CONSTRAINT IF EXISTS %I', parent || '_default', parent || '_order_fkey');
+            END IF;
+        END LOOP;
+    END IF;
+
+    FOREACH parent IN ARRAY parents LOOP
+        IF to_regclass(parent || suffix) IS NULL THEN
+            EXECUTE format('CREATE TABLE %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+                parent || suffix, parent, lower_bound, upper_bound);
+            IF parent <> 'orders' THEN
+                EXECUTE format('ALTER TABLE %I REPLICA IDENTITY FULL', parent || suffix);
+            END IF;
+        END IF;
+        IF move THEN
+            EXECUTE format('WITH moved AS (DELETE FROM %I WHERE date_created >= %L AND date_created < %L RETURNING *) '
+                'INSERT INTO %I SELECT * FROM moved',
+                parent || '_default', lower_bound, upper_bound, parent || suffix);
+            EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I DEFAULT', parent, parent || '_default');
+        END IF;
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OrderChangeChannel is the channel the triggers of migration 011 notify
+// with the UID of every changed order.
+const OrderChangeChannel = "order_changed"
+
+// ListenOrderChanges keeps a LISTEN connection on OrderChangeChannel and
+// calls changed with the UID of every order changed in the database, until
+// ctx is done. The connection is re-established automatically; notifications
+// sent while it was down are lost, so reconnected is called after every
+// reconnect.
+func (c *Client) ListenOrderChanges(ctx context.Context, changed func(orderUID string), reconnected func()) error {
+	listener := pq.NewListener(c.connString, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected:
+			slog.Info("Listening for order changes", "channel", OrderChangeChannel)
+		case pq.ListenerEventDisconnected:
+			slog.Warn("Order change listener disconnected", "error", err)
+		case pq.ListenerEventReconnected:
+			slog.Info("Order change listener reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			slog.Warn("Order change listener failed to connect", "error", err)
+		}
+	})
+	// Listen blocks until connected, closing the listener unblocks it
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	defer listener.Close()
+	if err := listener.Listen(OrderChangeChannel); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("error listening on %s: %w", OrderChangeChannel, err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n, ok := <-listener.Notify:
+			if !ok {
+				return nil
+			}
+			// a nil notification marks a reconnect
+			if n == nil {
+				reconnected()
+				continue
+			}
+			changed(n.Extra)
+		case <-time.After(90 * time.Second):
+			// detects a dead connection when there is no traffic
+			go listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Open returns the Database implementation selected by the scheme of
+// connString:
+//
+//	postgres://... or postgresql://...  Postgres (Client)
+//	sqlite://path/to/file.db            SQLite (SQLiteDB)
+//	memory://                           in-memory (MemoryDB)
+//
+// pool applies to Postgres only.
+func Open(connString string, pool PoolConfig) (Database, error) {
+	scheme, rest, ok := strings.Cut(connString, "://")
+	if !ok {
+		return nil, fmt.Errorf("database url has no scheme")
+	}
+	switch scheme {
+	case "postgres", "postgresql":
+		client, err := NewDB(connString, pool)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case "sqlite":
+		sqliteDB, err := NewSQLiteDB(rest)
+		if err != nil {
+			return nil, err
+		}
+		return sqliteDB, nil
+	case "memory":
+		return NewMemoryDB(), nil
+	default:
+		return nil, fmt.Errorf("unsupported database scheme %q", scheme)
+	}
+}
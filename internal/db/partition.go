@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// PartitionConfig controls the monthly partitions of orders and its child
+// tables.
+type PartitionConfig struct {
+	// Ahead is how many months of partitions exist beyond the current one.
+	Ahead int
+	// Retain is how many months before the current one stay attached; older
+	// partitions are detached once they are empty. Zero keeps every
+	// partition.
+	Retain   int
+	Interval time.Duration
+}
+
+// PartitionManager creates partitions before orders arrive for their month,
+// so they never land in the default partition, and detaches expired ones.
+// It never removes orders itself: the retention job archives and deletes
+// them through the cache, which evicts them on every instance, and only the
+// partitions it emptied are detached.
+type PartitionManager struct {
+	client *Client
+	cfg    PartitionConfig
+}
+
+func (c *Client) NewPartitionManager(cfg PartitionConfig) *PartitionManager {
+	return &PartitionManager{client: c, cfg: cfg}
+}
+
+// Run maintains the partitions once immediately and then on every interval
+// until ctx is done.
+func (p *PartitionManager) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := p.Maintain(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Partition maintenance failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Maintain creates the partitions for the current month and the months
+// ahead, then detaches the empty ones past the retention. Orders that
+// already landed in the default partition for a month are moved to the
+// month's partition when it is created, which locks orders and its child
+// tables for the move; see migration 021. A month that fails doesn't stop
+// the others; the errors are returned together.
+func (p *PartitionManager) Maintain(ctx context.Context) error {
+	now := time.Now().UTC()
+	current := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var errs []error
+	for i := 0; i <= p.cfg.Ahead; i++ {
+		month := current.AddDate(0, i, 0)
+		if _, err := p.client.db.ExecContext(ctx, `SELECT ensure_order_partition($1)`, month); err != nil {
+			errs = append(errs, fmt.Errorf("error creating partition for %s: %w", month.Format("2006-01"), err))
+		}
+	}
+	if p.cfg.Retain <= 0 {
+		return errors.Join(errs...)
+	}
+
+	months, err := p.partitionMonths(ctx)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	oldest := current.AddDate(0, -p.cfg.Retain, 0)
+	for _, month := range months {
+		if !month.Before(oldest) {
+			continue
+		}
+		detached, err := p.detachEmpty(ctx, month)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error detaching partition for %s: %w", month.Format("2006-01"), err))
+			continue
+		}
+		if detached {
+			slog.Info("Detached order partitions", "month", month.Format("2006-01"))
+		} else {
+			slog.Warn("Partition past retention still holds orders, archive them first", "month", month.Format("2006-01"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// detachEmpty detaches the partitions of the month if its orders partition
+// is empty. The partition is locked first so no order can land in it
+// between the check and the detach; the child partitions are empty too,
+// their rows reference the orders.
+func (p *PartitionManager) detachEmpty(ctx context.Context, month time.Time) (bool, error) {
+	table := pq.QuoteIdentifier("orders_p" + month.Format("2006_01"))
+	detached := false
+	err := p.client.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, `LOCK TABLE `+table+` IN ACCESS EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+		var empty bool
+		if err := tx.GetContext(ctx, &empty, `SELECT NOT EXISTS (SELECT 1 FROM `+table+`)`); err != nil {
+			return err
+		}
+		if !empty {
+			return nil
+		}
+		return tx.GetContext(ctx, &detached, `SELECT detach_order_partition($1)`, month)
+	})
+	return detached, err
+}
+
+// partitionMonths lists the months of the monthly partitions attached to
+// orders.
+func (p *PartitionManager) partitionMonths(ctx context.Context) ([]time.Time, error) {
+	query := `
+	SELECT c.relname
+	FROM pg_inherits i
+	JOIN pg_class c ON c.oid = i.inhrelid
+	WHERE i.inhparent = 'orders'::regclass
+	ORDER BY c.relname
+	`
+	var names []string
+	if err := p.client.db.SelectContext(ctx, &names, query); err != nil {
+		return nil, fmt.Errorf("error listing partitions: %w", err)
+	}
+	var months []time.Time
+	for _, name := range names {
+		suffix, ok := strings.CutPrefix(name, "orders_p")
+		if !ok {
+			continue // the default partition
+		}
+		month, err := time.Parse("2006_01", suffix)
+		if err != nil {
+			continue
+		}
+		months = append(months, month)
+	}
+	return months, nil
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"wbstorage/internal/models"
+	"wbstorage/internal/pii"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// deliveryRow is a delivery as stored in Postgres. When PIIKeyID is set the
+// PII fields hold ciphertext written with that key, and SearchTokens the
+// words of the encrypted name and address for search, see searchTokens.
+type deliveryRow struct {
+	models.Delivery
+	DateCreated  time.Time `db:"date_created" json:"-"`
+	PIIKeyID     *string   `db:"pii_key_id" json:"pii_key_id"`
+	EmailHash    []byte    `db:"email_hash" json:"-"`
+	PhoneHash    []byte    `db:"phone_hash" json:"-"`
+	SearchTokens *string   `db:"search_tokens" json:"-"`
+}
+
+type piiField struct {
+	name  string
+	value *string
+}
+
+// piiFields are the delivery fields that are encrypted at rest.
+func piiFields(d *models.Delivery) []piiField {
+	return []piiField{
+		{"name", &d.Name},
+		{"phone", &d.Phone},
+		{"address", &d.Address},
+		{"email", &d.Email},
+	}
+}
+
+// SetKeyring enables encryption of delivery PII. Without a keyring deliveries
+// are written in plaintext; rows encrypted earlier then cannot be read.
+func (c *Client) SetKeyring(k *pii.Keyring) {
+	c.pii = k
+}
+
+// sealDelivery encrypts the PII of d with the current key and computes its
+// blind indexes. Without a keyring it returns d unchanged.
+func (c *Client) sealDelivery(d models.Delivery) (deliveryRow, error) {
+	row := deliveryRow{Delivery: d}
+	if c.pii == nil {
+		return row, nil
+	}
+	row.EmailHash = c.pii.BlindIndex("email", pii.NormalizeEmail(d.Email))
+	row.PhoneHash = c.pii.BlindIndex("phone", pii.NormalizePhone(d.Phone))
+	tokens := searchTokens(c.pii, d.Name, d.Address)
+	row.SearchTokens = &tokens
+	for _, f := range piiFields(&row.Delivery) {
+		sealed, err := c.pii.Encrypt(f.name, *f.value)
+		if err != nil {
+			return row, err
+		}
+		*f.value = sealed
+	}
+	keyID := c.pii.CurrentID()
+	row.PIIKeyID = &keyID
+	return row, nil
+}
+
+// openDelivery decrypts the PII of d in place if it was written with keyID.
+func (c *Client) openDelivery(keyID *string, d *models.Delivery) error {
+	if keyID == nil {
+		return nil
+	}
+	if c.pii == nil {
+		return fmt.Errorf("delivery is encrypted with key %q but encryption is not configured: %w", *keyID, pii.ErrUnknownKey)
+	}
+	for _, f := range piiFields(d) {
+		plain, err := c.pii.Decrypt(*keyID, f.name, *f.value)
+		if err != nil {
+			return err
+		}
+		*f.value = plain
+	}
+	return nil
+}
+
+// sealSnapshot encodes the history snapshot of order with its delivery
+// encrypted like the deliveries table.
+func (c *Client) sealSnapshot(order *models.Order) ([]byte, *string, error) {
+	snapshot := order.Snapshot()
+	row, err := c.sealDelivery(snapshot.Delivery)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot.Delivery = row.Delivery
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, row.PIIKeyID, nil
+}
+
+// rewriteHistory decrypts the given history rows, applies change to their
+// snapshots if it is not nil, and writes them back encrypted with the current
+// key.
+func (c *Client) rewriteHistory(ctx context.Context, tx *sqlx.Tx, rows []historyRow, change func(*models.Order)) error {
+	for _, row := range rows {
+		v, err := c.openVersion(row)
+		if err != nil {
+			return fmt.Errorf("order %s version %d: %w", row.OrderUID, row.Version, err)
+		}
+		if change != nil {
+			change(v.Order)
+		}
+		snapshot, keyID, err := c.sealSnapshot(v.Order)
+		if err != nil {
+			return err
+		}
+		update := `UPDATE order_history SET snapshot = $3, pii_key_id = $4 WHERE order_uid = $1 AND version = $2`
+		if _, err := tx.ExecContext(ctx, update, row.OrderUID, row.Version, snapshot, keyID); err != nil {
+			return fmt.Errorf("error rewriting order history: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReencryptPII rewrites up to batchSize deliveries, history snapshots and
+// raw message payloads that are plaintext or encrypted with a key other than
+// the current one, and returns how many rows it changed.
+func (c *Client) ReencryptPII(ctx context.Context, batchSize int) (int, error) {
+	if c.pii == nil {
+		return 0, nil
+	}
+	current := c.pii.CurrentID()
+	changed := 0
+	err := c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		var deliveries []deliveryRow
+		query := `
+		SELECT id, order_uid, date_created, name, phone, zip, city, address, region, email, pii_key_id
+		FROM deliveries
+		WHERE pii_key_id IS DISTINCT FROM $1 OR search_tokens IS NULL
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+		`
+		if err := tx.SelectContext(ctx, &deliveries, query, current, batchSize); err != nil {
+			return fmt.Errorf("error fetching deliveries to re-encrypt: %w", err)
+		}
+		for _, d := range deliveries {
+			if err := c.openDelivery(d.PIIKeyID, &d.Delivery); err != nil {
+				return fmt.Errorf("delivery %d: %w", d.Id, err)
+			}
+			sealed, err := c.sealDelivery(d.Delivery)
+			if err != nil {
+				return err
+			}
+			sealed.DateCreated = d.DateCreated
+			update := `
+			UPDATE deliveries SET name = :name, phone = :phone, address = :address, email = :email,
+				pii_key_id = :pii_key_id, email_hash = :email_hash, phone_hash = :phone_hash,
+				search_tokens = :search_tokens
+			WHERE id = :id AND date_created = :date_created
+			`
+			if _, err := tx.NamedExecContext(ctx, update, sealed); err != nil {
+				return fmt.Errorf("error re-encrypting delivery %d: %w", d.Id, err)
+			}
+		}
+		changed += len(deliveries)
+
+		var versions []historyRow
+		query = `
+		SELECT ` + historyColumns + `, pii_key_id
+		FROM order_history
+		WHERE pii_key_id IS DISTINCT FROM $1
+		ORDER BY order_uid, version
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+		`
+		if err := tx.SelectContext(ctx, &versions, query, current, batchSize); err != nil {
+			return fmt.Errorf("error fetching history to re-encrypt: %w", err)
+		}
+		if err := c.rewriteHistory(ctx, tx, versions, nil); err != nil {
+			return err
+		}
+		changed += len(versions)
+
+		var raw []rawMessageRow
+		query = `
+		SELECT ` + rawMessageColumns + `, payload_key_id
+		FROM raw_messages
+		WHERE payload_key_id IS DISTINCT FROM $1
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+		`
+		if err := tx.SelectContext(ctx, &raw, query, current, batchSize); err != nil {
+			return fmt.Errorf("error fetching raw messages to re-encrypt: %w", err)
+		}
+		for _, row := range raw {
+			msg, err := c.openMessage(row)
+			if err != nil {
+				return err
+			}
+			payload, keyID, err := c.sealPayload(msg.Payload)
+			if err != nil {
+				return err
+			}
+			update := `UPDATE raw_messages SET payload = $2, payload_key_id = $3 WHERE id = $1`
+			if _, err := tx.ExecContext(ctx, update, row.ID, payload, keyID); err != nil {
+				return fmt.Errorf("error re-encrypting raw message %d: %w", row.ID, err)
+			}
+		}
+		changed += len(raw)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return changed, nil
+}
+
+// RunReencryption re-encrypts stale rows in batches on every interval until
+// ctx is done, so a key rotation completes in the background.
+func (c *Client) RunReencryption(ctx context.Context, interval time.Duration, batchSize int) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		total := 0
+		for ctx.Err() == nil {
+			n, err := c.ReencryptPII(ctx, batchSize)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("PII re-encryption failed", "error", err)
+				}
+				break
+			}
+			if n == 0 {
+				break
+			}
+			total += n
+		}
+		if total > 0 {
+			slog.Info("Re-encrypted PII", "rows", total, "keyID", c.pii.CurrentID())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// PoolConfig configures the Postgres connection pool and the session of
+// each connection. Zero values keep the database/sql and server defaults.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// StatementTimeout makes the server cancel any statement running longer.
+	StatementTimeout time.Duration
+	// ApplicationName identifies the connections in pg_stat_activity.
+	ApplicationName string
+	// SlowQueryThreshold is how long a statement runs before it is logged
+	// with its text and duration; zero uses 200ms.
+	SlowQueryThreshold time.Duration
+}
+
+func (p PoolConfig) apply(db *sqlx.DB) {
+	if p.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(p.MaxOpenConns)
+	}
+	if p.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(p.MaxIdleConns)
+	}
+	if p.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	}
+	if p.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	}
+}
+
+// connString adds the session parameters to a Postgres URL or key=value
+// connection string. lib/pq sends parameters it doesn't know itself, such as
+// statement_timeout, to the server when connecting.
+func (p PoolConfig) connString(connString string) (string, error) {
+	var params [][2]string
+	if p.ApplicationName != "" {
+		params = append(params, [2]string{"application_name", p.ApplicationName})
+	}
+	if p.StatementTimeout > 0 {
+		params = append(params, [2]string{"statement_timeout", strconv.FormatInt(p.StatementTimeout.Milliseconds(), 10)})
+	}
+	for _, param := range params {
+		var err error
+		if connString, err = setConnParam(connString, param[0], param[1]); err != nil {
+			return "", err
+		}
+	}
+	return connString, nil
+}
+
+// setConnParam adds key to a Postgres URL or key=value connection string,
+// unless it is set already.
+func setConnParam(connString, key, value string) (string, error) {
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		u, err := url.Parse(connString)
+		if err != nil {
+			return "", fmt.Errorf("invalid database url: %w", err)
+		}
+		query := u.Query()
+		if !query.Has(key) {
+			query.Set(key, value)
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	if strings.Contains(connString, key+"=") {
+		return connString, nil
+	}
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return connString + fmt.Sprintf(" %s='%s'", key, value), nil
+}
+
+// open connects to Postgres with the pool settings applied and slow
+// statements logged.
+func (p PoolConfig) open(connString string) (*sqlx.DB, error) {
+	connString, err := p.connString(connString)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := pq.NewConnector(connString)
+	if err != nil {
+		return nil, err
+	}
+	threshold := p.SlowQueryThreshold
+	if threshold <= 0 {
+		threshold = 200 * time.Millisecond
+	}
+	db := sqlx.NewDb(sql.OpenDB(tracedConnector{Connector: connector, threshold: threshold}), "postgres")
+	p.apply(db)
+	return db, nil
+}
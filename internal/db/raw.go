@@ -0,0 +1,271 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"wbstorage/internal/models"
+	"wbstorage/internal/pii"
+)
+
+// rawMessageRow is models.RawMessage with the headers as stored JSON. When
+// PayloadKeyID is set the payload holds ciphertext written with that key.
+type rawMessageRow struct {
+	models.RawMessage
+	OrderUID     sql.NullString `db:"order_uid"`
+	Headers      []byte         `db:"headers"`
+	PayloadKeyID *string        `db:"payload_key_id"`
+}
+
+func (r rawMessageRow) message() (models.RawMessage, error) {
+	msg := r.RawMessage
+	msg.OrderUID = r.OrderUID.String
+	if r.Headers != nil {
+		if err := json.Unmarshal(r.Headers, &msg.Headers); err != nil {
+			return msg, fmt.Errorf("error decoding headers: %w", err)
+		}
+	}
+	return msg, nil
+}
+
+// rawPayloadField binds encrypted payloads to raw messages, see
+// pii.Keyring.Encrypt.
+const rawPayloadField = "raw_payload"
+
+// sealPayload encrypts a raw message payload with the current key, as it
+// holds the delivery PII in plaintext. Without a keyring it is stored as is.
+func (c *Client) sealPayload(payload []byte) ([]byte, *string, error) {
+	if c.pii == nil {
+		return payload, nil, nil
+	}
+	sealed, err := c.pii.Encrypt(rawPayloadField, string(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID := c.pii.CurrentID()
+	return []byte(sealed), &keyID, nil
+}
+
+// openMessage decodes a raw message row, decrypting its payload.
+func (c *Client) openMessage(row rawMessageRow) (models.RawMessage, error) {
+	msg, err := row.message()
+	if err != nil || row.PayloadKeyID == nil {
+		return msg, err
+	}
+	if c.pii == nil {
+		return msg, fmt.Errorf("raw message %d is encrypted with key %q but encryption is not configured: %w",
+			row.ID, *row.PayloadKeyID, pii.ErrUnknownKey)
+	}
+	payload, err := c.pii.Decrypt(*row.PayloadKeyID, rawPayloadField, string(row.Payload))
+	if err != nil {
+		return msg, fmt.Errorf("raw message %d: %w", row.ID, err)
+	}
+	msg.Payload = []byte(payload)
+	return msg, nil
+}
+
+// ArchiveRawMessage stores msg with its payload encrypted. Messages are
+// identified by stream and stream sequence, so archiving a redelivered
+// message again is a no-op.
+func (c *Client) ArchiveRawMessage(ctx context.Context, msg models.RawMessage) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+	payload, keyID, err := c.sealPayload(msg.Payload)
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT INTO raw_messages
+		(order_uid, subject, stream, stream_seq, headers, payload, payload_key_id, received_at, decoder_version, parse_error)
+		VALUES (NULLIF($1, ''), $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT (stream, stream_seq) DO NOTHING
+	`
+	stmt, err := c.prepared(ctx, query)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, msg.OrderUID, msg.Subject, msg.Stream, int64(msg.StreamSeq),
+		headers, payload, keyID, msg.ReceivedAt, msg.DecoderVersion, msg.ParseError)
+	if err != nil {
+		return fmt.Errorf("error archiving raw message: %w", err)
+	}
+	return nil
+}
+
+const rawMessageColumns = `id, order_uid, subject, stream, stream_seq, headers, payload,
+	received_at, decoder_version, parse_error`
+
+func (c *Client) SelectRawMessages(ctx context.Context, orderUID string) ([]models.RawMessage, error) {
+	query := `SELECT ` + rawMessageColumns + `, payload_key_id FROM raw_messages WHERE order_uid = $1 ORDER BY received_at, id`
+	var rows []rawMessageRow
+	if err := c.db.SelectContext(ctx, &rows, query, orderUID); err != nil {
+		return nil, fmt.Errorf("error fetching raw messages: %w", err)
+	}
+	msgs := make([]models.RawMessage, 0, len(rows))
+	for _, row := range rows {
+		msg, err := c.openMessage(row)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (c *Client) SelectRawMessage(ctx context.Context, id int64) (*models.RawMessage, error) {
+	query := `SELECT ` + rawMessageColumns + `, payload_key_id FROM raw_messages WHERE id = $1`
+	var row rawMessageRow
+	if err := c.db.GetContext(ctx, &row, query, id); err != nil {
+		return nil, fmt.Errorf("error fetching raw message: %w", err)
+	}
+	msg, err := c.openMessage(row)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (m *MemoryDB) ArchiveRawMessage(ctx context.Context, msg models.RawMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, stored := range m.raw {
+		if stored.Stream == msg.Stream && stored.StreamSeq == msg.StreamSeq {
+			return nil
+		}
+	}
+	m.rawID++
+	msg.ID = m.rawID
+	msg.Payload = append([]byte(nil), msg.Payload...)
+	m.raw = append(m.raw, msg)
+	return nil
+}
+
+func (m *MemoryDB) SelectRawMessages(ctx context.Context, orderUID string) ([]models.RawMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	msgs := []models.RawMessage{}
+	for _, stored := range m.raw {
+		if stored.OrderUID == orderUID {
+			msgs = append(msgs, stored)
+		}
+	}
+	return msgs, nil
+}
+
+func (m *MemoryDB) SelectRawMessage(ctx context.Context, id int64) (*models.RawMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, stored := range m.raw {
+		if stored.ID == id {
+			return &stored, nil
+		}
+	}
+	return nil, fmt.Errorf("error fetching raw message: %w", sql.ErrNoRows)
+}
+
+// deleteRawMessages removes the messages that match and returns how many it
+// removed. m.mu must be held.
+func (m *MemoryDB) deleteRawMessages(match func(msg models.RawMessage) bool) int {
+	kept := m.raw[:0]
+	for _, msg := range m.raw {
+		if !match(msg) {
+			kept = append(kept, msg)
+		}
+	}
+	deleted := len(m.raw) - len(kept)
+	clear(m.raw[len(kept):])
+	m.raw = kept
+	return deleted
+}
+
+func (s *SQLiteDB) ArchiveRawMessage(ctx context.Context, msg models.RawMessage) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT INTO raw_messages
+		(order_uid, subject, stream, stream_seq, headers, payload, received_at, decoder_version, parse_error)
+		VALUES (NULLIF($1, ''), $2, $3, $4, $5, $6, $7, $8, $9)
+	ON CONFLICT (stream, stream_seq) DO NOTHING
+	`
+	_, err = s.db.ExecContext(ctx, query, msg.OrderUID, msg.Subject, msg.Stream, int64(msg.StreamSeq),
+		headers, msg.Payload, msg.ReceivedAt.UTC(), msg.DecoderVersion, msg.ParseError)
+	if err != nil {
+		return fmt.Errorf("error archiving raw message: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteDB) SelectRawMessages(ctx context.Context, orderUID string) ([]models.RawMessage, error) {
+	query := `SELECT ` + rawMessageColumns + ` FROM raw_messages WHERE order_uid = $1 ORDER BY received_at, id`
+	var rows []rawMessageRow
+	if err := s.db.SelectContext(ctx, &rows, query, orderUID); err != nil {
+		return nil, fmt.Errorf("error fetching raw messages: %w", err)
+	}
+	msgs := make([]models.RawMessage, 0, len(rows))
+	for _, row := range rows {
+		msg, err := row.message()
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (s *SQLiteDB) SelectRawMessage(ctx context.Context, id int64) (*models.RawMessage, error) {
+	query := `SELECT ` + rawMessageColumns + ` FROM raw_messages WHERE id = $1`
+	var row rawMessageRow
+	if err := s.db.GetContext(ctx, &row, query, id); err != nil {
+		return nil, fmt.Errorf("error fetching raw message: %w", err)
+	}
+	msg, err := row.message()
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (b *BreakerClient) ArchiveRawMessage(ctx context.Context, msg models.RawMessage) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.db.ArchiveRawMessage(ctx, msg)
+	b.record(err)
+	return err
+}
+
+func (b *BreakerClient) SelectRawMessages(ctx context.Context, orderUID string) ([]models.RawMessage, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	msgs, err := b.db.SelectRawMessages(ctx, orderUID)
+	b.record(err)
+	return msgs, err
+}
+
+func (b *BreakerClient) SelectRawMessage(ctx context.Context, id int64) (*models.RawMessage, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	msg, err := b.db.SelectRawMessage(ctx, id)
+	b.record(err)
+	return msg, err
+}
+
+func (c *CachedClient) ArchiveRawMessage(ctx context.Context, msg models.RawMessage) error {
+	return c.db.ArchiveRawMessage(ctx, msg)
+}
+
+func (c *CachedClient) SelectRawMessages(ctx context.Context, orderUID string) ([]models.RawMessage, error) {
+	return c.db.SelectRawMessages(ctx, orderUID)
+}
+
+func (c *CachedClient) SelectRawMessage(ctx context.Context, id int64) (*models.RawMessage, error) {
+	return c.db.SelectRawMessage(ctx, id)
+}
@@ -0,0 +1,222 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ReplicaConfig configures read replicas of the primary database.
+type ReplicaConfig struct {
+	URLs []string
+	// CheckInterval is how often each replica is pinged and its lag measured.
+	CheckInterval time.Duration
+	// MaxLag is the replication lag above which a replica stops serving reads.
+	MaxLag time.Duration
+	// StickyWindow is how long reads of an order written by this client go to
+	// the primary, so a caller always sees its own writes.
+	StickyWindow time.Duration
+}
+
+// preparer is the primary Client or a replica a read is routed to.
+type preparer interface {
+	prepared(ctx context.Context, query string) (*sqlx.Stmt, error)
+}
+
+type replica struct {
+	name    string
+	db      *sqlx.DB
+	stmts   stmtCache
+	healthy atomic.Bool
+}
+
+func (r *replica) prepared(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	return r.stmts.get(ctx, r.db, query)
+}
+
+// setHealthy records the replica's state and logs changes.
+func (r *replica) setHealthy(healthy bool, reason error) {
+	if r.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		slog.Info("Replica is serving reads", "replica", r.name)
+	} else {
+		slog.Warn("Replica removed from reads, using the primary", "replica", r.name, "reason", reason)
+	}
+}
+
+type replicaSet struct {
+	cfg      ReplicaConfig
+	replicas []*replica
+	next     atomic.Uint64
+
+	mu     sync.Mutex
+	writes map[string]time.Time
+}
+
+// SetReplicas connects to the replicas. They serve no reads until the first
+// health check in RunReplicaChecks passes.
+func (c *Client) SetReplicas(cfg ReplicaConfig) error {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = 5 * time.Second
+	}
+	if cfg.MaxLag <= 0 {
+		cfg.MaxLag = 10 * time.Second
+	}
+	if cfg.StickyWindow <= 0 {
+		cfg.StickyWindow = cfg.MaxLag
+	}
+	set := &replicaSet{cfg: cfg, writes: make(map[string]time.Time)}
+	for i, rawURL := range cfg.URLs {
+		db, err := c.pool.open(rawURL)
+		if err != nil {
+			return fmt.Errorf("replica %d: %w", i+1, err)
+		}
+		set.replicas = append(set.replicas, &replica{name: replicaName(i, rawURL), db: db})
+	}
+	c.replicas = set
+	return nil
+}
+
+// replicaName identifies a replica in logs by its host, never by the full
+// URL, which may hold credentials.
+func replicaName(i int, rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return fmt.Sprintf("replica-%d", i+1)
+}
+
+type primaryKey struct{}
+
+// WithPrimary makes the reads made with ctx skip the replicas, for callers
+// that must see every committed write.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// read runs fn on a healthy replica, or on the primary when there is none,
+// when orderUID was written within the sticky window, when ctx comes from
+// WithPrimary, or when the replica fails.
+func (c *Client) read(ctx context.Context, orderUID string, fn func(preparer) error) error {
+	if ctx.Value(primaryKey{}) != nil {
+		return fn(c)
+	}
+	if r := c.replicas.pick(orderUID); r != nil {
+		err := fn(r)
+		if !isBackendFailure(err) {
+			return err
+		}
+		r.setHealthy(false, err)
+	}
+	return fn(c)
+}
+
+// pick returns the next healthy replica round robin, or nil.
+func (s *replicaSet) pick(orderUID string) *replica {
+	if s == nil || len(s.replicas) == 0 {
+		return nil
+	}
+	if orderUID != "" && s.writtenRecently(orderUID) {
+		return nil
+	}
+	start := s.next.Add(1)
+	for i := range s.replicas {
+		r := s.replicas[(start+uint64(i))%uint64(len(s.replicas))]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// noteWrite sends reads of the orders to the primary for the sticky window.
+func (c *Client) noteWrite(orderUIDs ...string) {
+	s := c.replicas
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	for _, uid := range orderUIDs {
+		s.writes[uid] = now
+	}
+	s.mu.Unlock()
+}
+
+// StickyWindow returns how long reads of a written order go to the primary,
+// or zero without replicas.
+func (c *Client) StickyWindow() time.Duration {
+	if c.replicas == nil {
+		return 0
+	}
+	return c.replicas.cfg.StickyWindow
+}
+
+func (s *replicaSet) writtenRecently(orderUID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.writes[orderUID]
+	return ok && time.Since(at) < s.cfg.StickyWindow
+}
+
+// RunReplicaChecks checks every replica on each interval until ctx is done.
+func (c *Client) RunReplicaChecks(ctx context.Context) error {
+	s := c.replicas
+	if s == nil {
+		return nil
+	}
+	ticker := time.NewTicker(s.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, r := range s.replicas {
+			err := s.check(ctx, r)
+			r.setHealthy(err == nil, err)
+		}
+		s.forgetWrites()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// check pings the replica and measures how far its replay is behind. A
+// replica that has replayed everything it received counts as not lagging,
+// however old its last transaction is.
+func (s *replicaSet) check(ctx context.Context, r *replica) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.CheckInterval)
+	defer cancel()
+	query := `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM NOW() - pg_last_xact_replay_timestamp()), 0)
+	END
+	`
+	var lag float64
+	if err := r.db.GetContext(ctx, &lag, query); err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	if d := time.Duration(lag * float64(time.Second)); d > s.cfg.MaxLag {
+		return fmt.Errorf("replication lag %s exceeds %s", d.Round(time.Millisecond), s.cfg.MaxLag)
+	}
+	return nil
+}
+
+func (s *replicaSet) forgetWrites() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for uid, at := range s.writes {
+		if time.Since(at) >= s.cfg.StickyWindow {
+			delete(s.writes, uid)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"wbstorage/internal/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func (c *Client) GetOrdersCreatedBefore(ctx context.Context, before time.Time, n int) ([]string, error) {
+	var orderUIDs []string
+	query := `
+	SELECT order_uid
+	FROM orders
+	WHERE date_created < $1
+	ORDER BY date_created
+	LIMIT NULLIF($2, 0)
+	`
+	stmt, err := c.prepared(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := stmt.SelectContext(ctx, &orderUIDs, before, max(n, 0)); err != nil {
+		return nil, fmt.Errorf("error fetching orders created before %s: %v", before, err)
+	}
+	return orderUIDs, nil
+}
+
+// DeleteOrders removes the archived orders in one transaction and returns how
+// many it removed. Each order is locked like in deleteOrder and kept if it
+// no longer equals its archived copy, so an update that raced the archiving
+// is not lost. Unlike DeleteOrder it records no history: it is meant for
+// orders that were archived elsewhere.
+func (c *Client) DeleteOrders(ctx context.Context, archived []models.Order) (int, error) {
+	stmt, err := c.prepared(ctx, selectOrderQuery)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	err = c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		deleted = 0
+		for i := range archived {
+			orderUID := archived[i].OrderUID
+			c.noteWrite(orderUID)
+			dateCreated, err := lockOrder(ctx, tx, orderUID)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			order, err := c.scanOrder(ctx, tx.StmtxContext(ctx, stmt), orderUID)
+			if err != nil {
+				return err
+			}
+			if err := checkUnchanged(&archived[i], order); errors.Is(err, ErrOrderChanged) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			deleteQuery := `DELETE FROM orders WHERE order_uid = $1 AND date_created = $2`
+			if _, err := tx.ExecContext(ctx, deleteQuery, orderUID, dateCreated); err != nil {
+				return fmt.Errorf("error deleting orders: %w", err)
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// PurgeHistory removes raw messages received before the given time and the
+// history of orders that no longer exist, recorded before that time.
+func (c *Client) PurgeHistory(ctx context.Context, before time.Time) (int, error) {
+	purged := 0
+	err := c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, `
+		DELETE FROM order_history h
+		WHERE h.changed_at < $1
+			AND NOT EXISTS (SELECT 1 FROM orders o WHERE o.order_uid = h.order_uid)
+		`, before)
+		if err != nil {
+			return fmt.Errorf("error purging order history: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		purged += int(n)
+
+		res, err = tx.ExecContext(ctx, `DELETE FROM raw_messages WHERE received_at < $1`, before)
+		if err != nil {
+			return fmt.Errorf("error purging raw messages: %w", err)
+		}
+		n, _ = res.RowsAffected()
+		purged += int(n)
+		return nil
+	})
+	return purged, err
+}
+
+func (m *MemoryDB) GetOrdersCreatedBefore(ctx context.Context, before time.Time, n int) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var matched []*memoryOrder
+	for _, stored := range m.orders {
+		if stored.order.DateCreated.Before(before) {
+			matched = append(matched, stored)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].order.DateCreated.Before(matched[j].order.DateCreated)
+	})
+	return orderUIDs(matched, n), nil
+}
+
+func (m *MemoryDB) DeleteOrders(ctx context.Context, archived []models.Order) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := 0
+	for i := range archived {
+		uid := archived[i].OrderUID
+		stored, ok := m.orders[uid]
+		if !ok {
+			continue
+		}
+		if err := checkUnchanged(&archived[i], stored.order); errors.Is(err, ErrOrderChanged) {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		delete(m.orders, uid)
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (m *MemoryDB) PurgeHistory(ctx context.Context, before time.Time) (int, error) {
+	orphaned, err := m.orphanedHistory(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := m.purgeOrderHistory(ctx, orphaned, before)
+	if err != nil {
+		return purged, err
+	}
+	n, err := m.purgeRawMessages(ctx, before)
+	return purged + n, err
+}
+
+func (s *SQLiteDB) GetOrdersCreatedBefore(ctx context.Context, before time.Time, n int) ([]string, error) {
+	var orderUIDs []string
+	limit := n
+	if limit <= 0 {
+		limit = -1
+	}
+	query := `
+	SELECT order_uid
+	FROM orders
+	WHERE date_created < $1
+	ORDER BY date_created
+	LIMIT $2
+	`
+	if err := s.db.SelectContext(ctx, &orderUIDs, query, before.UnixMicro(), limit); err != nil {
+		return nil, fmt.Errorf("error fetching orders created before %s: %v", before, err)
+	}
+	return orderUIDs, nil
+}
+
+func (s *SQLiteDB) DeleteOrders(ctx context.Context, archived []models.Order) (int, error) {
+	deleted := 0
+	err := s.withTx(ctx, func(tx *sqlx.Tx) error {
+		deleted = 0
+		for i := range archived {
+			uid := archived[i].OrderUID
+			order, err := s.selectOrder(ctx, tx, uid)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("error deleting orders: %w", err)
+			}
+			if err := checkUnchanged(&archived[i], order); errors.Is(err, ErrOrderChanged) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM orders WHERE order_uid = $1`, uid); err != nil {
+				return fmt.Errorf("error deleting orders: %w", err)
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (s *SQLiteDB) PurgeHistory(ctx context.Context, before time.Time) (int, error) {
+	purged := 0
+	err := s.withTx(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, `
+		DELETE FROM order_history
+		WHERE changed_at < $1
+			AND order_uid NOT IN (SELECT order_uid FROM orders)
+		`, before.UTC())
+		if err != nil {
+			return fmt.Errorf("error purging order history: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		purged += int(n)
+
+		res, err = tx.ExecContext(ctx, `DELETE FROM raw_messages WHERE received_at < $1`, before.UTC())
+		if err != nil {
+			return fmt.Errorf("error purging raw messages: %w", err)
+		}
+		n, _ = res.RowsAffected()
+		purged += int(n)
+		return nil
+	})
+	return purged, err
+}
+
+func (b *BreakerClient) GetOrdersCreatedBefore(ctx context.Context, before time.Time, n int) ([]string, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	orderUIDs, err := b.db.GetOrdersCreatedBefore(ctx, before, n)
+	b.record(err)
+	return orderUIDs, err
+}
+
+func (b *BreakerClient) DeleteOrders(ctx context.Context, archived []models.Order) (int, error) {
+	if err := b.allow(); err != nil {
+		return 0, err
+	}
+	n, err := b.db.DeleteOrders(ctx, archived)
+	b.record(err)
+	return n, err
+}
+
+func (b *BreakerClient) PurgeHistory(ctx context.Context, before time.Time) (int, error) {
+	if err := b.allow(); err != nil {
+		return 0, err
+	}
+	n, err := b.db.PurgeHistory(ctx, before)
+	b.record(err)
+	return n, err
+}
+
+func (c *CachedClient) GetOrdersCreatedBefore(ctx context.Context, before time.Time, n int) ([]string, error) {
+	return c.db.GetOrdersCreatedBefore(ctx, before, n)
+}
+
+// DeleteOrders deletes the orders and evicts them here and, through the
+// invalidator, on other instances.
+func (c *CachedClient) DeleteOrders(ctx context.Context, archived []models.Order) (int, error) {
+	n, err := c.db.DeleteOrders(ctx, archived)
+	if err != nil {
+		return 0, err
+	}
+	for _, order := range archived {
+		c.Evict(order.OrderUID)
+		c.invalidate(ctx, order.OrderUID)
+	}
+	return n, nil
+}
+
+func (c *CachedClient) PurgeHistory(ctx context.Context, before time.Time) (int, error) {
+	return c.db.PurgeHistory(ctx, before)
+}
@@ -0,0 +1,358 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"wbstorage/internal/models"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// ErrReturnExists is returned by InsertReturn for a return ID that is taken.
+var ErrReturnExists = errors.New("return already exists")
+
+// ErrItemReturned is returned by InsertReturn for a return with an item that
+// is in another open return of the order.
+var ErrItemReturned = errors.New("item is already in another return")
+
+// ErrReturnChanged is returned by UpdateReturn when the return moved to
+// another status in the meantime.
+var ErrReturnChanged = errors.New("return was changed concurrently")
+
+// returnRow is a return as stored in Postgres, with the items as JSON.
+type returnRow struct {
+	models.Return
+	ItemsJSON         []byte         `db:"items"`
+	RefundTransaction sql.NullString `db:"refund_transaction"`
+}
+
+func (r returnRow) decode() (models.Return, error) {
+	ret := r.Return
+	ret.RefundTransaction = r.RefundTransaction.String
+	if err := json.Unmarshal(r.ItemsJSON, &ret.Items); err != nil {
+		return ret, fmt.Errorf("error decoding return items: %w", err)
+	}
+	return ret, nil
+}
+
+const returnColumns = `return_id, order_uid, status, items, refund_transaction, created_at, updated_at`
+
+// InsertReturn checks the items against the other returns of the order and
+// stores ret in one transaction, holding the order's advisory lock so
+// returns of the order are inserted one at a time.
+func (c *Client) InsertReturn(ctx context.Context, ret models.Return) error {
+	items, err := json.Marshal(ret.Items)
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT INTO returns (` + returnColumns + `)
+	VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
+	`
+	return c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		if err := lockOrderUID(ctx, tx, ret.OrderUID); err != nil {
+			return err
+		}
+		existing, err := c.orderReturns(ctx, tx, ret.OrderUID)
+		if err != nil {
+			return err
+		}
+		if err := checkOverlap(ret, existing); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, ret.ReturnID, ret.OrderUID, ret.Status, items,
+			ret.RefundTransaction, ret.CreatedAt, ret.UpdatedAt)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return fmt.Errorf("error inserting return %s: %w", ret.ReturnID, ErrReturnExists)
+		}
+		if err != nil {
+			return fmt.Errorf("error inserting return: %w", err)
+		}
+		return nil
+	})
+}
+
+// checkOverlap fails with ErrItemReturned if an item of ret is in another
+// open return of existing.
+func checkOverlap(ret models.Return, existing []models.Return) error {
+	if rid, other, ok := ret.Overlap(existing); ok {
+		return fmt.Errorf("%w: item %s is in return %s", ErrItemReturned, rid, other)
+	}
+	return nil
+}
+
+func (c *Client) SelectReturn(ctx context.Context, returnID string) (*models.Return, error) {
+	var row returnRow
+	query := `SELECT ` + returnColumns + ` FROM returns WHERE return_id = $1`
+	if err := c.db.GetContext(ctx, &row, query, returnID); err != nil {
+		return nil, fmt.Errorf("error fetching return: %w", err)
+	}
+	ret, err := row.decode()
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func (c *Client) OrderReturns(ctx context.Context, orderUID string) ([]models.Return, error) {
+	return c.orderReturns(ctx, c.db, orderUID)
+}
+
+func (c *Client) orderReturns(ctx context.Context, q sqlx.QueryerContext, orderUID string) ([]models.Return, error) {
+	var rows []returnRow
+	query := `SELECT ` + returnColumns + ` FROM returns WHERE order_uid = $1 ORDER BY created_at, return_id`
+	if err := sqlx.SelectContext(ctx, q, &rows, query, orderUID); err != nil {
+		return nil, fmt.Errorf("error fetching returns: %w", err)
+	}
+	returns := make([]models.Return, 0, len(rows))
+	for _, row := range rows {
+		ret, err := row.decode()
+		if err != nil {
+			return nil, err
+		}
+		returns = append(returns, ret)
+	}
+	return returns, nil
+}
+
+func (c *Client) UpdateReturn(ctx context.Context, ret models.Return, from string) error {
+	query := `
+	UPDATE returns SET status = $3, refund_transaction = NULLIF($4, ''), updated_at = $5
+	WHERE return_id = $1 AND status = $2
+	`
+	res, err := c.db.ExecContext(ctx, query, ret.ReturnID, from, ret.Status, ret.RefundTransaction, ret.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("error updating return: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error updating return: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	// tell a missing return apart from one that changed status
+	if _, err := c.SelectReturn(ctx, ret.ReturnID); err != nil {
+		return err
+	}
+	return ErrReturnChanged
+}
+
+func (s *SQLiteDB) InsertReturn(ctx context.Context, ret models.Return) error {
+	data, err := json.Marshal(ret)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO returns (return_id, order_uid, status, data) VALUES ($1, $2, $3, $4)`
+	return s.withTx(ctx, func(tx *sqlx.Tx) error {
+		existing, err := s.orderReturns(ctx, tx, ret.OrderUID)
+		if err != nil {
+			return err
+		}
+		if err := checkOverlap(ret, existing); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, ret.ReturnID, ret.OrderUID, ret.Status, data)
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+			return fmt.Errorf("error inserting return %s: %w", ret.ReturnID, ErrReturnExists)
+		}
+		if err != nil {
+			return fmt.Errorf("error inserting return: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteDB) SelectReturn(ctx context.Context, returnID string) (*models.Return, error) {
+	return s.selectReturn(ctx, s.db, returnID)
+}
+
+func (s *SQLiteDB) selectReturn(ctx context.Context, q sqlx.QueryerContext, returnID string) (*models.Return, error) {
+	var data []byte
+	if err := sqlx.GetContext(ctx, q, &data, `SELECT data FROM returns WHERE return_id = $1`, returnID); err != nil {
+		return nil, fmt.Errorf("error fetching return: %w", err)
+	}
+	var ret models.Return
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, fmt.Errorf("error decoding return: %w", err)
+	}
+	return &ret, nil
+}
+
+func (s *SQLiteDB) OrderReturns(ctx context.Context, orderUID string) ([]models.Return, error) {
+	return s.orderReturns(ctx, s.db, orderUID)
+}
+
+func (s *SQLiteDB) orderReturns(ctx context.Context, q sqlx.QueryerContext, orderUID string) ([]models.Return, error) {
+	var rows [][]byte
+	if err := sqlx.SelectContext(ctx, q, &rows, `SELECT data FROM returns WHERE order_uid = $1`, orderUID); err != nil {
+		return nil, fmt.Errorf("error fetching returns: %w", err)
+	}
+	returns := make([]models.Return, 0, len(rows))
+	for _, data := range rows {
+		var ret models.Return
+		if err := json.Unmarshal(data, &ret); err != nil {
+			return nil, fmt.Errorf("error decoding return: %w", err)
+		}
+		returns = append(returns, ret)
+	}
+	sortReturns(returns)
+	return returns, nil
+}
+
+func (s *SQLiteDB) UpdateReturn(ctx context.Context, ret models.Return, from string) error {
+	return s.withTx(ctx, func(tx *sqlx.Tx) error {
+		stored, err := s.selectReturn(ctx, tx, ret.ReturnID)
+		if err != nil {
+			return err
+		}
+		if stored.Status != from {
+			return ErrReturnChanged
+		}
+		stored.Status = ret.Status
+		stored.RefundTransaction = ret.RefundTransaction
+		stored.UpdatedAt = ret.UpdatedAt
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		query := `UPDATE returns SET status = $2, data = $3 WHERE return_id = $1`
+		if _, err := tx.ExecContext(ctx, query, ret.ReturnID, ret.Status, data); err != nil {
+			return fmt.Errorf("error updating return: %w", err)
+		}
+		return nil
+	})
+}
+
+func (m *MemoryDB) InsertReturn(ctx context.Context, ret models.Return) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.returns[ret.ReturnID]; ok {
+		return fmt.Errorf("error inserting return %s: %w", ret.ReturnID, ErrReturnExists)
+	}
+	var existing []models.Return
+	for _, other := range m.returns {
+		if other.OrderUID == ret.OrderUID {
+			existing = append(existing, *other)
+		}
+	}
+	if err := checkOverlap(ret, existing); err != nil {
+		return err
+	}
+	m.returns[ret.ReturnID] = ret.Clone()
+	return nil
+}
+
+func (m *MemoryDB) SelectReturn(ctx context.Context, returnID string) (*models.Return, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ret, ok := m.returns[returnID]
+	if !ok {
+		return nil, fmt.Errorf("error fetching return: %w", sql.ErrNoRows)
+	}
+	return ret.Clone(), nil
+}
+
+func (m *MemoryDB) OrderReturns(ctx context.Context, orderUID string) ([]models.Return, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	returns := []models.Return{}
+	for _, ret := range m.returns {
+		if ret.OrderUID == orderUID {
+			returns = append(returns, *ret.Clone())
+		}
+	}
+	sortReturns(returns)
+	return returns, nil
+}
+
+func (m *MemoryDB) UpdateReturn(ctx context.Context, ret models.Return, from string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.returns[ret.ReturnID]
+	if !ok {
+		return fmt.Errorf("error updating return: %w", sql.ErrNoRows)
+	}
+	if stored.Status != from {
+		return ErrReturnChanged
+	}
+	stored.Status = ret.Status
+	stored.RefundTransaction = ret.RefundTransaction
+	stored.UpdatedAt = ret.UpdatedAt
+	return nil
+}
+
+// sortReturns orders returns oldest first.
+func sortReturns(returns []models.Return) {
+	sort.Slice(returns, func(i, j int) bool {
+		if !returns[i].CreatedAt.Equal(returns[j].CreatedAt) {
+			return returns[i].CreatedAt.Before(returns[j].CreatedAt)
+		}
+		return returns[i].ReturnID < returns[j].ReturnID
+	})
+}
+
+func (b *BreakerClient) InsertReturn(ctx context.Context, ret models.Return) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.db.InsertReturn(ctx, ret)
+	b.record(err)
+	return err
+}
+
+func (b *BreakerClient) SelectReturn(ctx context.Context, returnID string) (*models.Return, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	ret, err := b.db.SelectReturn(ctx, returnID)
+	b.record(err)
+	return ret, err
+}
+
+func (b *BreakerClient) OrderReturns(ctx context.Context, orderUID string) ([]models.Return, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	returns, err := b.db.OrderReturns(ctx, orderUID)
+	b.record(err)
+	return returns, err
+}
+
+func (b *BreakerClient) UpdateReturn(ctx context.Context, ret models.Return, from string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.db.UpdateReturn(ctx, ret, from)
+	b.record(err)
+	return err
+}
+
+// Returns are not cached; refunds change the order through PatchOrder,
+// which evicts it.
+
+func (c *CachedClient) InsertReturn(ctx context.Context, ret models.Return) error {
+	return c.db.InsertReturn(ctx, ret)
+}
+
+func (c *CachedClient) SelectReturn(ctx context.Context, returnID string) (*models.Return, error) {
+	return c.db.SelectReturn(ctx, returnID)
+}
+
+func (c *CachedClient) OrderReturns(ctx context.Context, orderUID string) ([]models.Return, error) {
+	return c.db.OrderReturns(ctx, orderUID)
+}
+
+func (c *CachedClient) UpdateReturn(ctx context.Context, ret models.Return, from string) error {
+	return c.db.UpdateReturn(ctx, ret, from)
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+
+	"wbstorage/internal/models"
+	"wbstorage/internal/pii"
+)
+
+type SearchResult struct {
+	OrderUID string  `json:"order_uid"`
+	Rank     float64 `json:"rank"`
+	// Snippet is HTML-escaped text with the matched terms wrapped in <mark>.
+	Snippet string `json:"snippet"`
+}
+
+// Markers delimiting matches in raw snippets; they can't appear in the
+// terms and are replaced by <mark> tags once the text is escaped.
+const (
+	matchStart = "\x02"
+	matchStop  = "\x03"
+)
+
+// searchTerms splits a query into lower-cased words of letters and digits.
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// prefixTSQuery matches documents containing every term as a word prefix.
+// With a keyring a term also matches the search token of a whole word of an
+// encrypted delivery.
+func prefixTSQuery(terms []string, k *pii.Keyring) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = term + ":*"
+		if k != nil {
+			parts[i] = "(" + parts[i] + " | " + searchToken(k, term) + ")"
+		}
+	}
+	return strings.Join(parts, " & ")
+}
+
+// searchTokens returns the search tokens of the words of values, separated
+// by spaces. Encrypted delivery names and addresses are searched through
+// them: the tokens are blind indexes, so they match whole words only and
+// reveal nothing but equality of words.
+func searchTokens(k *pii.Keyring, values ...string) string {
+	var tokens []string
+	for _, value := range values {
+		for _, term := range searchTerms(value) {
+			tokens = append(tokens, searchToken(k, term))
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// searchToken is the blind index of a search term, shortened and prefixed to
+// be a single word of the search document.
+func searchToken(k *pii.Keyring, term string) string {
+	return "pii" + hex.EncodeToString(k.BlindIndex("search", term))[:16]
+}
+
+// markedToHTML escapes a snippet whose matches are delimited by
+// matchStart/matchStop and turns the delimiters into <mark> tags.
+func markedToHTML(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, matchStart, "<mark>")
+	return strings.ReplaceAll(escaped, matchStop, "</mark>")
+}
+
+func (c *Client) SearchOrders(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	searchQuery := `
+	SELECT s.order_uid,
+		ts_rank(s.tsv, q) AS rank,
+		ts_headline('simple', s.document, q, $2) AS snippet
+	FROM order_search s, to_tsquery('simple', $1) q
+	WHERE s.tsv @@ q
+	ORDER BY rank DESC, s.order_uid
+	LIMIT $3
+	`
+	options := "StartSel=" + matchStart + ", StopSel=" + matchStop + ", MaxFragments=2, MaxWords=20, MinWords=5"
+	var results []SearchResult
+	err := c.read(ctx, "", func(p preparer) error {
+		stmt, err := p.prepared(ctx, searchQuery)
+		if err != nil {
+			return err
+		}
+		results = results[:0]
+		if err := stmt.SelectContext(ctx, &results, prefixTSQuery(terms, c.pii), options, limit); err != nil {
+			return fmt.Errorf("error searching orders: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Snippet = markedToHTML(results[i].Snippet)
+	}
+	return results, nil
+}
+
+// searchDocument is the text searched for an order, the same fields the
+// Postgres order_search table is built from.
+func searchDocument(order *models.Order) string {
+	var parts []string
+	for _, item := range order.Items {
+		parts = append(parts, item.Name, item.Brand)
+	}
+	parts = append(parts, order.Delivery.Name, order.Delivery.City, order.Delivery.Address)
+	return strings.Join(parts, " ")
+}
+
+// matchOrders searches orders in memory, for the backends without a search
+// index. A term matches the start of a word, like the Postgres prefix query;
+// the rank is the number of matched words.
+func matchOrders(orders []*models.Order, query string, limit int) []SearchResult {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	var results []SearchResult
+	for _, order := range orders {
+		words := strings.Fields(searchDocument(order))
+		matched := make([]bool, len(words))
+		hits := 0
+		all := true
+		for _, term := range terms {
+			found := false
+			for i, word := range words {
+				if strings.HasPrefix(strings.ToLower(strings.TrimFunc(word, isPunct)), term) {
+					matched[i] = true
+					found = true
+					hits++
+				}
+			}
+			all = all && found
+		}
+		if !all {
+			continue
+		}
+
+		var b strings.Builder
+		for i, word := range words {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			if matched[i] {
+				b.WriteString(matchStart + word + matchStop)
+			} else {
+				b.WriteString(word)
+			}
+		}
+		results = append(results, SearchResult{
+			OrderUID: order.OrderUID,
+			Rank:     float64(hits),
+			Snippet:  markedToHTML(b.String()),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].OrderUID < results[j].OrderUID
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func isPunct(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+func (m *MemoryDB) SearchOrders(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	m.mu.RLock()
+	orders := make([]*models.Order, 0, len(m.orders))
+	for _, stored := range m.orders {
+		orders = append(orders, stored.order)
+	}
+	results := matchOrders(orders, query, limit)
+	m.mu.RUnlock()
+	return results, nil
+}
+
+// SearchOrders scans every order; SQLite is meant for small local datasets.
+func (s *SQLiteDB) SearchOrders(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	rows, err := s.db.QueryxContext(ctx, `SELECT data FROM orders`)
+	if err != nil {
+		return nil, fmt.Errorf("error searching orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []*models.Order
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("error searching orders: %w", err)
+		}
+		var order models.Order
+		if err := json.Unmarshal(data, &order); err != nil {
+			return nil, fmt.Errorf("error decoding order: %w", err)
+		}
+		orders = append(orders, &order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error searching orders: %w", err)
+	}
+	return matchOrders(orders, query, limit), nil
+}
+
+func (b *BreakerClient) SearchOrders(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	results, err := b.db.SearchOrders(ctx, query, limit)
+	b.record(err)
+	return results, err
+}
+
+func (c *CachedClient) SearchOrders(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	return c.db.SearchOrders(ctx, query, limit)
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"wbstorage/internal/models"
+	"wbstorage/internal/pii"
+)
+
+func testKeyring(t *testing.T, indexKey byte) *pii.Keyring {
+	t.Helper()
+	keyring, err := pii.NewKeyring(map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}, "k1", bytes.Repeat([]byte{indexKey}, 32))
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	return keyring
+}
+
+func TestSearchTokensMatchQueryWords(t *testing.T) {
+	keyring := testKeyring(t, 2)
+	tokens := strings.Fields(searchTokens(keyring, "Test Testov", "Ploshad Mira, 15"))
+	if len(tokens) != 5 {
+		t.Fatalf("got %d tokens, want one per word: %v", len(tokens), tokens)
+	}
+	for _, token := range tokens {
+		if !strings.HasPrefix(token, "pii") || len(token) != len("pii")+16 {
+			t.Errorf("token %q is not a shortened blind index", token)
+		}
+	}
+
+	query := prefixTSQuery(searchTerms("testov MIRA"), keyring)
+	for _, word := range []string{"testov", "mira"} {
+		token := searchToken(keyring, word)
+		if !strings.Contains(query, token) {
+			t.Errorf("query %q lacks the token of %q", query, word)
+		}
+		found := false
+		for _, stored := range tokens {
+			found = found || stored == token
+		}
+		if !found {
+			t.Errorf("the delivery has no token for %q", word)
+		}
+	}
+
+	if searchToken(testKeyring(t, 3), "testov") == searchToken(keyring, "testov") {
+		t.Error("tokens don't depend on the index key")
+	}
+	if got, want := prefixTSQuery([]string{"testov"}, nil), "testov:*"; got != want {
+		t.Errorf("query without a keyring: got %q, want %q", got, want)
+	}
+}
+
+func TestSearchRankingAndEscaping(t *testing.T) {
+	ctx := context.Background()
+	few := testOrder("search-few")
+	few.Items = []models.Item{{Name: "Red lipstick", Brand: "Sabo <b>"}}
+	many := testOrder("search-many")
+	many.Items = []models.Item{{Name: "Red red scarf", Brand: "Redwood"}}
+	other := testOrder("search-other")
+	other.Items = []models.Item{{Name: "Blue lipstick", Brand: "Sabo"}}
+
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "orders.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteDB: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.db.Close() })
+	for name, db := range map[string]Database{"memory": NewMemoryDB(), "sqlite": sqliteDB} {
+		t.Run(name, func(t *testing.T) {
+			for _, order := range []models.Order{few, many, other} {
+				mustInsert(t, db, order)
+			}
+
+			results, err := db.SearchOrders(ctx, "RED", 0)
+			if err != nil {
+				t.Fatalf("SearchOrders: %v", err)
+			}
+			if len(results) != 2 || results[0].OrderUID != many.OrderUID || results[1].OrderUID != few.OrderUID {
+				t.Fatalf("results %+v, want %s ranked above %s", results, many.OrderUID, few.OrderUID)
+			}
+			if results, _ := db.SearchOrders(ctx, "red", 1); len(results) != 1 {
+				t.Fatalf("limit 1 returned %d results", len(results))
+			}
+
+			// every term must match, operators are not passed through
+			results, err = db.SearchOrders(ctx, "lip & !sab:*", 0)
+			if err != nil {
+				t.Fatalf("SearchOrders: %v", err)
+			}
+			if len(results) != 2 {
+				t.Fatalf("results %+v, want both lipsticks", results)
+			}
+			for _, r := range results {
+				if strings.Contains(r.Snippet, "<b>") {
+					t.Errorf("snippet %q is not escaped", r.Snippet)
+				}
+				if !strings.Contains(r.Snippet, "<mark>") {
+					t.Errorf("snippet %q marks no match", r.Snippet)
+				}
+			}
+			if results, _ := db.SearchOrders(ctx, " &|! ", 0); len(results) != 0 {
+				t.Errorf("a query without words matched %+v", results)
+			}
+		})
+	}
+
+	if got, want := prefixTSQuery(searchTerms("lip & !sab:*"), nil), "lip:* & sab:*"; got != want {
+		t.Errorf("prefixTSQuery = %q, want %q", got, want)
+	}
+	if got, want := markedToHTML(matchStart+"a&b"+matchStop+" <i>"), "<mark>a&amp;b</mark> &lt;i&gt;"; got != want {
+		t.Errorf("markedToHTML = %q, want %q", got, want)
+	}
+}
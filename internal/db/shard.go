@@ -0,0 +1,940 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"time"
+
+	"wbstorage/internal/models"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"golang.org/x/sync/errgroup"
+)
+
+// ShardedDB is a Database spread over several databases. Each order lives on
+// the shard picked by its shardkey; see ShardFor.
+//
+// Reads by order UID don't know the shardkey, so they ask every shard and
+// prefer the copy on the order's home shard. That keeps orders readable
+// while Reshard moves them, at the cost of one query per shard. Writes of a
+// whole order know its home shard and ask the others only when it doesn't
+// hold the order.
+//
+// Raw messages are stored on the first shard only: their IDs come from a
+// per-database sequence and would collide across shards. Returns are kept
+// there as well, so they stay put when their orders are resharded.
+type ShardedDB struct {
+	shards []Database
+}
+
+// SourceShardMove is the history source of the deletes that remove an order
+// from its old shard after it was copied to its new one.
+const SourceShardMove = "shard-move"
+
+// ErrOrderChanged is returned when an order changed between reading it and
+// deleting it conditionally.
+var ErrOrderChanged = errors.New("order was changed concurrently")
+
+// shardStore is what ShardedDB needs of a shard beyond Database, for the
+// operations that span shards.
+type shardStore interface {
+	Database
+	// deleteOrder deletes the order; with expected set only if the stored
+	// order still equals it, checked in the transaction that deletes it.
+	deleteOrder(ctx context.Context, orderUID string, expected *models.Order) error
+	// orphanedHistory returns the orders with history recorded before the
+	// given time that are not stored on the shard.
+	orphanedHistory(ctx context.Context, before time.Time) ([]string, error)
+	// storedOrders returns which of the orders are stored on the shard.
+	storedOrders(ctx context.Context, orderUIDs []string) ([]string, error)
+	// purgeOrderHistory removes the history of the orders recorded before the
+	// given time, skipping orders stored on the shard.
+	purgeOrderHistory(ctx context.Context, orderUIDs []string, before time.Time) (int, error)
+	// purgeRawMessages removes the raw messages received before the given time.
+	purgeRawMessages(ctx context.Context, before time.Time) (int, error)
+	// eraseOrderData anonymizes the history of the orders and deletes their
+	// raw messages, leaving the orders themselves alone.
+	eraseOrderData(ctx context.Context, orderUIDs []string) error
+}
+
+// NewShardedDB spreads orders over shards, which must be Postgres, SQLite or
+// in-memory databases.
+func NewShardedDB(shards []Database) (*ShardedDB, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("sharded database needs at least one shard")
+	}
+	for i, shard := range shards {
+		if _, ok := shard.(shardStore); !ok {
+			return nil, fmt.Errorf("shard %d: %T can't be used as a shard", i, shard)
+		}
+	}
+	return &ShardedDB{shards: shards}, nil
+}
+
+func (s *ShardedDB) store(i int) shardStore {
+	return s.shards[i].(shardStore)
+}
+
+// checkUnchanged yields ErrOrderChanged when the content of current differs
+// from expected.
+func checkUnchanged(expected, current *models.Order) error {
+	changes, err := models.DiffOrders(expected, current)
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		return fmt.Errorf("order %s differs in %d fields: %w", current.OrderUID, len(changes), ErrOrderChanged)
+	}
+	return nil
+}
+
+// Shards returns the shards in configuration order.
+func (s *ShardedDB) Shards() []Database {
+	return s.shards
+}
+
+// ShardFor returns the index of the shard that owns shardKey among n shards.
+// Adding or removing a shard changes the owner of most keys, so Reshard has
+// to run after the shard list changes.
+func ShardFor(shardKey string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(shardKey))
+	return int(h.Sum32() % uint32(n))
+}
+
+func (s *ShardedDB) home(order *models.Order) int {
+	return ShardFor(order.ShardKey, len(s.shards))
+}
+
+// each runs fn on every shard concurrently and returns the first error.
+func (s *ShardedDB) each(ctx context.Context, fn func(ctx context.Context, i int, shard Database) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	for i, shard := range s.shards {
+		g.Go(func() error { return fn(ctx, i, shard) })
+	}
+	return g.Wait()
+}
+
+type shardCopy struct {
+	shard int
+	order *models.Order
+}
+
+// locate returns every stored copy of an order, the one on its home shard
+// first. There is more than one only while an order is being moved.
+//
+// A caller that knows the home shard passes it, or -1 otherwise. The home
+// shard is then asked first, and the other shards only when it doesn't hold
+// the order, and failures of the other shards are logged and skipped. Without
+// a home shard failures are skipped only once a copy on its home shard is
+// found, as any other copy is a leftover of a move.
+func (s *ShardedDB) locate(ctx context.Context, orderUID string, home int) ([]shardCopy, error) {
+	found := make([]*models.Order, len(s.shards))
+	if home >= 0 {
+		order, err := s.shards[home].SelectOrder(ctx, orderUID)
+		switch {
+		case err == nil && s.home(order) == home:
+			return []shardCopy{{shard: home, order: order}}, nil
+		case err == nil:
+			found[home] = order
+		case !errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("shard %d: %w", home, err)
+		}
+	}
+	errs := make([]error, len(s.shards))
+	// errors are collected rather than returned, so they don't cancel the
+	// queries of the other shards
+	s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		if i == home {
+			return nil
+		}
+		order, err := shard.SelectOrder(ctx, orderUID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			errs[i] = fmt.Errorf("shard %d: %w", i, err)
+			return nil
+		}
+		found[i] = order
+		return nil
+	})
+	var copies []shardCopy
+	settled := false
+	for i, order := range found {
+		if order != nil {
+			copies = append(copies, shardCopy{shard: i, order: order})
+			settled = settled || i == s.home(order)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		if home < 0 && !settled {
+			return nil, err
+		}
+		slog.Warn("Skipped failing shards while locating order", "orderUID", orderUID, "error", err)
+	}
+	sort.SliceStable(copies, func(i, j int) bool {
+		return copies[i].shard == s.home(copies[i].order) && copies[j].shard != s.home(copies[j].order)
+	})
+	return copies, nil
+}
+
+// dropCopies deletes the order from every shard in copies except keep. With
+// a shard to keep the order is moving, which the history records as the
+// source of the deletes.
+func (s *ShardedDB) dropCopies(ctx context.Context, copies []shardCopy, keep int) error {
+	if keep >= 0 {
+		ctx = WithSource(ctx, SourceShardMove)
+	}
+	for _, c := range copies {
+		if c.shard == keep {
+			continue
+		}
+		if err := s.shards[c.shard].DeleteOrder(ctx, c.order.OrderUID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("error removing order from shard %d: %w", c.shard, err)
+		}
+	}
+	return nil
+}
+
+func (s *ShardedDB) InsertOrder(ctx context.Context, order models.Order) error {
+	copies, err := s.locate(ctx, order.OrderUID, s.home(&order))
+	if err != nil {
+		return err
+	}
+	if len(copies) > 0 {
+		return fmt.Errorf("error inserting order %s: %w", order.OrderUID, ErrOrderExists)
+	}
+	return s.shards[s.home(&order)].InsertOrder(ctx, order)
+}
+
+func (s *ShardedDB) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
+	copies, err := s.locate(ctx, orderUID, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(copies) == 0 {
+		return nil, fmt.Errorf("error fetching order: %w", sql.ErrNoRows)
+	}
+	return copies[0].order, nil
+}
+
+// UpsertOrder stores order on its home shard. An order whose shardkey changed
+// is written to the new shard first and then removed from the old one.
+func (s *ShardedDB) UpsertOrder(ctx context.Context, order models.Order) error {
+	target := s.home(&order)
+	copies, err := s.locate(ctx, order.OrderUID, target)
+	if err != nil {
+		return err
+	}
+	if err := s.shards[target].UpsertOrder(ctx, order); err != nil {
+		return err
+	}
+	return s.dropCopies(ctx, copies, target)
+}
+
+func (s *ShardedDB) PatchOrder(ctx context.Context, orderUID string, patch []byte) (*models.Order, error) {
+	copies, err := s.locate(ctx, orderUID, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(copies) == 0 {
+		return nil, fmt.Errorf("error fetching order: %w", sql.ErrNoRows)
+	}
+	source := copies[0].shard
+	patched, err := s.shards[source].PatchOrder(ctx, orderUID, patch)
+	if err != nil {
+		return nil, err
+	}
+	target := s.home(patched)
+	if target != source {
+		if err := s.shards[target].UpsertOrder(ctx, *patched); err != nil {
+			return nil, fmt.Errorf("error moving order to shard %d: %w", target, err)
+		}
+		copies = append(copies, shardCopy{shard: source, order: patched})
+	}
+	if err := s.dropCopies(ctx, copies, target); err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
+
+// AddPayment adds the payment on the shard of the order; payments don't
+// change the shardkey, so the order stays there.
+func (s *ShardedDB) AddPayment(ctx context.Context, orderUID string, p models.Payment) (*models.Order, error) {
+	copies, err := s.locate(ctx, orderUID, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(copies) == 0 {
+		return nil, fmt.Errorf("error fetching order: %w", sql.ErrNoRows)
+	}
+	return s.shards[copies[0].shard].AddPayment(ctx, orderUID, p)
+}
+
+// MergeOrder merges on the shard of the order; payments and shipments don't
+// change the shardkey, so the order stays there.
+func (s *ShardedDB) MergeOrder(ctx context.Context, order models.Order) (*models.Order, bool, error) {
+	copies, err := s.locate(ctx, order.OrderUID, -1)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(copies) == 0 {
+		return nil, false, fmt.Errorf("error fetching order: %w", sql.ErrNoRows)
+	}
+	return s.shards[copies[0].shard].MergeOrder(ctx, order)
+}
+
+// DeleteOrder deletes the order from every shard. Unlike the other writes it
+// fails when any shard does, as a copy left on a failing shard would be moved
+// back by the next Reshard.
+func (s *ShardedDB) DeleteOrder(ctx context.Context, orderUID string) error {
+	deleted := make([]bool, len(s.shards))
+	err := s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		err := shard.DeleteOrder(ctx, orderUID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error removing order from shard %d: %w", i, err)
+		}
+		deleted[i] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ok := range deleted {
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("error deleting order: %w", sql.ErrNoRows)
+}
+
+// collect runs list on every shard and returns the results in shard order.
+func (s *ShardedDB) collect(ctx context.Context, list func(ctx context.Context, shard Database) ([]string, error)) ([][]string, error) {
+	results := make([][]string, len(s.shards))
+	err := s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		uids, err := list(ctx, shard)
+		results[i] = uids
+		return err
+	})
+	return results, err
+}
+
+// interleave merges per-shard lists, each already in the wanted order, by
+// taking one entry from every list in turn. Shards don't return the values
+// they sort by, so the merged order is approximate; n <= 0 means no limit.
+func interleave(lists [][]string, n int) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for i := 0; ; i++ {
+		more := false
+		for _, list := range lists {
+			if i >= len(list) {
+				continue
+			}
+			more = true
+			if !seen[list[i]] {
+				seen[list[i]] = true
+				merged = append(merged, list[i])
+			}
+		}
+		if !more || (n > 0 && len(merged) >= n) {
+			break
+		}
+	}
+	if n > 0 && len(merged) > n {
+		merged = merged[:n]
+	}
+	if merged == nil {
+		merged = []string{}
+	}
+	return merged
+}
+
+func (s *ShardedDB) GetRecentOrders(ctx context.Context, n int) ([]string, error) {
+	lists, err := s.collect(ctx, func(ctx context.Context, shard Database) ([]string, error) {
+		return shard.GetRecentOrders(ctx, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return interleave(lists, n), nil
+}
+
+func (s *ShardedDB) GetOrdersCreatedSince(ctx context.Context, since time.Time, n int) ([]string, error) {
+	lists, err := s.collect(ctx, func(ctx context.Context, shard Database) ([]string, error) {
+		return shard.GetOrdersCreatedSince(ctx, since, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return interleave(lists, n), nil
+}
+
+func (s *ShardedDB) GetOrdersCreatedBefore(ctx context.Context, before time.Time, n int) ([]string, error) {
+	lists, err := s.collect(ctx, func(ctx context.Context, shard Database) ([]string, error) {
+		return shard.GetOrdersCreatedBefore(ctx, before, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return interleave(lists, n), nil
+}
+
+// SearchOrders asks every shard for limit results and keeps the best ranked.
+// Ranks are computed per shard, so they compare well only while shards hold
+// similar data.
+func (s *ShardedDB) SearchOrders(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	results := make([][]SearchResult, len(s.shards))
+	err := s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		found, err := shard.SearchOrders(ctx, query, limit)
+		results[i] = found
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	merged := []SearchResult{}
+	for _, found := range results {
+		for _, r := range found {
+			if !seen[r.OrderUID] {
+				seen[r.OrderUID] = true
+				merged = append(merged, r)
+			}
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].Rank != merged[j].Rank {
+			return merged[i].Rank > merged[j].Rank
+		}
+		return merged[i].OrderUID < merged[j].OrderUID
+	})
+	if limit > 0 && len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged, nil
+}
+
+func (s *ShardedDB) ArchiveRawMessage(ctx context.Context, msg models.RawMessage) error {
+	return s.shards[0].ArchiveRawMessage(ctx, msg)
+}
+
+func (s *ShardedDB) SelectRawMessages(ctx context.Context, orderUID string) ([]models.RawMessage, error) {
+	return s.shards[0].SelectRawMessages(ctx, orderUID)
+}
+
+func (s *ShardedDB) SelectRawMessage(ctx context.Context, id int64) (*models.RawMessage, error) {
+	return s.shards[0].SelectRawMessage(ctx, id)
+}
+
+func (s *ShardedDB) InsertReturn(ctx context.Context, ret models.Return) error {
+	return s.shards[0].InsertReturn(ctx, ret)
+}
+
+func (s *ShardedDB) SelectReturn(ctx context.Context, returnID string) (*models.Return, error) {
+	return s.shards[0].SelectReturn(ctx, returnID)
+}
+
+func (s *ShardedDB) OrderReturns(ctx context.Context, orderUID string) ([]models.Return, error) {
+	return s.shards[0].OrderReturns(ctx, orderUID)
+}
+
+func (s *ShardedDB) UpdateReturn(ctx context.Context, ret models.Return, from string) error {
+	return s.shards[0].UpdateReturn(ctx, ret, from)
+}
+
+// OrderHistory merges the versions recorded on every shard. An order that
+// moved has a delete on the old shard and an insert on the new one, at the
+// same point in its history.
+func (s *ShardedDB) OrderHistory(ctx context.Context, orderUID string) ([]models.OrderVersion, error) {
+	results := make([][]models.OrderVersion, len(s.shards))
+	err := s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		versions, err := shard.OrderHistory(ctx, orderUID)
+		results[i] = versions
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	merged := []models.OrderVersion{}
+	for _, versions := range results {
+		merged = append(merged, versions...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].ChangedAt.Before(merged[j].ChangedAt)
+	})
+	return merged, nil
+}
+
+func (s *ShardedDB) SelectOrderAsOf(ctx context.Context, orderUID string, t time.Time) (*models.Order, error) {
+	found := make([]*models.Order, len(s.shards))
+	err := s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		order, err := shard.SelectOrderAsOf(ctx, orderUID, t)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		found[i] = order
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var match *models.Order
+	for i, order := range found {
+		if order == nil {
+			continue
+		}
+		if match == nil || i == s.home(order) {
+			match = order
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("error fetching order: %w", sql.ErrNoRows)
+	}
+	return match, nil
+}
+
+func (s *ShardedDB) DeleteOrders(ctx context.Context, archived []models.Order) (int, error) {
+	return s.sum(ctx, func(ctx context.Context, shard Database) (int, error) {
+		return shard.DeleteOrders(ctx, archived)
+	})
+}
+
+// PurgeHistory removes the history of orders that no shard stores any more.
+// A shard's own view is not enough: after a move the old shard still holds
+// the history from before it, which must stay while the order exists.
+func (s *ShardedDB) PurgeHistory(ctx context.Context, before time.Time) (int, error) {
+	orphaned := make([][]string, len(s.shards))
+	err := s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		uids, err := s.store(i).orphanedHistory(ctx, before)
+		orphaned[i] = uids
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	candidates := interleave(orphaned, 0)
+	stored, err := s.collect(ctx, func(ctx context.Context, shard Database) ([]string, error) {
+		if len(candidates) == 0 {
+			return nil, nil
+		}
+		return shard.(shardStore).storedOrders(ctx, candidates)
+	})
+	if err != nil {
+		return 0, err
+	}
+	live := make(map[string]bool)
+	for _, uids := range stored {
+		for _, uid := range uids {
+			live[uid] = true
+		}
+	}
+
+	counts := make([]int, len(s.shards))
+	err = s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		var purge []string
+		for _, uid := range orphaned[i] {
+			if !live[uid] {
+				purge = append(purge, uid)
+			}
+		}
+		if len(purge) > 0 {
+			n, err := s.store(i).purgeOrderHistory(ctx, purge, before)
+			counts[i] += n
+			if err != nil {
+				return err
+			}
+		}
+		if i == 0 {
+			n, err := s.store(i).purgeRawMessages(ctx, before)
+			counts[i] += n
+			return err
+		}
+		return nil
+	})
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total, err
+}
+
+func (s *ShardedDB) sum(ctx context.Context, fn func(ctx context.Context, shard Database) (int, error)) (int, error) {
+	counts := make([]int, len(s.shards))
+	err := s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		n, err := fn(ctx, shard)
+		counts[i] = n
+		return err
+	})
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total, err
+}
+
+func (s *ShardedDB) LookupOrders(ctx context.Context, contact Contact) ([]string, error) {
+	lists, err := s.collect(ctx, func(ctx context.Context, shard Database) ([]string, error) {
+		return shard.LookupOrders(ctx, contact)
+	})
+	if err != nil {
+		return nil, err
+	}
+	merged := interleave(lists, 0)
+	sort.Strings(merged)
+	return merged, nil
+}
+
+func (s *ShardedDB) CustomerOrders(ctx context.Context, customerID string) ([]string, error) {
+	lists, err := s.collect(ctx, func(ctx context.Context, shard Database) ([]string, error) {
+		return shard.CustomerOrders(ctx, customerID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return interleave(lists, 0), nil
+}
+
+// EraseCustomer erases the customer on every shard; each shard keeps an
+// audit entry for the orders it held. The history and raw messages of an
+// order can sit on other shards than the order, the history from before a
+// move and the raw messages on the first shard, so the erased orders are
+// then erased on every shard that didn't hold them.
+func (s *ShardedDB) EraseCustomer(ctx context.Context, customerID string) (*Erasure, error) {
+	results := make([]*Erasure, len(s.shards))
+	err := s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		erasure, err := shard.EraseCustomer(ctx, customerID)
+		results[i] = erasure
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	erasure := newErasure(ctx, customerID)
+	erased := make(map[string]bool)
+	for _, r := range results {
+		for _, uid := range r.OrderUIDs {
+			if !erased[uid] {
+				erased[uid] = true
+				erasure.OrderUIDs = append(erasure.OrderUIDs, uid)
+			}
+		}
+	}
+	sort.Strings(erasure.OrderUIDs)
+
+	err = s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		own := make(map[string]bool)
+		for _, uid := range results[i].OrderUIDs {
+			own[uid] = true
+		}
+		var others []string
+		for _, uid := range erasure.OrderUIDs {
+			if !own[uid] {
+				others = append(others, uid)
+			}
+		}
+		if len(others) == 0 {
+			return nil
+		}
+		return s.store(i).eraseOrderData(ctx, others)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return erasure, nil
+}
+
+// RecordAccesses sends the counts to every shard that tracks accesses; each
+// updates only the orders it holds.
+func (s *ShardedDB) RecordAccesses(ctx context.Context, accesses map[string]Access) error {
+	return s.each(ctx, func(ctx context.Context, i int, shard Database) error {
+		if store, ok := shard.(AccessStore); ok {
+			return store.RecordAccesses(ctx, accesses)
+		}
+		return nil
+	})
+}
+
+// ReshardStats counts the orders seen and moved by Reshard.
+type ReshardStats struct {
+	Scanned int `json:"scanned"`
+	Moved   int `json:"moved"`
+	Failed  int `json:"failed"`
+}
+
+// Reshard moves every order that is not on its home shard there. Each order
+// is copied, the copy is read back and compared, and only then is the order
+// deleted from its old shard, so an interruption at any point leaves at least
+// one complete copy and the run can simply be repeated. With dryRun the
+// orders are only counted. Access counts are not carried over.
+func (s *ShardedDB) Reshard(ctx context.Context, dryRun bool) (ReshardStats, error) {
+	var stats ReshardStats
+	// listed up front, so orders moved to a later shard aren't seen twice
+	lists, err := s.collect(ctx, func(ctx context.Context, shard Database) ([]string, error) {
+		return shard.GetOrdersCreatedSince(ctx, time.Time{}, 0)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("error listing orders: %w", err)
+	}
+	for i, shard := range s.shards {
+		for _, uid := range lists[i] {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+			order, err := shard.SelectOrder(ctx, uid)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return stats, fmt.Errorf("error reading order %s from shard %d: %w", uid, i, err)
+			}
+			stats.Scanned++
+			target := s.home(order)
+			if target == i {
+				continue
+			}
+			if dryRun {
+				slog.Info("Order would be moved", "orderUID", uid, "from", i, "to", target)
+				stats.Moved++
+				continue
+			}
+			if err := s.move(ctx, order, i, target); err != nil {
+				slog.Error("Failed to move order", "error", err, "orderUID", uid, "from", i, "to", target)
+				stats.Failed++
+				continue
+			}
+			stats.Moved++
+		}
+	}
+	return stats, nil
+}
+
+// moveAttempts bounds how often move copies an order that keeps changing on
+// its old shard.
+const moveAttempts = 3
+
+// move copies the order to its new shard and deletes the original only if it
+// is still what was copied, so a write that reached the old shard meanwhile
+// is copied over in the next attempt instead of being lost.
+func (s *ShardedDB) move(ctx context.Context, order *models.Order, from, to int) error {
+	for attempt := 1; ; attempt++ {
+		if err := s.shards[to].UpsertOrder(ctx, *order); err != nil {
+			return fmt.Errorf("error copying order: %w", err)
+		}
+		copied, err := s.shards[to].SelectOrder(ctx, order.OrderUID)
+		if err != nil {
+			return fmt.Errorf("error verifying copy: %w", err)
+		}
+		if err := checkUnchanged(order, copied); err != nil {
+			return fmt.Errorf("error verifying copy: %w", err)
+		}
+		err = s.store(from).deleteOrder(WithSource(ctx, SourceShardMove), order.OrderUID, order)
+		if err == nil || errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if !errors.Is(err, ErrOrderChanged) || attempt == moveAttempts {
+			return fmt.Errorf("error removing original: %w", err)
+		}
+		order, err = s.shards[from].SelectOrder(ctx, order.OrderUID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error rereading original: %w", err)
+		}
+	}
+}
+
+// The shardStore operations of the databases that can be shards.
+
+func (c *Client) orphanedHistory(ctx context.Context, before time.Time) ([]string, error) {
+	orderUIDs := []string{}
+	query := `
+	SELECT DISTINCT h.order_uid
+	FROM order_history h
+	WHERE h.changed_at < $1
+		AND NOT EXISTS (SELECT 1 FROM orders o WHERE o.order_uid = h.order_uid)
+	`
+	if err := c.db.SelectContext(ctx, &orderUIDs, query, before); err != nil {
+		return nil, fmt.Errorf("error fetching orphaned history: %w", err)
+	}
+	return orderUIDs, nil
+}
+
+func (c *Client) storedOrders(ctx context.Context, orderUIDs []string) ([]string, error) {
+	stored := []string{}
+	query := `SELECT order_uid FROM orders WHERE order_uid = ANY($1)`
+	if err := c.db.SelectContext(ctx, &stored, query, pq.Array(orderUIDs)); err != nil {
+		return nil, fmt.Errorf("error fetching stored orders: %w", err)
+	}
+	return stored, nil
+}
+
+func (c *Client) purgeOrderHistory(ctx context.Context, orderUIDs []string, before time.Time) (int, error) {
+	res, err := c.db.ExecContext(ctx, `
+	DELETE FROM order_history h
+	WHERE h.order_uid = ANY($1)
+		AND h.changed_at < $2
+		AND NOT EXISTS (SELECT 1 FROM orders o WHERE o.order_uid = h.order_uid)
+	`, pq.Array(orderUIDs), before)
+	if err != nil {
+		return 0, fmt.Errorf("error purging order history: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (c *Client) purgeRawMessages(ctx context.Context, before time.Time) (int, error) {
+	res, err := c.db.ExecContext(ctx, `DELETE FROM raw_messages WHERE received_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("error purging raw messages: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (c *Client) eraseOrderData(ctx context.Context, orderUIDs []string) error {
+	return c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		return c.eraseOrders(ctx, tx, orderUIDs)
+	})
+}
+
+func (m *MemoryDB) orphanedHistory(ctx context.Context, before time.Time) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	orderUIDs := []string{}
+	for uid, versions := range m.history {
+		if _, ok := m.orders[uid]; ok || len(versions) == 0 || !versions[0].ChangedAt.Before(before) {
+			continue
+		}
+		orderUIDs = append(orderUIDs, uid)
+	}
+	return orderUIDs, nil
+}
+
+func (m *MemoryDB) storedOrders(ctx context.Context, orderUIDs []string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored := []string{}
+	for _, uid := range orderUIDs {
+		if _, ok := m.orders[uid]; ok {
+			stored = append(stored, uid)
+		}
+	}
+	return stored, nil
+}
+
+func (m *MemoryDB) purgeOrderHistory(ctx context.Context, orderUIDs []string, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	purged := 0
+	for _, uid := range orderUIDs {
+		if _, ok := m.orders[uid]; ok {
+			continue
+		}
+		kept := []models.OrderVersion{}
+		for _, v := range m.history[uid] {
+			if v.ChangedAt.Before(before) {
+				purged++
+				continue
+			}
+			kept = append(kept, v)
+		}
+		if len(kept) == 0 {
+			delete(m.history, uid)
+		} else {
+			m.history[uid] = kept
+		}
+	}
+	return purged, nil
+}
+
+func (m *MemoryDB) purgeRawMessages(ctx context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	purged := m.deleteRawMessages(func(msg models.RawMessage) bool { return msg.ReceivedAt.Before(before) })
+	return purged, nil
+}
+
+func (m *MemoryDB) eraseOrderData(ctx context.Context, orderUIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.eraseOrders(orderUIDs)
+	return nil
+}
+
+func (s *SQLiteDB) orphanedHistory(ctx context.Context, before time.Time) ([]string, error) {
+	orderUIDs := []string{}
+	query := `
+	SELECT DISTINCT order_uid
+	FROM order_history
+	WHERE changed_at < $1
+		AND order_uid NOT IN (SELECT order_uid FROM orders)
+	`
+	if err := s.db.SelectContext(ctx, &orderUIDs, query, before.UTC()); err != nil {
+		return nil, fmt.Errorf("error fetching orphaned history: %w", err)
+	}
+	return orderUIDs, nil
+}
+
+func (s *SQLiteDB) storedOrders(ctx context.Context, orderUIDs []string) ([]string, error) {
+	uids, err := json.Marshal(orderUIDs)
+	if err != nil {
+		return nil, err
+	}
+	stored := []string{}
+	query := `SELECT order_uid FROM orders WHERE order_uid IN (SELECT value FROM json_each($1))`
+	if err := s.db.SelectContext(ctx, &stored, query, string(uids)); err != nil {
+		return nil, fmt.Errorf("error fetching stored orders: %w", err)
+	}
+	return stored, nil
+}
+
+func (s *SQLiteDB) purgeOrderHistory(ctx context.Context, orderUIDs []string, before time.Time) (int, error) {
+	uids, err := json.Marshal(orderUIDs)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.ExecContext(ctx, `
+	DELETE FROM order_history
+	WHERE order_uid IN (SELECT value FROM json_each($1))
+		AND changed_at < $2
+		AND order_uid NOT IN (SELECT order_uid FROM orders)
+	`, string(uids), before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("error purging order history: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (s *SQLiteDB) purgeRawMessages(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM raw_messages WHERE received_at < $1`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("error purging raw messages: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (s *SQLiteDB) eraseOrderData(ctx context.Context, orderUIDs []string) error {
+	return s.withTx(ctx, func(tx *sqlx.Tx) error {
+		for _, uid := range orderUIDs {
+			if err := s.eraseOrder(ctx, tx, uid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
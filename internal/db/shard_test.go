@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"wbstorage/internal/models"
+)
+
+// failingShard is a shard whose reads fail.
+type failingShard struct {
+	*MemoryDB
+}
+
+var errShardDown = errors.New("shard is down")
+
+func (f failingShard) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
+	return nil, errShardDown
+}
+
+// shardKeyFor returns a shardkey that belongs to shard i of n.
+func shardKeyFor(t *testing.T, i, n int) string {
+	t.Helper()
+	for k := 0; k < 1000; k++ {
+		key := fmt.Sprint(k)
+		if ShardFor(key, n) == i {
+			return key
+		}
+	}
+	t.Fatalf("no shardkey for shard %d of %d", i, n)
+	return ""
+}
+
+func newTestShards(t *testing.T, shards ...Database) *ShardedDB {
+	t.Helper()
+	sharded, err := NewShardedDB(shards)
+	if err != nil {
+		t.Fatalf("NewShardedDB: %v", err)
+	}
+	return sharded
+}
+
+func TestShardedDBSkipsFailingShards(t *testing.T) {
+	ctx := context.Background()
+	home := NewMemoryDB()
+	sharded := newTestShards(t, home, failingShard{NewMemoryDB()})
+
+	order := testOrder("on-home-shard")
+	order.ShardKey = shardKeyFor(t, 0, 2)
+	if err := sharded.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder with a failing shard that isn't home: %v", err)
+	}
+	if _, err := sharded.SelectOrder(ctx, order.OrderUID); err != nil {
+		t.Fatalf("SelectOrder of an order on its home shard: %v", err)
+	}
+	if err := sharded.UpsertOrder(ctx, order); err != nil {
+		t.Fatalf("UpsertOrder with a failing shard that isn't home: %v", err)
+	}
+
+	// an order off its home shard may have a newer copy on the failing one
+	stray := testOrder("off-home-shard")
+	stray.ShardKey = shardKeyFor(t, 1, 2)
+	if err := home.InsertOrder(ctx, stray); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	if _, err := sharded.SelectOrder(ctx, stray.OrderUID); !errors.Is(err, errShardDown) {
+		t.Fatalf("SelectOrder of an order off its home shard: got %v, want the shard's error", err)
+	}
+}
+
+func TestShardedDBMoveRechecksSource(t *testing.T) {
+	ctx := context.Background()
+	from, to := NewMemoryDB(), NewMemoryDB()
+	sharded := newTestShards(t, from, to)
+
+	order := testOrder("moved")
+	order.ShardKey = shardKeyFor(t, 1, 2)
+	if err := from.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	// the order was read before a payment reached the old shard
+	stale := order.Clone()
+	refund := models.Payment{Kind: models.PaymentRefund, Transaction: "late-refund", Currency: "USD", Amount: 10}
+	if _, err := from.AddPayment(ctx, order.OrderUID, refund); err != nil {
+		t.Fatalf("AddPayment: %v", err)
+	}
+
+	if err := sharded.move(ctx, stale, 0, 1); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	moved, err := to.SelectOrder(ctx, order.OrderUID)
+	if err != nil {
+		t.Fatalf("SelectOrder on the new shard: %v", err)
+	}
+	found := false
+	for _, p := range moved.AllPayments() {
+		found = found || p.Transaction == "late-refund"
+	}
+	if !found {
+		t.Fatalf("the payment added during the move was lost: %+v", moved.Payments)
+	}
+	if _, err := from.SelectOrder(ctx, order.OrderUID); err == nil {
+		t.Fatal("the order is still on its old shard")
+	}
+}
+
+func TestShardedDBPurgeHistoryKeepsMovedOrders(t *testing.T) {
+	ctx := context.Background()
+	from, to := NewMemoryDB(), NewMemoryDB()
+	sharded := newTestShards(t, from, to)
+
+	order := testOrder("purged")
+	order.ShardKey = shardKeyFor(t, 1, 2)
+	if err := from.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	if _, err := sharded.Reshard(ctx, false); err != nil {
+		t.Fatalf("Reshard: %v", err)
+	}
+	before, err := sharded.OrderHistory(ctx, order.OrderUID)
+	if err != nil {
+		t.Fatalf("OrderHistory: %v", err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	if _, err := sharded.PurgeHistory(ctx, future); err != nil {
+		t.Fatalf("PurgeHistory: %v", err)
+	}
+	after, err := sharded.OrderHistory(ctx, order.OrderUID)
+	if err != nil {
+		t.Fatalf("OrderHistory: %v", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("purge removed %d versions of a stored order", len(before)-len(after))
+	}
+
+	if err := sharded.DeleteOrder(ctx, order.OrderUID); err != nil {
+		t.Fatalf("DeleteOrder: %v", err)
+	}
+	if _, err := sharded.PurgeHistory(ctx, future); err != nil {
+		t.Fatalf("PurgeHistory: %v", err)
+	}
+	after, err = sharded.OrderHistory(ctx, order.OrderUID)
+	if err != nil {
+		t.Fatalf("OrderHistory: %v", err)
+	}
+	if len(after) != 0 {
+		t.Fatalf("%d versions of a deleted order are left", len(after))
+	}
+}
+
+func TestShardedDBEraseCustomerAcrossShards(t *testing.T) {
+	ctx := context.Background()
+	first, second := NewMemoryDB(), NewMemoryDB()
+	sharded := newTestShards(t, first, second)
+
+	order := testOrder("erased")
+	order.ShardKey = shardKeyFor(t, 0, 2)
+	if err := sharded.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	msg := models.RawMessage{OrderUID: order.OrderUID, Stream: "ORDERS", StreamSeq: 1, Payload: []byte("{}"), ReceivedAt: time.Now()}
+	if err := sharded.ArchiveRawMessage(ctx, msg); err != nil {
+		t.Fatalf("ArchiveRawMessage: %v", err)
+	}
+	// moving the order leaves its raw message and first versions on shard 0
+	patch := fmt.Sprintf(`{"shardkey": %q}`, shardKeyFor(t, 1, 2))
+	if _, err := sharded.PatchOrder(ctx, order.OrderUID, []byte(patch)); err != nil {
+		t.Fatalf("PatchOrder: %v", err)
+	}
+
+	erasure, err := sharded.EraseCustomer(ctx, order.CustomerID)
+	if err != nil {
+		t.Fatalf("EraseCustomer: %v", err)
+	}
+	if len(erasure.OrderUIDs) != 1 || erasure.OrderUIDs[0] != order.OrderUID {
+		t.Fatalf("erased orders %v", erasure.OrderUIDs)
+	}
+	msgs, err := sharded.SelectRawMessages(ctx, order.OrderUID)
+	if err != nil {
+		t.Fatalf("SelectRawMessages: %v", err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("%d raw messages are left on the first shard", len(msgs))
+	}
+	history, err := first.OrderHistory(ctx, order.OrderUID)
+	if err != nil {
+		t.Fatalf("OrderHistory: %v", err)
+	}
+	for _, v := range history {
+		if v.Order.CustomerID != "" || v.Order.Delivery.Name != "" {
+			t.Errorf("version %d on the first shard was not anonymized", v.Version)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package db
+
+import (
+	"context"
+)
+
+type sourceKey struct{}
+
+// WithSource tags writes made with ctx with the given source, e.g. "api" or
+// the NATS subject, in the order history.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// SourceFrom returns the source set by WithSource, or "unknown".
+func SourceFrom(ctx context.Context) string {
+	if source, ok := ctx.Value(sourceKey{}).(string); ok {
+		return source
+	}
+	return "unknown"
+}
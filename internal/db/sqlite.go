@@ -0,0 +1,327 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"wbstorage/internal/models"
+
+	"github.com/jmoiron/sqlx"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteSchema keeps each order as a JSON document next to the columns used
+// for listing; SQLite is meant for local runs, not for production volumes.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS orders (
+	order_uid TEXT PRIMARY KEY,
+	date_created INTEGER NOT NULL,
+	last_interaction INTEGER NOT NULL,
+	access_count INTEGER NOT NULL DEFAULT 0,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS orders_access_idx ON orders (access_count DESC, last_interaction DESC);
+CREATE INDEX IF NOT EXISTS orders_date_created_idx ON orders (date_created DESC);
+
+CREATE TABLE IF NOT EXISTS raw_messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_uid TEXT,
+	subject TEXT NOT NULL,
+	stream TEXT NOT NULL,
+	stream_seq INTEGER NOT NULL,
+	headers TEXT,
+	payload BLOB NOT NULL,
+	received_at TIMESTAMP NOT NULL,
+	decoder_version TEXT NOT NULL,
+	parse_error TEXT NOT NULL DEFAULT '',
+	UNIQUE (stream, stream_seq)
+);
+CREATE INDEX IF NOT EXISTS raw_messages_order_uid_idx ON raw_messages (order_uid);
+
+CREATE TABLE IF NOT EXISTS order_history (
+	order_uid TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	operation TEXT NOT NULL,
+	source TEXT NOT NULL,
+	snapshot TEXT NOT NULL,
+	changed_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (order_uid, version)
+);
+
+CREATE TABLE IF NOT EXISTS returns (
+	return_id TEXT PRIMARY KEY,
+	order_uid TEXT NOT NULL,
+	status TEXT NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS returns_order_uid_idx ON returns (order_uid);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	action TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	order_uids TEXT NOT NULL,
+	source TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+`
+
+// SQLiteDB is a Database stored in a single SQLite file.
+type SQLiteDB struct {
+	db *sqlx.DB
+}
+
+// NewSQLiteDB opens or creates the database at path and creates the schema.
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := sqlx.Connect("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY and
+	// keeps ":memory:" databases shared.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sqlite schema: %w", err)
+	}
+	return &SQLiteDB{db: db}, nil
+}
+
+func (s *SQLiteDB) InsertOrder(ctx context.Context, order models.Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT INTO orders (order_uid, date_created, last_interaction, data)
+	VALUES ($1, $2, $3, $4)
+	`
+	return s.withTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, query, order.OrderUID, order.DateCreated.UnixMicro(), time.Now().UnixMicro(), data)
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+			return fmt.Errorf("error inserting order %s: %w", order.OrderUID, ErrOrderExists)
+		}
+		if err != nil {
+			return fmt.Errorf("error inserting order: %w", err)
+		}
+		return s.recordVersion(ctx, tx, models.OperationInsert, &order)
+	})
+}
+
+func (s *SQLiteDB) SelectOrder(ctx context.Context, orderUID string) (*models.Order, error) {
+	return s.selectOrder(ctx, s.db, orderUID)
+}
+
+func (s *SQLiteDB) selectOrder(ctx context.Context, q sqlx.QueryerContext, orderUID string) (*models.Order, error) {
+	var row struct {
+		Data            []byte `db:"data"`
+		LastInteraction int64  `db:"last_interaction"`
+	}
+	query := `SELECT data, last_interaction FROM orders WHERE order_uid = $1`
+	if err := sqlx.GetContext(ctx, q, &row, query, orderUID); err != nil {
+		return nil, fmt.Errorf("error fetching order: %w", err)
+	}
+	var order models.Order
+	if err := json.Unmarshal(row.Data, &order); err != nil {
+		return nil, fmt.Errorf("error decoding order: %w", err)
+	}
+	order.LastInteraction = time.UnixMicro(row.LastInteraction)
+	return &order, nil
+}
+
+func (s *SQLiteDB) GetRecentOrders(ctx context.Context, n int) ([]string, error) {
+	var orderUIDs []string
+	query := `
+	SELECT order_uid
+	FROM orders
+	ORDER BY access_count DESC, last_interaction DESC
+	LIMIT $1
+	`
+	if err := s.db.SelectContext(ctx, &orderUIDs, query, n); err != nil {
+		return nil, fmt.Errorf("error fetching recent orders: %v", err)
+	}
+	return orderUIDs, nil
+}
+
+func (s *SQLiteDB) GetOrdersCreatedSince(ctx context.Context, since time.Time, n int) ([]string, error) {
+	var orderUIDs []string
+	// a negative LIMIT means no limit in SQLite
+	limit := n
+	if limit <= 0 {
+		limit = -1
+	}
+	query := `
+	SELECT order_uid
+	FROM orders
+	WHERE date_created >= $1
+	ORDER BY date_created DESC
+	LIMIT $2
+	`
+	if err := s.db.SelectContext(ctx, &orderUIDs, query, since.UnixMicro(), limit); err != nil {
+		return nil, fmt.Errorf("error fetching orders created since %s: %v", since, err)
+	}
+	return orderUIDs, nil
+}
+
+func (s *SQLiteDB) UpsertOrder(ctx context.Context, order models.Order) error {
+	return s.withTx(ctx, func(tx *sqlx.Tx) error {
+		return s.upsertOrder(ctx, tx, order)
+	})
+}
+
+func (s *SQLiteDB) upsertOrder(ctx context.Context, tx *sqlx.Tx, order models.Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM orders WHERE order_uid = $1)`, order.OrderUID); err != nil {
+		return fmt.Errorf("error upserting order: %w", err)
+	}
+	query := `
+	INSERT INTO orders (order_uid, date_created, last_interaction, data)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (order_uid) DO UPDATE SET
+		date_created = excluded.date_created,
+		data = excluded.data
+	`
+	if _, err := tx.ExecContext(ctx, query, order.OrderUID, order.DateCreated.UnixMicro(), time.Now().UnixMicro(), data); err != nil {
+		return fmt.Errorf("error upserting order: %w", err)
+	}
+
+	operation := models.OperationInsert
+	if exists {
+		operation = models.OperationUpdate
+	}
+	return s.recordVersion(ctx, tx, operation, &order)
+}
+
+func (s *SQLiteDB) PatchOrder(ctx context.Context, orderUID string, patch []byte) (*models.Order, error) {
+	var patched *models.Order
+	err := s.withTx(ctx, func(tx *sqlx.Tx) error {
+		order, err := s.selectOrder(ctx, tx, orderUID)
+		if err != nil {
+			return err
+		}
+		if err := order.ApplyMergePatch(patch); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		if order.OrderUID != orderUID {
+			return fmt.Errorf("%w: order_uid cannot be changed", ErrInvalidPatch)
+		}
+		order.SetOrderUID(orderUID)
+		if err := s.upsertOrder(ctx, tx, *order); err != nil {
+			return err
+		}
+		patched = order
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
+
+func (s *SQLiteDB) AddPayment(ctx context.Context, orderUID string, p models.Payment) (*models.Order, error) {
+	var order *models.Order
+	err := s.withTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		order, err = s.selectOrder(ctx, tx, orderUID)
+		if err != nil {
+			return err
+		}
+		added, err := order.AddPayment(p)
+		if err != nil || !added {
+			return err
+		}
+		return s.upsertOrder(ctx, tx, *order)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *SQLiteDB) MergeOrder(ctx context.Context, update models.Order) (*models.Order, bool, error) {
+	var order *models.Order
+	var merged bool
+	err := s.withTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		order, err = s.selectOrder(ctx, tx, update.OrderUID)
+		if err != nil {
+			return err
+		}
+		if err := s.checkErased(ctx, tx, update.OrderUID); err != nil {
+			return err
+		}
+		merged, err = order.MergeRecords(&update)
+		if err != nil || !merged {
+			return err
+		}
+		return s.upsertOrder(ctx, tx, *order)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return order, merged, nil
+}
+
+func (s *SQLiteDB) DeleteOrder(ctx context.Context, orderUID string) error {
+	return s.deleteOrder(ctx, orderUID, nil)
+}
+
+// deleteOrder deletes the order; with expected set only if the stored order
+// still equals it, see checkUnchanged.
+func (s *SQLiteDB) deleteOrder(ctx context.Context, orderUID string, expected *models.Order) error {
+	return s.withTx(ctx, func(tx *sqlx.Tx) error {
+		order, err := s.selectOrder(ctx, tx, orderUID)
+		if err != nil {
+			return fmt.Errorf("error deleting order: %w", err)
+		}
+		if expected != nil {
+			if err := checkUnchanged(expected, order); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM orders WHERE order_uid = $1`, orderUID); err != nil {
+			return fmt.Errorf("error deleting order: %w", err)
+		}
+		return s.recordVersion(ctx, tx, models.OperationDelete, order)
+	})
+}
+
+// withTx runs fn in a transaction, committing if fn succeeds.
+func (s *SQLiteDB) withTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) RecordAccesses(ctx context.Context, accesses map[string]Access) error {
+	query := `
+	UPDATE orders
+	SET access_count = access_count + $1,
+		last_interaction = MAX(last_interaction, $2)
+	WHERE order_uid = $3
+	`
+	return s.withTx(ctx, func(tx *sqlx.Tx) error {
+		for uid, a := range accesses {
+			if _, err := tx.ExecContext(ctx, query, a.Hits, a.AccessedAt.UnixMicro(), uid); err != nil {
+				return fmt.Errorf("error recording order accesses: %w", err)
+			}
+		}
+		return nil
+	})
+}
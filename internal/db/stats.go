@@ -0,0 +1,58 @@
+package db
+
+import (
+	"time"
+)
+
+type CacheEntryInfo struct {
+	OrderUID string    `json:"order_uid"`
+	CachedAt time.Time `json:"cached_at"`
+}
+
+type CacheStats struct {
+	Size      int             `json:"size"`
+	Stale     int             `json:"stale"`
+	Hits      uint64          `json:"hits"`
+	StaleHits uint64          `json:"stale_hits"`
+	Misses    uint64          `json:"misses"`
+	HitRatio  float64         `json:"hit_ratio"`
+	Oldest    *CacheEntryInfo `json:"oldest,omitempty"`
+	Newest    *CacheEntryInfo `json:"newest,omitempty"`
+}
+
+// Stats returns a snapshot of the cache contents and counters. Stale hits
+// count as hits in HitRatio.
+func (c *CachedClient) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:      c.hits.Load(),
+		StaleHits: c.staleHits.Load(),
+		Misses:    c.misses.Load(),
+	}
+	if total := stats.Hits + stats.StaleHits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits+stats.StaleHits) / float64(total)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats.Size = len(c.cache)
+	stats.Stale = len(c.stale)
+	for uid, entry := range c.cache {
+		if stats.Oldest == nil || entry.cachedAt.Before(stats.Oldest.CachedAt) {
+			stats.Oldest = &CacheEntryInfo{OrderUID: uid, CachedAt: entry.cachedAt}
+		}
+		if stats.Newest == nil || entry.cachedAt.After(stats.Newest.CachedAt) {
+			stats.Newest = &CacheEntryInfo{OrderUID: uid, CachedAt: entry.cachedAt}
+		}
+	}
+	return stats
+}
+
+// Flush drops every cached order and returns how many were dropped.
+func (c *CachedClient) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.cache)
+	c.cache = make(map[string]*cacheEntry)
+	c.stale = make(map[string]struct{})
+	return n
+}
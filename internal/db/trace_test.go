@@ -0,0 +1,95 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"modernc.org/sqlite"
+)
+
+// dsnConnector opens connections of a driver that has no Connector itself.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.driver.Open(c.dsn) }
+
+func (c dsnConnector) Driver() driver.Driver { return c.driver }
+
+// openTraced opens an in-memory SQLite database through tracedConnector and
+// returns it with the buffer the slow statements are logged to.
+func openTraced(t *testing.T, threshold time.Duration) (*sqlx.DB, *bytes.Buffer) {
+	t.Helper()
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	connector := tracedConnector{Connector: dsnConnector{driver: &sqlite.Driver{}, dsn: ":memory:"}, threshold: threshold}
+	db := sqlx.NewDb(sql.OpenDB(connector), "sqlite")
+	// every connection of :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db, &logs
+}
+
+func TestTracedConnectorLogsSlowStatements(t *testing.T) {
+	ctx := context.Background()
+	db, logs := openTraced(t, time.Nanosecond)
+
+	if _, err := db.ExecContext(ctx, `CREATE TABLE orders (order_uid TEXT PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := db.PreparexContext(ctx, `INSERT INTO orders (order_uid) VALUES (?)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if _, err := stmt.ExecContext(ctx, "uid-1"); err != nil {
+		t.Fatal(err)
+	}
+	var uids []string
+	if err := db.SelectContext(ctx, &uids, `SELECT order_uid FROM orders WHERE order_uid = ?`, "uid-1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 1 {
+		t.Fatalf("selected %v, want uid-1", uids)
+	}
+
+	out := logs.String()
+	for _, query := range []string{
+		"CREATE TABLE orders",
+		"INSERT INTO orders (order_uid) VALUES (?)",
+		"SELECT order_uid FROM orders WHERE order_uid = ?",
+	} {
+		if !strings.Contains(out, query) {
+			t.Errorf("log has no entry for %q:\n%s", query, out)
+		}
+	}
+	if strings.Contains(out, "uid-1") {
+		t.Errorf("log contains the arguments:\n%s", out)
+	}
+}
+
+func TestTracedConnectorSkipsFastStatements(t *testing.T) {
+	ctx := context.Background()
+	db, logs := openTraced(t, time.Hour)
+
+	if _, err := db.ExecContext(ctx, `CREATE TABLE orders (order_uid TEXT PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO orders (order_uid) VALUES (?)`, "uid-1"); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("fast statements were logged:\n%s", logs.String())
+	}
+}
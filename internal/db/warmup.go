@@ -0,0 +1,189 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// WarmupByCount loads the newest orders by date_created.
+	WarmupByCount = "count"
+	// WarmupByWindow loads orders created within the configured window.
+	WarmupByWindow = "window"
+	// WarmupByAccess loads the most accessed orders.
+	WarmupByAccess = "access"
+)
+
+// ErrWarmupRunning is returned by Warmup while another warm-up is running.
+var ErrWarmupRunning = errors.New("cache warm-up already running")
+
+type WarmupConfig struct {
+	Mode       string
+	Count      int
+	Window     time.Duration
+	Workers    int
+	Background bool
+}
+
+type WarmupProgress struct {
+	Running    bool      `json:"running"`
+	Total      int       `json:"total"`
+	Loaded     int       `json:"loaded"`
+	Failed     int       `json:"failed"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+	// Warmed is set once the first warm-up has finished and stays set
+	// through later re-warms.
+	Warmed bool `json:"warmed"`
+}
+
+// Ready reports whether the first warm-up has finished. A re-warm started
+// later does not make the instance unready, its cache is already filled.
+func (p WarmupProgress) Ready() bool {
+	return p.Warmed
+}
+
+type warmupState struct {
+	mu       sync.Mutex
+	progress WarmupProgress
+}
+
+func (s *warmupState) update(fn func(p *WarmupProgress)) {
+	s.mu.Lock()
+	fn(&s.progress)
+	s.mu.Unlock()
+}
+
+func (s *warmupState) get() WarmupProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.progress
+}
+
+// WarmupProgress returns a snapshot of the latest warm-up run.
+func (c *CachedClient) WarmupProgress() WarmupProgress {
+	return c.warmup.get()
+}
+
+// StartWarmup starts a warm-up in the background and reports whether it
+// did; it returns false if a warm-up is already running.
+func (c *CachedClient) StartWarmup(ctx context.Context) bool {
+	if !c.beginWarmup() {
+		return false
+	}
+	go func() {
+		defer c.endWarmup()
+		if err := c.runWarmup(ctx); err != nil {
+			slog.Error("Background cache warm-up failed", "error", err)
+		}
+	}()
+	return true
+}
+
+// Warmup loads orders selected by the configured mode into the cache.
+// Orders that fail to load are skipped and counted; only a failure to list
+// the orders aborts the run. It returns ErrWarmupRunning if a warm-up is
+// already running.
+func (c *CachedClient) Warmup(ctx context.Context) error {
+	if !c.beginWarmup() {
+		return ErrWarmupRunning
+	}
+	defer c.endWarmup()
+	return c.runWarmup(ctx)
+}
+
+// beginWarmup claims the warm-up under c.mu, so that two callers checking
+// at once cannot both start one.
+func (c *CachedClient) beginWarmup() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.warming {
+		return false
+	}
+	c.warming = true
+	c.warmup.update(func(p *WarmupProgress) {
+		*p = WarmupProgress{Running: true, StartedAt: time.Now(), Warmed: p.Warmed}
+	})
+	return true
+}
+
+func (c *CachedClient) endWarmup() {
+	c.mu.Lock()
+	c.warming = false
+	c.mu.Unlock()
+}
+
+func (c *CachedClient) runWarmup(ctx context.Context) error {
+	cfg := c.warmupCfg
+
+	UIDsList, err := c.warmupCandidates(ctx, cfg)
+	if err != nil {
+		slog.Error("Failed to retrieve orders for cache warming", "error", err)
+		c.warmup.update(func(p *WarmupProgress) {
+			p.Running = false
+			p.FinishedAt = time.Now()
+			p.Error = err.Error()
+			p.Warmed = true
+		})
+		return err
+	}
+	c.warmup.update(func(p *WarmupProgress) { p.Total = len(UIDsList) })
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
+	for _, orderUID := range UIDsList {
+		if gctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			// bypasses access tracking, warm-up reads are not real accesses
+			if _, _, err := c.selectOrder(gctx, orderUID); err != nil {
+				slog.Error("Skipping order during cache warming", "error", err, "orderUID", orderUID)
+				c.warmup.update(func(p *WarmupProgress) { p.Failed++ })
+				return nil
+			}
+			c.warmup.update(func(p *WarmupProgress) { p.Loaded++ })
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	progress := WarmupProgress{}
+	c.warmup.update(func(p *WarmupProgress) {
+		p.Running = false
+		p.FinishedAt = time.Now()
+		p.Warmed = true
+		if err := ctx.Err(); err != nil {
+			p.Error = err.Error()
+		}
+		progress = *p
+	})
+	slog.Info("Cache warm-up finished",
+		"mode", cfg.Mode, "total", progress.Total, "loaded", progress.Loaded, "failed", progress.Failed,
+		"duration", progress.FinishedAt.Sub(progress.StartedAt))
+	return ctx.Err()
+}
+
+func (c *CachedClient) warmupCandidates(ctx context.Context, cfg WarmupConfig) ([]string, error) {
+	switch cfg.Mode {
+	case WarmupByCount, "":
+		return c.db.GetOrdersCreatedSince(ctx, time.Time{}, cfg.Count)
+	case WarmupByWindow:
+		return c.db.GetOrdersCreatedSince(ctx, time.Now().Add(-cfg.Window), cfg.Count)
+	case WarmupByAccess:
+		return c.GetRecentOrders(ctx, cfg.Count)
+	default:
+		return nil, fmt.Errorf("unknown warm-up mode %q", cfg.Mode)
+	}
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"wbstorage/internal/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const upsertOrderQuery = `
+	INSERT INTO orders
+		(order_uid, track_number, entry, locale, internal_signature,
+		customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard, last_interaction)
+		VALUES
+		(:order_uid, :track_number, :entry, :locale, :internal_signature,
+		:customer_id, :delivery_service, :shardkey, :sm_id, :date_created, :oof_shard, NOW())
+	ON CONFLICT (order_uid, date_created) DO UPDATE SET
+		track_number = EXCLUDED.track_number,
+		entry = EXCLUDED.entry,
+		locale = EXCLUDED.locale,
+		internal_signature = EXCLUDED.internal_signature,
+		customer_id = EXCLUDED.customer_id,
+		delivery_service = EXCLUDED.delivery_service,
+		shardkey = EXCLUDED.shardkey,
+		sm_id = EXCLUDED.sm_id,
+		oof_shard = EXCLUDED.oof_shard
+	`
+
+// UpsertOrder stores order, replacing the delivery, payments, shipments and
+// items of an existing order with the same UID in one transaction.
+func (c *Client) UpsertOrder(ctx context.Context, order models.Order) error {
+	c.noteWrite(order.OrderUID)
+	return c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		return c.upsertOrder(ctx, tx, order)
+	})
+}
+
+func (c *Client) upsertOrder(ctx context.Context, tx *sqlx.Tx, order models.Order) error {
+	if err := lockOrderUID(ctx, tx, order.OrderUID); err != nil {
+		return err
+	}
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM orders WHERE order_uid = $1)`, order.OrderUID); err != nil {
+		return fmt.Errorf("error upserting order: %w", err)
+	}
+	if exists {
+		// a changed date_created moves the order to another partition: the
+		// old row is deleted with its children and the order inserted anew
+		moved := `DELETE FROM orders WHERE order_uid = $1 AND date_created <> $2`
+		if _, err := tx.ExecContext(ctx, moved, order.OrderUID, order.DateCreated); err != nil {
+			return fmt.Errorf("error upserting order: %w", err)
+		}
+	}
+	if _, err := tx.NamedExecContext(ctx, upsertOrderQuery, order); err != nil {
+		return fmt.Errorf("error upserting order: %w", err)
+	}
+	if err := deleteChildren(ctx, tx, order.OrderUID, order.DateCreated); err != nil {
+		return err
+	}
+	if err := c.insertChildren(ctx, tx, order); err != nil {
+		return fmt.Errorf("error replacing order details: %w", err)
+	}
+
+	operation := models.OperationUpdate
+	if !exists {
+		operation = models.OperationInsert
+	}
+	return c.recordHistory(ctx, tx, operation, &order)
+}
+
+// PatchOrder applies a JSON merge patch to the stored order and returns the
+// result. The order row is locked for the duration of the update.
+func (c *Client) PatchOrder(ctx context.Context, orderUID string, patch []byte) (*models.Order, error) {
+	return c.updateOrder(ctx, orderUID, func(tx *sqlx.Tx, order *models.Order) (bool, error) {
+		if err := order.ApplyMergePatch(patch); err != nil {
+			return false, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		if order.OrderUID != orderUID {
+			return false, fmt.Errorf("%w: order_uid cannot be changed", ErrInvalidPatch)
+		}
+		order.SetOrderUID(orderUID)
+		return true, nil
+	})
+}
+
+// AddPayment appends p to the payment records of the order while the order
+// row is locked, so payments recorded concurrently are kept.
+func (c *Client) AddPayment(ctx context.Context, orderUID string, p models.Payment) (*models.Order, error) {
+	return c.updateOrder(ctx, orderUID, func(tx *sqlx.Tx, order *models.Order) (bool, error) {
+		return order.AddPayment(p)
+	})
+}
+
+// MergeOrder adds the new payments and shipments of order to the stored one,
+// see models.Order.MergeRecords. The stored order is read from the primary
+// and written back in one transaction while it is locked, so payments
+// recorded concurrently are kept.
+func (c *Client) MergeOrder(ctx context.Context, order models.Order) (*models.Order, bool, error) {
+	var merged bool
+	stored, err := c.updateOrder(ctx, order.OrderUID, func(tx *sqlx.Tx, stored *models.Order) (bool, error) {
+		if err := c.checkErased(ctx, tx, order.OrderUID); err != nil {
+			return false, err
+		}
+		var err error
+		merged, err = stored.MergeRecords(&order)
+		return merged, err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return stored, merged, nil
+}
+
+// updateOrder reads the order with its row locked, lets fn change it and
+// stores the result if fn reports a change.
+func (c *Client) updateOrder(ctx context.Context, orderUID string, fn func(tx *sqlx.Tx, order *models.Order) (bool, error)) (*models.Order, error) {
+	c.noteWrite(orderUID)
+	stmt, err := c.prepared(ctx, selectOrderQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated *models.Order
+	err = c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		if _, err := lockOrder(ctx, tx, orderUID); err != nil {
+			return err
+		}
+
+		order, err := c.scanOrder(ctx, tx.StmtxContext(ctx, stmt), orderUID)
+		if err != nil {
+			return err
+		}
+		changed, err := fn(tx, order)
+		if err != nil {
+			return err
+		}
+		if changed {
+			if err := c.upsertOrder(ctx, tx, *order); err != nil {
+				return err
+			}
+		}
+		updated = order
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteOrder removes the order; its details are removed by the cascading
+// foreign keys. The last state of the order is kept in the
+// history. A missing order yields sql.ErrNoRows.
+func (c *Client) DeleteOrder(ctx context.Context, orderUID string) error {
+	return c.deleteOrder(ctx, orderUID, nil)
+}
+
+// deleteOrder deletes the order; with expected set only if the stored order
+// still equals it, see checkUnchanged.
+func (c *Client) deleteOrder(ctx context.Context, orderUID string, expected *models.Order) error {
+	c.noteWrite(orderUID)
+	stmt, err := c.prepared(ctx, selectOrderQuery)
+	if err != nil {
+		return err
+	}
+
+	return c.withTx(ctx, nil, func(tx *sqlx.Tx) error {
+		dateCreated, err := lockOrder(ctx, tx, orderUID)
+		if err != nil {
+			return err
+		}
+		order, err := c.scanOrder(ctx, tx.StmtxContext(ctx, stmt), orderUID)
+		if err != nil {
+			return err
+		}
+		if expected != nil {
+			if err := checkUnchanged(expected, order); err != nil {
+				return err
+			}
+		}
+		deleteQuery := `DELETE FROM orders WHERE order_uid = $1 AND date_created = $2`
+		if _, err := tx.ExecContext(ctx, deleteQuery, orderUID, dateCreated); err != nil {
+			return fmt.Errorf("error deleting order: %w", err)
+		}
+		return c.recordHistory(ctx, tx, models.OperationDelete, order)
+	})
+}
+
+func deleteChildren(ctx context.Context, tx *sqlx.Tx, orderUID string, dateCreated time.Time) error {
+	for _, table := range []string{"items", "shipments", "payments", "deliveries"} {
+		query := `DELETE FROM ` + table + ` WHERE order_uid = $1 AND date_created = $2`
+		if _, err := tx.ExecContext(ctx, query, orderUID, dateCreated); err != nil {
+			return fmt.Errorf("error deleting %s: %w", table, err)
+		}
+	}
+	return nil
+}
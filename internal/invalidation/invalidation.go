@@ -0,0 +1,72 @@
+package invalidation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+)
+
+const Subject = "CACHE.invalidate"
+
+// Cache is the part of a local order cache the invalidator needs.
+type Cache interface {
+	Evict(orderUID string)
+}
+
+type message struct {
+	InstanceID string `json:"instance_id"`
+	OrderUID   string `json:"order_uid"`
+}
+
+// Invalidator broadcasts order changes to other instances over core NATS
+// and evicts entries changed elsewhere from the local cache.
+type Invalidator struct {
+	nc         *nats.Conn
+	instanceID string
+	sub        *nats.Subscription
+}
+
+func NewInvalidator(nc *nats.Conn, instanceID string, cache Cache) (*Invalidator, error) {
+	inv := &Invalidator{
+		nc:         nc,
+		instanceID: instanceID,
+	}
+
+	sub, err := nc.Subscribe(Subject, func(msg *nats.Msg) {
+		var m message
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			slog.Error("Error parsing invalidation message", "error", err)
+			return
+		}
+		// our own writes are already reflected in the local cache
+		if m.InstanceID == inv.instanceID {
+			return
+		}
+		cache.Evict(m.OrderUID)
+		slog.Info("Order evicted by remote invalidation", "orderUID", m.OrderUID, "instanceID", m.InstanceID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to %s: %w", Subject, err)
+	}
+	inv.sub = sub
+
+	return inv, nil
+}
+
+func (inv *Invalidator) Publish(ctx context.Context, orderUID string) error {
+	data, err := json.Marshal(message{InstanceID: inv.instanceID, OrderUID: orderUID})
+	if err != nil {
+		return err
+	}
+	if err := inv.nc.Publish(Subject, data); err != nil {
+		return fmt.Errorf("error publishing invalidation: %w", err)
+	}
+	return nil
+}
+
+func (inv *Invalidator) Close() error {
+	return inv.sub.Unsubscribe()
+}
@@ -0,0 +1,19 @@
+package models
+
+// Anonymize removes the personal data of the order: the customer ID, the
+// delivery contact and address, and the payment identifiers. Amounts, items
+// and the delivery city and region are kept for reporting.
+func (o *Order) Anonymize() {
+	o.CustomerID = ""
+	o.Delivery.Name = ""
+	o.Delivery.Phone = ""
+	o.Delivery.Zip = ""
+	o.Delivery.Address = ""
+	o.Delivery.Email = ""
+	o.Payment.Transaction = ""
+	o.Payment.RequestID = ""
+	for i := range o.Payments {
+		o.Payments[i].Transaction = ""
+		o.Payments[i].RequestID = ""
+	}
+}
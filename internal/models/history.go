@@ -0,0 +1,140 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	OperationInsert = "insert"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// OrderVersion is one recorded change of an order. Order holds the full
+// order after the change, or before it for deletes.
+type OrderVersion struct {
+	OrderUID  string    `json:"order_uid" db:"order_uid"`
+	Version   int       `json:"version" db:"version"`
+	Operation string    `json:"operation" db:"operation"`
+	Source    string    `json:"source" db:"source"`
+	ChangedAt time.Time `json:"changed_at" db:"changed_at"`
+	Order     *Order    `json:"order" db:"-"`
+}
+
+// FieldChange is a difference in one field between two order versions.
+// Path uses dots for nested objects and [i] for list elements.
+type FieldChange struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+// Snapshot returns a copy of the order suitable for history: database row
+// ids and the last interaction time are cleared, as they are not part of
+// the order's content.
+func (o *Order) Snapshot() *Order {
+	snapshot := o.Clone()
+	snapshot.LastInteraction = time.Time{}
+	snapshot.Delivery.Id = 0
+	snapshot.Payment.Id = 0
+	for i := range snapshot.Payments {
+		snapshot.Payments[i].Id = 0
+	}
+	for i := range snapshot.Shipments {
+		snapshot.Shipments[i].Id = 0
+	}
+	for i := range snapshot.Items {
+		snapshot.Items[i].Id = 0
+	}
+	return snapshot
+}
+
+// DiffOrders lists the fields that differ between old and new, either of
+// which may be nil, sorted by path.
+func DiffOrders(old, new *Order) ([]FieldChange, error) {
+	oldDoc, err := orderDocument(old)
+	if err != nil {
+		return nil, err
+	}
+	newDoc, err := orderDocument(new)
+	if err != nil {
+		return nil, err
+	}
+	var changes []FieldChange
+	diffValues("", oldDoc, newDoc, &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+func orderDocument(o *Order) (any, error) {
+	if o == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(o.Snapshot())
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// diffIgnored are the JSON keys of bookkeeping fields that Snapshot clears
+// or that only repeat the order UID.
+var diffIgnored = map[string]struct{}{
+	"Id":              {},
+	"OrderUID":        {},
+	"LastInteraction": {},
+}
+
+func diffValues(path string, old, new any, changes *[]FieldChange) {
+	oldMap, oldIsMap := old.(map[string]any)
+	newMap, newIsMap := new.(map[string]any)
+	if oldIsMap || newIsMap {
+		keys := make(map[string]struct{})
+		for k := range oldMap {
+			keys[k] = struct{}{}
+		}
+		for k := range newMap {
+			keys[k] = struct{}{}
+		}
+		for k := range keys {
+			if _, ok := diffIgnored[k]; ok {
+				continue
+			}
+			diffValues(joinPath(path, k), oldMap[k], newMap[k], changes)
+		}
+		return
+	}
+
+	oldList, oldIsList := old.([]any)
+	newList, newIsList := new.([]any)
+	if oldIsList || newIsList {
+		for i := 0; i < max(len(oldList), len(newList)); i++ {
+			var o, n any
+			if i < len(oldList) {
+				o = oldList[i]
+			}
+			if i < len(newList) {
+				n = newList[i]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), o, n, changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, FieldChange{Path: path, Old: old, New: new})
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
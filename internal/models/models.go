@@ -6,21 +6,23 @@ import (
 )
 
 type Order struct {
-	OrderUID          string    `json:"order_uid" db:"order_uid"`
-	TrackNumber       string    `json:"track_number" db:"track_number"`
-	Entry             string    `json:"entry" db:"entry"`
-	Delivery          Delivery  `json:"delivery"`
-	Payment           Payment   `json:"payment"`
-	Items             []Item    `json:"items"`
-	Locale            string    `json:"locale" db:"locale"`
-	InternalSignature string    `json:"internal_signature" db:"internal_signature"`
-	CustomerID        string    `json:"customer_id" db:"customer_id"`
-	DeliveryService   string    `json:"delivery_service" db:"delivery_service"`
-	ShardKey          string    `json:"shardkey" db:"shardkey"`
-	SmID              int       `json:"sm_id" db:"sm_id"`
-	DateCreated       time.Time `json:"date_created" db:"date_created"`
-	OofShard          string    `json:"oof_shard" db:"oof_shard"`
-	LastInteraction   time.Time `db:"last_interaction"`
+	OrderUID          string     `json:"order_uid" db:"order_uid"`
+	TrackNumber       string     `json:"track_number" db:"track_number"`
+	Entry             string     `json:"entry" db:"entry"`
+	Delivery          Delivery   `json:"delivery"`
+	Payment           Payment    `json:"payment"`
+	Payments          []Payment  `json:"payments,omitempty"`
+	Shipments         []Shipment `json:"shipments,omitempty"`
+	Items             []Item     `json:"items"`
+	Locale            string     `json:"locale" db:"locale"`
+	InternalSignature string     `json:"internal_signature" db:"internal_signature"`
+	CustomerID        string     `json:"customer_id" db:"customer_id"`
+	DeliveryService   string     `json:"delivery_service" db:"delivery_service"`
+	ShardKey          string     `json:"shardkey" db:"shardkey"`
+	SmID              int        `json:"sm_id" db:"sm_id"`
+	DateCreated       time.Time  `json:"date_created" db:"date_created"`
+	OofShard          string     `json:"oof_shard" db:"oof_shard"`
+	LastInteraction   time.Time  `db:"last_interaction"`
 }
 
 type Delivery struct {
@@ -38,6 +40,7 @@ type Delivery struct {
 type Payment struct {
 	Id           int    `db:"id"`
 	OrderUID     string `db:"order_uid"`
+	Kind         string `json:"kind" db:"kind"`
 	Transaction  string `json:"transaction" db:"transaction"`
 	RequestID    string `json:"request_id" db:"request_id"`
 	Currency     string `json:"currency" db:"currency"`
@@ -66,6 +69,24 @@ type Item struct {
 	Status      int    `json:"status" db:"status"`
 }
 
+// Clone returns a deep copy of the order that shares no memory with o.
+func (o *Order) Clone() *Order {
+	clone := *o
+	if o.Payments != nil {
+		clone.Payments = make([]Payment, len(o.Payments))
+		copy(clone.Payments, o.Payments)
+	}
+	if o.Shipments != nil {
+		clone.Shipments = make([]Shipment, len(o.Shipments))
+		copy(clone.Shipments, o.Shipments)
+	}
+	if o.Items != nil {
+		clone.Items = make([]Item, len(o.Items))
+		copy(clone.Items, o.Items)
+	}
+	return &clone
+}
+
 func (o *Order) UnmarshalJSON(bytes []byte) error {
 	type order Order
 	err := json.Unmarshal(bytes, (*order)(o))
@@ -73,13 +94,85 @@ func (o *Order) UnmarshalJSON(bytes []byte) error {
 		return err
 	}
 
-	o.Delivery.OrderUID = o.OrderUID
-	o.Payment.OrderUID = o.OrderUID
+	o.SetOrderUID(o.OrderUID)
+	// payments written before kinds existed are charges
+	if o.Payment.Kind == "" {
+		o.Payment.Kind = PaymentCharge
+	}
+	for i := range o.Payments {
+		if o.Payments[i].Kind == "" {
+			o.Payments[i].Kind = PaymentCharge
+		}
+	}
+
+	return nil
+}
+
+// SetOrderUID sets the order UID on the order and all of its parts.
+func (o *Order) SetOrderUID(orderUID string) {
+	o.OrderUID = orderUID
+	o.Delivery.OrderUID = orderUID
+	o.Payment.OrderUID = orderUID
+	for i := range o.Payments {
+		o.Payments[i].OrderUID = orderUID
+	}
+	for i := range o.Shipments {
+		o.Shipments[i].OrderUID = orderUID
+	}
 
 	for i, item := range o.Items {
-		item.OrderUID = o.OrderUID
+		item.OrderUID = orderUID
 		o.Items[i] = item
 	}
+}
+
+// ApplyMergePatch applies a JSON merge patch (RFC 7386) to the order. Objects
+// in the patch are merged recursively, null removes a field and any other
+// value, including arrays, replaces the field. The patched order must pass
+// Validate.
+func (o *Order) ApplyMergePatch(patch []byte) error {
+	current, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	var doc, p any
+	if err := json.Unmarshal(current, &doc); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return err
+	}
+	merged, err := json.Marshal(mergePatch(doc, p))
+	if err != nil {
+		return err
+	}
 
+	var patched Order
+	if err := json.Unmarshal(merged, &patched); err != nil {
+		return err
+	}
+	if err := patched.Validate(); err != nil {
+		return err
+	}
+	*o = patched
 	return nil
 }
+
+func mergePatch(doc, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]any)
+	if !ok {
+		d = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = mergePatch(d[k], v)
+	}
+	return d
+}
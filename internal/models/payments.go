@@ -0,0 +1,205 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Payment kinds. Amounts are always positive; refunds and chargebacks are
+// subtracted from the charges.
+const (
+	PaymentCharge     = "charge"
+	PaymentRefund     = "refund"
+	PaymentChargeback = "chargeback"
+)
+
+// Refund statuses of an order, see Balance.
+const (
+	RefundNone    = "none"
+	RefundPartial = "partial"
+	RefundFull    = "full"
+)
+
+// Shipment is one parcel of an order. Its items are those with the same
+// track number.
+type Shipment struct {
+	Id              int    `db:"id"`
+	OrderUID        string `db:"order_uid"`
+	TrackNumber     string `json:"track_number" db:"track_number"`
+	DeliveryService string `json:"delivery_service" db:"delivery_service"`
+	Status          string `json:"status" db:"status"`
+}
+
+// Parcel is a shipment with the items it carries.
+type Parcel struct {
+	Shipment
+	Items []Item
+}
+
+// Balance sums the payment records of an order. Net is what the customer
+// has paid after refunds and chargebacks.
+type Balance struct {
+	Currency     string `json:"currency"`
+	Charged      int    `json:"charged"`
+	Refunded     int    `json:"refunded"`
+	ChargedBack  int    `json:"charged_back"`
+	Net          int    `json:"net"`
+	RefundStatus string `json:"refund_status"`
+}
+
+// ErrInvalidOrder is returned by Validate.
+var ErrInvalidOrder = errors.New("invalid order")
+
+// AllPayments returns Payment followed by the later payment records.
+func (o *Order) AllPayments() []Payment {
+	return append([]Payment{o.Payment}, o.Payments...)
+}
+
+// AddPayment appends p to the payment records unless a payment with its
+// transaction is there already, and reports whether it did. A payment
+// without a transaction, such as one cleared by Anonymize, matches none. The
+// order must still be valid with p.
+func (o *Order) AddPayment(p Payment) (bool, error) {
+	if o.hasTransaction(p.Transaction) {
+		return false, nil
+	}
+	o.Payments = append(o.Payments, p)
+	if err := o.Validate(); err != nil {
+		o.Payments = o.Payments[:len(o.Payments)-1]
+		return false, err
+	}
+	return true, nil
+}
+
+// MergeRecords adds the payments and shipments of update that o lacks, by
+// transaction and by track number, and reports whether it added any. The
+// rest of update is ignored, and so are its payments without a transaction,
+// which can't be told from the recorded ones. The order must still be valid
+// afterwards.
+func (o *Order) MergeRecords(update *Order) (bool, error) {
+	merged := o.Clone()
+	for _, p := range update.AllPayments() {
+		if p.Transaction != "" && !merged.hasTransaction(p.Transaction) {
+			p.Id = 0
+			merged.Payments = append(merged.Payments, p)
+		}
+	}
+	tracks := make(map[string]bool, len(merged.Shipments))
+	for _, s := range merged.Shipments {
+		tracks[s.TrackNumber] = true
+	}
+	for _, s := range update.Shipments {
+		if !tracks[s.TrackNumber] {
+			s.Id = 0
+			merged.Shipments = append(merged.Shipments, s)
+			tracks[s.TrackNumber] = true
+		}
+	}
+	if len(merged.Payments) == len(o.Payments) && len(merged.Shipments) == len(o.Shipments) {
+		return false, nil
+	}
+	if err := merged.Validate(); err != nil {
+		return false, err
+	}
+	merged.SetOrderUID(o.OrderUID)
+	*o = *merged
+	return true, nil
+}
+
+func (o *Order) hasTransaction(transaction string) bool {
+	if transaction == "" {
+		return false
+	}
+	for _, p := range o.AllPayments() {
+		if p.Transaction == transaction {
+			return true
+		}
+	}
+	return false
+}
+
+// Balance computes the order balance from its payment records. The refund
+// status counts chargebacks as refunds: it is full once the customer got
+// back everything charged.
+func (o *Order) Balance() Balance {
+	b := Balance{Currency: o.Payment.Currency}
+	for _, p := range o.AllPayments() {
+		switch p.Kind {
+		case PaymentRefund:
+			b.Refunded += p.Amount
+		case PaymentChargeback:
+			b.ChargedBack += p.Amount
+		default:
+			b.Charged += p.Amount
+		}
+	}
+	b.Net = b.Charged - b.Refunded - b.ChargedBack
+	switch returned := b.Refunded + b.ChargedBack; {
+	case returned == 0:
+		b.RefundStatus = RefundNone
+	case returned >= b.Charged:
+		b.RefundStatus = RefundFull
+	default:
+		b.RefundStatus = RefundPartial
+	}
+	return b
+}
+
+// Parcels groups the items by shipment, in the order of Shipments. Items
+// whose track number matches no shipment are returned last, in a parcel
+// with an empty shipment; without shipments that is every item.
+func (o *Order) Parcels() []Parcel {
+	parcels := make([]Parcel, len(o.Shipments))
+	index := make(map[string]int, len(o.Shipments))
+	for i, s := range o.Shipments {
+		parcels[i].Shipment = s
+		index[s.TrackNumber] = i
+	}
+	var unshipped []Item
+	for _, item := range o.Items {
+		if i, ok := index[item.TrackNumber]; ok {
+			parcels[i].Items = append(parcels[i].Items, item)
+			continue
+		}
+		unshipped = append(unshipped, item)
+	}
+	if len(unshipped) > 0 {
+		parcels = append(parcels, Parcel{Items: unshipped})
+	}
+	return parcels
+}
+
+// Validate checks the payment records and shipments of the order: known
+// kinds, non-negative amounts in the currency of the order, no more
+// returned than charged, and distinct shipment track numbers.
+func (o *Order) Validate() error {
+	for i, p := range o.AllPayments() {
+		switch p.Kind {
+		case PaymentCharge, PaymentRefund, PaymentChargeback, "":
+		default:
+			return fmt.Errorf("%w: payment %d has unknown kind %q", ErrInvalidOrder, i, p.Kind)
+		}
+		if p.Amount < 0 {
+			return fmt.Errorf("%w: payment %d has a negative amount", ErrInvalidOrder, i)
+		}
+		if p.Currency != "" && o.Payment.Currency != "" && p.Currency != o.Payment.Currency {
+			return fmt.Errorf("%w: payment %d is in %s, the order in %s", ErrInvalidOrder, i, p.Currency, o.Payment.Currency)
+		}
+	}
+	if b := o.Balance(); b.Net < 0 {
+		return fmt.Errorf("%w: refunds and chargebacks of %d exceed the charges of %d",
+			ErrInvalidOrder, b.Refunded+b.ChargedBack, b.Charged)
+	}
+
+	seen := make(map[string]bool, len(o.Shipments))
+	for i, s := range o.Shipments {
+		if s.TrackNumber == "" {
+			return fmt.Errorf("%w: shipment %d has no track number", ErrInvalidOrder, i)
+		}
+		if seen[s.TrackNumber] {
+			return fmt.Errorf("%w: duplicate shipment %s", ErrInvalidOrder, s.TrackNumber)
+		}
+		seen[s.TrackNumber] = true
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func paymentsOrder() *Order {
+	return &Order{
+		OrderUID: "payments",
+		Payment:  Payment{Kind: PaymentCharge, Transaction: "charge", Currency: "USD", Amount: 100},
+		Payments: []Payment{{Kind: PaymentRefund, Transaction: "refund", Currency: "USD", Amount: 10}},
+	}
+}
+
+func TestAddPaymentWithoutTransaction(t *testing.T) {
+	order := paymentsOrder()
+	// an anonymized order has no transactions left
+	order.Anonymize()
+	for i := 0; i < 2; i++ {
+		added, err := order.AddPayment(Payment{Kind: PaymentRefund, Currency: "USD", Amount: 5})
+		if err != nil {
+			t.Fatalf("AddPayment: %v", err)
+		}
+		if !added {
+			t.Fatalf("AddPayment #%d without a transaction was dropped", i+1)
+		}
+	}
+	if b := order.Balance(); b.Refunded != 20 {
+		t.Fatalf("refunded %d, want 20", b.Refunded)
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	order := paymentsOrder()
+	order.Shipments = []Shipment{{TrackNumber: "first"}}
+	update := paymentsOrder()
+	update.TrackNumber = "ignored"
+	update.Payments = append(update.Payments,
+		Payment{Kind: PaymentChargeback, Transaction: "chargeback", Currency: "USD", Amount: 20},
+		Payment{Kind: PaymentRefund, Currency: "USD", Amount: 1})
+	update.Shipments = []Shipment{{TrackNumber: "first"}, {TrackNumber: "second"}}
+
+	merged, err := order.MergeRecords(update)
+	if err != nil || !merged {
+		t.Fatalf("MergeRecords: merged %v, %v", merged, err)
+	}
+	if len(order.Payments) != 2 || order.Payments[1].Transaction != "chargeback" {
+		t.Fatalf("payments after merge: %+v", order.Payments)
+	}
+	if len(order.Shipments) != 2 || order.Shipments[1].TrackNumber != "second" {
+		t.Fatalf("shipments after merge: %+v", order.Shipments)
+	}
+	if order.TrackNumber != "" {
+		t.Fatalf("MergeRecords applied the track number %q", order.TrackNumber)
+	}
+	if merged, err := order.MergeRecords(update); err != nil || merged {
+		t.Fatalf("MergeRecords again: merged %v, %v", merged, err)
+	}
+
+	oversized := paymentsOrder()
+	oversized.Payments = []Payment{{Kind: PaymentRefund, Transaction: "huge", Currency: "USD", Amount: 1000}}
+	before := len(order.Payments)
+	if _, err := order.MergeRecords(oversized); !errors.Is(err, ErrInvalidOrder) {
+		t.Fatalf("MergeRecords of an oversized refund: got %v, want ErrInvalidOrder", err)
+	}
+	if len(order.Payments) != before {
+		t.Fatal("a rejected merge changed the order")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(o *Order)
+		valid  bool
+	}{
+		{"valid", func(o *Order) {}, true},
+		{"legacy payment without a kind", func(o *Order) { o.Payment.Kind = "" }, true},
+		{"unknown kind", func(o *Order) { o.Payments[0].Kind = "gift" }, false},
+		{"negative amount", func(o *Order) { o.Payments[0].Amount = -1 }, false},
+		{"other currency", func(o *Order) { o.Payments[0].Currency = "EUR" }, false},
+		{"refunds exceed charges", func(o *Order) { o.Payments[0].Amount = 101 }, false},
+		{"shipment without track number", func(o *Order) { o.Shipments = []Shipment{{}} }, false},
+		{"duplicate shipment", func(o *Order) {
+			o.Shipments = []Shipment{{TrackNumber: "T"}, {TrackNumber: "T"}}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := paymentsOrder()
+			tt.modify(order)
+			err := order.Validate()
+			if tt.valid && err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidOrder) {
+				t.Fatalf("Validate: got %v, want ErrInvalidOrder", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+// RawMessage is a message as it was received from NATS, kept for audits and
+// for re-parsing orders after schema changes.
+type RawMessage struct {
+	ID             int64               `json:"id" db:"id"`
+	OrderUID       string              `json:"order_uid,omitempty" db:"order_uid"`
+	Subject        string              `json:"subject" db:"subject"`
+	Stream         string              `json:"stream" db:"stream"`
+	StreamSeq      uint64              `json:"stream_seq" db:"stream_seq"`
+	Headers        map[string][]string `json:"headers,omitempty" db:"-"`
+	Payload        []byte              `json:"-" db:"payload"`
+	ReceivedAt     time.Time           `json:"received_at" db:"received_at"`
+	DecoderVersion string              `json:"decoder_version" db:"decoder_version"`
+	// ParseError is set when the payload could not be decoded into an Order.
+	ParseError string `json:"parse_error,omitempty" db:"parse_error"`
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"time"
+)
+
+// Return statuses. A return is requested, then received and inspected at
+// the warehouse, and finally refunded or rejected.
+const (
+	ReturnRequested = "requested"
+	ReturnReceived  = "received"
+	ReturnInspected = "inspected"
+	ReturnRefunded  = "refunded"
+	ReturnRejected  = "rejected"
+)
+
+// Return reason codes.
+const (
+	ReasonDefective      = "defective"
+	ReasonDamaged        = "damaged"
+	ReasonWrongItem      = "wrong_item"
+	ReasonWrongSize      = "wrong_size"
+	ReasonNotAsDescribed = "not_as_described"
+	ReasonChangedMind    = "changed_mind"
+	ReasonOther          = "other"
+)
+
+// ReturnReasons are the accepted reason codes.
+var ReturnReasons = map[string]bool{
+	ReasonDefective:      true,
+	ReasonDamaged:        true,
+	ReasonWrongItem:      true,
+	ReasonWrongSize:      true,
+	ReasonNotAsDescribed: true,
+	ReasonChangedMind:    true,
+	ReasonOther:          true,
+}
+
+// returnTransitions lists the statuses each status can move to.
+var returnTransitions = map[string][]string{
+	ReturnRequested: {ReturnReceived, ReturnRejected},
+	ReturnReceived:  {ReturnInspected},
+	ReturnInspected: {ReturnRefunded, ReturnRejected},
+}
+
+// returnStages orders the statuses; refunded and rejected are both final.
+var returnStages = map[string]int{
+	ReturnRequested: 0,
+	ReturnReceived:  1,
+	ReturnInspected: 2,
+	ReturnRefunded:  3,
+	ReturnRejected:  3,
+}
+
+// Return is a request to return some of the items of an order (an RMA).
+// RefundTransaction links a refunded return to the refund payment record of
+// the order.
+type Return struct {
+	ReturnID          string       `json:"return_id" db:"return_id"`
+	OrderUID          string       `json:"order_uid" db:"order_uid"`
+	Status            string       `json:"status" db:"status"`
+	Items             []ReturnItem `json:"items" db:"-"`
+	RefundTransaction string       `json:"refund_transaction,omitempty" db:"refund_transaction"`
+	CreatedAt         time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time    `json:"updated_at" db:"updated_at"`
+}
+
+// ReturnItem is a returned item of the order, identified by its rid and
+// chrt_id.
+type ReturnItem struct {
+	RID    string `json:"rid"`
+	ChrtID int    `json:"chrt_id"`
+	Reason string `json:"reason"`
+}
+
+// ReturnEvent is a return message received from NATS on RETURNS.<status>.
+// Items are set for requested returns; refunded returns carry the refund
+// payment, or the transaction of a refund already recorded on the order.
+type ReturnEvent struct {
+	ReturnID          string       `json:"return_id"`
+	OrderUID          string       `json:"order_uid"`
+	Status            string       `json:"status"`
+	Items             []ReturnItem `json:"items,omitempty"`
+	Refund            *Payment     `json:"refund,omitempty"`
+	RefundTransaction string       `json:"refund_transaction,omitempty"`
+}
+
+// Clone returns a deep copy of the return.
+func (r *Return) Clone() *Return {
+	clone := *r
+	if r.Items != nil {
+		clone.Items = make([]ReturnItem, len(r.Items))
+		copy(clone.Items, r.Items)
+	}
+	return &clone
+}
+
+// Open reports whether the return still holds its items, i.e. it was not
+// rejected.
+func (r *Return) Open() bool {
+	return r.Status != ReturnRejected
+}
+
+// Overlap finds an item of r that is also in one of the open returns among
+// others, not counting r itself, and returns its rid and that return's ID.
+func (r *Return) Overlap(others []Return) (rid, returnID string, ok bool) {
+	returned := make(map[string]string)
+	for _, other := range others {
+		if other.ReturnID == r.ReturnID || !other.Open() {
+			continue
+		}
+		for _, item := range other.Items {
+			returned[item.RID] = other.ReturnID
+		}
+	}
+	for _, item := range r.Items {
+		if returnID, ok := returned[item.RID]; ok {
+			return item.RID, returnID, true
+		}
+	}
+	return "", "", false
+}
+
+// CanMoveTo reports whether the return can go from its status to status.
+func (r *Return) CanMoveTo(status string) bool {
+	for _, next := range returnTransitions[r.Status] {
+		if next == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Passed reports whether the return has already reached the stage of
+// status, so a message setting it is outdated.
+func (r *Return) Passed(status string) bool {
+	stage, ok := returnStages[status]
+	return ok && returnStages[r.Status] >= stage
+}
+
+// ValidReturnStatus reports whether status is a known return status.
+func ValidReturnStatus(status string) bool {
+	_, ok := returnStages[status]
+	return ok
+}
@@ -0,0 +1,140 @@
+// Package pii encrypts personal data fields with AES-GCM and derives blind
+// index hashes that allow exact lookups without decrypting.
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// ErrDecrypt is returned by Decrypt for values that can't be opened, such as
+// corrupted ciphertext or a value moved from another field.
+var ErrDecrypt = errors.New("error decrypting value")
+
+// Keyring holds the encryption keys by ID. New values are encrypted with the
+// current key; values written with any other key in the ring can still be
+// decrypted, which is what allows rotation.
+type Keyring struct {
+	current  string
+	aeads    map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// NewKeyring builds a keyring from 32-byte AES keys. The index key is used for
+// blind indexes and, unlike the encryption keys, is never rotated, since
+// changing it would invalidate every stored hash.
+func NewKeyring(keys map[string][]byte, current string, indexKey []byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q: %w", current, ErrUnknownKey)
+	}
+	if len(indexKey) < 32 {
+		return nil, errors.New("blind index key must be at least 32 bytes")
+	}
+	k := &Keyring{current: current, aeads: make(map[string]cipher.AEAD), indexKey: indexKey}
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, got %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// ParseKeys decodes base64 keys, as read from configuration.
+func ParseKeys(encoded map[string]string) (map[string][]byte, error) {
+	keys := make(map[string][]byte, len(encoded))
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// CurrentID is the ID of the key new values are encrypted with.
+func (k *Keyring) CurrentID() string {
+	return k.current
+}
+
+// Encrypt seals plaintext with the current key and returns base64 of the
+// nonce followed by the ciphertext. The field name is bound as additional
+// data, so a value cannot be moved to another column.
+func (k *Keyring) Encrypt(field, plaintext string) (string, error) {
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(field))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt with the key it was written with.
+func (k *Keyring) Decrypt(keyID, field, ciphertext string) (string, error) {
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return "", fmt.Errorf("key %q: %w", keyID, ErrUnknownKey)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s is not valid base64: %v", ErrDecrypt, field, err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("%w: %s: ciphertext too short", ErrDecrypt, field)
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrDecrypt, field, err)
+	}
+	return string(plaintext), nil
+}
+
+// BlindIndex returns a keyed hash of the normalized value for exact-match
+// lookups, or nil for an empty value.
+func (k *Keyring) BlindIndex(field, value string) []byte {
+	if value == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// NormalizeEmail trims and lowercases an email address.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizePhone keeps only the digits of a phone number, so formatting
+// differences do not affect lookups.
+func NormalizePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, phone)
+}
@@ -0,0 +1,165 @@
+package pii
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func newKeyring(t *testing.T, keys map[string][]byte, current string) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(keys, current, key(9))
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	return k
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	k := newKeyring(t, map[string][]byte{"k1": key(1)}, "k1")
+	for _, plaintext := range []string{"", "Test Testov", "Плошадь Мира, 15"} {
+		sealed, err := k.Encrypt("name", plaintext)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		if plaintext != "" && bytes.Contains([]byte(sealed), []byte(plaintext)) {
+			t.Fatalf("ciphertext %q contains the plaintext", sealed)
+		}
+		got, err := k.Decrypt("k1", "name", sealed)
+		if err != nil {
+			t.Fatalf("Decrypt: %v", err)
+		}
+		if got != plaintext {
+			t.Fatalf("Decrypt = %q, want %q", got, plaintext)
+		}
+	}
+	a, _ := k.Encrypt("name", "same")
+	b, _ := k.Encrypt("name", "same")
+	if a == b {
+		t.Fatal("equal plaintexts encrypted to equal ciphertexts, the nonce is reused")
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	k := newKeyring(t, map[string][]byte{"k1": key(1)}, "k1")
+	sealed, err := k.Encrypt("name", "Test Testov")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	other := newKeyring(t, map[string][]byte{"k1": key(2)}, "k1")
+	corrupted := []byte(sealed)
+	corrupted[len(corrupted)/2] ^= 1
+
+	tests := []struct {
+		name       string
+		keyring    *Keyring
+		keyID      string
+		field      string
+		ciphertext string
+		want       error
+	}{
+		{"unknown key", k, "k2", "name", sealed, ErrUnknownKey},
+		{"wrong key", other, "k1", "name", sealed, ErrDecrypt},
+		{"other field", k, "k1", "address", sealed, ErrDecrypt},
+		{"corrupted", k, "k1", "name", string(corrupted), ErrDecrypt},
+		{"not base64", k, "k1", "name", "not base64!", ErrDecrypt},
+		{"too short", k, "k1", "name", "AAAA", ErrDecrypt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.keyring.Decrypt(tt.keyID, tt.field, tt.ciphertext); !errors.Is(err, tt.want) {
+				t.Fatalf("Decrypt: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewKeyringRejectsBadKeys(t *testing.T) {
+	if _, err := NewKeyring(map[string][]byte{"k1": key(1)}, "k2", key(9)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("missing current key: got %v, want ErrUnknownKey", err)
+	}
+	if _, err := NewKeyring(map[string][]byte{"k1": key(1)[:16]}, "k1", key(9)); err == nil {
+		t.Error("a 16-byte key was accepted")
+	}
+	if _, err := NewKeyring(map[string][]byte{"k1": key(1)}, "k1", key(9)[:16]); err == nil {
+		t.Error("a 16-byte index key was accepted")
+	}
+}
+
+// TestRotation re-encrypts a value like the re-encryption job does: read
+// with the key it was written with, sealed again with the current one.
+func TestRotation(t *testing.T) {
+	before := newKeyring(t, map[string][]byte{"k1": key(1)}, "k1")
+	sealed, err := before.Encrypt("email", "test@example.com")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	after := newKeyring(t, map[string][]byte{"k1": key(1), "k2": key(2)}, "k2")
+	if after.CurrentID() != "k2" {
+		t.Fatalf("CurrentID = %q, want k2", after.CurrentID())
+	}
+	plaintext, err := after.Decrypt("k1", "email", sealed)
+	if err != nil {
+		t.Fatalf("Decrypt with the old key: %v", err)
+	}
+	resealed, err := after.Encrypt("email", plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if _, err := after.Decrypt("k1", "email", resealed); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("re-encrypted value opened with the old key: %v", err)
+	}
+
+	// once k1 is retired, only re-encrypted values can be read
+	retired := newKeyring(t, map[string][]byte{"k2": key(2)}, "k2")
+	if got, err := retired.Decrypt("k2", "email", resealed); err != nil || got != "test@example.com" {
+		t.Fatalf("Decrypt after retiring k1 = %q, %v", got, err)
+	}
+	if _, err := retired.Decrypt("k1", "email", sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Decrypt with a retired key: got %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	k := newKeyring(t, map[string][]byte{"k1": key(1)}, "k1")
+	// the index key, not the encryption keys, determines the hashes
+	rotated := newKeyring(t, map[string][]byte{"k2": key(2)}, "k2")
+	email := k.BlindIndex("email", NormalizeEmail("Test@Example.com "))
+	if !bytes.Equal(email, k.BlindIndex("email", NormalizeEmail("test@example.com"))) {
+		t.Error("emails differing in case and spaces hash differently")
+	}
+	if !bytes.Equal(email, rotated.BlindIndex("email", NormalizeEmail("test@example.com"))) {
+		t.Error("rotating the encryption key changed the blind index")
+	}
+	phone := k.BlindIndex("phone", NormalizePhone("+972 000-000-000"))
+	if !bytes.Equal(phone, k.BlindIndex("phone", NormalizePhone("+972000000000"))) {
+		t.Error("phones differing in formatting hash differently")
+	}
+	if bytes.Equal(k.BlindIndex("email", "value"), k.BlindIndex("phone", "value")) {
+		t.Error("the same value hashes equally in different fields")
+	}
+	other, err := NewKeyring(map[string][]byte{"k1": key(1)}, "k1", key(8))
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	if bytes.Equal(email, other.BlindIndex("email", NormalizeEmail("test@example.com"))) {
+		t.Error("a different index key gave the same hash")
+	}
+	if k.BlindIndex("email", "") != nil {
+		t.Error("an empty value has a blind index")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	if got := NormalizeEmail("  Test@Example.COM\n"); got != "test@example.com" {
+		t.Errorf("NormalizeEmail = %q", got)
+	}
+	if got := NormalizePhone("+972 (0) 000-00-01"); got != "97200000001" {
+		t.Errorf("NormalizePhone = %q", got)
+	}
+}
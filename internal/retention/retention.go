@@ -0,0 +1,229 @@
+// Package retention archives old orders to compressed files and purges
+// archived data once it is past its retention period.
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const archiveExt = ".ndjson.zst"
+
+// Policy configures retention. Orders created more than ArchiveAfter ago are
+// exported to Dir and deleted; archive files, raw messages and history of
+// deleted orders older than PurgeAfter are removed. A zero duration disables
+// that step.
+type Policy struct {
+	ArchiveAfter time.Duration
+	PurgeAfter   time.Duration
+	Interval     time.Duration
+	BatchSize    int
+	Dir          string
+}
+
+// Locker keeps the instances sharing a database from running the job at the
+// same time, which would archive the same orders twice; see db.Client.TryLock.
+type Locker interface {
+	TryLock(ctx context.Context, name string) (unlock func(), ok bool, err error)
+}
+
+// Job deletes and purges through database, which keeps its cache in step, but
+// reads the orders it archives from reader on the primary, so an archive never
+// holds a cached or replica copy older than the order it replaces. A nil
+// locker runs every time.
+type Job struct {
+	db     db.Database
+	reader db.Database
+	locker Locker
+	policy Policy
+}
+
+func NewJob(database, reader db.Database, locker Locker, policy Policy) *Job {
+	if policy.BatchSize <= 0 {
+		policy.BatchSize = 500
+	}
+	if policy.Interval <= 0 {
+		policy.Interval = time.Hour
+	}
+	return &Job{db: database, reader: reader, locker: locker, policy: policy}
+}
+
+// Run applies the policy once immediately and then on every interval until
+// ctx is done.
+func (j *Job) Run(ctx context.Context) error {
+	ticker := time.NewTicker(j.policy.Interval)
+	defer ticker.Stop()
+	for {
+		if err := j.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Retention run failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce archives every order past ArchiveAfter, batch by batch, and then
+// purges data past PurgeAfter. It does nothing while another instance runs.
+func (j *Job) RunOnce(ctx context.Context) error {
+	if j.locker != nil {
+		unlock, ok, err := j.locker.TryLock(ctx, "retention")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			slog.Info("Retention run skipped, another instance is running it")
+			return nil
+		}
+		defer unlock()
+	}
+	ctx = db.WithPrimary(ctx)
+	now := time.Now()
+	if j.policy.ArchiveAfter > 0 {
+		archived, err := j.archive(ctx, now.Add(-j.policy.ArchiveAfter))
+		if archived > 0 {
+			slog.Info("Archived old orders", "orders", archived)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if j.policy.PurgeAfter > 0 {
+		if err := j.purge(ctx, now.Add(-j.policy.PurgeAfter)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *Job) archive(ctx context.Context, cutoff time.Time) (int, error) {
+	if err := os.MkdirAll(j.policy.Dir, 0o755); err != nil {
+		return 0, fmt.Errorf("error creating archive directory: %w", err)
+	}
+	archived := 0
+	for batch := 0; ; batch++ {
+		orderUIDs, err := j.db.GetOrdersCreatedBefore(ctx, cutoff, j.policy.BatchSize)
+		if err != nil {
+			return archived, err
+		}
+		if len(orderUIDs) == 0 {
+			return archived, nil
+		}
+		name := fmt.Sprintf("orders-%s-%04d%s", time.Now().UTC().Format("20060102T150405"), batch, archiveExt)
+		orders, err := j.export(ctx, filepath.Join(j.policy.Dir, name), orderUIDs)
+		if err != nil {
+			return archived, err
+		}
+		// only delete once the batch is safely on disk; orders updated since
+		// they were exported are kept and archived again by the next batch
+		n, err := j.db.DeleteOrders(ctx, orders)
+		if err != nil {
+			return archived, err
+		}
+		archived += n
+		if kept := len(orders) - n; kept > 0 {
+			slog.Info("Kept orders changed since archiving", "orders", kept)
+			if n == 0 {
+				// every order keeps changing, leave them to the next run
+				return archived, nil
+			}
+		}
+	}
+}
+
+// export writes the orders as NDJSON to a zstd file, syncs it and returns
+// the orders written. Orders that disappeared since they were listed are
+// skipped.
+func (j *Job) export(ctx context.Context, path string, orderUIDs []string) (orders []models.Order, err error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	zw, err := zstd.NewWriter(f)
+	if err != nil {
+		return nil, fmt.Errorf("error creating zstd writer: %w", err)
+	}
+	enc := json.NewEncoder(zw)
+	for _, uid := range orderUIDs {
+		order, err := j.reader.SelectOrder(ctx, uid)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			zw.Close()
+			return nil, fmt.Errorf("error reading order %s for archiving: %w", uid, err)
+		}
+		if err := enc.Encode(order); err != nil {
+			zw.Close()
+			return nil, fmt.Errorf("error writing order %s to archive: %w", uid, err)
+		}
+		orders = append(orders, *order)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("error finishing archive: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("error syncing archive: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("error closing archive: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (j *Job) purge(ctx context.Context, cutoff time.Time) error {
+	entries, err := os.ReadDir(j.policy.Dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading archive directory: %w", err)
+	}
+	files := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), archiveExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(j.policy.Dir, entry.Name())); err != nil {
+			slog.Error("Failed to purge archive file", "file", entry.Name(), "error", err)
+			continue
+		}
+		files++
+	}
+
+	rows, err := j.db.PurgeHistory(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+	if files > 0 || rows > 0 {
+		slog.Info("Purged expired data", "files", files, "rows", rows)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func testOrder(orderUID string, created time.Time) models.Order {
+	return models.Order{
+		OrderUID:    orderUID,
+		TrackNumber: "WBILTRACK",
+		Payment:     models.Payment{Kind: models.PaymentCharge, Transaction: orderUID, Currency: "USD", Amount: 100},
+		Items:       []models.Item{{ChrtID: 1, RID: orderUID + "-1", Name: "Mascaras"}},
+		DateCreated: created,
+	}
+}
+
+// readArchives returns the orders in the archive files of dir.
+func readArchives(t *testing.T, dir string) []models.Order {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+archiveExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orders []models.Order
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := json.NewDecoder(zr)
+		for dec.More() {
+			var order models.Order
+			if err := dec.Decode(&order); err != nil {
+				t.Fatalf("decoding %s: %v", path, err)
+			}
+			orders = append(orders, order)
+		}
+		zr.Close()
+		f.Close()
+	}
+	return orders
+}
+
+func TestArchiveAndPurge(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewMemoryDB()
+	now := time.Now().UTC()
+	old := []models.Order{
+		testOrder("old-1", now.AddDate(-2, 0, 0)),
+		testOrder("old-2", now.AddDate(-2, 0, 1)),
+		testOrder("old-3", now.AddDate(-1, 0, 0)),
+	}
+	recent := testOrder("recent", now)
+	for _, order := range append(old, recent) {
+		if err := database.InsertOrder(ctx, order); err != nil {
+			t.Fatalf("InsertOrder: %v", err)
+		}
+	}
+	msg := models.RawMessage{OrderUID: "old-1", Stream: "ORDERS", StreamSeq: 1, Payload: []byte(`{}`), ReceivedAt: now.AddDate(-2, 0, 0)}
+	if err := database.ArchiveRawMessage(ctx, msg); err != nil {
+		t.Fatalf("ArchiveRawMessage: %v", err)
+	}
+
+	dir := t.TempDir()
+	archiver := NewJob(database, database, nil, Policy{ArchiveAfter: 180 * 24 * time.Hour, BatchSize: 2, Dir: dir})
+	if err := archiver.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	archived := readArchives(t, dir)
+	if len(archived) != len(old) {
+		t.Fatalf("archived %d orders, want %d", len(archived), len(old))
+	}
+	for _, order := range old {
+		if _, err := database.SelectOrder(ctx, order.OrderUID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("archived order %s is still stored: %v", order.OrderUID, err)
+		}
+	}
+	if _, err := database.SelectOrder(ctx, recent.OrderUID); err != nil {
+		t.Fatalf("recent order: %v", err)
+	}
+	// running again finds nothing to archive
+	if err := archiver.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if n := len(readArchives(t, dir)); n != len(old) {
+		t.Fatalf("%d archived orders after a second run, want %d", n, len(old))
+	}
+
+	// archives and history older than PurgeAfter go, stored orders keep theirs
+	time.Sleep(10 * time.Millisecond)
+	purger := NewJob(database, database, nil, Policy{PurgeAfter: 5 * time.Millisecond, Dir: dir})
+	if err := purger.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if n := len(readArchives(t, dir)); n != 0 {
+		t.Fatalf("%d archived orders left after the purge", n)
+	}
+	if history, _ := database.OrderHistory(ctx, "old-1"); len(history) != 0 {
+		t.Errorf("history of an archived order was kept: %d versions", len(history))
+	}
+	if history, _ := database.OrderHistory(ctx, recent.OrderUID); len(history) != 1 {
+		t.Errorf("history of a stored order has %d versions, want 1", len(history))
+	}
+	if msgs, _ := database.SelectRawMessages(ctx, "old-1"); len(msgs) != 0 {
+		t.Errorf("%d raw messages left after the purge", len(msgs))
+	}
+}
+
+type busyLocker struct{}
+
+func (busyLocker) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	return nil, false, nil
+}
+
+func TestRunOnceSkipsWhileLocked(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewMemoryDB()
+	order := testOrder("old", time.Now().AddDate(-2, 0, 0))
+	if err := database.InsertOrder(ctx, order); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	job := NewJob(database, database, busyLocker{}, Policy{ArchiveAfter: time.Hour, Dir: t.TempDir()})
+	if err := job.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if _, err := database.SelectOrder(ctx, order.OrderUID); err != nil {
+		t.Fatalf("order archived while another instance holds the lock: %v", err)
+	}
+}
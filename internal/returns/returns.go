@@ -0,0 +1,226 @@
+// Package returns handles return requests (RMAs) for order items. It checks
+// requests against their orders, moves returns through their statuses and
+// records refunds as payment records of the order.
+package returns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+
+	"github.com/nats-io/nuid"
+)
+
+var (
+	// ErrInvalid is returned for requests and updates that can never be
+	// applied.
+	ErrInvalid = errors.New("invalid return")
+	// ErrOutOfOrder is returned for a status the return can't move to yet,
+	// such as inspected for a return that was not received.
+	ErrOutOfOrder = errors.New("return is not ready for this status")
+	// ErrOutdated is returned for a status the return already has or has
+	// gone past.
+	ErrOutdated = errors.New("return already reached this status")
+)
+
+// Update moves a return to Status. A refunded return needs its refund:
+// either Refund, recorded on the order unless a payment with its
+// transaction is there already, or the RefundTransaction of a refund the
+// order has. A refund pays for one return only.
+type Update struct {
+	Status            string          `json:"status"`
+	Refund            *models.Payment `json:"refund,omitempty"`
+	RefundTransaction string          `json:"refund_transaction,omitempty"`
+}
+
+type Service struct {
+	db db.Database
+}
+
+func NewService(database db.Database) *Service {
+	return &Service{db: database}
+}
+
+// Request creates a return in status requested for some items of its
+// order. A return ID is generated if ret has none. Items must be items of
+// the order, identified by rid and chrt_id, and not part of another return
+// that was not rejected.
+func (s *Service) Request(ctx context.Context, ret models.Return) (*models.Return, error) {
+	order, err := s.db.SelectOrder(ctx, ret.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.db.OrderReturns(ctx, ret.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkItems(order, existing, ret); err != nil {
+		return nil, err
+	}
+
+	if ret.ReturnID == "" {
+		ret.ReturnID = nuid.Next()
+	}
+	ret.Status = models.ReturnRequested
+	ret.RefundTransaction = ""
+	ret.CreatedAt = time.Now().UTC()
+	ret.UpdatedAt = ret.CreatedAt
+	// InsertReturn checks the items again, as another return may have taken
+	// them since they were read
+	err = s.db.InsertReturn(ctx, ret)
+	if errors.Is(err, db.ErrItemReturned) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func checkItems(order *models.Order, existing []models.Return, ret models.Return) error {
+	if len(ret.Items) == 0 {
+		return fmt.Errorf("%w: no items", ErrInvalid)
+	}
+	ordered := make(map[string]int, len(order.Items))
+	for _, item := range order.Items {
+		ordered[item.RID] = item.ChrtID
+	}
+	seen := make(map[string]bool, len(ret.Items))
+	for _, item := range ret.Items {
+		chrtID, ok := ordered[item.RID]
+		if !ok || chrtID != item.ChrtID {
+			return fmt.Errorf("%w: item %s/%d is not in order %s", ErrInvalid, item.RID, item.ChrtID, order.OrderUID)
+		}
+		if !models.ReturnReasons[item.Reason] {
+			return fmt.Errorf("%w: unknown reason %q for item %s", ErrInvalid, item.Reason, item.RID)
+		}
+		if seen[item.RID] {
+			return fmt.Errorf("%w: item %s is listed twice", ErrInvalid, item.RID)
+		}
+		seen[item.RID] = true
+	}
+	if rid, other, ok := ret.Overlap(existing); ok {
+		return fmt.Errorf("%w: item %s is already in return %s", ErrInvalid, rid, other)
+	}
+	return nil
+}
+
+// Update moves the return to u.Status, recording the refund first for
+// refunded returns. Retrying an update after a failure is safe: the refund
+// is recorded only once.
+func (s *Service) Update(ctx context.Context, returnID string, u Update) (*models.Return, error) {
+	if !models.ValidReturnStatus(u.Status) {
+		return nil, fmt.Errorf("%w: unknown status %q", ErrInvalid, u.Status)
+	}
+	ret, err := s.db.SelectReturn(ctx, returnID)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Passed(u.Status) {
+		return nil, fmt.Errorf("%w: return %s is %s", ErrOutdated, returnID, ret.Status)
+	}
+	if !ret.CanMoveTo(u.Status) {
+		return nil, fmt.Errorf("%w: return %s is %s, not ready for %s", ErrOutOfOrder, returnID, ret.Status, u.Status)
+	}
+
+	if u.Status == models.ReturnRefunded {
+		transaction, err := s.refund(ctx, ret, u)
+		if err != nil {
+			return nil, err
+		}
+		ret.RefundTransaction = transaction
+	}
+	from := ret.Status
+	ret.Status = u.Status
+	ret.UpdatedAt = time.Now().UTC()
+	if err := s.db.UpdateReturn(ctx, *ret, from); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// refund finds or records the refund payment of ret on its order and
+// returns its transaction. A refund without an amount refunds the total
+// price of the returned items.
+func (s *Service) refund(ctx context.Context, ret *models.Return, u Update) (string, error) {
+	order, err := s.db.SelectOrder(ctx, ret.OrderUID)
+	if err != nil {
+		return "", err
+	}
+	transaction := u.RefundTransaction
+	if u.Refund != nil {
+		transaction = u.Refund.Transaction
+	}
+	if transaction == "" {
+		return "", fmt.Errorf("%w: refunded returns need a refund transaction", ErrInvalid)
+	}
+	// one refund pays for one return
+	existing, err := s.db.OrderReturns(ctx, ret.OrderUID)
+	if err != nil {
+		return "", err
+	}
+	for _, other := range existing {
+		if other.ReturnID != ret.ReturnID && other.RefundTransaction == transaction {
+			return "", fmt.Errorf("%w: refund %s is already used by return %s", ErrInvalid, transaction, other.ReturnID)
+		}
+	}
+	for _, p := range order.AllPayments() {
+		if p.Transaction != transaction {
+			continue
+		}
+		if p.Kind != models.PaymentRefund {
+			return "", fmt.Errorf("%w: payment %s is a %s, not a refund", ErrInvalid, transaction, p.Kind)
+		}
+		return transaction, nil
+	}
+	if u.Refund == nil {
+		return "", fmt.Errorf("%w: order %s has no refund %s", ErrInvalid, order.OrderUID, transaction)
+	}
+
+	refund := *u.Refund
+	refund.Kind = models.PaymentRefund
+	if refund.Currency == "" {
+		refund.Currency = order.Payment.Currency
+	}
+	if refund.Amount == 0 {
+		refund.Amount = itemsTotal(order, ret)
+	}
+	if refund.PaymentDt == 0 {
+		refund.PaymentDt = time.Now().Unix()
+	}
+	// the refund is appended to the payments as stored, not to those read
+	// above, which may be outdated
+	updated, err := s.db.AddPayment(ctx, order.OrderUID, refund)
+	if errors.Is(err, models.ErrInvalidOrder) {
+		return "", fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	// a concurrent update may have recorded another payment with the
+	// transaction first
+	for _, p := range updated.AllPayments() {
+		if p.Transaction == transaction && p.Kind != models.PaymentRefund {
+			return "", fmt.Errorf("%w: payment %s is a %s, not a refund", ErrInvalid, transaction, p.Kind)
+		}
+	}
+	return transaction, nil
+}
+
+func itemsTotal(order *models.Order, ret *models.Return) int {
+	returned := make(map[string]bool, len(ret.Items))
+	for _, item := range ret.Items {
+		returned[item.RID] = true
+	}
+	total := 0
+	for _, item := range order.Items {
+		if returned[item.RID] {
+			total += item.TotalPrice
+		}
+	}
+	return total
+}
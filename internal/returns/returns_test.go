@@ -0,0 +1,184 @@
+package returns
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+)
+
+func testOrder() models.Order {
+	return models.Order{
+		OrderUID: "returns",
+		Payment:  models.Payment{Kind: models.PaymentCharge, Transaction: "charge", Currency: "USD", Amount: 300},
+		Items: []models.Item{
+			{RID: "rid-1", ChrtID: 1, TotalPrice: 100},
+			{RID: "rid-2", ChrtID: 2, TotalPrice: 200},
+		},
+	}
+}
+
+func newTestService(t *testing.T) (*Service, db.Database) {
+	t.Helper()
+	database := db.NewMemoryDB()
+	if err := database.InsertOrder(context.Background(), testOrder()); err != nil {
+		t.Fatalf("InsertOrder: %v", err)
+	}
+	return NewService(database), database
+}
+
+// inspected requests a return of the item and moves it to inspected.
+func inspected(t *testing.T, s *Service, item models.Item) *models.Return {
+	t.Helper()
+	ctx := context.Background()
+	ret, err := s.Request(ctx, models.Return{
+		OrderUID: "returns",
+		Items:    []models.ReturnItem{{RID: item.RID, ChrtID: item.ChrtID, Reason: models.ReasonDefective}},
+	})
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	for _, status := range []string{models.ReturnReceived, models.ReturnInspected} {
+		if ret, err = s.Update(ctx, ret.ReturnID, Update{Status: status}); err != nil {
+			t.Fatalf("Update to %s: %v", status, err)
+		}
+	}
+	return ret
+}
+
+func TestRefundPaysForOneReturn(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestService(t)
+	items := testOrder().Items
+	first, second := inspected(t, s, items[0]), inspected(t, s, items[1])
+
+	refund := &models.Payment{Transaction: "refund-1"}
+	if _, err := s.Update(ctx, first.ReturnID, Update{Status: models.ReturnRefunded, Refund: refund}); err != nil {
+		t.Fatalf("refunding the first return: %v", err)
+	}
+	// retrying the same refund is fine
+	if _, err := s.Update(ctx, first.ReturnID, Update{Status: models.ReturnRefunded, Refund: refund}); !errors.Is(err, ErrOutdated) {
+		t.Fatalf("refunding the first return again: got %v, want ErrOutdated", err)
+	}
+	_, err := s.Update(ctx, second.ReturnID, Update{Status: models.ReturnRefunded, RefundTransaction: "refund-1"})
+	if !errors.Is(err, ErrInvalid) {
+		t.Fatalf("refunding the second return with the first refund: got %v, want ErrInvalid", err)
+	}
+}
+
+func TestReturnStateMachine(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		steps []string
+		last  string
+		want  error
+	}{
+		{"skips received", nil, models.ReturnInspected, ErrOutOfOrder},
+		{"refunds uninspected", []string{models.ReturnReceived}, models.ReturnRefunded, ErrOutOfOrder},
+		{"rejects received", []string{models.ReturnReceived}, models.ReturnRejected, ErrOutOfOrder},
+		{"goes back", []string{models.ReturnReceived}, models.ReturnRequested, ErrOutdated},
+		{"repeats", []string{models.ReturnReceived}, models.ReturnReceived, ErrOutdated},
+		{"refunds rejected", []string{models.ReturnRejected}, models.ReturnRefunded, ErrOutdated},
+		{"unknown status", nil, "lost", ErrInvalid},
+		{"rejects requested", nil, models.ReturnRejected, nil},
+		{"rejects inspected", []string{models.ReturnReceived, models.ReturnInspected}, models.ReturnRejected, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			item := testOrder().Items[0]
+			ret, err := s.Request(ctx, models.Return{
+				OrderUID: "returns",
+				Items:    []models.ReturnItem{{RID: item.RID, ChrtID: item.ChrtID, Reason: models.ReasonDamaged}},
+			})
+			if err != nil {
+				t.Fatalf("Request: %v", err)
+			}
+			if ret.Status != models.ReturnRequested {
+				t.Fatalf("new return is %s", ret.Status)
+			}
+			for _, status := range tt.steps {
+				if _, err := s.Update(ctx, ret.ReturnID, Update{Status: status}); err != nil {
+					t.Fatalf("Update to %s: %v", status, err)
+				}
+			}
+			updated, err := s.Update(ctx, ret.ReturnID, Update{Status: tt.last})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Update to %s: got %v, want %v", tt.last, err, tt.want)
+			}
+			if tt.want == nil && updated.Status != tt.last {
+				t.Fatalf("return is %s, want %s", updated.Status, tt.last)
+			}
+		})
+	}
+}
+
+func TestRequestChecksItems(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestService(t)
+	item := testOrder().Items[0]
+	returned := models.ReturnItem{RID: item.RID, ChrtID: item.ChrtID, Reason: models.ReasonDefective}
+	tests := []struct {
+		name  string
+		items []models.ReturnItem
+	}{
+		{"no items", nil},
+		{"unknown item", []models.ReturnItem{{RID: "rid-9", ChrtID: 9, Reason: models.ReasonDefective}}},
+		{"other chrt_id", []models.ReturnItem{{RID: item.RID, ChrtID: 2, Reason: models.ReasonDefective}}},
+		{"unknown reason", []models.ReturnItem{{RID: item.RID, ChrtID: item.ChrtID, Reason: "bored"}}},
+		{"listed twice", []models.ReturnItem{returned, returned}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Request(ctx, models.Return{OrderUID: "returns", Items: tt.items}); !errors.Is(err, ErrInvalid) {
+				t.Fatalf("Request: got %v, want ErrInvalid", err)
+			}
+		})
+	}
+
+	first, err := s.Request(ctx, models.Return{OrderUID: "returns", Items: []models.ReturnItem{returned}})
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if _, err := s.Request(ctx, models.Return{OrderUID: "returns", Items: []models.ReturnItem{returned}}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("Request of a returned item: got %v, want ErrInvalid", err)
+	}
+	// a rejected return frees its items
+	if _, err := s.Update(ctx, first.ReturnID, Update{Status: models.ReturnRejected}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, err := s.Request(ctx, models.Return{OrderUID: "returns", Items: []models.ReturnItem{returned}}); err != nil {
+		t.Fatalf("Request after the rejection: %v", err)
+	}
+}
+
+func TestRefundRecordsPayment(t *testing.T) {
+	ctx := context.Background()
+	s, database := newTestService(t)
+	ret := inspected(t, s, testOrder().Items[1])
+
+	if _, err := s.Update(ctx, ret.ReturnID, Update{Status: models.ReturnRefunded}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("refund without a transaction: got %v, want ErrInvalid", err)
+	}
+	if _, err := s.Update(ctx, ret.ReturnID, Update{Status: models.ReturnRefunded, RefundTransaction: "charge"}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("refund with the charge: got %v, want ErrInvalid", err)
+	}
+	refunded, err := s.Update(ctx, ret.ReturnID, Update{Status: models.ReturnRefunded, Refund: &models.Payment{Transaction: "refund-1"}})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if refunded.Status != models.ReturnRefunded || refunded.RefundTransaction != "refund-1" {
+		t.Fatalf("refunded return = %+v", refunded)
+	}
+	order, err := database.SelectOrder(ctx, "returns")
+	if err != nil {
+		t.Fatalf("SelectOrder: %v", err)
+	}
+	// the refund defaults to the price of the returned items
+	if b := order.Balance(); b.Refunded != 200 {
+		t.Fatalf("refunded %d, want 200", b.Refunded)
+	}
+}
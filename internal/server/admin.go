@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"wbstorage/internal/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// cacheAdmin is implemented by databases with an inspectable cache.
+type cacheAdmin interface {
+	Stats() db.CacheStats
+	Evict(orderUID string)
+	Flush() int
+	StartWarmup(ctx context.Context) bool
+	WarmupProgress() db.WarmupProgress
+}
+
+func (s *Server) adminRouter() http.Handler {
+	router := chi.NewRouter()
+	router.Use(s.requireAdminToken)
+	router.Use(withSource("admin"))
+	if cache, ok := s.db.(cacheAdmin); ok {
+		router.Get("/cache/stats", s.handleCacheStats(cache))
+		router.Delete("/cache", s.handleCacheFlush(cache))
+		router.Delete("/cache/{orderUID}", s.handleCacheEvict(cache))
+		router.Post("/cache/warmup", s.handleCacheWarmup(cache))
+	}
+	router.Get("/orders", s.handleLookupOrders())
+	router.Get("/customers/{customerID}/export", s.handleExportCustomer())
+	router.Post("/customers/{customerID}/erase", s.handleEraseCustomer())
+	router.Get("/orders/{orderUID}/raw", s.handleListRawMessages())
+	router.Get("/raw/{id}", s.handleGetRawMessage())
+	return router
+}
+
+// requireAdminToken accepts requests carrying "Authorization: Bearer <token>".
+func (s *Server) requireAdminToken(next http.Handler) http.Handler {
+	return requireToken(s.adminToken)(next)
+}
+
+// requireWriteToken accepts requests carrying the write token or the admin
+// token.
+func (s *Server) requireWriteToken(next http.Handler) http.Handler {
+	return requireToken(s.writeToken, s.adminToken)(next)
+}
+
+// requireToken accepts requests carrying "Authorization: Bearer <token>" for
+// one of the tokens that are set.
+func requireToken(tokens ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if ok && validToken(token, tokens) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
+
+func validToken(token string, tokens []string) bool {
+	valid := false
+	for _, t := range tokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func (s *Server) handleCacheStats(cache cacheAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, cache.Stats())
+	}
+}
+
+func (s *Server) handleCacheFlush(cache cacheAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := cache.Flush()
+		slog.Info("Cache flushed by admin", "evicted", n)
+		writeJSON(w, http.StatusOK, map[string]int{"evicted": n})
+	}
+}
+
+func (s *Server) handleCacheEvict(cache cacheAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderUID := chi.URLParam(r, "orderUID")
+		cache.Evict(orderUID)
+		slog.Info("Order evicted by admin", "orderUID", orderUID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleCacheWarmup(cache cacheAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the warm-up outlives the request, progress is reported by /readyz
+		if !cache.StartWarmup(context.WithoutCancel(r.Context())) {
+			http.Error(w, "Warm-up already running", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+
+	"wbstorage/internal/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// handleExportCustomer returns every stored order of a customer, with its
+// history and raw messages, as one JSON document.
+func (s *Server) handleExportCustomer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerID := chi.URLParam(r, "customerID")
+		export, err := db.ExportCustomer(r.Context(), s.db, customerID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		slog.Info("Customer data exported", "customerID", customerID, "orders", len(export.Orders))
+		writeJSON(w, http.StatusOK, export)
+	}
+}
+
+// handleEraseCustomer anonymizes every order of a customer and returns the
+// audit record of the erasure.
+func (s *Server) handleEraseCustomer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerID := chi.URLParam(r, "customerID")
+		erasure, err := s.db.EraseCustomer(r.Context(), customerID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		slog.Info("Customer data erased", "customerID", customerID, "orders", len(erasure.OrderUIDs))
+		writeJSON(w, http.StatusOK, erasure)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// historyEntry is an order version with its changes against the previous one.
+type historyEntry struct {
+	models.OrderVersion
+	Changes []models.FieldChange `json:"changes"`
+}
+
+type historyPage struct {
+	OrderUID string
+	Entries  []historyEntry
+}
+
+// orderHistory loads the history of an order and diffs consecutive versions.
+func (s *Server) orderHistory(ctx context.Context, orderUID string) ([]historyEntry, error) {
+	versions, err := s.db.OrderHistory(ctx, orderUID)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]historyEntry, 0, len(versions))
+	var prev *models.Order
+	for _, v := range versions {
+		next := v.Order
+		if v.Operation == models.OperationDelete {
+			next = nil
+		}
+		changes, err := models.DiffOrders(prev, next)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, historyEntry{OrderVersion: v, Changes: changes})
+		prev = next
+	}
+	return entries, nil
+}
+
+func (s *Server) handleOrderHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := s.orderHistory(r.Context(), chi.URLParam(r, "orderUID"))
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+func (s *Server) handleOrderHistoryPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderUID := chi.URLParam(r, "orderUID")
+		entries, err := s.orderHistory(r.Context(), orderUID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		page := historyPage{OrderUID: orderUID, Entries: entries}
+		if err := s.tmpl.ExecuteTemplate(w, "history.html", page); err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		}
+	}
+}
+
+// handleGetOrderJSON returns the order as JSON with its balance and returns,
+// as it was at the time given by the optional RFC 3339 "as_of" parameter.
+// Returns are always the current ones.
+func (s *Server) handleGetOrderJSON() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderUID := chi.URLParam(r, "orderUID")
+		order, stale, err := s.orderAsOf(r, orderUID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if stale {
+			w.Header().Set("X-Cache-Stale", "true")
+		}
+		resp, err := s.orderResponse(r.Context(), order)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// orderAsOf reads the current order, or its past state if the request has an
+// "as_of" parameter.
+func (s *Server) orderAsOf(r *http.Request, orderUID string) (*models.Order, bool, error) {
+	asOf := r.URL.Query().Get("as_of")
+	if asOf == "" {
+		return s.selectOrder(r.Context(), orderUID)
+	}
+	t, err := time.Parse(time.RFC3339, asOf)
+	if err != nil {
+		return nil, false, errBadRequest("as_of must be an RFC 3339 time")
+	}
+	order, err := s.db.SelectOrderAsOf(r.Context(), orderUID, t)
+	return order, false, err
+}
+
+// withSource tags the writes of the wrapped handlers with source in the
+// order history.
+func withSource(source string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(db.WithSource(r.Context(), source)))
+		})
+	}
+}
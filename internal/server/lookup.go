@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+
+	"wbstorage/internal/db"
+)
+
+// handleLookupOrders finds orders by delivery email and/or phone, given as
+// query parameters. It is admin-only since it confirms a customer's orders.
+func (s *Server) handleLookupOrders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contact := db.Contact{
+			Email: r.URL.Query().Get("email"),
+			Phone: r.URL.Query().Get("phone"),
+		}
+		if contact.Email == "" && contact.Phone == "" {
+			http.Error(w, "Missing email or phone", http.StatusBadRequest)
+			return
+		}
+		orderUIDs, err := s.db.LookupOrders(r.Context(), contact)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if orderUIDs == nil {
+			orderUIDs = []string{}
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"order_uids": orderUIDs})
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxOrderBody limits the size of order bodies accepted by write routes.
+const maxOrderBody = 1 << 20
+
+func (s *Server) handlePutOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderUID := chi.URLParam(r, "orderUID")
+		var order models.Order
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxOrderBody)).Decode(&order); err != nil {
+			http.Error(w, "Invalid order: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if order.OrderUID != "" && order.OrderUID != orderUID {
+			http.Error(w, "order_uid does not match the URL", http.StatusBadRequest)
+			return
+		}
+		order.SetOrderUID(orderUID)
+		if err := order.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.db.UpsertOrder(r.Context(), order); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, order)
+	}
+}
+
+func (s *Server) handlePatchOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderUID := chi.URLParam(r, "orderUID")
+		patch, err := io.ReadAll(io.LimitReader(r.Body, maxOrderBody))
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+
+		order, err := s.db.PatchOrder(r.Context(), orderUID, patch)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, order)
+	}
+}
+
+func (s *Server) handleDeleteOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderUID := chi.URLParam(r, "orderUID")
+		if err := s.db.DeleteOrder(r.Context(), orderUID); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// errBadRequest is an invalid request detected before reaching the database.
+type errBadRequest string
+
+func (e errBadRequest) Error() string {
+	return string(e)
+}
+
+func writeDBError(w http.ResponseWriter, err error) {
+	var badRequest errBadRequest
+	switch {
+	case errors.As(err, &badRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrInvalidPatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, db.ErrCircuitOpen):
+		http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
+	default:
+		slog.Error("Database request failed", "error", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// handleListRawMessages lists the archived messages of an order without
+// their payloads.
+func (s *Server) handleListRawMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		msgs, err := s.db.SelectRawMessages(r.Context(), chi.URLParam(r, "orderUID"))
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, msgs)
+	}
+}
+
+// handleGetRawMessage returns the payload exactly as it was received, with
+// the message metadata in X-Raw-* headers.
+func (s *Server) handleGetRawMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid message id", http.StatusBadRequest)
+			return
+		}
+		msg, err := s.db.SelectRawMessage(r.Context(), id)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("X-Raw-Order-Uid", msg.OrderUID)
+		h.Set("X-Raw-Subject", msg.Subject)
+		h.Set("X-Raw-Stream", msg.Stream)
+		h.Set("X-Raw-Stream-Seq", strconv.FormatUint(msg.StreamSeq, 10))
+		h.Set("X-Raw-Received-At", msg.ReceivedAt.Format(time.RFC3339Nano))
+		h.Set("X-Raw-Decoder-Version", msg.DecoderVersion)
+		w.WriteHeader(http.StatusOK)
+		w.Write(msg.Payload)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+	"wbstorage/internal/returns"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// orderResponse is an order as served by the JSON API and the order page,
+// with its balance computed from the payment records and its returns.
+type orderResponse struct {
+	*models.Order
+	Balance models.Balance  `json:"balance"`
+	Returns []models.Return `json:"returns"`
+}
+
+func (s *Server) orderResponse(ctx context.Context, order *models.Order) (*orderResponse, error) {
+	rets, err := s.db.OrderReturns(ctx, order.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	return &orderResponse{Order: order, Balance: order.Balance(), Returns: rets}, nil
+}
+
+func (s *Server) handleOrderReturns() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rets, err := s.db.OrderReturns(r.Context(), chi.URLParam(r, "orderUID"))
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rets)
+	}
+}
+
+func (s *Server) handleGetReturn() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ret, err := s.db.SelectReturn(r.Context(), chi.URLParam(r, "returnID"))
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ret)
+	}
+}
+
+// handleRequestReturn creates a return from a body with the items and,
+// optionally, the return ID.
+func (s *Server) handleRequestReturn() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ret models.Return
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxOrderBody)).Decode(&ret); err != nil {
+			http.Error(w, "Invalid return: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ret.OrderUID = chi.URLParam(r, "orderUID")
+		created, err := s.returns.Request(r.Context(), ret)
+		if err != nil {
+			writeReturnError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, created)
+	}
+}
+
+// handleUpdateReturn moves a return to the status in the body; see
+// returns.Update.
+func (s *Server) handleUpdateReturn() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var u returns.Update
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxOrderBody)).Decode(&u); err != nil {
+			http.Error(w, "Invalid update: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated, err := s.returns.Update(r.Context(), chi.URLParam(r, "returnID"), u)
+		if err != nil {
+			writeReturnError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, updated)
+	}
+}
+
+func writeReturnError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, returns.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, returns.ErrOutOfOrder), errors.Is(err, returns.ErrOutdated),
+		errors.Is(err, db.ErrReturnExists), errors.Is(err, db.ErrReturnChanged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeDBError(w, err)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"wbstorage/internal/db"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+type searchPage struct {
+	Query   string
+	Results []searchPageResult
+}
+
+type searchPageResult struct {
+	OrderUID string
+	Snippet  template.HTML
+}
+
+func (s *Server) handleSearch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, err := s.search(r)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if results == nil {
+			results = []db.SearchResult{}
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+func (s *Server) handleSearchPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, err := s.search(r)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		page := searchPage{Query: r.URL.Query().Get("q")}
+		for _, result := range results {
+			page.Results = append(page.Results, searchPageResult{
+				OrderUID: result.OrderUID,
+				// snippets are escaped by the database layer, only <mark> is markup
+				Snippet: template.HTML(result.Snippet),
+			})
+		}
+		if err := s.tmpl.ExecuteTemplate(w, "search.html", page); err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		}
+	}
+}
+
+// search runs the query from the "q" parameter, limited by "limit". With PII
+// encryption, names and addresses only match whole words, see
+// db.Database.SearchOrders.
+func (s *Server) search(r *http.Request) ([]db.SearchResult, error) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		return nil, nil
+	}
+	limit := defaultSearchLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxSearchLimit)
+	}
+	return s.db.SearchOrders(r.Context(), query, limit)
+}
@@ -1,48 +1,131 @@
 package server
 
 import (
+	"context"
 	"embed"
+	"encoding/json"
 	"html/template"
+	"log/slog"
 	"net/http"
 
 	"wbstorage/internal/db"
+	"wbstorage/internal/models"
+	"wbstorage/internal/returns"
 
 	"github.com/go-chi/chi/v5"
 )
 
-//go:embed "templates/order.html"
+//go:embed "templates/*.html"
 var tmplFS embed.FS
 
+// warmupReporter is implemented by databases that warm up a cache on start.
+type warmupReporter interface {
+	WarmupProgress() db.WarmupProgress
+}
+
+// staleReader is implemented by databases that may serve expired orders
+// while the backend is unavailable.
+type staleReader interface {
+	SelectOrderStale(ctx context.Context, orderUID string) (*models.Order, bool, error)
+}
+
 type Server struct {
-	db   db.Database
-	tmpl *template.Template
+	db         db.Database
+	returns    *returns.Service
+	tmpl       *template.Template
+	adminToken string
+	writeToken string
 }
 
-func NewServer(db db.Database) (*Server, error) {
-	tmpl, err := template.ParseFS(tmplFS, "templates/order.html")
+// NewServer creates the HTTP server. Admin routes are only served when
+// adminToken is set, and the routes changing orders or returns when
+// writeToken or adminToken is set; they accept either token.
+func NewServer(db db.Database, adminToken, writeToken string) (*Server, error) {
+	tmpl, err := template.ParseFS(tmplFS, "templates/*.html")
 	s := &Server{
-		db:   db,
-		tmpl: tmpl,
+		db:         db,
+		returns:    returns.NewService(db),
+		tmpl:       tmpl,
+		adminToken: adminToken,
+		writeToken: writeToken,
 	}
 	return s, err
 }
 
 func NewRouter(s *Server) *chi.Mux {
 	router := chi.NewRouter()
+	if s.adminToken != "" {
+		router.Mount("/admin", s.adminRouter())
+	}
+	router.Get("/readyz", s.handleReadiness())
+	router.Get("/search", s.handleSearchPage())
+	router.Get("/api/search", s.handleSearch())
+	router.Get("/api/orders/{orderUID}", s.handleGetOrderJSON())
+	router.Get("/api/orders/{orderUID}/history", s.handleOrderHistory())
+	router.Get("/api/orders/{orderUID}/returns", s.handleOrderReturns())
+	router.Get("/api/returns/{returnID}", s.handleGetReturn())
 	router.Get("/{orderUID}", s.handleGetOrder())
+	router.Get("/{orderUID}/history", s.handleOrderHistoryPage())
+	if s.adminToken != "" || s.writeToken != "" {
+		router.Group(func(r chi.Router) {
+			r.Use(s.requireWriteToken)
+			r.Use(withSource("api"))
+			r.Put("/{orderUID}", s.handlePutOrder())
+			r.Patch("/{orderUID}", s.handlePatchOrder())
+			r.Delete("/{orderUID}", s.handleDeleteOrder())
+			r.Post("/api/orders/{orderUID}/returns", s.handleRequestReturn())
+			r.Post("/api/returns/{returnID}/status", s.handleUpdateReturn())
+		})
+	}
 	return router
 }
 
 func (s *Server) handleGetOrder() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		orderUID := chi.URLParam(r, "orderUID")
-		order, err := s.db.SelectOrder(r.Context(), orderUID)
+		order, stale, err := s.orderAsOf(r, orderUID)
 		if err != nil {
 			http.Error(w, "Order not found", http.StatusNotFound)
 			return
 		}
-		if err := s.tmpl.Execute(w, order); err != nil {
+		if stale {
+			w.Header().Set("X-Cache-Stale", "true")
+		}
+		resp, err := s.orderResponse(r.Context(), order)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if err := s.tmpl.ExecuteTemplate(w, "order.html", resp); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		}
 	}
 }
+
+func (s *Server) selectOrder(ctx context.Context, orderUID string) (*models.Order, bool, error) {
+	if sr, ok := s.db.(staleReader); ok {
+		return sr.SelectOrderStale(ctx, orderUID)
+	}
+	order, err := s.db.SelectOrder(ctx, orderUID)
+	return order, false, err
+}
+
+// handleReadiness reports 503 until the cache warm-up has finished, with the
+// warm-up progress in the body either way.
+func (s *Server) handleReadiness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wr, ok := s.db.(warmupReporter)
+		if !ok {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		progress := wr.WarmupProgress()
+		w.Header().Set("Content-Type", "application/json")
+		if !progress.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(progress); err != nil {
+			slog.Error("Failed to encode readiness", "error", err)
+		}
+	}
+}